@@ -0,0 +1,105 @@
+package main
+
+import (
+	"chalmers/tkey-group22/application/data/db"
+	"chalmers/tkey-group22/application/internal/util"
+	"database/sql"
+	"fmt"
+	"os"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// database holds the connection to the database selected with the DATABASE environment variable
+// Only one of the fields is set.
+type database struct {
+	mongo  *db.MongoDB // Set when DATABASE is "mongo"
+	sqlite *sql.DB     // Set when DATABASE is "sqlite"
+}
+
+// openDatabase connects to the database selected with DATABASE
+// It is "mongo" (default) for the MongoDB database tkeyUserDB at MONGO_URI, or "sqlite" for the
+// SQLite database in the file SQLITE_PATH (default "tkey.db"), which needs no database server.
+// The MongoDB database is migrated to the current schema, see db.MongoMigrations.
+// Database operations are abandoned after DB_TIMEOUT, see util.LoadOperationTimeout.
+//
+// Returns:
+//   - *database: The connected database
+//   - error: An error if DATABASE or DB_TIMEOUT is invalid, the connection fails or the migrations fail
+func openDatabase() (*database, error) {
+	// Each database operation is abandoned after DB_TIMEOUT, so that a hung database cannot hang the server
+	timeout, err := util.LoadOperationTimeout()
+	if err != nil {
+		return nil, err
+	}
+	util.OperationTimeout = timeout
+
+	switch os.Getenv("DATABASE") {
+	case "", "mongo":
+		// Connects to the MongoDB database named tkeyUserDB
+		mongoDB, err := db.ConnectMongoDB(os.Getenv("MONGO_URI"), "tkeyUserDB", util.OperationTimeout)
+		if err != nil {
+			return nil, fmt.Errorf("failed to connect to MongoDB: %w", err)
+		}
+		// Creates the indexes and updates existing documents to the current schema
+		if err := db.Migrate(mongoDB.Database, db.MongoMigrations); err != nil {
+			mongoDB.Close()
+			return nil, fmt.Errorf("failed to migrate MongoDB: %w", err)
+		}
+		return &database{mongo: mongoDB}, nil
+	case "sqlite":
+		path := os.Getenv("SQLITE_PATH")
+		if path == "" {
+			path = "tkey.db"
+		}
+		sqliteDB, err := db.OpenSQLite(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open SQLite database %s: %w", path, err)
+		}
+		return &database{sqlite: sqliteDB}, nil
+	default:
+		return nil, fmt.Errorf("unknown DATABASE: %s", os.Getenv("DATABASE"))
+	}
+}
+
+// repositories returns the repositories of users, notes and OpenID Connect clients kept in the database
+func (database *database) repositories() (util.UserRepository, util.NotesRepository, util.OIDCClientRepository) {
+	if database.sqlite != nil {
+		return util.NewSQLiteUserRepo(database.sqlite), util.NewSQLiteNotesRepo(database.sqlite), util.NewSQLiteOIDCClientRepo(database.sqlite)
+	}
+	return util.NewUserRepo(database.mongo.Database), util.NewNotesRepo(database.mongo.Database), util.NewOIDCClientRepo(database.mongo.Database)
+}
+
+// storeName returns where a store that defaults to the database is kept, as configured with the environment variable
+// It is "mongo" when the variable is not set. These stores have no SQLite implementation, so with DATABASE=sqlite
+// the server exits unless the variable is explicitly set to "memory", rather than silently losing them on restart.
+func (database *database) storeName(variable string) string {
+	name := os.Getenv(variable)
+	if name != "" {
+		return name
+	}
+	if database.mongo == nil {
+		fmt.Printf("%s=memory must be set with DATABASE=sqlite, which cannot keep this store\n", variable)
+		os.Exit(1)
+	}
+	return "mongo"
+}
+
+// requireMongo returns the MongoDB database for a store configured with the environment variable to be kept there
+// The server exits if the database is not MongoDB.
+func (database *database) requireMongo(variable string) *mongo.Database {
+	if database.mongo == nil {
+		fmt.Printf("%s=mongo requires DATABASE=mongo\n", variable)
+		os.Exit(1)
+	}
+	return database.mongo.Database
+}
+
+// Close closes the connection to the database
+func (database *database) Close() {
+	if database.sqlite != nil {
+		database.sqlite.Close()
+		return
+	}
+	database.mongo.Close()
+}
@@ -1,15 +1,19 @@
-// Package starts the backend server and connects to the MongoDB database
+// Package starts the backend server and connects to the database
 package main
 
 import (
-	"chalmers/tkey-group22/application/data/db"
+	"chalmers/tkey-group22/application/internal"
+	"chalmers/tkey-group22/application/internal/audit"
+	"chalmers/tkey-group22/application/internal/device"
 	"chalmers/tkey-group22/application/internal/handlers"
+	"chalmers/tkey-group22/application/internal/oidc"
+	"chalmers/tkey-group22/application/internal/ratelimit"
 	"chalmers/tkey-group22/application/internal/session_util"
-	"chalmers/tkey-group22/application/internal/util"
 
 	"fmt"
 	"net/http"
 	"os"
+	"strings"
 
 	"github.com/joho/godotenv"
 )
@@ -21,53 +25,171 @@ func main() {
 		fmt.Printf("Failed to load .env file: %v\n", err)
 	}
 
+	if len(os.Args) > 1 && os.Args[1] == "register-oidc-client" {
+		registerOIDCClient(os.Args[2:])
+		return
+	}
+
 	// Initiates the functions so that the .env variables gets loaded
-	session_util.InitCSRF()
-	session_util.InitSession()
+	if err := session_util.InitCSRF(); err != nil {
+		fmt.Printf("Failed to initialize CSRF protection: %v\n", err)
+		os.Exit(1)
+	}
+
+	// Loads the key the server signs challenges with, generating it on first start
+	serverKeyFile := os.Getenv("SERVER_KEY_FILE")
+	if serverKeyFile == "" {
+		serverKeyFile = "server_identity.key"
+	}
+	if err := internal.InitServerIdentity(os.Getenv("SERVER_KEY"), serverKeyFile); err != nil {
+		fmt.Printf("Failed to load server identity key: %v\n", err)
+		os.Exit(1)
+	}
 
-	// Connects to the MongoDB database named tkeyUserDB
-	db, err := db.ConnectMongoDB(os.Getenv("MONGO_URI"), "tkeyUserDB")
+	// Connects to the database selected with DATABASE, MongoDB unless it is set to "sqlite"
+	database, err := openDatabase()
 	if err != nil {
-		fmt.Printf("Failed to connect to MongoDB: %v\n", err)
+		fmt.Printf("%v\n", err)
 		os.Exit(1)
 	}
 
-	if db == nil {
-		fmt.Println("Database connection is nil")
+	// Initialize the UserRepository, NoteRepository and the applications that may log their users in
+	// through the OpenID Connect provider with the database
+	handlers.UserRepo, handlers.NotesRepo, handlers.OIDCClients = database.repositories()
+
+	// Origins that login challenges may be bound to, e.g. the URL the GUI is served from
+	if origins := os.Getenv("RP_ORIGINS"); origins != "" {
+		internal.AllowedOrigins = internal.ParseOrigins(origins)
+	}
+
+	// Challenges are kept in memory unless CHALLENGE_STORE is set to "mongo"
+	// The MongoDB store is required when running more than one backend replica
+	switch os.Getenv("CHALLENGE_STORE") {
+	case "", "memory":
+	case "mongo":
+		mongoDB := database.requireMongo("CHALLENGE_STORE")
+		internal.ActiveChallenges = internal.NewMongoChallengeStore(mongoDB)
+
+		// Authorization codes are short-lived single use state as well, and must also be shared between replicas
+		oidc.Codes = oidc.NewMongoCodeStore(mongoDB)
+
+		// So are device logins, which may be started, approved and polled at different replicas
+		device.Authorizations = device.NewMongoStore(mongoDB)
+	default:
+		fmt.Printf("Unknown CHALLENGE_STORE: %s\n", os.Getenv("CHALLENGE_STORE"))
 		os.Exit(1)
 	}
 
-	// Initialize the UserRepository and NoteRepository struct with the database reference
-	handlers.UserRepo = util.NewUserRepo(db.Database)
-	handlers.NotesRepo = util.NewNotesRepo(db.Database)
+	// Sessions are kept in MongoDB unless SESSION_STORE is set to "memory", which is required when the database is SQLite
+	// The memory store loses all sessions on restart and cannot be shared between replicas
+	var sessionBackend session_util.SessionBackend
+	sessionStore := database.storeName("SESSION_STORE")
+	switch sessionStore {
+	case "mongo":
+		sessionBackend = session_util.NewMongoSessionBackend(database.requireMongo("SESSION_STORE"))
+	case "memory":
+		sessionBackend = session_util.NewMemorySessionBackend()
+	default:
+		fmt.Printf("Unknown SESSION_STORE: %s\n", sessionStore)
+		os.Exit(1)
+	}
+	// The audit log is kept in MongoDB unless AUDIT_STORE is set to "memory", which is required when the database is SQLite
+	// The memory store loses the log on restart, so it is only meant for development
+	auditStoreName := database.storeName("AUDIT_STORE")
+	switch auditStoreName {
+	case "mongo":
+		audit.Log = audit.NewMongoStore(database.requireMongo("AUDIT_STORE"))
+	case "memory":
+	default:
+		fmt.Printf("Unknown AUDIT_STORE: %s\n", auditStoreName)
+		os.Exit(1)
+	}
 
-	if handlers.UserRepo == nil {
-		fmt.Println("Failed to initialize UserRepository")
+	// The idle timeout, absolute lifetime and cookie flags of sessions are configured in the environment
+	policy, err := session_util.LoadSessionPolicy()
+	if err != nil {
+		fmt.Printf("Invalid session policy: %v\n", err)
+		os.Exit(1)
+	}
+	session_util.Policy = policy
+	if err := session_util.InitSession(sessionBackend); err != nil {
+		fmt.Printf("Failed to initialize sessions: %v\n", err)
 		os.Exit(1)
 	}
 
-	if handlers.NotesRepo == nil {
-		fmt.Println("Failed to initialize NotesRepository")
+	// The URL the OpenID Connect endpoints are reached at, and the login page users are sent to during authorization
+	if issuer := os.Getenv("OIDC_ISSUER"); issuer != "" {
+		oidc.Issuer = strings.TrimSuffix(issuer, "/")
+	}
+	if loginURL := os.Getenv("OIDC_LOGIN_URL"); loginURL != "" {
+		oidc.LoginURL = loginURL
+	}
+
+	// The client IP shown for sessions and used for rate limiting is taken from X-Forwarded-For only behind a trusted proxy
+	session_util.TrustProxyHeaders = os.Getenv("TRUST_PROXY_HEADERS") == "true"
+
+	// Login requests are limited per IP address and per username, and usernames are locked after failed signatures
+	rateLimitPolicy, err := ratelimit.LoadPolicy()
+	if err != nil {
+		fmt.Printf("Invalid rate limiting policy: %v\n", err)
 		os.Exit(1)
 	}
+	ratelimit.Configure(rateLimitPolicy)
 
 	mux := http.NewServeMux()
 
+	mux.HandleFunc("/api/public", handlers.ServerPublicKeyHandler)
+
+	// OpenID Connect provider, the issuer is expected to be the URL these are reached at through the GUI
+	mux.HandleFunc("/api/oidc/.well-known/openid-configuration", handlers.OIDCDiscoveryHandler)
+	mux.HandleFunc("/api/oidc/jwks", handlers.OIDCJWKSHandler)
+	mux.HandleFunc("/api/oidc/authorize", handlers.OIDCAuthorizeHandler)
+	mux.HandleFunc("/api/oidc/token", handlers.OIDCTokenHandler)
+	mux.HandleFunc("/api/oidc/userinfo", handlers.OIDCUserInfoHandler)
+
+	mux.HandleFunc("/api/register-challenge", handlers.RegisterChallengeHandler)
 	mux.HandleFunc("/api/register", handlers.RegisterHandler)
-	mux.Handle("/api/login", http.HandlerFunc(handlers.LoginHandler))
-	mux.Handle("/api/verify", http.HandlerFunc(handlers.VerifyHandler))
-	mux.Handle("/api/getuser", session_util.SessionMiddleware(session_util.CsrfMiddleware((http.HandlerFunc(handlers.GetUserHandler)))))
+	mux.Handle("/api/login", ratelimit.Middleware(http.HandlerFunc(handlers.LoginHandler)))
+	mux.Handle("/api/verify", ratelimit.Middleware(http.HandlerFunc(handlers.VerifyHandler)))
+	// Bearer tokens issued by /api/verify are refreshed and revoked with the refresh token
+	mux.HandleFunc("/api/token/refresh", handlers.RefreshTokenHandler)
+	mux.HandleFunc("/api/token/revoke", handlers.RevokeTokenHandler)
+
+	// Logging in a browser by approving it from the TKey client on another machine
+	mux.Handle("/api/device/authorize", ratelimit.Middleware(http.HandlerFunc(handlers.DeviceAuthorizeHandler)))
+	mux.Handle("/api/device/challenge", ratelimit.Middleware(http.HandlerFunc(handlers.DeviceChallengeHandler)))
+	mux.Handle("/api/device/approve", ratelimit.Middleware(http.HandlerFunc(handlers.DeviceApproveHandler)))
+	mux.HandleFunc("/api/device/token", handlers.DeviceTokenHandler)
+	// Recovery sessions are checked by the handlers, they can only be used to enroll a new key
+	mux.Handle("/api/recover", ratelimit.Middleware(http.HandlerFunc(handlers.RecoverHandler)))
+	mux.Handle("/api/recover/challenge", ratelimit.Middleware(http.HandlerFunc(handlers.RecoveryChallengeHandler)))
+	mux.Handle("/api/recover/enroll", ratelimit.Middleware(http.HandlerFunc(handlers.RecoveryEnrollHandler)))
+	// Routes wrapped in AllowBearer can also be used with an access token that has the given scope
+	mux.Handle("/api/getuser", session_util.AllowBearer(session_util.ScopeAccount, session_util.SessionMiddleware(session_util.CsrfMiddleware((http.HandlerFunc(handlers.GetUserHandler))))))
 	mux.Handle("/api/unregister", session_util.SessionMiddleware(session_util.CsrfMiddleware(http.HandlerFunc(handlers.UnregisterHandler))))
+	mux.Handle("/api/step-up-challenge", session_util.SessionMiddleware(session_util.CsrfMiddleware(http.HandlerFunc(handlers.StepUpChallengeHandler))))
+	mux.Handle("/api/step-up", session_util.SessionMiddleware(session_util.CsrfMiddleware(http.HandlerFunc(handlers.StepUpHandler))))
 	mux.Handle("/api/add-public-key", session_util.SessionMiddleware(session_util.CsrfMiddleware(http.HandlerFunc(handlers.AddPublicKeyHandler))))
 	mux.Handle("/api/remove-public-key", session_util.SessionMiddleware(session_util.CsrfMiddleware(http.HandlerFunc(handlers.RemovePublicKeyHandler))))
-	mux.Handle("/api/get-public-key-labels", session_util.SessionMiddleware(session_util.CsrfMiddleware(http.HandlerFunc(handlers.GetPublicKeyLabelsHandler))))
+	mux.Handle("/api/rename-public-key", session_util.SessionMiddleware(session_util.CsrfMiddleware(http.HandlerFunc(handlers.RenamePublicKeyHandler))))
+	mux.Handle("/api/suspend-public-key", session_util.SessionMiddleware(session_util.CsrfMiddleware(http.HandlerFunc(handlers.SuspendPublicKeyHandler))))
+	mux.Handle("/api/reactivate-public-key", session_util.SessionMiddleware(session_util.CsrfMiddleware(http.HandlerFunc(handlers.ReactivatePublicKeyHandler))))
+	mux.Handle("/api/regenerate-recovery-codes", session_util.SessionMiddleware(session_util.CsrfMiddleware(http.HandlerFunc(handlers.RegenerateRecoveryCodesHandler))))
+	mux.Handle("/api/list-public-keys", session_util.AllowBearer(session_util.ScopeAccount, session_util.SessionMiddleware(session_util.CsrfMiddleware(http.HandlerFunc(handlers.ListPublicKeysHandler)))))
+	mux.Handle("/api/get-public-key-labels", session_util.AllowBearer(session_util.ScopeAccount, session_util.SessionMiddleware(session_util.CsrfMiddleware(http.HandlerFunc(handlers.GetPublicKeyLabelsHandler)))))
+
+	mux.Handle("/api/sessions", session_util.AllowBearer(session_util.ScopeAccount, session_util.SessionMiddleware(session_util.CsrfMiddleware(http.HandlerFunc(handlers.ListSessionsHandler)))))
+	mux.Handle("/api/sessions/revoke", session_util.SessionMiddleware(session_util.CsrfMiddleware(http.HandlerFunc(handlers.RevokeSessionHandler))))
+	mux.Handle("/api/sessions/revoke-others", session_util.SessionMiddleware(session_util.CsrfMiddleware(http.HandlerFunc(handlers.RevokeOtherSessionsHandler))))
+
+	mux.Handle("/api/audit", session_util.AllowBearer(session_util.ScopeAccount, session_util.SessionMiddleware(session_util.CsrfMiddleware(http.HandlerFunc(handlers.ListAuditEventsHandler)))))
 
 	mux.Handle("/api/csrf-token", session_util.SessionMiddleware(session_util.CsrfMiddleware(http.HandlerFunc(handlers.GetCSRF))))
 
-	mux.Handle("/api/create-note", session_util.SessionMiddleware(session_util.CsrfMiddleware(http.HandlerFunc(handlers.CreateNoteHandler))))
-	mux.Handle("/api/get-user-note", session_util.SessionMiddleware(session_util.CsrfMiddleware(http.HandlerFunc(handlers.GetNotesHandler))))
-	mux.Handle("/api/update-note", session_util.SessionMiddleware(session_util.CsrfMiddleware(http.HandlerFunc(handlers.UpdateNoteHandler))))
-	mux.Handle("/api/delete-note", session_util.SessionMiddleware(session_util.CsrfMiddleware(http.HandlerFunc(handlers.DeleteNoteHandler))))
+	mux.Handle("/api/create-note", session_util.AllowBearer(session_util.ScopeNotes, session_util.SessionMiddleware(session_util.CsrfMiddleware(http.HandlerFunc(handlers.CreateNoteHandler)))))
+	mux.Handle("/api/get-user-note", session_util.AllowBearer(session_util.ScopeNotes, session_util.SessionMiddleware(session_util.CsrfMiddleware(http.HandlerFunc(handlers.GetNotesHandler)))))
+	mux.Handle("/api/update-note", session_util.AllowBearer(session_util.ScopeNotes, session_util.SessionMiddleware(session_util.CsrfMiddleware(http.HandlerFunc(handlers.UpdateNoteHandler)))))
+	mux.Handle("/api/delete-note", session_util.AllowBearer(session_util.ScopeNotes, session_util.SessionMiddleware(session_util.CsrfMiddleware(http.HandlerFunc(handlers.DeleteNoteHandler)))))
 	mux.Handle("/api/logout", session_util.SessionMiddleware(session_util.CsrfMiddleware(http.HandlerFunc(handlers.LogoutHandler))))
 
 	fmt.Println("Mock application running on http://localhost:8080")
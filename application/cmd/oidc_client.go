@@ -0,0 +1,54 @@
+package main
+
+import (
+	"chalmers/tkey-group22/application/internal/util"
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// registerOIDCClient registers an application with the OpenID Connect provider and prints its credentials
+// It is run as "main register-oidc-client -name <name> -redirect-uri <uri>[,<uri>...]".
+// The client secret is only shown here, since only its hash is stored.
+//
+// Parameters:
+//   - args: The command line arguments after the command name
+func registerOIDCClient(args []string) {
+	flags := flag.NewFlagSet("register-oidc-client", flag.ExitOnError)
+	name := flags.String("name", "", "Name of the application")
+	redirectURIs := flags.String("redirect-uri", "", "Comma separated URIs users may be sent back to after logging in")
+	flags.Parse(args)
+
+	var uris []string
+	for _, uri := range strings.Split(*redirectURIs, ",") {
+		if uri = strings.TrimSpace(uri); uri != "" {
+			uris = append(uris, uri)
+		}
+	}
+
+	client, secret, err := util.NewOIDCClient(*name, uris)
+	if err != nil {
+		fmt.Printf("Invalid client: %v\n", err)
+		flags.Usage()
+		os.Exit(1)
+	}
+
+	database, err := openDatabase()
+	if err != nil {
+		fmt.Printf("%v\n", err)
+		os.Exit(1)
+	}
+	defer database.Close()
+
+	_, _, clients := database.repositories()
+	if err := clients.CreateClient(context.Background(), client); err != nil {
+		fmt.Printf("Failed to register client: %v\n", err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("Registered OpenID Connect client %s\n", client.Name)
+	fmt.Printf("client_id:     %s\n", client.ClientID)
+	fmt.Printf("client_secret: %s\n", secret)
+}
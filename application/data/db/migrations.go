@@ -0,0 +1,205 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// migrationCollection is the MongoDB collection the applied migrations are recorded in
+const migrationCollection = "schema_migrations"
+
+// Migration is a versioned change to the schema of the MongoDB database, such as creating indexes
+// or backfilling a new field on existing documents
+// Migrations must be idempotent: when several replicas start at the same time, or a replica stops
+// during a migration, the same migration may run more than once.
+type Migration struct {
+	Version     int                                  // Version of the schema after the migration, starting at 1
+	Description string                               // What the migration changes
+	Up          func(database *mongo.Database) error // Applies the migration
+}
+
+// appliedMigration records that a migration has been applied
+type appliedMigration struct {
+	Version     int       `bson:"_id"`         // Version of the migration
+	Description string    `bson:"description"` // What the migration changed
+	AppliedAt   time.Time `bson:"appliedAt"`   // Time the migration finished
+}
+
+// MongoMigrations are the migrations of the database, in order
+// Append new migrations to the end, and never change one that has been released.
+var MongoMigrations = []Migration{
+	{
+		Version:     1,
+		Description: "unique index on users.username",
+		Up: func(database *mongo.Database) error {
+			// Fails if there already are duplicate users, which must then be resolved by hand
+			return createIndexes(database, "users", mongo.IndexModel{
+				Keys:    bson.D{{Key: "username", Value: 1}},
+				Options: options.Index().SetUnique(true),
+			})
+		},
+	},
+	{
+		Version:     2,
+		Description: "index on user_notes.username",
+		Up: func(database *mongo.Database) error {
+			return createIndexes(database, "user_notes", mongo.IndexModel{
+				Keys: bson.D{{Key: "username", Value: 1}},
+			})
+		},
+	},
+	{
+		Version:     3,
+		Description: "backfill status and use count of public keys stored before they were recorded",
+		Up: func(database *mongo.Database) error {
+			if err := backfillPublicKeyField(database, "status", "active"); err != nil {
+				return err
+			}
+			return backfillPublicKeyField(database, "useCount", 0)
+		},
+	},
+	{
+		Version:     4,
+		Description: "TTL index on challenges.ttl and index on challenges.username",
+		Up: func(database *mongo.Database) error {
+			return createIndexes(database, "challenges", mongo.IndexModel{
+				Keys:    bson.D{{Key: "ttl", Value: 1}},
+				Options: options.Index().SetExpireAfterSeconds(0),
+			}, mongo.IndexModel{
+				Keys: bson.D{{Key: "username", Value: 1}},
+			})
+		},
+	},
+	{
+		Version:     5,
+		Description: "TTL index on sessions.expiresAt and index on sessions.username",
+		Up: func(database *mongo.Database) error {
+			return createIndexes(database, "sessions", mongo.IndexModel{
+				Keys:    bson.D{{Key: "expiresAt", Value: 1}},
+				Options: options.Index().SetExpireAfterSeconds(0),
+			}, mongo.IndexModel{
+				Keys: bson.D{{Key: "username", Value: 1}},
+			})
+		},
+	},
+	{
+		Version:     6,
+		Description: "index on audit_log.username and time",
+		Up: func(database *mongo.Database) error {
+			return createIndexes(database, "audit_log", mongo.IndexModel{
+				Keys: bson.D{{Key: "username", Value: 1}, {Key: "time", Value: -1}},
+			})
+		},
+	},
+	{
+		Version:     7,
+		Description: "TTL index on oidc_codes.expiresAt",
+		Up: func(database *mongo.Database) error {
+			return createIndexes(database, "oidc_codes", mongo.IndexModel{
+				Keys:    bson.D{{Key: "expiresAt", Value: 1}},
+				Options: options.Index().SetExpireAfterSeconds(0),
+			})
+		},
+	},
+	{
+		Version:     8,
+		Description: "TTL index on device_authorizations.expiresAt and unique index on device_authorizations.userCode",
+		Up: func(database *mongo.Database) error {
+			return createIndexes(database, "device_authorizations", mongo.IndexModel{
+				Keys:    bson.D{{Key: "expiresAt", Value: 1}},
+				Options: options.Index().SetExpireAfterSeconds(0),
+			}, mongo.IndexModel{
+				Keys:    bson.D{{Key: "userCode", Value: 1}},
+				Options: options.Index().SetUnique(true),
+			})
+		},
+	},
+}
+
+// Migrate applies the migrations that have not been applied to the database yet, in order
+// Each applied migration is recorded, so it is only run again if the server stops before recording it.
+//
+// Parameters:
+//   - database: The MongoDB database to migrate
+//   - migrations: The migrations of the database in order of their versions, usually MongoMigrations
+//
+// Returns:
+//   - error: An error if the migrations are out of order or a migration fails, in which case the later ones are not applied
+func Migrate(database *mongo.Database, migrations []Migration) error {
+	for i, migration := range migrations {
+		if migration.Version != i+1 {
+			return fmt.Errorf("migration %q has version %d, expected %d", migration.Description, migration.Version, i+1)
+		}
+	}
+
+	version, err := SchemaVersion(database)
+	if err != nil {
+		return err
+	}
+
+	collection := database.Collection(migrationCollection)
+	for _, migration := range migrations[min(version, len(migrations)):] {
+		fmt.Printf("Applying database migration %d: %s\n", migration.Version, migration.Description)
+		if err := migration.Up(database); err != nil {
+			return fmt.Errorf("migration %d (%s) failed: %w", migration.Version, migration.Description, err)
+		}
+
+		record := appliedMigration{Version: migration.Version, Description: migration.Description, AppliedAt: time.Now()}
+		_, err := collection.InsertOne(context.Background(), record)
+		// Another replica may have applied the same migration at the same time
+		if err != nil && !mongo.IsDuplicateKeyError(err) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// SchemaVersion returns the version of the latest migration applied to the database, or 0 if none has been
+//
+// Parameters:
+//   - database: The MongoDB database
+//
+// Returns:
+//   - int: The version of the schema
+//   - error: An error if the applied migrations cannot be read
+func SchemaVersion(database *mongo.Database) (int, error) {
+	var latest appliedMigration
+	opts := options.FindOne().SetSort(bson.D{{Key: "_id", Value: -1}})
+	err := database.Collection(migrationCollection).FindOne(context.Background(), bson.M{}, opts).Decode(&latest)
+	if err == mongo.ErrNoDocuments {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return latest.Version, nil
+}
+
+// createIndexes creates the indexes on the collection
+// Creating an index that already exists with the same options does nothing.
+func createIndexes(database *mongo.Database, collection string, indexes ...mongo.IndexModel) error {
+	_, err := database.Collection(collection).Indexes().CreateMany(context.Background(), indexes)
+	return err
+}
+
+// backfillPublicKeyField sets a field of every public key of every user that does not have it yet
+func backfillPublicKeyField(database *mongo.Database, field string, value interface{}) error {
+	filter := bson.M{"publicKeys": bson.M{"$elemMatch": bson.M{field: bson.M{"$exists": false}}}}
+	update := bson.M{"$set": bson.M{"publicKeys.$[key]." + field: value}}
+	opts := options.Update().SetArrayFilters(options.ArrayFilters{
+		Filters: []interface{}{bson.M{"key." + field: bson.M{"$exists": false}}},
+	})
+
+	result, err := database.Collection("users").UpdateMany(context.Background(), filter, update, opts)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Backfilled publicKeys.%s of %d users\n", field, result.ModifiedCount)
+	return nil
+}
@@ -3,11 +3,16 @@ package db
 import (
 	"context"
 	"log"
+	"time"
 
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
+// connectTimeout is how long connecting to MongoDB and disconnecting from it may take
+// The server does not start when MongoDB cannot be reached in time, instead of waiting for it forever.
+const connectTimeout = 10 * time.Second
+
 // MongoDB instance struct
 type MongoDB struct {
 	Client   *mongo.Client
@@ -16,24 +21,30 @@ type MongoDB struct {
 
 // ConnectMongoDB establishes a connection to a MongoDB instance using the provided URI and database name
 // It returns a MongoDB struct containing the client and database reference, or an error if the connection fails
+// Every operation of the client is bounded by operationTimeout, so that a hung MongoDB cannot hang its callers,
+// including the stores that are not given the context of a request.
 //
 // Parameters:
 //   - uri: The connection string URI for the MongoDB instance
 //   - dbName: The name of the database to connect to
+//   - operationTimeout: How long each operation of the client may take when its context has no earlier deadline
 //
 // Returns:
 //   - *MongoDB: A struct containing the MongoDB client and database reference
 //   - error: An error if the connection to MongoDB fails
-func ConnectMongoDB(uri, dbName string) (*MongoDB, error) {
-	clientOptions := options.Client().ApplyURI(uri)
+func ConnectMongoDB(uri, dbName string, operationTimeout time.Duration) (*MongoDB, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), connectTimeout)
+	defer cancel()
+
+	clientOptions := options.Client().ApplyURI(uri).SetTimeout(operationTimeout)
 
-	client, err := mongo.Connect(context.TODO(), clientOptions)
+	client, err := mongo.Connect(ctx, clientOptions)
 	if err != nil {
 		return nil, err
 	}
 
 	// Ping MongoDB to confirm connection
-	if err := client.Ping(context.TODO(), nil); err != nil {
+	if err := client.Ping(ctx, nil); err != nil {
 		return nil, err
 	}
 
@@ -49,7 +60,10 @@ func ConnectMongoDB(uri, dbName string) (*MongoDB, error) {
 // Parameters:
 //   - db: The MongoDB struct containing the client to disconnect
 func (db *MongoDB) Close() {
-	err := db.Client.Disconnect(context.TODO())
+	ctx, cancel := context.WithTimeout(context.Background(), connectTimeout)
+	defer cancel()
+
+	err := db.Client.Disconnect(ctx)
 	if err != nil {
 		log.Fatal(err)
 	}
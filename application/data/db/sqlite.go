@@ -0,0 +1,79 @@
+package db
+
+import (
+	"database/sql"
+
+	_ "modernc.org/sqlite"
+)
+
+// sqliteSchema creates the tables of the SQLite backend if they do not exist yet
+// Public keys, recovery codes and notes belong to a user and are deleted together with it.
+var sqliteSchema = []string{
+	`CREATE TABLE IF NOT EXISTS users (
+		id       INTEGER PRIMARY KEY,
+		username TEXT NOT NULL UNIQUE
+	)`,
+	`CREATE TABLE IF NOT EXISTS public_keys (
+		id                INTEGER PRIMARY KEY,
+		user_id           INTEGER NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+		label             TEXT NOT NULL,
+		key               TEXT NOT NULL,
+		created_at        INTEGER,
+		last_used         INTEGER,
+		use_count         INTEGER NOT NULL DEFAULT 0,
+		signer_app_name   TEXT NOT NULL DEFAULT '',
+		signer_app_digest TEXT NOT NULL DEFAULT '',
+		status            TEXT NOT NULL DEFAULT 'active',
+		status_reason     TEXT NOT NULL DEFAULT '',
+		status_changed_at INTEGER,
+		UNIQUE (user_id, label),
+		UNIQUE (user_id, key)
+	)`,
+	`CREATE TABLE IF NOT EXISTS recovery_codes (
+		user_id   INTEGER NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+		code_hash TEXT NOT NULL,
+		PRIMARY KEY (user_id, code_hash)
+	)`,
+	`CREATE TABLE IF NOT EXISTS notes (
+		id      INTEGER PRIMARY KEY,
+		user_id INTEGER NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+		name    TEXT NOT NULL,
+		note    TEXT NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS notes_user_id ON notes (user_id)`,
+	`CREATE TABLE IF NOT EXISTS oidc_clients (
+		client_id     TEXT PRIMARY KEY,
+		name          TEXT NOT NULL,
+		secret_hash   TEXT NOT NULL,
+		redirect_uris TEXT NOT NULL,
+		created_at    INTEGER NOT NULL
+	)`,
+}
+
+// OpenSQLite opens the SQLite database in the given file, creating it and its tables if needed
+// Foreign keys are enforced, and a single connection is used so that writes never wait on each other's locks.
+// Transactions take the write lock when they begin, so that a change to a user read in a transaction
+// cannot be overwritten by another process using the same file.
+//
+// Parameters:
+//   - path: The path of the database file
+//
+// Returns:
+//   - *sql.DB: The database handle
+//   - error: An error if the database cannot be opened or the tables cannot be created
+func OpenSQLite(path string) (*sql.DB, error) {
+	database, err := sql.Open("sqlite", path+"?_pragma=foreign_keys(1)&_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)&_txlock=immediate")
+	if err != nil {
+		return nil, err
+	}
+	database.SetMaxOpenConns(1)
+
+	for _, statement := range sqliteSchema {
+		if _, err := database.Exec(statement); err != nil {
+			database.Close()
+			return nil, err
+		}
+	}
+
+	return database, nil
+}
@@ -2,6 +2,8 @@ import React, { useState, useEffect } from "react";
 import RegisterComponent from "./components/RegisterComponent";
 import { Routes, Route } from "react-router-dom";
 import LoginComponent from "./components/LoginComponent";
+import RecoverComponent from "./components/RecoverComponent";
+import DeviceLoginComponent from "./components/DeviceLoginComponent";
 import Navbar from "./components/Navbar";
 import "./components/styles.css";
 import NotesApp from "./components/NotesApp";
@@ -15,15 +17,27 @@ const App = () => {
   const [showLoginSuccess, setShowLoginSuccess] = useState(false);
   const user = useFetchUser();
 
+  // An application logging its user in through OpenID Connect sends them here with the pending authorization request
+  const authorizeRequest = new URLSearchParams(window.location.search).get(
+    "authorize"
+  );
+
   useEffect(() => {
+    if (user !== null && authorizeRequest) {
+      // Once logged in, the authorization continues and the user is sent back to the application
+      window.location.assign("/api/oidc/authorize?" + authorizeRequest);
+      return;
+    }
     if (user !== null) {
       setPage("app");
       setShowLoginSuccess(true);
+    } else if (authorizeRequest) {
+      setPage("login");
     } else {
       setPage("start");
     }
     setLoading(false);
-  }, [user]);
+  }, [user, authorizeRequest]);
 
   return (
     <div>
@@ -33,7 +47,9 @@ const App = () => {
       ) : (
         <>
           {page === "register" && <RegisterComponent />}
-          {page === "login" && <LoginComponent />}
+          {page === "login" && <LoginComponent setPage={setPage} />}
+          {page === "recover" && <RecoverComponent />}
+          {page === "device" && <DeviceLoginComponent setPage={setPage} />}
           {page === "app" && <NotesApp />}
           {page === "start" && <StartPage setPage={setPage} />}
           {showLoginSuccess && (
@@ -0,0 +1,115 @@
+import React, { useState, useEffect, useCallback } from "react";
+import "./styles.css";
+import LoadingCircle from "./LoadingCircle";
+
+const DeviceLoginComponent = ({ setPage }) => {
+  const [authorization, setAuthorization] = useState(null);
+  const [error, setError] = useState("");
+
+  /**
+   * Starts a login that is approved from the TKey client on another machine.
+   *
+   * This function sends a POST request to the /api/device/authorize endpoint and
+   * keeps the device code to poll with, and the user code to show to the user.
+   */
+  const startLogin = useCallback(async () => {
+    setError("");
+    setAuthorization(null);
+    try {
+      const response = await fetch("/api/device/authorize", {
+        method: "POST",
+        credentials: "include",
+      });
+      if (!response.ok) {
+        throw new Error(await response.text());
+      }
+      setAuthorization(await response.json());
+    } catch (error) {
+      setError(error.message);
+    }
+  }, []);
+
+  useEffect(() => {
+    startLogin();
+  }, [startLogin]);
+
+  /**
+   * Polls the /api/device/token endpoint until the login is approved, in which case
+   * the session cookie is set and the page is reloaded, or until the code expires.
+   */
+  useEffect(() => {
+    if (!authorization) {
+      return;
+    }
+
+    let interval = authorization.interval * 1000;
+    let timer;
+    let stopped = false;
+
+    const poll = async () => {
+      try {
+        const response = await fetch("/api/device/token", {
+          method: "POST",
+          headers: {
+            "Content-Type": "application/json",
+          },
+          credentials: "include",
+          body: JSON.stringify({ device_code: authorization.device_code }),
+        });
+        if (response.ok) {
+          window.location.reload();
+          return;
+        }
+
+        const data = await response.json().catch(() => ({}));
+        if (data.error === "slow_down") {
+          interval += 5000;
+        } else if (data.error !== "authorization_pending") {
+          setError("The code has expired, please get a new code.");
+          return;
+        }
+      } catch (error) {
+        console.error("Polling failed:", error);
+      }
+      if (!stopped) {
+        timer = setTimeout(poll, interval);
+      }
+    };
+
+    timer = setTimeout(poll, interval);
+    return () => {
+      stopped = true;
+      clearTimeout(timer);
+    };
+  }, [authorization]);
+
+  return (
+    <div className="container">
+      <h2>Log in with a TKey on another machine</h2>
+      {authorization && !error && (
+        <>
+          <p className="message">
+            On the machine with your TKey, run the TKey client with "-mode cmd",
+            choose "Approve browser login" and enter this code:
+          </p>
+          <h2>{authorization.user_code}</h2>
+          <LoadingCircle loading={true} />
+          <p>Waiting for the login to be approved...</p>
+        </>
+      )}
+      {error && (
+        <>
+          <p className="error">{error}</p>
+          <button type="button" onClick={startLogin}>
+            Get a new code
+          </button>
+        </>
+      )}
+      <button type="button" onClick={() => setPage("login")}>
+        Back to login
+      </button>
+    </div>
+  );
+};
+
+export default DeviceLoginComponent;
@@ -4,7 +4,7 @@ import config from "../config";
 import { useNavigate } from "react-router-dom";
 import LoadingCircle from "./LoadingCircle";
 
-const LoginComponent = () => {
+const LoginComponent = ({ setPage }) => {
   const [username, setUsername] = useState("");
   const [message, setMessage] = useState("");
   const [success, setSuccess] = useState("");
@@ -44,7 +44,7 @@ const LoginComponent = () => {
       }
 
       const data = await response.json();
-      verifySignedChallenge(username, data.signed_challenge);
+      verifySignedChallenge(username, data.challenge_id, data.signed_challenge);
     } catch (error) {
       setLoading(false);
     }
@@ -54,10 +54,11 @@ const LoginComponent = () => {
    * Verifies the signed challenge for the given username.
    *
    * @param {string} username - The username of the user.
+   * @param {string} challengeId - The ID of the challenge that was signed.
    * @param {string} signedChallenge - The signed challenge to verify.
    * @throws {Error} - Throws an error if the HTTP request fails.
    */
-  async function verifySignedChallenge(username, signedChallenge) {
+  async function verifySignedChallenge(username, challengeId, signedChallenge) {
     try {
       const response = await fetch("/api/verify", {
         method: "POST",
@@ -67,6 +68,7 @@ const LoginComponent = () => {
         credentials: "include",
         body: JSON.stringify({
           username: username,
+          challenge_id: challengeId,
           signature: signedChallenge,
         }),
       });
@@ -108,6 +110,12 @@ const LoginComponent = () => {
           {loading ? "Awaiting login" : "Login"}
         </button>
       </form>
+      <button type="button" onClick={() => setPage("recover")}>
+        Lost your TKeys? Use a recovery code
+      </button>
+      <button type="button" onClick={() => setPage("device")}>
+        No TKey on this machine? Approve the login from another one
+      </button>
       {message && <p className="message">{message}</p>}
       {success && <p className="success">{success}</p>}
       {error && <p className="error">{error}</p>}
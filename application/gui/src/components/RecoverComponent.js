@@ -0,0 +1,158 @@
+import React, { useState } from "react";
+import "./styles.css";
+import config from "../config";
+import LoadingCircle from "./LoadingCircle";
+
+const RecoverComponent = () => {
+  const [username, setUsername] = useState("");
+  const [code, setCode] = useState("");
+  const [label, setLabel] = useState("");
+  const [codeAccepted, setCodeAccepted] = useState(false);
+  const [message, setMessage] = useState("");
+  const [error, setError] = useState("");
+  const [loading, setLoading] = useState(false);
+
+  /**
+   * Sends the username and recovery code to the backend. If the code is valid the
+   * session may be used to enroll a new key, which is required before logging in.
+   *
+   * @param {Event} event - The event object from the form submission.
+   */
+  const handleRecover = async (event) => {
+    event.preventDefault();
+    setError("");
+    setLoading(true);
+
+    const response = await fetch("/api/recover", {
+      method: "POST",
+      headers: {
+        "Content-Type": "application/json",
+      },
+      credentials: "include",
+      body: JSON.stringify({ username, code }),
+    });
+
+    if (response.ok) {
+      setCodeAccepted(true);
+      setMessage("Recovery code accepted. Insert a new TKey to enroll it.");
+    } else {
+      setError(await response.text());
+    }
+    setLoading(false);
+  };
+
+  /**
+   * Enrolls the connected TKey as a new key for the user. The key signs a challenge
+   * to prove possession of it, after which the user is logged in with it.
+   *
+   * @param {Event} event - The event object from the form submission.
+   */
+  const handleEnroll = async (event) => {
+    event.preventDefault();
+    setError("");
+    setLoading(true);
+    setMessage("Please touch your TKey to enroll it.");
+
+    try {
+      const challengeResponse = await fetch("/api/recover/challenge", {
+        method: "POST",
+        headers: {
+          "Content-Type": "application/json",
+        },
+        credentials: "include",
+        body: JSON.stringify({}),
+      });
+      if (!challengeResponse.ok) {
+        throw new Error(await challengeResponse.text());
+      }
+      const challenge = await challengeResponse.json();
+
+      const clientResponse = await fetch(
+        config.clientBaseUrl + "/api/add-public-key",
+        {
+          method: "POST",
+          headers: {
+            "Content-Type": "application/json",
+          },
+          body: JSON.stringify({ username, ...challenge }),
+        }
+      );
+      if (!clientResponse.ok) {
+        throw new Error(await clientResponse.text());
+      }
+      const newKey = await clientResponse.json();
+
+      const enrollResponse = await fetch("/api/recover/enroll", {
+        method: "POST",
+        headers: {
+          "Content-Type": "application/json",
+        },
+        credentials: "include",
+        body: JSON.stringify({ ...newKey, label }),
+      });
+      if (!enrollResponse.ok) {
+        throw new Error(await enrollResponse.text());
+      }
+
+      window.location.reload();
+    } catch (error) {
+      setMessage("");
+      setError(error.message);
+      setLoading(false);
+    }
+  };
+
+  return (
+    <div className="container">
+      <h2>Account Recovery</h2>
+      <LoadingCircle loading={loading} />
+      {!codeAccepted ? (
+        <form onSubmit={handleRecover}>
+          <div className="form-group">
+            <label htmlFor="username">Username</label>
+            <input
+              id="username"
+              type="text"
+              placeholder="Enter your username"
+              value={username}
+              onChange={(e) => setUsername(e.target.value)}
+            />
+          </div>
+          <div className="form-group">
+            <label htmlFor="recoveryCode">Recovery Code</label>
+            <input
+              id="recoveryCode"
+              type="text"
+              placeholder="xxxx-xxxx-xxxx-xxxx"
+              value={code}
+              onChange={(e) => setCode(e.target.value)}
+            />
+          </div>
+          <button onClick={handleRecover} disabled={loading}>
+            Use Recovery Code
+          </button>
+        </form>
+      ) : (
+        <form onSubmit={handleEnroll}>
+          <div className="form-group">
+            <label htmlFor="keyLabel">Key Label</label>
+            <input
+              id="keyLabel"
+              type="text"
+              placeholder="Enter a label for the new key"
+              value={label}
+              onChange={(e) => setLabel(e.target.value)}
+            />
+          </div>
+          <button onClick={handleEnroll} disabled={loading}>
+            Enroll New Key
+          </button>
+        </form>
+      )}
+      {message && <p className="message">{message}</p>}
+      {error && <p className="error">{error}</p>}
+    </div>
+  );
+};
+
+export default RecoverComponent;
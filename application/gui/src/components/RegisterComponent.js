@@ -7,6 +7,7 @@ const RegisterComponent = () => {
   const [label, setLabel] = useState("");
   const [success, setSuccess] = useState("");
   const [error, setError] = useState("");
+  const [recoveryCodes, setRecoveryCodes] = useState([]);
   const [loading, setLoading] = useState(false);
 
   /**
@@ -34,6 +35,9 @@ const RegisterComponent = () => {
 
     // Checks whether fetch response was successful or not. And responds accordingly.
     if (result.ok) {
+      // The recovery codes are only shown once, right after registration.
+      const data = await result.json();
+      setRecoveryCodes(data.recovery_codes || []);
       setSuccess("Success!");
       setError("");
     } else {
@@ -76,6 +80,22 @@ const RegisterComponent = () => {
         </button>
       </form>
       {success && <p className="success">{success}</p>}
+      {recoveryCodes.length > 0 && (
+        <div>
+          <p>
+            Store these recovery codes somewhere safe. Each code can be used
+            once to regain access if you lose all your TKeys. They will not be
+            shown again.
+          </p>
+          <ul>
+            {recoveryCodes.map((code) => (
+              <li key={code}>
+                <code>{code}</code>
+              </li>
+            ))}
+          </ul>
+        </div>
+      )}
       {error && <p className="error">{error}</p>}
     </div>
   );
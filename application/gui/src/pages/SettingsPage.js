@@ -1,8 +1,8 @@
 import React, { useState, useEffect } from "react";
 import useFetchUser from "../hooks/useFetchUser";
-import config from "../config";
 import "../components/styles.css";
 import { secureFetch } from "../util/secureFetch";
+import { stepUp, proveNewKey } from "../util/stepUp";
 import { useNavigate } from "react-router-dom";
 
 const SettingsPage = () => {
@@ -10,58 +10,95 @@ const SettingsPage = () => {
   const user = useFetchUser();
   const [addKeyLabel, setAddKeyLabel] = useState("");
   const [removeKeyLabel, setRemoveKeyLabel] = useState("");
+  const [renameKeyLabel, setRenameKeyLabel] = useState("");
+  const [newKeyLabel, setNewKeyLabel] = useState("");
   const [message, setMessage] = useState("");
   const [messageType, setMessageType] = useState("");
-  const [keyLabels, setKeyLabels] = useState([]);
+  const [keys, setKeys] = useState([]);
   const [showDeletePopup, setShowDeletePopup] = useState(false);
   const [deleteConfirmation, setDeleteConfirmation] = useState("");
   const [popupMessage, setPopupMessage] = useState("");
+  const [sessionKey, setSessionKey] = useState(null);
+  const [recoveryCodes, setRecoveryCodes] = useState([]);
+  const [sessions, setSessions] = useState([]);
 
-  const fetchKeyLabels = async () => {
-    const response = await secureFetch("/api/get-public-key-labels", {
-      method: "POST",
-      body: JSON.stringify({ username: user }),
+  const fetchSessionKey = async () => {
+    const response = await fetch("/api/getuser", {
+      method: "GET",
+      credentials: "include",
+    });
+
+    if (response.ok) {
+      const data = await response.json();
+      if (data.keyLabel) {
+        setSessionKey({
+          label: data.keyLabel,
+          authenticatedAt: data.authenticatedAt,
+        });
+      }
+    }
+  };
+
+  const fetchKeys = async () => {
+    const response = await secureFetch("/api/list-public-keys", {
+      method: "GET",
+    });
+
+    if (response.ok) {
+      const data = await response.json();
+      setKeys(data.keys);
+    } else {
+      setMessage("Error fetching public keys");
+      setMessageType("error");
+    }
+  };
+
+  const fetchSessions = async () => {
+    const response = await secureFetch("/api/sessions", {
+      method: "GET",
     });
 
     if (response.ok) {
       const data = await response.json();
-      setKeyLabels(data.labels);
+      setSessions(data.sessions);
     } else {
-      setMessage("Error fetching public key labels");
+      setMessage("Error fetching sessions");
       setMessageType("error");
     }
   };
 
+  const formatTime = (time) =>
+    time ? new Date(time).toLocaleString() : "Never";
+
   useEffect(() => {
     if (user) {
-      fetchKeyLabels();
+      fetchKeys();
+      fetchSessionKey();
+      fetchSessions();
     }
   }, [user]);
 
   const handleAddKey = async () => {
     try {
-      const clientResponse = await fetch(
-        config.clientBaseUrl + "/api/add-public-key",
-        {
-          method: "POST",
-          headers: {
-            "Content-Type": "application/json",
-          },
-        }
-      );
-
-      if (!clientResponse.ok) {
-        const errorText = await clientResponse.text();
-        setMessage(errorText);
-        setMessageType("error");
-        return;
-      }
+      // A registered TKey must authorize adding a new key
+      window.alert("Insert one of your registered TKeys and touch it when it blinks");
+      await stepUp(user, "add-key");
 
-      const { pubkey } = await clientResponse.json();
+      // The new TKey proves that it is in the user's possession
+      window.alert("Insert the TKey you want to add and touch it when it blinks");
+      const { pubkey, app_name, app_digest, challenge_id, signature } =
+        await proveNewKey(user);
 
       const backendResponse = await secureFetch("/api/add-public-key", {
         method: "POST",
-        body: JSON.stringify({ label: addKeyLabel, pubkey }),
+        body: JSON.stringify({
+          label: addKeyLabel,
+          pubkey,
+          app_name,
+          app_digest,
+          challenge_id,
+          signature,
+        }),
       });
 
       if (!backendResponse.ok) {
@@ -74,7 +111,7 @@ const SettingsPage = () => {
       setMessage("Public key added successfully");
       setMessageType("success");
       setAddKeyLabel("");
-      fetchKeyLabels();
+      fetchKeys();
     } catch (error) {
       console.error("Error in add key flow:", error);
       setMessage(`Unexpected Error: ${error.message}`);
@@ -83,22 +120,161 @@ const SettingsPage = () => {
   };
 
   const handleRemoveKey = async () => {
+    try {
+      // A registered TKey must authorize removing a key
+      await stepUp(user, "remove-key");
+    } catch (error) {
+      setMessage(error.message);
+      setMessageType("error");
+      return;
+    }
+
     const response = await secureFetch("/api/remove-public-key", {
       method: "POST",
       body: JSON.stringify({ label: removeKeyLabel }),
     });
 
+    // Removing the key of this session logs the user out
+    if (response.ok && sessionKey && sessionKey.label === removeKeyLabel) {
+      navigate("/");
+      return;
+    }
+
     if (response.ok) {
       setMessage("Public key removed successfully");
       setMessageType("success");
       setRemoveKeyLabel("");
-      fetchKeyLabels();
+      fetchKeys();
+    } else {
+      const errorText = await response.text();
+      setMessage(errorText);
+      setMessageType("error");
+      return;
+    }
+  };
+
+  const handleRenameKey = async () => {
+    const response = await secureFetch("/api/rename-public-key", {
+      method: "POST",
+      body: JSON.stringify({ label: renameKeyLabel, new_label: newKeyLabel }),
+    });
+
+    if (response.ok) {
+      setMessage("Public key renamed successfully");
+      setMessageType("success");
+      setRenameKeyLabel("");
+      setNewKeyLabel("");
+      fetchKeys();
+      fetchSessionKey();
     } else {
       const errorText = await response.text();
       setMessage(errorText);
       setMessageType("error");
+    }
+  };
+
+  const handleKeyStatus = async (endpoint, purpose, label, successMessage) => {
+    try {
+      // A registered TKey must authorize changing the status of a key
+      await stepUp(user, purpose);
+    } catch (error) {
+      setMessage(error.message);
+      setMessageType("error");
       return;
     }
+
+    const response = await secureFetch(endpoint, {
+      method: "POST",
+      body: JSON.stringify({ label }),
+    });
+
+    // Suspending the key of this session logs the user out
+    if (
+      response.ok &&
+      endpoint === "/api/suspend-public-key" &&
+      sessionKey &&
+      sessionKey.label === label
+    ) {
+      navigate("/");
+      return;
+    }
+
+    if (response.ok) {
+      setMessage(successMessage);
+      setMessageType("success");
+      fetchKeys();
+    } else {
+      const errorText = await response.text();
+      setMessage(errorText);
+      setMessageType("error");
+    }
+  };
+
+  const handleRegenerateRecoveryCodes = async () => {
+    try {
+      // A registered TKey must authorize replacing the recovery codes
+      await stepUp(user, "recovery-codes");
+    } catch (error) {
+      setMessage(error.message);
+      setMessageType("error");
+      return;
+    }
+
+    const response = await secureFetch("/api/regenerate-recovery-codes", {
+      method: "POST",
+    });
+
+    if (response.ok) {
+      const data = await response.json();
+      setRecoveryCodes(data.recovery_codes);
+      setMessage("New recovery codes generated, the old codes no longer work");
+      setMessageType("success");
+    } else {
+      const errorText = await response.text();
+      setMessage(errorText);
+      setMessageType("error");
+    }
+  };
+
+  const handleRevokeSession = async (session) => {
+    const response = await secureFetch("/api/sessions/revoke", {
+      method: "POST",
+      body: JSON.stringify({ id: session.id }),
+    });
+
+    if (!response.ok) {
+      const errorText = await response.text();
+      setMessage(errorText);
+      setMessageType("error");
+      return;
+    }
+
+    // Revoking the current session logs the user out
+    if (session.current) {
+      navigate("/");
+      return;
+    }
+
+    setMessage("Session revoked successfully");
+    setMessageType("success");
+    fetchSessions();
+  };
+
+  const handleRevokeOtherSessions = async () => {
+    const response = await secureFetch("/api/sessions/revoke-others", {
+      method: "POST",
+    });
+
+    if (response.ok) {
+      const data = await response.json();
+      setMessage(`Signed out of ${data.revoked} other sessions`);
+      setMessageType("success");
+      fetchSessions();
+    } else {
+      const errorText = await response.text();
+      setMessage(errorText);
+      setMessageType("error");
+    }
   };
 
   const handleAccountDeletion = async () => {
@@ -127,13 +303,84 @@ const SettingsPage = () => {
       {/* Message Display */}
       {message && <p className={`message ${messageType}`}>{message}</p>}
 
+      {sessionKey && (
+        <p>
+          Signed in with key <strong>{sessionKey.label}</strong> at{" "}
+          {new Date(sessionKey.authenticatedAt).toLocaleString()}
+        </p>
+      )}
+
       <div>
         <h2>Your Public Keys</h2>
         <ul>
-          {keyLabels.map((label, index) => (
-            <li key={index}>{label}</li>
+          {keys.map((key) => (
+            <li key={key.label}>
+              <strong>{key.label}</strong> ({key.status})
+              {key.status === "active" && (
+                <button
+                  onClick={() =>
+                    handleKeyStatus(
+                      "/api/suspend-public-key",
+                      "suspend-key",
+                      key.label,
+                      "Public key suspended successfully"
+                    )
+                  }
+                >
+                  Suspend
+                </button>
+              )}
+              {key.status === "suspended" && (
+                <button
+                  onClick={() =>
+                    handleKeyStatus(
+                      "/api/reactivate-public-key",
+                      "reactivate-key",
+                      key.label,
+                      "Public key reactivated successfully"
+                    )
+                  }
+                >
+                  Reactivate
+                </button>
+              )}
+              <br />
+              Added: {formatTime(key.created_at)}
+              <br />
+              Last used: {formatTime(key.last_used)} ({key.use_count} logins)
+              {key.app_name && (
+                <>
+                  <br />
+                  Signer app: {key.app_name}
+                </>
+              )}
+            </li>
+          ))}
+        </ul>
+      </div>
+      <div>
+        <h2>Active Sessions</h2>
+        <ul>
+          {sessions.map((session) => (
+            <li key={session.id}>
+              <strong>{session.user_agent || "Unknown device"}</strong>
+              {session.current && " (this session)"}
+              <button onClick={() => handleRevokeSession(session)}>
+                {session.current ? "Sign out" : "Revoke"}
+              </button>
+              <br />
+              IP address: {session.ip}
+              <br />
+              Signed in with key {session.key_label} at{" "}
+              {formatTime(session.created_at)}
+              <br />
+              Last active: {formatTime(session.last_seen)}
+            </li>
           ))}
         </ul>
+        <button onClick={handleRevokeOtherSessions}>
+          Sign Out All Other Sessions
+        </button>
       </div>
       <div>
         <h2>Add Public Key</h2>
@@ -149,6 +396,30 @@ const SettingsPage = () => {
         </div>
         <button onClick={handleAddKey}>Add Public Key</button>
       </div>
+      <div>
+        <h2>Rename Public Key</h2>
+        <div className="form-group">
+          <label htmlFor="renameKeyLabel">Current Label</label>
+          <input
+            id="renameKeyLabel"
+            type="text"
+            placeholder="Enter the label of the key to rename"
+            value={renameKeyLabel}
+            onChange={(e) => setRenameKeyLabel(e.target.value)}
+          />
+        </div>
+        <div className="form-group">
+          <label htmlFor="newKeyLabel">New Label</label>
+          <input
+            id="newKeyLabel"
+            type="text"
+            placeholder="Enter the new label"
+            value={newKeyLabel}
+            onChange={(e) => setNewKeyLabel(e.target.value)}
+          />
+        </div>
+        <button onClick={handleRenameKey}>Rename Public Key</button>
+      </div>
       <div>
         <h2>Remove Public Key</h2>
         <div className="form-group">
@@ -164,6 +435,26 @@ const SettingsPage = () => {
         <button onClick={handleRemoveKey}>Remove Public Key</button>
       </div>
 
+      <div>
+        <h2>Recovery Codes</h2>
+        <p>
+          Recovery codes let you enroll a new TKey if you lose all of your
+          keys. Generating new codes replaces the old ones.
+        </p>
+        {recoveryCodes.length > 0 && (
+          <ul>
+            {recoveryCodes.map((code) => (
+              <li key={code}>
+                <code>{code}</code>
+              </li>
+            ))}
+          </ul>
+        )}
+        <button onClick={handleRegenerateRecoveryCodes}>
+          Generate New Recovery Codes
+        </button>
+      </div>
+
       <div>
         <h2>Account Deletion</h2>
         <button
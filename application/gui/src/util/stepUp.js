@@ -0,0 +1,66 @@
+/* Helpers for sensitive operations that need a fresh TKey signature (step-up authentication).
+ * Challenges are requested from the backend with the session cookie and signed by the
+ * TKey client, which checks that they were issued by the trusted server for this page.
+ */
+import config from "../config";
+import { secureFetch } from "./secureFetch";
+
+/* Throws an error with the response body as message if the response is not ok */
+const checkResponse = async (response) => {
+  if (!response.ok) {
+    const errorText = await response.text();
+    throw new Error(errorText);
+  }
+  return response;
+};
+
+/* Requests a challenge for the given purpose from the backend */
+export const requestChallenge = async (purpose) => {
+  const response = await secureFetch("/api/step-up-challenge", {
+    method: "POST",
+    body: JSON.stringify({ purpose }),
+  });
+  await checkResponse(response);
+  return response.json();
+};
+
+/* Signs a step-up challenge for the purpose with the connected TKey and
+ * submits the signature, authorizing one operation of that purpose, e.g. "add-key" */
+export const stepUp = async (username, purpose) => {
+  const challenge = await requestChallenge(purpose);
+
+  const clientResponse = await fetch(config.clientBaseUrl + "/api/sign", {
+    method: "POST",
+    headers: {
+      "Content-Type": "application/json",
+    },
+    body: JSON.stringify({ username, purpose, ...challenge }),
+  });
+  await checkResponse(clientResponse);
+  const { challenge_id, signed_challenge } = await clientResponse.json();
+
+  const response = await secureFetch("/api/step-up", {
+    method: "POST",
+    body: JSON.stringify({ purpose, challenge_id, signature: signed_challenge }),
+  });
+  await checkResponse(response);
+};
+
+/* Gets the public key of the connected TKey together with its signature over
+ * a "new-key" challenge, proving possession of the key that is being added */
+export const proveNewKey = async (username) => {
+  const challenge = await requestChallenge("new-key");
+
+  const clientResponse = await fetch(
+    config.clientBaseUrl + "/api/add-public-key",
+    {
+      method: "POST",
+      headers: {
+        "Content-Type": "application/json",
+      },
+      body: JSON.stringify({ username, ...challenge }),
+    }
+  );
+  await checkResponse(clientResponse);
+  return clientResponse.json();
+};
@@ -0,0 +1,116 @@
+// Package audit keeps a persistent, append-only log of the security relevant events of the accounts,
+// such as registrations, logins, failed signatures and changes to the keys, which users can review
+// to notice activity they do not recognize
+package audit
+
+import (
+	"chalmers/tkey-group22/application/internal/session_util"
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Types of the events in the log
+const (
+	EventRegister         = "register"           // The account was registered
+	EventChallengeIssued  = "challenge_issued"   // A challenge was issued, the detail is its purpose
+	EventLoginSucceeded   = "login_succeeded"    // A signature was verified and the user logged in, the detail is how
+	EventLoginFailed      = "login_failed"       // A signature could not be verified, the detail is how the user tried to log in
+	EventKeyAdded         = "key_added"          // A public key was added to the account, the detail is "recovery" during recovery
+	EventKeyRemoved       = "key_removed"        // A public key was removed from the account, the detail is "recovery" during recovery
+	EventKeySuspended     = "key_suspended"      // A public key was suspended, the detail is the reason given
+	EventKeyReactivated   = "key_reactivated"    // A suspended public key was reactivated
+	EventKeyRenamed       = "key_renamed"        // A public key was renamed, the key label is the new label and the detail the old one
+	EventRecoveryCodeUsed = "recovery_code_used" // A recovery code was used to start recovering the account
+	EventRecoveryFailed   = "recovery_failed"    // A recovery code was not valid
+	EventOIDCLogin        = "oidc_login"         // The user logged in to an OpenID Connect client, the detail is the name of the client
+	EventLogout           = "logout"             // The user logged out
+	EventUnregister       = "unregister"         // The account was deleted
+)
+
+// How a user logged in, given as the detail of EventLoginSucceeded and EventLoginFailed
+const (
+	LoginSession = "session" // At /api/verify, with a session cookie
+	LoginTokens  = "tokens"  // At /api/verify, with bearer tokens
+	LoginDevice  = "device"  // By approving a browser with a user code
+)
+
+var (
+	DefaultListLimit   = 100 // Events listed when no limit is requested
+	MaxListLimit       = 500 // Most events that can be listed at once
+	maxUserAgentLength = 256 // User agents are truncated so that a client cannot fill the log
+)
+
+// Log is the store the events are appended to
+// It defaults to an in-memory store and can be replaced at startup, e.g. with a MongoStore
+var Log Store = NewMemoryStore()
+
+// Event is an entry in the audit log
+type Event struct {
+	Type      string    `bson:"type"`               // One of the Event constants
+	Username  string    `bson:"username"`           // User the event concerns
+	KeyLabel  string    `bson:"keyLabel,omitempty"` // Label of the key that was used, added or removed
+	Detail    string    `bson:"detail,omitempty"`   // Further information depending on the type
+	IP        string    `bson:"ip"`                 // IP address of the client that made the request
+	UserAgent string    `bson:"userAgent"`          // User agent of the client that made the request
+	Time      time.Time `bson:"time"`               // When the event happened
+}
+
+// Record appends an event caused by the request to the log
+// A failure to store the event is logged and does not fail the request.
+// Events are recorded for usernames that are not registered as well, e.g. failed logins,
+// since they are only listed to the user of an account registered after them, see List.
+//
+// Parameters:
+//   - r: The request that caused the event, which gives the IP address and user agent
+//   - eventType: One of the Event constants
+//   - username: The user the event concerns
+//   - keyLabel: The label of the key involved, if any
+//   - detail: Further information, if any
+func Record(r *http.Request, eventType string, username string, keyLabel string, detail string) {
+	userAgent := r.UserAgent()
+	if len(userAgent) > maxUserAgentLength {
+		userAgent = userAgent[:maxUserAgentLength]
+	}
+
+	event := &Event{
+		Type:      eventType,
+		Username:  username,
+		KeyLabel:  keyLabel,
+		Detail:    detail,
+		IP:        session_util.ClientIP(r),
+		UserAgent: userAgent,
+		Time:      time.Now(),
+	}
+	// The event is still recorded when the client goes away before it is written
+	if err := Log.Append(context.WithoutCancel(r.Context()), event); err != nil {
+		fmt.Printf("Unable to record %s event for user %s: %v\n", eventType, username, err)
+	}
+}
+
+// List returns the most recent events of the account of a user, newest first
+// The log is never modified, so it still holds the events of an earlier account with the same username
+// that was deleted. Only the events since the user's registration are returned.
+//
+// Parameters:
+//   - ctx: The context of the request
+//   - username: The user whose events to list
+//   - limit: The most events to return
+//
+// Returns:
+//   - []Event: The events of the account, newest first
+//   - error: An error if the events cannot be read
+func List(ctx context.Context, username string, limit int) ([]Event, error) {
+	events, err := Log.List(ctx, username, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, event := range events {
+		if event.Type == EventRegister {
+			return events[:i+1], nil
+		}
+	}
+	return events, nil
+}
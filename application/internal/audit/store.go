@@ -0,0 +1,147 @@
+package audit
+
+import (
+	"chalmers/tkey-group22/application/internal/util"
+	"context"
+	"sync"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Store is the storage for the audit log
+// It is append-only: events can be added and read, but never changed or removed.
+// Implementations must be safe for concurrent use.
+type Store interface {
+	// Append adds an event to the log
+	Append(ctx context.Context, event *Event) error
+	// List returns at most limit events of the user, newest first
+	List(ctx context.Context, username string, limit int) ([]Event, error)
+}
+
+// MemoryStore keeps the audit log in the memory of the running process
+// The log is lost on restart, so it is only suitable for development and tests
+type MemoryStore struct {
+	events []Event
+	lock   sync.Mutex
+}
+
+// NewMemoryStore creates an empty in-memory audit log
+//
+// Returns:
+//   - *MemoryStore: A pointer to the new store
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{}
+}
+
+// Append adds an event to the log
+//
+// Parameters:
+//   - ctx: The context of the request
+//   - event: The event to add
+//
+// Returns:
+//   - error: Always nil
+func (store *MemoryStore) Append(ctx context.Context, event *Event) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	store.events = append(store.events, *event)
+	return nil
+}
+
+// List returns at most limit events of the user, newest first
+//
+// Parameters:
+//   - ctx: The context of the request
+//   - username: The user whose events to list
+//   - limit: The most events to return
+//
+// Returns:
+//   - []Event: Copies of the events
+//   - error: Always nil
+func (store *MemoryStore) List(ctx context.Context, username string, limit int) ([]Event, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	events := []Event{}
+	for i := len(store.events) - 1; i >= 0 && len(events) < limit; i-- {
+		if store.events[i].Username == username {
+			events = append(events, store.events[i])
+		}
+	}
+	return events, nil
+}
+
+// auditCollection is the MongoDB collection used by MongoStore
+const auditCollection = "audit_log"
+
+// MongoStore keeps the audit log in a MongoDB collection
+// The store only ever inserts into the collection. To make the log tamper-resistant, the database user
+// of the backend can be limited to the insert and find actions on it.
+type MongoStore struct {
+	db *mongo.Database
+}
+
+// NewMongoStore creates an audit log backed by the given database
+// The index used to list the events of a user is created by the database migrations, see db.MongoMigrations.
+//
+// Parameters:
+//   - db: The MongoDB database reference
+//
+// Returns:
+//   - *MongoStore: A pointer to the new store
+func NewMongoStore(db *mongo.Database) *MongoStore {
+	return &MongoStore{db: db}
+}
+
+// Append adds an event to the log
+//
+// Parameters:
+//   - ctx: The context of the request
+//   - event: The event to add
+//
+// Returns:
+//   - error: The database error, if any
+func (store *MongoStore) Append(ctx context.Context, event *Event) error {
+	ctx, cancel := util.OperationContext(ctx)
+	defer cancel()
+
+	collection := store.db.Collection(auditCollection)
+
+	_, err := collection.InsertOne(ctx, event)
+	return err
+}
+
+// List returns at most limit events of the user, newest first
+// Events recorded in the same instant are ordered by their ObjectID, which increases with insertion
+//
+// Parameters:
+//   - ctx: The context of the request
+//   - username: The user whose events to list
+//   - limit: The most events to return
+//
+// Returns:
+//   - []Event: The events
+//   - error: The database error, if any
+func (store *MongoStore) List(ctx context.Context, username string, limit int) ([]Event, error) {
+	ctx, cancel := util.OperationContext(ctx)
+	defer cancel()
+
+	collection := store.db.Collection(auditCollection)
+
+	findOptions := options.Find().
+		SetSort(bson.D{{Key: "time", Value: -1}, {Key: "_id", Value: -1}}).
+		SetLimit(int64(limit))
+	cursor, err := collection.Find(ctx, bson.M{"username": username}, findOptions)
+	if err != nil {
+		return nil, err
+	}
+
+	events := []Event{}
+	if err := cursor.All(ctx, &events); err != nil {
+		return nil, err
+	}
+	return events, nil
+}
@@ -2,136 +2,329 @@ package internal
 
 import (
 	"chalmers/tkey-group22/application/internal/util"
+	"context"
 	"crypto/ed25519"
 	"crypto/rand"
 	"encoding/base64"
 	"encoding/hex"
 	"errors"
 	"fmt"
-	"sync"
 	"time"
 )
 
 // Challenge represents a challenge that is generated for a user.
-// It contains a random value and an expiration time.
+// It contains a unique ID, the user, origin and purpose it was issued for, the encoded
+// ChallengePayload that is signed and an expiration time.
+// Device challenges also contain the user code of the device authorization they approve.
 type Challenge struct {
+	ID        string
+	Username  string
+	Origin    string
+	Purpose   string
 	Value     string
 	ExpiresAt time.Time
+	UserCode  string
 }
 
 var (
-	ValidDuration    = time.Duration(20) * time.Second // challenges are valid for 20 seconds
-	challengeLength  = 128                             // number of bytes in challenge
-	cleanupInterval  = time.Duration(2) * time.Minute
-	activeChallenges = make(map[string]*Challenge)
-	challengesLock   sync.Mutex
+	ValidDuration        = time.Duration(20) * time.Second // challenges are valid for 20 seconds
+	MaxChallengesPerUser = 5                               // max number of outstanding challenges for a single user
+	challengeLength      = 32                              // number of random bytes in the challenge nonce
+	challengeIDLength    = 16                              // number of bytes in challenge ID
+	cleanupInterval      = time.Duration(2) * time.Minute
 )
 
-// Asynchronous function that runs in the background to clean up expired challenges.
-func init() {
-	go cleanupExpiredChallenges()
+// ErrTooManyChallenges is returned when a user already has MaxChallengesPerUser outstanding challenges
+var ErrTooManyChallenges = errors.New("too many active challenges for given user")
+
+// ActiveChallenges is the store that holds the challenges waiting to be signed
+// It defaults to an in-memory store and can be replaced at startup, e.g. with a MongoChallengeStore
+var ActiveChallenges ChallengeStore = NewMemoryChallengeStore()
+
+// GenerateChallenge generates a new challenge for the given user, origin and purpose
+// It creates a random nonce and builds a ChallengePayload binding the nonce to the origin, purpose,
+// user and expiration time. The encoded payload is stored in ActiveChallenges under a new random challenge ID.
+// A user can have several outstanding challenges, e.g. when logging in from two browser tabs at once,
+// but at most MaxChallengesPerUser of them.
+//
+// Parameters:
+//   - ctx: The context of the request.
+//   - username: The username for which the challenge is generated.
+//   - purpose: What the signature will authorize, e.g. PurposeLogin.
+//   - origin: The relying-party origin the challenge is requested for. Must be in AllowedOrigins.
+//
+// Returns:
+//   - *Challenge: The generated challenge, including the ID the signature must be verified against.
+//   - error: ErrOriginNotAllowed or ErrTooManyChallenges if the challenge cannot be issued,
+//     or an error if the random byte generation fails or the challenge cannot be stored.
+func GenerateChallenge(ctx context.Context, username string, purpose string, origin string) (*Challenge, error) {
+	return generateChallenge(ctx, username, purpose, origin, "")
 }
 
-// GenerateChallenge generates a new challenge for the given public key
-// It creates a random byte sequence, encodes it to a hexadecimal string and stores it in the activeChallenges map with an expiration time
+// GenerateDeviceChallenge generates a "device" challenge bound to the user code of a device authorization
+// The user code is part of the signed payload, so the signature approves the login of that browser only,
+// and the client can show the code before the user touches the TKey.
 //
 // Parameters:
+//   - ctx: The context of the request.
 //   - username: The username for which the challenge is generated.
+//   - origin: The relying-party origin the challenge is requested for. Must be in AllowedOrigins.
+//   - userCode: The user code shown by the browser that is waiting to be logged in.
 //
 // Returns:
-//   - A string representing the generated challenge.
-//   - An error if the random byte generation fails.
-func GenerateChallenge(username string) (string, error) {
-	challengesLock.Lock()
-	defer challengesLock.Unlock()
+//   - *Challenge: The generated challenge.
+//   - error: The same errors as GenerateChallenge.
+func GenerateDeviceChallenge(ctx context.Context, username string, origin string, userCode string) (*Challenge, error) {
+	if userCode == "" {
+		return nil, errors.New("user code is required")
+	}
+	return generateChallenge(ctx, username, PurposeDevice, origin, userCode)
+}
 
-	bytes := make([]byte, challengeLength)
-	rand.Read(bytes)
+// generateChallenge generates and stores a challenge, see GenerateChallenge
+func generateChallenge(ctx context.Context, username string, purpose string, origin string, userCode string) (*Challenge, error) {
+	if !IsAllowedOrigin(origin) {
+		return nil, ErrOriginNotAllowed
+	}
 
-	challenge := &Challenge{
-		Value:     hex.EncodeToString(bytes),
-		ExpiresAt: time.Now().Add(ValidDuration),
+	if !validPurposes[purpose] {
+		return nil, fmt.Errorf("unknown challenge purpose: %s", purpose)
 	}
 
-	activeChallenges[username] = challenge
+	// The count and the insert are not atomic, so concurrent requests may slightly exceed the cap
+	outstanding, err := ActiveChallenges.CountForUser(ctx, username)
+	if err != nil {
+		return nil, err
+	}
+	if outstanding >= MaxChallengesPerUser {
+		return nil, ErrTooManyChallenges
+	}
 
-	return challenge.Value, nil
-}
+	id, err := randomHex(challengeIDLength)
+	if err != nil {
+		return nil, err
+	}
 
-// cleanupExpiredChallenges periodically removes expired challenges from the activeChallenges map
-// The function runs indefinitely, sleeping for a duration specified by cleanupInterval between each cleanup cycle
-func cleanupExpiredChallenges() {
-	for {
-		time.Sleep(cleanupInterval)
-		challengesLock.Lock()
-		for pubKey, challenge := range activeChallenges {
-			if time.Now().After(challenge.ExpiresAt) {
-				delete(activeChallenges, pubKey)
-			}
-		}
-		challengesLock.Unlock()
+	nonce, err := randomHex(challengeLength)
+	if err != nil {
+		return nil, err
+	}
+
+	// The payload encodes the expiration time with second precision
+	payload := &ChallengePayload{
+		Origin:    origin,
+		Purpose:   purpose,
+		Username:  username,
+		Nonce:     nonce,
+		ExpiresAt: time.Now().Add(ValidDuration).Truncate(time.Second),
+		UserCode:  userCode,
+	}
+
+	challenge := &Challenge{
+		ID:        id,
+		Username:  username,
+		Origin:    origin,
+		Purpose:   purpose,
+		Value:     payload.Encode(),
+		ExpiresAt: payload.ExpiresAt,
+		UserCode:  userCode,
+	}
+
+	if err := ActiveChallenges.Put(ctx, challenge.ID, challenge, ValidDuration); err != nil {
+		return nil, err
 	}
+
+	return challenge, nil
 }
 
-// VerifySignature verifies the signed response for a given public key
+// VerifySignature verifies the signed response for a given challenge
+// The challenge is removed from the store whether or not the signature is valid, so it can only be used once.
+// Only active keys of the user are tried, so suspended and revoked keys cannot be used.
 //
 // Parameters:
+//   - ctx: The context of the request.
 //   - username: The username as a string.
+//   - challengeID: The ID of the challenge that was signed.
+//   - purpose: The purpose the challenge must have been issued for, e.g. PurposeLogin.
 //   - signature: The signature as a byte slice.
+//   - userRepo: The repository to look up the user's public keys in.
 //
 // Returns:
-//   - bool: True if the signature is valid, false otherwise.
-//   - error: An error if the verification fails due to an invalid format, expired challenge, or no active challenge.
-func VerifySignature(username string, signature []byte, userRepo util.UserRepository) (bool, error) {
-	challengesLock.Lock()
-	challenge, exists := activeChallenges[username]
-	if exists {
-		delete(activeChallenges, username)
-	}
-	challengesLock.Unlock()
+//   - *util.PublicKey: The public key of the user that made the signature, or nil if the signature is invalid.
+//   - error: An error if the verification fails due to an invalid format, mismatching payload, expired challenge, or no active challenge.
+func VerifySignature(ctx context.Context, username string, challengeID string, purpose string, signature []byte, userRepo util.UserRepository) (*util.PublicKey, error) {
+	return verifySignature(ctx, username, challengeID, purpose, "", signature, userRepo)
+}
 
-	if !exists {
-		fmt.Println(activeChallenges)
-		return false, errors.New("no active challenge found for given user")
+// VerifyDeviceSignature verifies the signature over a "device" challenge approving the given user code
+// It works like VerifySignature, and additionally requires that the challenge was issued for the user code.
+//
+// Parameters:
+//   - ctx: The context of the request.
+//   - username: The username as a string.
+//   - challengeID: The ID of the challenge that was signed.
+//   - userCode: The user code the signature must approve.
+//   - signature: The signature as a byte slice.
+//   - userRepo: The repository to look up the user's public keys in.
+//
+// Returns:
+//   - *util.PublicKey: The public key of the user that made the signature, or nil if the signature is invalid.
+//   - error: An error if the verification fails, including when the challenge was issued for another user code.
+func VerifyDeviceSignature(ctx context.Context, username string, challengeID string, userCode string, signature []byte, userRepo util.UserRepository) (*util.PublicKey, error) {
+	if userCode == "" {
+		return nil, errors.New("user code is required")
 	}
+	return verifySignature(ctx, username, challengeID, PurposeDevice, userCode, signature, userRepo)
+}
 
-	if time.Now().After(challenge.ExpiresAt) {
-		return false, errors.New("challenge expired")
+// verifySignature verifies a signature by an active key of the user, see VerifySignature
+func verifySignature(ctx context.Context, username string, challengeID string, purpose string, userCode string, signature []byte, userRepo util.UserRepository) (*util.PublicKey, error) {
+	challenge, err := takeChallenge(ctx, username, challengeID, purpose, userCode)
+	if err != nil {
+		return nil, err
 	}
 
-	userData, err := userRepo.GetUser(username)
+	userData, err := userRepo.GetUser(ctx, username)
 	if err != nil {
-		return false, err
+		return nil, err
 	}
 
 	for _, publicKey := range userData.PublicKeys {
+		if !publicKey.IsActive() {
+			continue
+		}
 		pubKeyBytes, err := base64.StdEncoding.DecodeString(publicKey.Key)
 		if err != nil {
-			return false, err
+			return nil, err
 		}
 		edPubKey := ed25519.PublicKey(pubKeyBytes)
 		if ed25519.Verify(edPubKey, []byte(challenge.Value), signature) {
-			return true, nil
+			return &publicKey, nil
 		}
 	}
 
-	return false, errors.New("invalid signature")
+	return nil, errors.New("invalid signature")
 }
 
-// HasActiveChallenge checks if there is an active challenge for the given user.
-// It locks the challengesLock mutex to ensure thread safety while accessing the activeChallenges map.
+// VerifyPossession verifies that a challenge was signed with the private key belonging to the given public key
+// It is used to make sure that a key that is being added belongs to whoever adds it.
+// Like VerifySignature, the challenge can only be used once.
 //
 // Parameters:
-//   - username: The username to check for an active challenge.
+//   - ctx: The context of the request.
+//   - username: The username the challenge must have been issued to.
+//   - challengeID: The ID of the challenge that was signed.
+//   - purpose: The purpose the challenge must have been issued for, e.g. PurposeNewKey.
+//   - pubkey: The ed25519 public key that must have made the signature.
+//   - signature: The signature as a byte slice.
 //
 // Returns:
-//   - bool: True if there is an active challenge for the user, false otherwise.
-func HasActiveChallenge(username string) bool {
-	// Aquire the lock
-	challengesLock.Lock()
-	// Release the lock when the function returns
-	defer challengesLock.Unlock()
-
-	_, exists := activeChallenges[username]
+//   - error: An error if the key is malformed, the challenge is not valid, or the signature was not made by the key.
+func VerifyPossession(ctx context.Context, username string, challengeID string, purpose string, pubkey ed25519.PublicKey, signature []byte) error {
+	if len(pubkey) != ed25519.PublicKeySize {
+		return errors.New("public key must be 32 bytes")
+	}
+
+	challenge, err := takeChallenge(ctx, username, challengeID, purpose, "")
+	if err != nil {
+		return err
+	}
+
+	if !ed25519.Verify(pubkey, []byte(challenge.Value), signature) {
+		return errors.New("invalid signature")
+	}
+
+	return nil
+}
+
+// takeChallenge removes a challenge from the store and checks that it was issued to the user for the purpose
+//
+// Parameters:
+//   - ctx: The context of the request.
+//   - username: The username the challenge must have been issued to.
+//   - challengeID: The ID of the challenge.
+//   - purpose: The purpose the challenge must have been issued for.
+//   - userCode: The user code the challenge must have been issued for, empty for all but device challenges.
+//
+// Returns:
+//   - *Challenge: The challenge, if it is valid.
+//   - error: An error if there is no such challenge or its payload does not match.
+func takeChallenge(ctx context.Context, username string, challengeID string, purpose string, userCode string) (*Challenge, error) {
+	challenge, err := ActiveChallenges.Take(ctx, challengeID)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := checkChallengePayload(challenge, username, purpose, userCode); err != nil {
+		return nil, err
+	}
+
+	return challenge, nil
+}
+
+// checkChallengePayload checks the signed payload of a challenge field by field against
+// what the challenge was issued for and what the caller expects
+//
+// Parameters:
+//   - challenge: The challenge taken from the store.
+//   - username: The username the signature is verified for.
+//   - purpose: The purpose the signature is verified for.
+//   - userCode: The user code the signature is verified for, empty for all but device challenges.
+//
+// Returns:
+//   - error: An error describing the first field that does not match, otherwise nil.
+func checkChallengePayload(challenge *Challenge, username string, purpose string, userCode string) error {
+	payload, err := ParseChallengePayload(challenge.Value)
+	if err != nil {
+		return err
+	}
+
+	if payload.Username != challenge.Username || payload.Username != username {
+		return errors.New("challenge was not issued for given user")
+	}
+
+	if payload.Purpose != challenge.Purpose || payload.Purpose != purpose {
+		return errors.New("challenge was not issued for this purpose")
+	}
+
+	if payload.UserCode != challenge.UserCode || payload.UserCode != userCode {
+		return errors.New("challenge was not issued for this user code")
+	}
+
+	if payload.Origin != challenge.Origin || !IsAllowedOrigin(payload.Origin) {
+		return ErrOriginNotAllowed
+	}
+
+	if !payload.ExpiresAt.Equal(challenge.ExpiresAt) || time.Now().After(payload.ExpiresAt) {
+		return errors.New("challenge expired")
+	}
+
+	return nil
+}
+
+// HasActiveChallenge checks if there is an active challenge with the given ID.
+// A failure to query the challenge store is treated as no active challenge.
+//
+// Parameters:
+//   - ctx: The context of the request.
+//   - challengeID: The challenge ID to check for an active challenge.
+//
+// Returns:
+//   - bool: True if there is an active challenge with the ID, false otherwise.
+func HasActiveChallenge(ctx context.Context, challengeID string) bool {
+	exists, err := ActiveChallenges.Has(ctx, challengeID)
+	if err != nil {
+		fmt.Printf("Unable to check for active challenge: %v\n", err)
+		return false
+	}
 	return exists
 }
+
+// randomHex returns n cryptographically random bytes encoded as a hexadecimal string
+func randomHex(n int) (string, error) {
+	bytes := make([]byte, n)
+	if _, err := rand.Read(bytes); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(bytes), nil
+}
@@ -0,0 +1,164 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// challengeHeader is the first line of every challenge payload
+// It separates the signatures made for this application from signatures over any other data
+const challengeHeader = "tkey-passwordless-authentication challenge v1"
+
+// Purposes a challenge can be issued for
+// A signature over a challenge is only accepted for the purpose the challenge was issued for
+const (
+	PurposeLogin     = "login"
+	PurposeRegister  = "register"   // signature by the key a new user registers with, proving possession of it
+	PurposeAddKey    = "add-key"    // step-up signature by a registered key, authorizing a new key to be added
+	PurposeRemoveKey = "remove-key" // step-up signature by a registered key, authorizing a key to be removed
+	PurposeNewKey    = "new-key"    // signature by the key being added, proving possession of it
+
+	PurposeRecoveryCodes = "recovery-codes" // step-up signature by a registered key, authorizing new recovery codes
+	PurposeDevice        = "device"         // signature by a registered key, approving the login of a browser showing a user code
+
+	PurposeSuspendKey    = "suspend-key"    // step-up signature by a registered key, authorizing a key to be suspended
+	PurposeReactivateKey = "reactivate-key" // step-up signature by a registered key, authorizing a key to be reactivated
+)
+
+var validPurposes = map[string]bool{
+	PurposeLogin:     true,
+	PurposeRegister:  true,
+	PurposeAddKey:    true,
+	PurposeRemoveKey: true,
+	PurposeNewKey:    true,
+
+	PurposeRecoveryCodes: true,
+	PurposeDevice:        true,
+
+	PurposeSuspendKey:    true,
+	PurposeReactivateKey: true,
+}
+
+// AllowedOrigins is the list of relying-party origins that challenges may be issued for
+// The origin is included in the signed payload, so that the client can refuse to sign
+// a challenge that is requested by a page served from any other origin
+var AllowedOrigins = []string{"http://localhost:3000", "http://localhost:8080"}
+
+// ErrOriginNotAllowed is returned when a challenge is requested for an origin that is not in AllowedOrigins
+var ErrOriginNotAllowed = errors.New("origin is not allowed")
+
+// ChallengePayload is the structured data that the TKey signs
+// It is encoded as a header line followed by one "field: value" line per field
+// The user code is only part of "device" challenges, where it is the last line
+type ChallengePayload struct {
+	Origin    string    // Relying-party origin the challenge was issued for
+	Purpose   string    // What the signature authorizes, e.g. "login"
+	Username  string    // User the challenge was issued to
+	Nonce     string    // Random value encoded as hex
+	ExpiresAt time.Time // When the challenge stops being valid
+	UserCode  string    // User code of the device authorization the signature approves, if any
+}
+
+// Encode returns the text representation of the payload, which is what gets signed
+//
+// Returns:
+//   - string: The encoded payload
+func (payload *ChallengePayload) Encode() string {
+	lines := []string{
+		challengeHeader,
+		"origin: " + payload.Origin,
+		"purpose: " + payload.Purpose,
+		"username: " + payload.Username,
+		"nonce: " + payload.Nonce,
+		"expires: " + payload.ExpiresAt.UTC().Format(time.RFC3339),
+	}
+	if payload.UserCode != "" {
+		lines = append(lines, "user-code: "+payload.UserCode)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// ParseChallengePayload parses an encoded challenge payload
+// All fields but the user code must be present, in the order written by Encode
+//
+// Parameters:
+//   - encoded: The encoded payload
+//
+// Returns:
+//   - *ChallengePayload: The parsed payload
+//   - error: An error if the payload is malformed
+func ParseChallengePayload(encoded string) (*ChallengePayload, error) {
+	lines := strings.Split(encoded, "\n")
+	if (len(lines) != 6 && len(lines) != 7) || lines[0] != challengeHeader {
+		return nil, errors.New("malformed challenge payload")
+	}
+
+	fields := []string{"origin", "purpose", "username", "nonce", "expires"}
+	values := make([]string, len(fields))
+	for i, field := range fields {
+		value, found := strings.CutPrefix(lines[i+1], field+": ")
+		if !found {
+			return nil, fmt.Errorf("malformed challenge payload: missing %s", field)
+		}
+		values[i] = value
+	}
+
+	expiresAt, err := time.Parse(time.RFC3339, values[4])
+	if err != nil {
+		return nil, fmt.Errorf("malformed challenge payload: %w", err)
+	}
+
+	var userCode string
+	if len(lines) == 7 {
+		value, found := strings.CutPrefix(lines[6], "user-code: ")
+		if !found || value == "" {
+			return nil, errors.New("malformed challenge payload: missing user-code")
+		}
+		userCode = value
+	}
+
+	return &ChallengePayload{
+		Origin:    values[0],
+		Purpose:   values[1],
+		Username:  values[2],
+		Nonce:     values[3],
+		ExpiresAt: expiresAt,
+		UserCode:  userCode,
+	}, nil
+}
+
+// IsAllowedOrigin checks if challenges may be issued for the given origin
+//
+// Parameters:
+//   - origin: The origin to check, e.g. "http://localhost:3000"
+//
+// Returns:
+//   - bool: True if the origin is in AllowedOrigins, false otherwise
+func IsAllowedOrigin(origin string) bool {
+	for _, allowed := range AllowedOrigins {
+		if origin == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseOrigins splits a comma separated list of origins, as used in the RP_ORIGINS environment variable
+//
+// Parameters:
+//   - origins: The comma separated origins
+//
+// Returns:
+//   - []string: The origins with surrounding whitespace and trailing slashes removed
+func ParseOrigins(origins string) []string {
+	var parsed []string
+	for _, origin := range strings.Split(origins, ",") {
+		origin = strings.TrimSuffix(strings.TrimSpace(origin), "/")
+		if origin != "" {
+			parsed = append(parsed, origin)
+		}
+	}
+	return parsed
+}
@@ -0,0 +1,299 @@
+package internal
+
+import (
+	"chalmers/tkey-group22/application/internal/util"
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// ErrNoActiveChallenge is returned by a ChallengeStore when no unexpired challenge exists for a key
+var ErrNoActiveChallenge = errors.New("no active challenge found")
+
+// ChallengeStore is the storage backend for active challenges
+// Implementations must be safe for concurrent use and Take must remove the challenge atomically,
+// so that a challenge can only be used once even when several backend replicas share the store
+type ChallengeStore interface {
+	// Put stores the challenge under the given key, replacing any existing challenge.
+	// The store may discard the challenge once ttl has passed
+	Put(ctx context.Context, key string, challenge *Challenge, ttl time.Duration) error
+	// Take removes and returns the challenge stored under the given key.
+	// It returns ErrNoActiveChallenge if there is none
+	Take(ctx context.Context, key string) (*Challenge, error)
+	// Has reports whether an unexpired challenge is stored under the given key
+	Has(ctx context.Context, key string) (bool, error)
+	// CountForUser returns the number of unexpired challenges issued to the given user
+	CountForUser(ctx context.Context, username string) (int, error)
+}
+
+// MemoryChallengeStore keeps challenges in a map in the memory of the running process
+// It is only suitable when a single backend instance is running
+type MemoryChallengeStore struct {
+	challenges map[string]*Challenge
+	lock       sync.Mutex
+}
+
+// NewMemoryChallengeStore creates an empty in-memory challenge store
+// It starts a goroutine that runs in the background to clean up expired challenges
+//
+// Returns:
+//   - *MemoryChallengeStore: A pointer to the new store
+func NewMemoryChallengeStore() *MemoryChallengeStore {
+	store := &MemoryChallengeStore{challenges: make(map[string]*Challenge)}
+	go store.cleanupExpiredChallenges()
+	return store
+}
+
+// Put stores the challenge under the given key, replacing any existing challenge
+// Expired challenges are removed by the background cleanup, so ttl is not tracked separately
+//
+// Parameters:
+//   - ctx: The context of the request
+//   - key: The key to store the challenge under
+//   - challenge: The challenge to store
+//   - ttl: How long the challenge should be kept
+//
+// Returns:
+//   - error: Always nil
+func (store *MemoryChallengeStore) Put(ctx context.Context, key string, challenge *Challenge, ttl time.Duration) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	store.challenges[key] = challenge
+	return nil
+}
+
+// Take removes and returns the challenge stored under the given key
+//
+// Parameters:
+//   - ctx: The context of the request
+//   - key: The key the challenge is stored under
+//
+// Returns:
+//   - *Challenge: The stored challenge
+//   - error: ErrNoActiveChallenge if there is no challenge for the key
+func (store *MemoryChallengeStore) Take(ctx context.Context, key string) (*Challenge, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	challenge, exists := store.challenges[key]
+	if !exists {
+		return nil, ErrNoActiveChallenge
+	}
+	delete(store.challenges, key)
+
+	return challenge, nil
+}
+
+// Has reports whether an unexpired challenge is stored under the given key
+//
+// Parameters:
+//   - ctx: The context of the request
+//   - key: The key to check
+//
+// Returns:
+//   - bool: True if there is an unexpired challenge for the key, false otherwise
+//   - error: Always nil
+func (store *MemoryChallengeStore) Has(ctx context.Context, key string) (bool, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	challenge, exists := store.challenges[key]
+	return exists && time.Now().Before(challenge.ExpiresAt), nil
+}
+
+// CountForUser returns the number of unexpired challenges issued to the given user
+//
+// Parameters:
+//   - ctx: The context of the request
+//   - username: The username to count challenges for
+//
+// Returns:
+//   - int: The number of unexpired challenges for the user
+//   - error: Always nil
+func (store *MemoryChallengeStore) CountForUser(ctx context.Context, username string) (int, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	count := 0
+	now := time.Now()
+	for _, challenge := range store.challenges {
+		if challenge.Username == username && now.Before(challenge.ExpiresAt) {
+			count++
+		}
+	}
+	return count, nil
+}
+
+// cleanupExpiredChallenges periodically removes expired challenges from the store
+// The function runs indefinitely, sleeping for a duration specified by cleanupInterval between each cleanup cycle
+func (store *MemoryChallengeStore) cleanupExpiredChallenges() {
+	for {
+		time.Sleep(cleanupInterval)
+		store.lock.Lock()
+		for key, challenge := range store.challenges {
+			if time.Now().After(challenge.ExpiresAt) {
+				delete(store.challenges, key)
+			}
+		}
+		store.lock.Unlock()
+	}
+}
+
+// challengeCollection is the MongoDB collection used by MongoChallengeStore
+const challengeCollection = "challenges"
+
+// challengeDocument is the representation of a stored challenge in MongoDB
+// StoreExpiresAt has a TTL index so that MongoDB removes abandoned challenges by itself
+type challengeDocument struct {
+	Key            string    `bson:"_id"`                // Key the challenge is stored under
+	Username       string    `bson:"username"`           // User the challenge was issued to
+	Origin         string    `bson:"origin"`             // Origin the challenge was issued for
+	Purpose        string    `bson:"purpose"`            // Purpose the challenge was issued for
+	Value          string    `bson:"value"`              // The challenge value
+	ExpiresAt      time.Time `bson:"expiresAt"`          // When the challenge stops being valid
+	UserCode       string    `bson:"userCode,omitempty"` // User code of the device authorization the challenge approves
+	StoreExpiresAt time.Time `bson:"ttl"`                // When MongoDB may remove the document
+}
+
+// MongoChallengeStore keeps challenges in a MongoDB collection
+// It allows several backend replicas to share challenges, so that a login started on one
+// instance can be verified on another
+type MongoChallengeStore struct {
+	db *mongo.Database
+}
+
+// NewMongoChallengeStore creates a challenge store backed by the given database
+// The TTL index used to expire challenges and the index used to count a user's challenges are created
+// by the database migrations, see db.MongoMigrations.
+//
+// Parameters:
+//   - db: The MongoDB database reference
+//
+// Returns:
+//   - *MongoChallengeStore: A pointer to the new store
+func NewMongoChallengeStore(db *mongo.Database) *MongoChallengeStore {
+	return &MongoChallengeStore{db: db}
+}
+
+// Put stores the challenge under the given key, replacing any existing challenge
+//
+// Parameters:
+//   - ctx: The context of the request
+//   - key: The key to store the challenge under
+//   - challenge: The challenge to store
+//   - ttl: How long MongoDB should keep the challenge
+//
+// Returns:
+//   - error: An error if the challenge could not be stored
+func (store *MongoChallengeStore) Put(ctx context.Context, key string, challenge *Challenge, ttl time.Duration) error {
+	ctx, cancel := util.OperationContext(ctx)
+	defer cancel()
+
+	collection := store.db.Collection(challengeCollection)
+
+	document := challengeDocument{
+		Key:            key,
+		Username:       challenge.Username,
+		Origin:         challenge.Origin,
+		Purpose:        challenge.Purpose,
+		Value:          challenge.Value,
+		ExpiresAt:      challenge.ExpiresAt,
+		UserCode:       challenge.UserCode,
+		StoreExpiresAt: time.Now().Add(ttl),
+	}
+
+	filter := bson.M{"_id": key}
+	_, err := collection.ReplaceOne(ctx, filter, document, options.Replace().SetUpsert(true))
+	return err
+}
+
+// Take removes and returns the challenge stored under the given key
+// The find and delete happen in a single operation, so only one replica can take a challenge
+//
+// Parameters:
+//   - ctx: The context of the request
+//   - key: The key the challenge is stored under
+//
+// Returns:
+//   - *Challenge: The stored challenge
+//   - error: ErrNoActiveChallenge if there is no challenge for the key, or the database error
+func (store *MongoChallengeStore) Take(ctx context.Context, key string) (*Challenge, error) {
+	ctx, cancel := util.OperationContext(ctx)
+	defer cancel()
+
+	collection := store.db.Collection(challengeCollection)
+
+	var document challengeDocument
+	filter := bson.M{"_id": key}
+	err := collection.FindOneAndDelete(ctx, filter).Decode(&document)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrNoActiveChallenge
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &Challenge{
+		ID:        document.Key,
+		Username:  document.Username,
+		Origin:    document.Origin,
+		Purpose:   document.Purpose,
+		Value:     document.Value,
+		ExpiresAt: document.ExpiresAt,
+		UserCode:  document.UserCode,
+	}, nil
+}
+
+// Has reports whether an unexpired challenge is stored under the given key
+//
+// Parameters:
+//   - ctx: The context of the request
+//   - key: The key to check
+//
+// Returns:
+//   - bool: True if there is an unexpired challenge for the key, false otherwise
+//   - error: An error if the database query fails
+func (store *MongoChallengeStore) Has(ctx context.Context, key string) (bool, error) {
+	ctx, cancel := util.OperationContext(ctx)
+	defer cancel()
+
+	collection := store.db.Collection(challengeCollection)
+
+	filter := bson.M{"_id": key, "expiresAt": bson.M{"$gt": time.Now()}}
+	count, err := collection.CountDocuments(ctx, filter)
+	if err != nil {
+		return false, err
+	}
+
+	return count > 0, nil
+}
+
+// CountForUser returns the number of unexpired challenges issued to the given user
+//
+// Parameters:
+//   - ctx: The context of the request
+//   - username: The username to count challenges for
+//
+// Returns:
+//   - int: The number of unexpired challenges for the user
+//   - error: An error if the database query fails
+func (store *MongoChallengeStore) CountForUser(ctx context.Context, username string) (int, error) {
+	ctx, cancel := util.OperationContext(ctx)
+	defer cancel()
+
+	collection := store.db.Collection(challengeCollection)
+
+	filter := bson.M{"username": username, "expiresAt": bson.M{"$gt": time.Now()}}
+	count, err := collection.CountDocuments(ctx, filter)
+	if err != nil {
+		return 0, err
+	}
+
+	return int(count), nil
+}
@@ -0,0 +1,205 @@
+// Package device implements a device authorization flow in the style of RFC 8628, letting users log in
+// to the web application on a machine that does not have their TKey plugged in
+// The browser starts an authorization and shows its user code, the user enters the code in the TKey client
+// on the machine that has the TKey and signs a challenge bound to it, and the browser, which polls with
+// the device code only it knows, is then logged in.
+package device
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"math/big"
+	"strings"
+	"time"
+)
+
+var (
+	CodeValidDuration = 10 * time.Minute // The user must approve the login within 10 minutes
+	PollInterval      = 5 * time.Second  // The browser may poll once every 5 seconds
+	deviceCodeLength  = 32               // number of random bytes in a device code
+	userCodeLength    = 8                // number of characters in a user code
+)
+
+// userCodeAlphabet is the characters of a user code
+// Only consonants are used, as RFC 8628 recommends, so the codes are easy to type and never spell words
+const userCodeAlphabet = "BCDFGHJKLMNPQRSTVWXZ"
+
+// Authorizations is the store that holds the pending device authorizations
+// It defaults to an in-memory store and can be replaced at startup, e.g. with a MongoStore
+var Authorizations Store = NewMemoryStore()
+
+// Errors returned while polling, named after the error codes of RFC 8628
+var (
+	ErrAuthorizationPending = errors.New("authorization_pending") // The user has not approved the login yet
+	ErrSlowDown             = errors.New("slow_down")             // The browser polls more often than PollInterval
+	ErrExpiredCode          = errors.New("expired_token")         // The code does not exist, has expired or was already used
+)
+
+// ErrUserCodeTaken is returned by Store.Put when the user code belongs to another pending authorization
+var ErrUserCodeTaken = errors.New("user code is already in use")
+
+// Authorization is a login waiting to be approved from the TKey client
+type Authorization struct {
+	UserCode   string    `bson:"userCode"`           // Code shown in the browser and entered in the TKey client
+	Approved   bool      `bson:"approved"`           // Set once the user signed a challenge bound to the user code
+	Username   string    `bson:"username,omitempty"` // User who approved the login
+	KeyLabel   string    `bson:"keyLabel,omitempty"` // Label of the key the login was approved with
+	LastPolled time.Time `bson:"lastPolled"`         // When the browser last asked whether the login was approved
+	ExpiresAt  time.Time `bson:"expiresAt"`          // When the authorization stops being valid
+}
+
+// Start begins a device authorization for a browser
+// Only the hash of the device code is stored, so the codes cannot be read from the store.
+//
+// Returns:
+//   - string: The device code the browser polls with, kept secret by the browser.
+//   - *Authorization: The new authorization, holding the user code to show.
+//   - error: An error if the codes cannot be generated or stored.
+func Start() (string, *Authorization, error) {
+	deviceCode, err := randomCode()
+	if err != nil {
+		return "", nil, err
+	}
+
+	// A new user code is drawn if it collides with a pending one, which is unlikely with 20^8 possible codes
+	for attempt := 0; attempt < 3; attempt++ {
+		userCode, err := newUserCode()
+		if err != nil {
+			return "", nil, err
+		}
+
+		authorization := &Authorization{
+			UserCode:  userCode,
+			ExpiresAt: time.Now().Add(CodeValidDuration),
+		}
+		err = Authorizations.Put(HashCode(deviceCode), authorization)
+		if err == ErrUserCodeTaken {
+			continue
+		}
+		if err != nil {
+			return "", nil, err
+		}
+		return deviceCode, authorization, nil
+	}
+	return "", nil, ErrUserCodeTaken
+}
+
+// Pending returns the pending authorization with the given user code
+// It lets the TKey client find out that a code was mistyped before the user touches the TKey.
+//
+// Parameters:
+//   - userCode: The user code as entered by the user, see NormalizeUserCode.
+//
+// Returns:
+//   - *Authorization: The pending authorization.
+//   - error: ErrExpiredCode if there is no pending authorization with the user code.
+func Pending(userCode string) (*Authorization, error) {
+	return Authorizations.FindPending(NormalizeUserCode(userCode))
+}
+
+// Approve approves the pending authorization with the given user code for the user
+// It must only be called after verifying a signature over a challenge bound to the user code.
+//
+// Parameters:
+//   - userCode: The user code that was approved.
+//   - username: The user who approved the login.
+//   - keyLabel: The label of the key that signed the challenge.
+//
+// Returns:
+//   - error: ErrExpiredCode if there is no pending authorization with the user code.
+func Approve(userCode string, username string, keyLabel string) error {
+	return Authorizations.Approve(NormalizeUserCode(userCode), username, keyLabel)
+}
+
+// Poll checks whether the authorization of a device code has been approved
+// An approved authorization is removed, so the browser can only be logged in once.
+//
+// Parameters:
+//   - deviceCode: The device code returned by Start.
+//
+// Returns:
+//   - *Authorization: The approved authorization.
+//   - error: ErrAuthorizationPending, ErrSlowDown or ErrExpiredCode if the browser cannot be logged in (yet).
+func Poll(deviceCode string) (*Authorization, error) {
+	now := time.Now()
+	authorization, err := Authorizations.Poll(HashCode(deviceCode), now)
+	if err != nil {
+		return nil, err
+	}
+	if authorization.Approved {
+		return authorization, nil
+	}
+	if now.Sub(authorization.LastPolled) < PollInterval {
+		return nil, ErrSlowDown
+	}
+	return nil, ErrAuthorizationPending
+}
+
+// NormalizeUserCode converts a user code as typed by the user to the form it is stored in
+// Letters are upper-cased and separators are removed, so "bcdf-ghjk" and "BCDFGHJK" are the same code.
+//
+// Parameters:
+//   - userCode: The user code as typed.
+//
+// Returns:
+//   - string: The normalized user code.
+func NormalizeUserCode(userCode string) string {
+	userCode = strings.ToUpper(userCode)
+	return strings.Map(func(r rune) rune {
+		if r == '-' || r == ' ' {
+			return -1
+		}
+		return r
+	}, userCode)
+}
+
+// FormatUserCode formats a user code for display, e.g. "BCDF-GHJK"
+//
+// Parameters:
+//   - userCode: The normalized user code.
+//
+// Returns:
+//   - string: The user code split in two halves.
+func FormatUserCode(userCode string) string {
+	if len(userCode) != userCodeLength {
+		return userCode
+	}
+	return userCode[:userCodeLength/2] + "-" + userCode[userCodeLength/2:]
+}
+
+// HashCode returns the key a device code is stored under
+//
+// Parameters:
+//   - code: The device code.
+//
+// Returns:
+//   - string: The SHA-256 hash of the code, encoded as hex.
+func HashCode(code string) string {
+	hash := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(hash[:])
+}
+
+// newUserCode draws a random user code from userCodeAlphabet
+func newUserCode() (string, error) {
+	code := make([]byte, userCodeLength)
+	for i := range code {
+		index, err := rand.Int(rand.Reader, big.NewInt(int64(len(userCodeAlphabet))))
+		if err != nil {
+			return "", err
+		}
+		code[i] = userCodeAlphabet[index.Int64()]
+	}
+	return string(code), nil
+}
+
+// randomCode returns a random device code
+func randomCode() (string, error) {
+	random := make([]byte, deviceCodeLength)
+	if _, err := rand.Read(random); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(random), nil
+}
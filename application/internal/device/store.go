@@ -0,0 +1,284 @@
+package device
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Store is the storage for device authorizations, keyed by the hash of their device code
+// Implementations must be safe for concurrent use, and Approve and Poll must be atomic,
+// so that a user code is approved once and an approved authorization logs in a single browser,
+// even when several backend replicas share the store
+type Store interface {
+	// Put stores a new authorization under the given key, or returns ErrUserCodeTaken
+	Put(key string, authorization *Authorization) error
+	// FindPending returns the unexpired, unapproved authorization with the user code, or ErrExpiredCode
+	FindPending(userCode string) (*Authorization, error)
+	// Approve approves the unexpired, unapproved authorization with the user code, or returns ErrExpiredCode
+	Approve(userCode string, username string, keyLabel string) error
+	// Poll sets when the authorization stored under the key was last polled and returns it as it was before,
+	// removing it if it was approved, or returns ErrExpiredCode
+	Poll(key string, now time.Time) (*Authorization, error)
+}
+
+// MemoryStore keeps device authorizations in a map in the memory of the running process
+// It is only suitable when a single backend instance is running
+type MemoryStore struct {
+	authorizations map[string]*Authorization
+	lock           sync.Mutex
+}
+
+// NewMemoryStore creates an empty in-memory device authorization store
+//
+// Returns:
+//   - *MemoryStore: A pointer to the new store
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{authorizations: make(map[string]*Authorization)}
+}
+
+// Put stores a new authorization under the given key
+// Expired authorizations are removed whenever a new one is stored
+//
+// Parameters:
+//   - key: The hash of the device code
+//   - authorization: The new authorization
+//
+// Returns:
+//   - error: ErrUserCodeTaken if another authorization has the same user code
+func (store *MemoryStore) Put(key string, authorization *Authorization) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	now := time.Now()
+	for existing, stored := range store.authorizations {
+		if now.After(stored.ExpiresAt) {
+			delete(store.authorizations, existing)
+		} else if stored.UserCode == authorization.UserCode {
+			return ErrUserCodeTaken
+		}
+	}
+	stored := *authorization
+	store.authorizations[key] = &stored
+	return nil
+}
+
+// FindPending returns the unexpired, unapproved authorization with the user code
+//
+// Parameters:
+//   - userCode: The normalized user code
+//
+// Returns:
+//   - *Authorization: A copy of the authorization
+//   - error: ErrExpiredCode if there is no such authorization
+func (store *MemoryStore) FindPending(userCode string) (*Authorization, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	_, authorization := store.findPending(userCode)
+	if authorization == nil {
+		return nil, ErrExpiredCode
+	}
+	found := *authorization
+	return &found, nil
+}
+
+// Approve approves the unexpired, unapproved authorization with the user code
+//
+// Parameters:
+//   - userCode: The normalized user code
+//   - username: The user who approved the login
+//   - keyLabel: The label of the key the login was approved with
+//
+// Returns:
+//   - error: ErrExpiredCode if there is no such authorization
+func (store *MemoryStore) Approve(userCode string, username string, keyLabel string) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	_, authorization := store.findPending(userCode)
+	if authorization == nil {
+		return ErrExpiredCode
+	}
+	authorization.Approved = true
+	authorization.Username = username
+	authorization.KeyLabel = keyLabel
+	return nil
+}
+
+// Poll sets when the authorization stored under the key was last polled and returns it as it was before
+// An approved authorization is removed
+//
+// Parameters:
+//   - key: The hash of the device code
+//   - now: The time of the poll
+//
+// Returns:
+//   - *Authorization: A copy of the authorization before the poll
+//   - error: ErrExpiredCode if there is no unexpired authorization under the key
+func (store *MemoryStore) Poll(key string, now time.Time) (*Authorization, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	authorization, exists := store.authorizations[key]
+	if !exists || now.After(authorization.ExpiresAt) {
+		return nil, ErrExpiredCode
+	}
+
+	polled := *authorization
+	if authorization.Approved {
+		delete(store.authorizations, key)
+	} else {
+		authorization.LastPolled = now
+	}
+	return &polled, nil
+}
+
+// findPending returns the key and the unexpired, unapproved authorization with the user code, if there is one
+// The caller must hold the lock
+func (store *MemoryStore) findPending(userCode string) (string, *Authorization) {
+	now := time.Now()
+	for key, authorization := range store.authorizations {
+		if authorization.UserCode == userCode && !authorization.Approved && now.Before(authorization.ExpiresAt) {
+			return key, authorization
+		}
+	}
+	return "", nil
+}
+
+// authorizationCollection is the MongoDB collection used by MongoStore
+const authorizationCollection = "device_authorizations"
+
+// MongoStore keeps device authorizations in a MongoDB collection
+// It allows a login started at one backend replica to be approved and polled at others
+type MongoStore struct {
+	db *mongo.Database
+}
+
+// NewMongoStore creates a device authorization store backed by the given database
+// The TTL index used to remove expired authorizations and the unique index on the user code are created
+// by the database migrations, see db.MongoMigrations.
+//
+// Parameters:
+//   - db: The MongoDB database reference
+//
+// Returns:
+//   - *MongoStore: A pointer to the new store
+func NewMongoStore(db *mongo.Database) *MongoStore {
+	return &MongoStore{db: db}
+}
+
+// authorizationDocument is the representation of a stored device authorization in MongoDB
+type authorizationDocument struct {
+	Key           string `bson:"_id"`
+	Authorization `bson:",inline"`
+}
+
+// Put stores a new authorization under the given key
+// The unique index on the user code refuses a code that is still stored, even if it has expired but not been removed yet
+//
+// Parameters:
+//   - key: The hash of the device code
+//   - authorization: The new authorization
+//
+// Returns:
+//   - error: ErrUserCodeTaken if another authorization has the same user code, or the database error
+func (store *MongoStore) Put(key string, authorization *Authorization) error {
+	collection := store.db.Collection(authorizationCollection)
+
+	_, err := collection.InsertOne(context.Background(), authorizationDocument{Key: key, Authorization: *authorization})
+	if mongo.IsDuplicateKeyError(err) {
+		return ErrUserCodeTaken
+	}
+	return err
+}
+
+// FindPending returns the unexpired, unapproved authorization with the user code
+//
+// Parameters:
+//   - userCode: The normalized user code
+//
+// Returns:
+//   - *Authorization: The authorization
+//   - error: ErrExpiredCode if there is no such authorization, or the database error
+func (store *MongoStore) FindPending(userCode string) (*Authorization, error) {
+	collection := store.db.Collection(authorizationCollection)
+
+	var document authorizationDocument
+	err := collection.FindOne(context.Background(), pendingFilter(userCode)).Decode(&document)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrExpiredCode
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &document.Authorization, nil
+}
+
+// Approve approves the unexpired, unapproved authorization with the user code
+// The check and the update happen in a single operation, so a user code can only be approved once
+//
+// Parameters:
+//   - userCode: The normalized user code
+//   - username: The user who approved the login
+//   - keyLabel: The label of the key the login was approved with
+//
+// Returns:
+//   - error: ErrExpiredCode if there is no such authorization, or the database error
+func (store *MongoStore) Approve(userCode string, username string, keyLabel string) error {
+	collection := store.db.Collection(authorizationCollection)
+
+	update := bson.M{"$set": bson.M{"approved": true, "username": username, "keyLabel": keyLabel}}
+	result, err := collection.UpdateOne(context.Background(), pendingFilter(userCode), update)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return ErrExpiredCode
+	}
+	return nil
+}
+
+// Poll sets when the authorization stored under the key was last polled and returns it as it was before
+// An approved authorization is removed, and only the replica that removes it may log the browser in
+//
+// Parameters:
+//   - key: The hash of the device code
+//   - now: The time of the poll
+//
+// Returns:
+//   - *Authorization: The authorization before the poll
+//   - error: ErrExpiredCode if there is no unexpired authorization under the key, or the database error
+func (store *MongoStore) Poll(key string, now time.Time) (*Authorization, error) {
+	collection := store.db.Collection(authorizationCollection)
+
+	var document authorizationDocument
+	filter := bson.M{"_id": key, "expiresAt": bson.M{"$gt": now}}
+	update := bson.M{"$set": bson.M{"lastPolled": now}}
+	err := collection.FindOneAndUpdate(context.Background(), filter, update).Decode(&document)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrExpiredCode
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if document.Approved {
+		result, err := collection.DeleteOne(context.Background(), bson.M{"_id": key, "approved": true})
+		if err != nil {
+			return nil, err
+		}
+		if result.DeletedCount == 0 {
+			return nil, ErrExpiredCode
+		}
+	}
+	return &document.Authorization, nil
+}
+
+// pendingFilter matches the unexpired, unapproved authorization with the user code
+func pendingFilter(userCode string) bson.M {
+	return bson.M{"userCode": userCode, "approved": false, "expiresAt": bson.M{"$gt": time.Now()}}
+}
@@ -0,0 +1,66 @@
+package handlers
+
+import (
+	"chalmers/tkey-group22/application/internal/audit"
+	"chalmers/tkey-group22/application/internal/structs"
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+// ListAuditEventsHandler handles the listing of the audit log of the user's account
+// It expects a GET request from an authenticated session, optionally with a "limit" query parameter
+// giving the most events to return, up to audit.MaxListLimit
+//
+// Possible responses:
+// - 401 Unauthorized: if the user is not authenticated
+// - 405 Method Not Allowed: if the request method is not GET
+// - 400 Bad Request: if the limit is not a positive number
+// - 500 Internal Server Error: if the audit log cannot be read
+// - 200 OK: with the type, key label, detail, IP address, user agent and time of the events, newest first
+func ListAuditEventsHandler(w http.ResponseWriter, r *http.Request) {
+
+	// Get the authenticated user
+	username, err := getAuthenticatedUser(r)
+
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	limit := audit.DefaultListLimit
+	if value := r.URL.Query().Get("limit"); value != "" {
+		limit, err = strconv.Atoi(value)
+		if err != nil || limit <= 0 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = min(limit, audit.MaxListLimit)
+	}
+
+	events, err := audit.List(r.Context(), username, limit)
+	if err != nil {
+		fmt.Printf("Unable to list audit events for user %s: %v\n", username, err)
+		http.Error(w, "Unable to list audit events", http.StatusInternalServerError)
+		return
+	}
+
+	response := structs.ListAuditEventsResponse{Events: make([]structs.AuditEvent, len(events))}
+	for i, event := range events {
+		response.Events[i] = structs.AuditEvent{
+			Type:      event.Type,
+			KeyLabel:  event.KeyLabel,
+			Detail:    event.Detail,
+			IP:        event.IP,
+			UserAgent: event.UserAgent,
+			Time:      event.Time.UTC(),
+		}
+	}
+
+	sendJSONResponse(w, http.StatusOK, response)
+}
@@ -0,0 +1,243 @@
+package handlers
+
+import (
+	"chalmers/tkey-group22/application/internal"
+	"chalmers/tkey-group22/application/internal/audit"
+	"chalmers/tkey-group22/application/internal/device"
+	"chalmers/tkey-group22/application/internal/ratelimit"
+	"chalmers/tkey-group22/application/internal/session_util"
+	"chalmers/tkey-group22/application/internal/structs"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// DeviceAuthorizeHandler starts a login in a browser that is approved from the TKey client on another machine
+// It expects a POST request from the browser. The browser shows the user code in the response, and polls
+// /api/device/token with the device code until the user has approved the login.
+//
+// Possible responses:
+// - 405 Method Not Allowed: if the request method is not POST
+// - 500 Internal Server Error: if the authorization cannot be started
+// - 200 OK: with the device code, the user code, and how long and how often to poll
+func DeviceAuthorizeHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	deviceCode, authorization, err := device.Start()
+	if err != nil {
+		fmt.Printf("Unable to start device authorization: %v\n", err)
+		http.Error(w, "Unable to start login", http.StatusInternalServerError)
+		return
+	}
+
+	response := structs.DeviceAuthorizationResponse{
+		DeviceCode: deviceCode,
+		UserCode:   device.FormatUserCode(authorization.UserCode),
+		ExpiresIn:  int(device.CodeValidDuration.Seconds()),
+		Interval:   int(device.PollInterval.Seconds()),
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	sendJSONResponse(w, http.StatusOK, response)
+}
+
+// DeviceChallengeHandler issues the TKey client a challenge approving the browser login with a user code
+// It expects a POST request with a JSON body containing the username, the user code shown by the browser
+// and the origin the challenge should be bound to. The user code is part of the signed challenge.
+// Like LoginHandler, a challenge is issued whether or not the user exists.
+//
+// Possible responses:
+// - 405 Method Not Allowed: if the request method is not POST
+// - 400 Bad Request: if the request body is invalid or cannot be parsed, or the origin is not allowed
+// - 404 Not Found: if no login is waiting with the user code
+// - 429 Too Many Requests: if the user already has too many outstanding challenges
+// - 500 Internal Server Error: if there is an error creating the challenge
+// - 503 Service Unavailable: if the database cannot be reached
+// - 504 Gateway Timeout: if the database does not respond in time
+// - 200 OK: with the challenge, its ID and the server's signature over it
+func DeviceChallengeHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	requestBody := structs.DeviceChallengeRequest{}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if err := json.Unmarshal(body, &requestBody); err != nil || requestBody.Username == "" || requestBody.UserCode == "" {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	// Only malformed usernames are refused, unknown users get a challenge that can never be signed
+	_, err = UserRepo.GetUser(r.Context(), requestBody.Username)
+	if sendDatabaseError(w, err) {
+		return
+	}
+	if sanitizationErr, ok := err.(*structs.ErrorInputNotSanitized); ok {
+		http.Error(w, sanitizationErr.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// A mistyped code is reported before the user touches the TKey
+	authorization, err := device.Pending(requestBody.UserCode)
+	if err == device.ErrExpiredCode {
+		http.Error(w, "No login is waiting with this code", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		fmt.Printf("Unable to look up device authorization: %v\n", err)
+		http.Error(w, "Unable to create challenge", http.StatusInternalServerError)
+		return
+	}
+
+	origin := requestOrigin(r, requestBody.Origin)
+	challenge, err := internal.GenerateDeviceChallenge(r.Context(), requestBody.Username, origin, authorization.UserCode)
+	if err == internal.ErrOriginNotAllowed {
+		http.Error(w, "Origin not allowed", http.StatusBadRequest)
+		return
+	}
+	if err == internal.ErrTooManyChallenges {
+		http.Error(w, "Too many active login attempts, try again later", http.StatusTooManyRequests)
+		return
+	}
+	if err != nil {
+		fmt.Printf("Unable to generate device challenge for user: %s: %v\n", requestBody.Username, err)
+		http.Error(w, "Unable to create challenge", http.StatusInternalServerError)
+		return
+	}
+	audit.Record(r, audit.EventChallengeIssued, requestBody.Username, "", internal.PurposeDevice)
+
+	response, err := newChallengeResponse(challenge)
+	if err != nil {
+		fmt.Printf("Unable to sign device challenge for user: %s: %v\n", requestBody.Username, err)
+		http.Error(w, "Unable to create challenge", http.StatusInternalServerError)
+		return
+	}
+	sendJSONResponse(w, http.StatusOK, response)
+}
+
+// DeviceApproveHandler approves the browser login with a user code, after the user signed a device challenge for it
+// It expects a POST request with a JSON body containing the username, the user code, the challenge ID and the signature.
+// The browser waiting with the user code is logged in as the user the next time it polls.
+// Failed signatures are counted towards the lockout of the username like those at VerifyHandler.
+//
+// Possible responses:
+// - 405 Method Not Allowed: if the request method is not POST
+// - 400 Bad Request: if the request body is invalid or cannot be parsed
+// - 401 Unauthorized: if the signature is invalid or the challenge was not issued for the user code
+// - 404 Not Found: if no login is waiting with the user code any longer
+// - 500 Internal Server Error: if the login cannot be approved
+// - 503 Service Unavailable: if the database cannot be reached
+// - 504 Gateway Timeout: if the database does not respond in time
+// - 200 OK: if the login is approved
+func DeviceApproveHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	requestBody := structs.DeviceApproveRequest{}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if err := json.Unmarshal(body, &requestBody); err != nil || requestBody.Username == "" || requestBody.UserCode == "" {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	userCode := device.NormalizeUserCode(requestBody.UserCode)
+	publicKey, err := internal.VerifyDeviceSignature(r.Context(), requestBody.Username, requestBody.ChallengeID, userCode, requestBody.Signature, UserRepo)
+	if sendDatabaseError(w, err) {
+		return
+	}
+	if publicKey == nil {
+		fmt.Printf("Device login approval failed for user %s: %v\n", requestBody.Username, err)
+		ratelimit.RecordFailure(requestBody.Username)
+		audit.Record(r, audit.EventLoginFailed, requestBody.Username, "", audit.LoginDevice)
+		http.Error(w, "Invalid signature", http.StatusUnauthorized)
+		return
+	}
+
+	ratelimit.RecordSuccess(requestBody.Username)
+
+	err = device.Approve(userCode, requestBody.Username, publicKey.Label)
+	if err == device.ErrExpiredCode {
+		http.Error(w, "No login is waiting with this code", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		fmt.Printf("Unable to approve device login for user %s: %v\n", requestBody.Username, err)
+		http.Error(w, "Unable to approve login", http.StatusInternalServerError)
+		return
+	}
+
+	// A failure to record the key use should not stop the user from logging in
+	if err := UserRepo.RecordKeyUse(r.Context(), requestBody.Username, publicKey.Label); err != nil {
+		fmt.Printf("Unable to record use of key %s for user %s: %v\n", publicKey.Label, requestBody.Username, err)
+	}
+
+	fmt.Printf("User %s approved a device login with key %s\n", requestBody.Username, publicKey.Label)
+	audit.Record(r, audit.EventLoginSucceeded, requestBody.Username, publicKey.Label, audit.LoginDevice)
+	response := map[string]string{"message": "Login approved"}
+	sendJSONResponse(w, http.StatusOK, response)
+}
+
+// DeviceTokenHandler is polled by the browser waiting for its login to be approved
+// It expects a POST request with a JSON body containing the device code. Once the login is approved,
+// the session cookie is set and the device code cannot be used again.
+// Until then it responds with an OAuth 2.0 error as in RFC 8628: "authorization_pending" while waiting,
+// "slow_down" when polled too often and "expired_token" when the code is no longer valid.
+//
+// Possible responses:
+// - 405 Method Not Allowed: if the request method is not POST
+// - 400 Bad Request: if the request body is invalid, or the login is not approved (yet)
+// - 500 Internal Server Error: if the authorization cannot be read or the session cannot be set
+// - 200 OK: if the login was approved and the session is set
+func DeviceTokenHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	requestBody := structs.DeviceTokenRequest{}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if err := json.Unmarshal(body, &requestBody); err != nil || requestBody.DeviceCode == "" {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	authorization, err := device.Poll(requestBody.DeviceCode)
+	if err == device.ErrAuthorizationPending || err == device.ErrSlowDown || err == device.ErrExpiredCode {
+		sendOIDCError(w, http.StatusBadRequest, err.Error(), "")
+		return
+	}
+	if err != nil {
+		fmt.Printf("Unable to poll device authorization: %v\n", err)
+		http.Error(w, "Unable to check login", http.StatusInternalServerError)
+		return
+	}
+
+	if err := session_util.SetSession(w, r, authorization.Username, authorization.KeyLabel); err != nil {
+		http.Error(w, "Failed to set session", http.StatusInternalServerError)
+		return
+	}
+
+	response := map[string]string{"message": "Logged in"}
+	sendJSONResponse(w, http.StatusOK, response)
+}
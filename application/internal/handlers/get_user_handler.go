@@ -1,10 +1,13 @@
 package handlers
 
 import (
+	"chalmers/tkey-group22/application/internal/session_util"
 	"net/http"
+	"time"
 )
 
 // GetUserHandler returns the username of the current session user
+// together with the label of the key the session was authenticated with and when
 // It expects a valid authenticated session
 //
 // Possible responses:
@@ -20,6 +23,14 @@ func GetUserHandler(w http.ResponseWriter, r *http.Request) {
 
 	// Send success response
 	response := map[string]string{"message": "Access granted", "user": username}
+
+	// Sessions created before keys were tracked do not hold these values
+	if keyLabel, err := session_util.GetSessionKeyLabel(r); err == nil {
+		response["keyLabel"] = keyLabel
+	}
+	if authenticatedAt, err := session_util.GetSessionAuthenticatedAt(r); err == nil {
+		response["authenticatedAt"] = authenticatedAt.UTC().Format(time.RFC3339)
+	}
 	sendJSONResponse(w, http.StatusOK, response)
 
 }
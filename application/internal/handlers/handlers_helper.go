@@ -1,26 +1,156 @@
 package handlers
 
 import (
+	"chalmers/tkey-group22/application/internal"
 	"chalmers/tkey-group22/application/internal/session_util"
+	"chalmers/tkey-group22/application/internal/structs"
 	"chalmers/tkey-group22/application/internal/util"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
+	"strings"
 )
 
 // UserRepo is a global variable that holds the UserRepository for other handlers to use
 var UserRepo util.UserRepository
 
-// Helper function to retrieve the authenticated username from session
+// Helper function to retrieve the authenticated username from session, or from the bearer token of the request
 func getAuthenticatedUser(r *http.Request) (string, error) {
-	session, _ := session_util.Store.Get(r, "session-name")
-	username, ok := session.Values["username"].(string)
-	if !ok || username == "" {
+	username, err := session_util.GetSessionUsername(r)
+	if err != nil || username == "" {
 		return "", fmt.Errorf("unauthorized")
 	}
 	return username, nil
 }
 
+// Helper function to get the origin a challenge should be bound to
+// The origin given in the request body takes precedence over the Origin header,
+// since the TKey client calls the backend directly on behalf of the page
+func requestOrigin(r *http.Request, bodyOrigin string) string {
+	origin := bodyOrigin
+	if origin == "" {
+		origin = r.Header.Get("Origin")
+	}
+	return strings.TrimSuffix(origin, "/")
+}
+
+// Helper function to build the response for a newly generated challenge
+// The challenge is signed with the server identity key so that the client can verify it came from this server
+func newChallengeResponse(challenge *internal.Challenge) (*structs.LoginResponse, error) {
+	signature, err := internal.SignWithServerIdentity([]byte(challenge.Value))
+	if err != nil {
+		return nil, err
+	}
+
+	return &structs.LoginResponse{
+		ChallengeID: challenge.ID,
+		Challenge:   challenge.Value,
+		Signature:   base64.StdEncoding.EncodeToString(signature),
+	}, nil
+}
+
+// Helper function to convert a stored public key to the form it is listed in
+// Keys registered before the metadata was tracked have no creation time
+func newPublicKeyInfo(pubkey util.PublicKey) structs.PublicKeyInfo {
+	key, _ := base64.StdEncoding.DecodeString(pubkey.Key)
+	info := structs.PublicKeyInfo{
+		Label:        pubkey.Label,
+		Pubkey:       key,
+		UseCount:     pubkey.UseCount,
+		AppName:      pubkey.SignerApp.Name,
+		AppDigest:    pubkey.SignerApp.Digest,
+		Status:       pubkey.Status,
+		StatusReason: pubkey.StatusReason,
+	}
+	if info.Status == "" {
+		info.Status = util.KeyStatusActive
+	}
+	if !pubkey.CreatedAt.IsZero() {
+		createdAt := pubkey.CreatedAt.UTC()
+		info.CreatedAt = &createdAt
+	}
+	if !pubkey.LastUsed.IsZero() {
+		lastUsed := pubkey.LastUsed.UTC()
+		info.LastUsed = &lastUsed
+	}
+	if !pubkey.StatusChangedAt.IsZero() {
+		statusChangedAt := pubkey.StatusChangedAt.UTC()
+		info.StatusChangedAt = &statusChangedAt
+	}
+	return info
+}
+
+// Helper function to respond when a repository call failed because of the database rather than the request
+// It sends 504 Gateway Timeout if the database did not answer before the deadline of the operation,
+// and 503 Service Unavailable if it could not be reached or the request was cancelled.
+// Returns true if a response has been sent
+func sendDatabaseError(w http.ResponseWriter, err error) bool {
+	if util.IsTimeout(err) {
+		http.Error(w, "Database did not respond in time", http.StatusGatewayTimeout)
+		return true
+	}
+	if util.IsUnavailable(err) {
+		http.Error(w, "Database unavailable", http.StatusServiceUnavailable)
+		return true
+	}
+	return false
+}
+
+// Helper function to respond with the error returned by UserRepo.AddPublicKey
+func sendAddPublicKeyError(w http.ResponseWriter, err error) {
+	if sendDatabaseError(w, err) {
+		return
+	}
+	if sanitizationErr, ok := err.(*structs.ErrorInputNotSanitized); ok {
+		http.Error(w, sanitizationErr.Error(), http.StatusBadRequest)
+	} else if errors.Is(err, util.ErrMaxPublicKeys) || errors.Is(err, util.ErrKeyRevoked) ||
+		errors.Is(err, util.ErrKeyExists) || errors.Is(err, util.ErrLabelExists) || errors.Is(err, util.ErrConcurrentUpdate) {
+		http.Error(w, err.Error(), http.StatusConflict)
+	} else {
+		http.Error(w, "Unable to add public key", http.StatusInternalServerError)
+	}
+}
+
+// Helper function to use up the step-up for the purpose before a sensitive operation is performed
+// Returns false if the session holds no usable step-up, in which case an error response has been sent
+func useStepUp(w http.ResponseWriter, r *http.Request, username string, purpose string) bool {
+	used, err := session_util.UseStepUp(w, r, purpose)
+	if err != nil {
+		fmt.Printf("Unable to use step-up for user %s: %v\n", username, err)
+		http.Error(w, "Unable to use step-up", http.StatusInternalServerError)
+		return false
+	}
+	if !used {
+		http.Error(w, "Step-up authentication required", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// Helper function to end every session that was authenticated with a key that can no longer be used
+// Returns true if the current session was one of them, in which case its cookie has been removed as well
+func endKeySessions(w http.ResponseWriter, r *http.Request, username string, label string) bool {
+	currentKeyLabel, _ := session_util.GetSessionKeyLabel(r)
+
+	revoked, err := session_util.RevokeKeySessions(r.Context(), username, label)
+	if err != nil {
+		fmt.Printf("Unable to revoke sessions of key %s for user %s: %v\n", label, username, err)
+	} else {
+		fmt.Printf("Revoked %d sessions of key %s for user %s\n", revoked, label, username)
+	}
+
+	if currentKeyLabel != label {
+		return false
+	}
+
+	if err := session_util.TerminateSession(w, r); err != nil {
+		fmt.Printf("Unable to terminate session for user %s: %v\n", username, err)
+	}
+	return true
+}
+
 // Helper function to send JSON responses
 func sendJSONResponse(w http.ResponseWriter, status int, payload interface{}) {
 	w.Header().Set("Content-Type", "application/json")
@@ -2,6 +2,7 @@ package handlers
 
 import (
 	"chalmers/tkey-group22/application/internal"
+	"chalmers/tkey-group22/application/internal/audit"
 	"chalmers/tkey-group22/application/internal/structs"
 	"encoding/json"
 	"fmt"
@@ -11,12 +12,17 @@ import (
 
 // LoginHandler handles user login requests
 // It expects a POST request with a JSON body containing the username of the user attempting to log in
+// and the origin the challenge should be bound to. If no origin is given, the Origin header is used.
+// A challenge is issued whether or not the user exists, so the response does not tell which usernames are registered.
+// A signature over the challenge of a user that does not exist is simply never valid.
 //
 // Possible responses:
 // - 405 Method Not Allowed: if the request method is not POST
-// - 400 Bad Request: if the request body is invalid or cannot be parsed
-// - 404 Not Found: if the user does not exist
+// - 400 Bad Request: if the request body is invalid or cannot be parsed, or the origin is not allowed
+// - 429 Too Many Requests: if the username already has too many outstanding challenges
 // - 500 Internal Server Error: if there is an error creating the challenge or sending the response
+// - 503 Service Unavailable: if the database cannot be reached
+// - 504 Gateway Timeout: if the database does not respond in time
 // - 200 OK: if the challenge is generated successfully
 func LoginHandler(w http.ResponseWriter, r *http.Request) {
 
@@ -57,7 +63,10 @@ func LoginHandler(w http.ResponseWriter, r *http.Request) {
 	fmt.Printf("Received login request for user: %s\n", username)
 
 	// Check if the specified user is found
-	userExists, err := UserRepo.GetUser(username)
+	userExists, err := UserRepo.GetUser(r.Context(), username)
+	if sendDatabaseError(w, err) {
+		return
+	}
 
 	// Checks for sanitization error
 	if _, ok := err.(*structs.ErrorInputNotSanitized); ok {
@@ -67,17 +76,37 @@ func LoginHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Unknown users get a challenge as well, which is stored like any other to take as long and count towards the cap
 	if userExists == nil || err != nil {
-		fmt.Printf("User not found: %s\n", username)
-		http.Error(w, "User not found", http.StatusNotFound)
+		fmt.Printf("Login requested for unknown user: %s\n", username)
+	}
+	origin := requestOrigin(r, requestBody.Origin)
+
+	// Generate a challenge for the user bound to the origin
+	challenge, err := internal.GenerateChallenge(r.Context(), username, internal.PurposeLogin, origin)
+	if err == internal.ErrOriginNotAllowed {
+		fmt.Printf("Login requested for disallowed origin: %s\n", origin)
+		http.Error(w, "Origin not allowed", http.StatusBadRequest)
+		return
+	}
+	if err == internal.ErrTooManyChallenges {
+		fmt.Printf("Too many active challenges for user: %s\n", username)
+		http.Error(w, "Too many active login attempts, try again later", http.StatusTooManyRequests)
 		return
 	}
-	// Generate a challenge using public key
-	challenge, _ := internal.GenerateChallenge(username)
+	if err != nil {
+		fmt.Printf("Unable to generate challenge for user: %s: %v\n", username, err)
+		http.Error(w, "Unable to create challenge", http.StatusInternalServerError)
+		return
+	}
+	audit.Record(r, audit.EventChallengeIssued, username, "", internal.PurposeLogin)
 
-	// Send the challenge in the response
-	response := structs.LoginResponse{
-		Challenge: challenge,
+	// Send the challenge, its ID and the server's signature in the response
+	response, err := newChallengeResponse(challenge)
+	if err != nil {
+		fmt.Printf("Unable to sign challenge for user: %s: %v\n", username, err)
+		http.Error(w, "Unable to create challenge", http.StatusInternalServerError)
+		return
 	}
 	res, err := json.Marshal(response)
 	if err != nil {
@@ -1,6 +1,7 @@
 package handlers
 
 import (
+	"chalmers/tkey-group22/application/internal/audit"
 	"chalmers/tkey-group22/application/internal/session_util"
 	"net/http"
 )
@@ -18,10 +19,17 @@ func LogoutHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// The user and key are read before the session is ended, to record who logged out
+	username, _ := session_util.GetSessionUsername(r)
+	keyLabel, _ := session_util.GetSessionKeyLabel(r)
+
 	err := session_util.TerminateSession(w, r)
 	if err != nil {
 		http.Error(w, "No active session found", http.StatusNotFound)
 	}
+	if err == nil && username != "" {
+		audit.Record(r, audit.EventLogout, username, keyLabel, "")
+	}
 
 	// Send a success response
 	w.WriteHeader(http.StatusOK)
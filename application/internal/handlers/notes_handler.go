@@ -5,10 +5,9 @@ import (
 	"chalmers/tkey-group22/application/internal/structs"
 	"chalmers/tkey-group22/application/internal/util"
 	"encoding/json"
+	"errors"
 	"io"
 	"net/http"
-
-	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
 var NotesRepo util.NotesRepository
@@ -21,7 +20,9 @@ var NotesRepo util.NotesRepository
 // Possible responses:
 // - 405 Method Not Allowed: if the request method is not GET
 // - 401 Unauthorized: if there is no user signed in
-// - 500 Internal Server Error: if there is an error marshalling the notes to JSON
+// - 500 Internal Server Error: if there is an error retrieving the notes or marshalling the notes to JSON
+// - 503 Service Unavailable: if the database cannot be reached
+// - 504 Gateway Timeout: if the database does not respond in time
 // - 200 OK: if the notes are retrieved and marshalled successfully
 func GetNotesHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
@@ -34,7 +35,14 @@ func GetNotesHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "No user signed in", http.StatusUnauthorized)
 		return
 	}
-	notes, _ := NotesRepo.GetNotes(username)
+	notes, err := NotesRepo.GetNotes(r.Context(), username)
+	if sendDatabaseError(w, err) {
+		return
+	}
+	if err != nil {
+		http.Error(w, "Unable to retrieve notes", http.StatusInternalServerError)
+		return
+	}
 
 	// Convert notes to JSON
 	responseBodyBytes, err := json.Marshal(notes)
@@ -58,6 +66,8 @@ func GetNotesHandler(w http.ResponseWriter, r *http.Request) {
 // - 400 Bad Request: if the request body is invalid
 // - 401 Unauthorized: if there is no user signed in
 // - 500 Internal Server Error: if there is an error saving the note or marshalling the response
+// - 503 Service Unavailable: if the database cannot be reached
+// - 504 Gateway Timeout: if the database does not respond in time
 // - 200 OK: if the note is created and the response is marshalled successfully
 func CreateNoteHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
@@ -85,15 +95,18 @@ func CreateNoteHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	result, err := NotesRepo.CreateNote(username, name, note)
-	if result == nil || err != nil {
+	id, err := NotesRepo.CreateNote(r.Context(), username, name, note)
+	if sendDatabaseError(w, err) {
+		return
+	}
+	if err != nil {
 		http.Error(w, "Failed to save notes", http.StatusInternalServerError)
 		return
 	}
 
 	responseBody := map[string]interface{}{
 		"message": "Notes saved successfully",
-		"id":      result.InsertedID.(primitive.ObjectID).Hex(),
+		"id":      id,
 	}
 	responseBodyBytes, err := json.Marshal(responseBody)
 	if err != nil {
@@ -116,7 +129,10 @@ func CreateNoteHandler(w http.ResponseWriter, r *http.Request) {
 // - 405 Method Not Allowed: if the request method is not POST
 // - 400 Bad Request: if the request body is invalid
 // - 401 Unauthorized: if there is no user signed in or the user is not the owner of the note
+// - 404 Not Found: if there is no note with the ID
 // - 500 Internal Server Error: if there is an error retrieving or updating the note
+// - 503 Service Unavailable: if the database cannot be reached
+// - 504 Gateway Timeout: if the database does not respond in time
 // - 200 OK: if the note is updated successfully
 func UpdateNoteHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
@@ -138,9 +154,17 @@ func UpdateNoteHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	username, _ := session_util.GetSessionUsername(r)
-	currentEntry, err := NotesRepo.GetNote(requestBody.ID)
+	currentEntry, err := NotesRepo.GetNote(r.Context(), requestBody.ID)
+	if sendDatabaseError(w, err) {
+		return
+	}
+	if errors.Is(err, util.ErrNoteNotFound) {
+		http.Error(w, "Entry not found", http.StatusNotFound)
+		return
+	}
 	if err != nil {
 		http.Error(w, "Error retrieving entry", http.StatusInternalServerError)
+		return
 	}
 
 	if username != currentEntry.Username {
@@ -148,8 +172,11 @@ func UpdateNoteHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	result, err := NotesRepo.UpdateNote(requestBody.ID, username, requestBody.Name, requestBody.Note)
-	if result == nil || err != nil {
+	err = NotesRepo.UpdateNote(r.Context(), requestBody.ID, username, requestBody.Name, requestBody.Note)
+	if sendDatabaseError(w, err) {
+		return
+	}
+	if err != nil {
 		http.Error(w, "Failed to update note", http.StatusInternalServerError)
 		return
 	}
@@ -170,7 +197,10 @@ func UpdateNoteHandler(w http.ResponseWriter, r *http.Request) {
 // - 405 Method Not Allowed: if the request method is not DELETE
 // - 400 Bad Request: if the request body is invalid
 // - 401 Unauthorized: if there is no user signed in or the user is not the owner of the note
+// - 404 Not Found: if there is no note with the ID
 // - 500 Internal Server Error: if there is an error retrieving or deleting the note
+// - 503 Service Unavailable: if the database cannot be reached
+// - 504 Gateway Timeout: if the database does not respond in time
 // - 200 OK: if the note is deleted successfully
 func DeleteNoteHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodDelete {
@@ -197,7 +227,14 @@ func DeleteNoteHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	currentEntry, err := NotesRepo.GetNote(requestBody.ID)
+	currentEntry, err := NotesRepo.GetNote(r.Context(), requestBody.ID)
+	if sendDatabaseError(w, err) {
+		return
+	}
+	if errors.Is(err, util.ErrNoteNotFound) {
+		http.Error(w, "Entry not found", http.StatusNotFound)
+		return
+	}
 	if err != nil {
 		http.Error(w, "Error retrieving entry", http.StatusInternalServerError)
 		return
@@ -208,8 +245,11 @@ func DeleteNoteHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	result, err := NotesRepo.DeleteNote(requestBody.ID)
-	if result == nil || err != nil {
+	err = NotesRepo.DeleteNote(r.Context(), requestBody.ID)
+	if sendDatabaseError(w, err) {
+		return
+	}
+	if err != nil {
 		http.Error(w, "Failed to delete note", http.StatusInternalServerError)
 		return
 	}
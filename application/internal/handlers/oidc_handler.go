@@ -0,0 +1,324 @@
+package handlers
+
+import (
+	"chalmers/tkey-group22/application/internal"
+	"chalmers/tkey-group22/application/internal/audit"
+	"chalmers/tkey-group22/application/internal/jws"
+	"chalmers/tkey-group22/application/internal/oidc"
+	"chalmers/tkey-group22/application/internal/session_util"
+	"chalmers/tkey-group22/application/internal/structs"
+	"chalmers/tkey-group22/application/internal/util"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// OIDCClients is a global variable that holds the OIDCClientRepository for the OpenID Connect handlers to use
+var OIDCClients util.OIDCClientRepository
+
+// OIDCDiscoveryHandler publishes the metadata of the OpenID Connect provider
+//
+// Possible responses:
+// - 405 Method Not Allowed: if the request method is not GET
+// - 200 OK: with the provider metadata in the response body
+func OIDCDiscoveryHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	response := structs.OIDCDiscoveryResponse{
+		Issuer:                            oidc.Issuer,
+		AuthorizationEndpoint:             oidc.Issuer + "/authorize",
+		TokenEndpoint:                     oidc.Issuer + "/token",
+		UserInfoEndpoint:                  oidc.Issuer + "/userinfo",
+		JWKSURI:                           oidc.Issuer + "/jwks",
+		ResponseTypesSupported:            []string{"code"},
+		GrantTypesSupported:               []string{"authorization_code"},
+		SubjectTypesSupported:             []string{"public"},
+		IDTokenSigningAlgValuesSupported:  []string{jws.Algorithm},
+		ScopesSupported:                   []string{oidc.ScopeOpenID, oidc.ScopeProfile},
+		ClaimsSupported:                   []string{"iss", "sub", "aud", "exp", "iat", "auth_time", "nonce", "preferred_username"},
+		TokenEndpointAuthMethodsSupported: []string{"client_secret_basic", "client_secret_post"},
+		CodeChallengeMethodsSupported:     []string{"S256"},
+	}
+	sendJSONResponse(w, http.StatusOK, response)
+}
+
+// OIDCJWKSHandler publishes the key the ID tokens are signed with, which is the server identity key
+//
+// Possible responses:
+// - 405 Method Not Allowed: if the request method is not GET
+// - 500 Internal Server Error: if the server identity key is not loaded
+// - 200 OK: with the key set in the response body
+func OIDCJWKSHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	pubkey := internal.ServerPublicKey()
+	if pubkey == nil {
+		http.Error(w, "Server identity not available", http.StatusInternalServerError)
+		return
+	}
+
+	sendJSONResponse(w, http.StatusOK, jws.JWKSet{Keys: []jws.JWK{jws.NewJWK(pubkey)}})
+}
+
+// OIDCAuthorizeHandler handles an OpenID Connect authorization request using the authorization code flow
+// A user who is not logged in, or whose login is older than the requested max_age, is sent to the login page
+// with the authorization request in the "authorize" query parameter, and comes back here after touching the TKey.
+// A logged in user is sent back to the client with an authorization code.
+//
+// Possible responses:
+// - 405 Method Not Allowed: if the request method is not GET or POST
+// - 400 Bad Request: if the client is unknown or the redirect URI is not registered for it
+// - 503 Service Unavailable: if the database cannot be reached
+// - 504 Gateway Timeout: if the database does not respond in time
+// - 302 Found: to the login page, or to the redirect URI with either a code or an error
+func OIDCAuthorizeHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	// The user must not be redirected to a URI that is not registered for the client
+	client, err := OIDCClients.GetClient(r.Context(), r.Form.Get("client_id"))
+	if sendDatabaseError(w, err) {
+		return
+	}
+	if client == nil || err != nil {
+		http.Error(w, "Unknown client", http.StatusBadRequest)
+		return
+	}
+
+	redirectURI := r.Form.Get("redirect_uri")
+	if !client.HasRedirectURI(redirectURI) {
+		http.Error(w, "Redirect URI is not registered for the client", http.StatusBadRequest)
+		return
+	}
+
+	state := r.Form.Get("state")
+	if r.Form.Get("response_type") != "code" {
+		redirectAuthorizationError(w, r, redirectURI, state, "unsupported_response_type")
+		return
+	}
+
+	scope := r.Form.Get("scope")
+	if !oidc.HasScope(scope, oidc.ScopeOpenID) {
+		redirectAuthorizationError(w, r, redirectURI, state, "invalid_scope")
+		return
+	}
+
+	codeChallenge := r.Form.Get("code_challenge")
+	if codeChallenge != "" && r.Form.Get("code_challenge_method") != "S256" {
+		redirectAuthorizationError(w, r, redirectURI, state, "invalid_request")
+		return
+	}
+
+	// The login must have been made with the TKey recently enough
+	maxAge := session_util.Policy.AbsoluteLifetime
+	if value := r.Form.Get("max_age"); value != "" {
+		seconds, err := strconv.Atoi(value)
+		if err != nil || seconds < 0 {
+			redirectAuthorizationError(w, r, redirectURI, state, "invalid_request")
+			return
+		}
+		maxAge = min(maxAge, time.Duration(seconds)*time.Second)
+	}
+
+	username, err := getAuthenticatedUser(r)
+	authTime, timeErr := session_util.GetSessionAuthenticatedAt(r)
+	if err != nil || timeErr != nil || time.Since(authTime) > maxAge {
+		http.Redirect(w, r, oidc.LoginURL+"?authorize="+url.QueryEscape(r.Form.Encode()), http.StatusFound)
+		return
+	}
+
+	code, err := oidc.IssueCode(&oidc.Authorization{
+		ClientID:      client.ClientID,
+		RedirectURI:   redirectURI,
+		Username:      username,
+		Scope:         scope,
+		Nonce:         r.Form.Get("nonce"),
+		CodeChallenge: codeChallenge,
+		AuthTime:      authTime,
+	})
+	if err != nil {
+		fmt.Printf("Unable to issue authorization code for user %s: %v\n", username, err)
+		redirectAuthorizationError(w, r, redirectURI, state, "server_error")
+		return
+	}
+
+	fmt.Printf("User %s authorized OpenID Connect client %s\n", username, client.Name)
+	keyLabel, _ := session_util.GetSessionKeyLabel(r)
+	audit.Record(r, audit.EventOIDCLogin, username, keyLabel, client.Name)
+
+	redirectAuthorization(w, r, redirectURI, url.Values{"code": {code}, "state": {state}})
+}
+
+// OIDCTokenHandler exchanges an authorization code for an ID token and an access token
+// It expects a form encoded POST request from a client authenticated with its secret,
+// either with HTTP Basic authentication or with client_id and client_secret in the body.
+//
+// Possible responses:
+// - 405 Method Not Allowed: if the request method is not POST
+// - 401 Unauthorized: with error invalid_client if the client cannot be authenticated
+// - 400 Bad Request: with error unsupported_grant_type or invalid_grant if the code cannot be redeemed
+// - 500 Internal Server Error: if the tokens cannot be issued
+// - 503 Service Unavailable: if the database cannot be reached
+// - 504 Gateway Timeout: if the database does not respond in time
+// - 200 OK: with the tokens in the response body
+func OIDCTokenHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		sendOIDCError(w, http.StatusBadRequest, "invalid_request", "Invalid request body")
+		return
+	}
+
+	// The credentials in the Authorization header are form encoded
+	clientID, clientSecret, ok := r.BasicAuth()
+	if ok {
+		clientID, _ = url.QueryUnescape(clientID)
+		clientSecret, _ = url.QueryUnescape(clientSecret)
+	} else {
+		clientID = r.PostForm.Get("client_id")
+		clientSecret = r.PostForm.Get("client_secret")
+	}
+
+	client, err := OIDCClients.GetClient(r.Context(), clientID)
+	if sendDatabaseError(w, err) {
+		return
+	}
+	if client == nil || err != nil || !client.CheckSecret(clientSecret) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="oidc"`)
+		sendOIDCError(w, http.StatusUnauthorized, "invalid_client", "Client authentication failed")
+		return
+	}
+
+	if r.PostForm.Get("grant_type") != "authorization_code" {
+		sendOIDCError(w, http.StatusBadRequest, "unsupported_grant_type", "")
+		return
+	}
+
+	authorization, err := oidc.RedeemCode(r.PostForm.Get("code"), client.ClientID, r.PostForm.Get("redirect_uri"), r.PostForm.Get("code_verifier"))
+	if err == oidc.ErrInvalidCode {
+		sendOIDCError(w, http.StatusBadRequest, "invalid_grant", "Invalid or expired authorization code")
+		return
+	}
+	if err != nil {
+		fmt.Printf("Unable to redeem authorization code for client %s: %v\n", client.Name, err)
+		sendOIDCError(w, http.StatusInternalServerError, "server_error", "")
+		return
+	}
+
+	// The user may have been deleted since logging in
+	user, err := UserRepo.GetUser(r.Context(), authorization.Username)
+	if sendDatabaseError(w, err) {
+		return
+	}
+	if user == nil || err != nil {
+		sendOIDCError(w, http.StatusBadRequest, "invalid_grant", "User no longer exists")
+		return
+	}
+
+	idToken, err := oidc.NewIDToken(authorization)
+	if err != nil {
+		fmt.Printf("Unable to issue ID token for user %s: %v\n", authorization.Username, err)
+		sendOIDCError(w, http.StatusInternalServerError, "server_error", "")
+		return
+	}
+	accessToken, err := oidc.NewAccessToken(authorization)
+	if err != nil {
+		fmt.Printf("Unable to issue access token for user %s: %v\n", authorization.Username, err)
+		sendOIDCError(w, http.StatusInternalServerError, "server_error", "")
+		return
+	}
+
+	response := structs.OIDCTokenResponse{
+		AccessToken: accessToken,
+		TokenType:   "Bearer",
+		ExpiresIn:   int(oidc.TokenLifetime.Seconds()),
+		IDToken:     idToken,
+		Scope:       authorization.Scope,
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	sendJSONResponse(w, http.StatusOK, response)
+}
+
+// OIDCUserInfoHandler returns the claims about the user an access token was issued for
+// It expects a GET or POST request with the access token in the Authorization header as a Bearer token.
+//
+// Possible responses:
+// - 405 Method Not Allowed: if the request method is not GET or POST
+// - 401 Unauthorized: if the access token is missing, invalid or expired, or the user no longer exists
+// - 503 Service Unavailable: if the database cannot be reached
+// - 504 Gateway Timeout: if the database does not respond in time
+// - 200 OK: with the claims in the response body
+func OIDCUserInfoHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	claims, err := oidc.ParseAccessToken(token)
+	if !found || err != nil {
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	user, err := UserRepo.GetUser(r.Context(), claims.Subject)
+	if sendDatabaseError(w, err) {
+		return
+	}
+	if user == nil || err != nil {
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	response := structs.OIDCUserInfoResponse{Subject: user.Username}
+	if oidc.HasScope(claims.Scope, oidc.ScopeProfile) {
+		response.PreferredUsername = user.Username
+	}
+	sendJSONResponse(w, http.StatusOK, response)
+}
+
+// Helper function to send the user back to the client with the given parameters
+// The parameters are added to any query the registered redirect URI already has
+func redirectAuthorization(w http.ResponseWriter, r *http.Request, redirectURI string, params url.Values) {
+	target, _ := url.Parse(redirectURI)
+	query := target.Query()
+	for name, values := range params {
+		if values[0] != "" {
+			query.Set(name, values[0])
+		}
+	}
+	target.RawQuery = query.Encode()
+	http.Redirect(w, r, target.String(), http.StatusFound)
+}
+
+// Helper function to send the user back to the client with an OAuth 2.0 error code
+func redirectAuthorizationError(w http.ResponseWriter, r *http.Request, redirectURI string, state string, code string) {
+	redirectAuthorization(w, r, redirectURI, url.Values{"error": {code}, "state": {state}})
+}
+
+// Helper function to send an OAuth 2.0 error response from the token endpoint, or while polling for a device login
+func sendOIDCError(w http.ResponseWriter, status int, code string, description string) {
+	w.Header().Set("Cache-Control", "no-store")
+	sendJSONResponse(w, status, structs.OIDCErrorResponse{Error: code, ErrorDescription: description})
+}
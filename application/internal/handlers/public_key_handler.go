@@ -1,8 +1,14 @@
 package handlers
 
 import (
+	"chalmers/tkey-group22/application/internal"
+	"chalmers/tkey-group22/application/internal/audit"
+	"chalmers/tkey-group22/application/internal/session_util"
 	"chalmers/tkey-group22/application/internal/structs"
+	"chalmers/tkey-group22/application/internal/util"
+	"crypto/ed25519"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
@@ -16,6 +22,8 @@ import (
 // - 400 Bad Request: if the request body is invalid or cannot be parsed
 // - 404 Not Found: if the user does not exist
 // - 500 Internal Server Error: if there is an error retrieving the labels or sending the response
+// - 503 Service Unavailable: if the database cannot be reached
+// - 504 Gateway Timeout: if the database does not respond in time
 // - 200 OK: if the labels are retrieved successfully
 func GetPublicKeyLabelsHandler(w http.ResponseWriter, r *http.Request) {
 
@@ -34,13 +42,19 @@ func GetPublicKeyLabelsHandler(w http.ResponseWriter, r *http.Request) {
 
 	fmt.Printf("Received request to get public key labels for user: %s\n", username)
 
-	userExists, err := UserRepo.GetUser(username)
+	userExists, err := UserRepo.GetUser(r.Context(), username)
+	if sendDatabaseError(w, err) {
+		return
+	}
 	if userExists == nil || err != nil {
 		http.Error(w, "User not found", http.StatusNotFound)
 		return
 	}
 
-	labels, err := UserRepo.GetPublicKeyLabels(username)
+	labels, err := UserRepo.GetPublicKeyLabels(r.Context(), username)
+	if sendDatabaseError(w, err) {
+		return
+	}
 	if err != nil {
 		http.Error(w, "Unable to retrieve public key labels", http.StatusInternalServerError)
 		return
@@ -52,15 +66,64 @@ func GetPublicKeyLabelsHandler(w http.ResponseWriter, r *http.Request) {
 
 }
 
+// ListPublicKeysHandler handles the listing of the public keys of a user together with their metadata
+// It expects a GET request from an authenticated session
+//
+// Possible responses:
+// - 401 Unauthorized: if the user is not authenticated
+// - 405 Method Not Allowed: if the request method is not GET
+// - 404 Not Found: if the user does not exist
+// - 503 Service Unavailable: if the database cannot be reached
+// - 504 Gateway Timeout: if the database does not respond in time
+// - 200 OK: with the label, public key, creation time, last use, use count and signer app of every key
+func ListPublicKeysHandler(w http.ResponseWriter, r *http.Request) {
+
+	// Get the authenticated user
+	username, err := getAuthenticatedUser(r)
+
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user, err := UserRepo.GetUser(r.Context(), username)
+	if sendDatabaseError(w, err) {
+		return
+	}
+	if user == nil || err != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	keys := make([]structs.PublicKeyInfo, len(user.PublicKeys))
+	for i, pubkey := range user.PublicKeys {
+		keys[i] = newPublicKeyInfo(pubkey)
+	}
+
+	sendJSONResponse(w, http.StatusOK, structs.ListPublicKeysResponse{Keys: keys})
+}
+
 // AddPublicKeyHandler handles the addition of a new public key for a user
-// It expects a POST request with a JSON body containing the username and the new public key
+// It expects a POST request with a JSON body containing the new public key and its label,
+// and optionally the name and digest of the TKey signer app that produced the key.
+// The session must hold a step-up for "add-key" made with a registered key (see StepUpHandler), and the body must
+// contain the ID of a "new-key" challenge and a signature over it made with the new key, proving possession of it.
 //
 // Possible responses:
 // - 405 Method Not Allowed: if the request method is not POST
-// - 400 Bad Request: if the request body is invalid or cannot be parsed
+// - 400 Bad Request: if the request body is invalid or cannot be parsed, the key is not a 32 byte ed25519 key, or the input is not sanitized
+// - 401 Unauthorized: if the new key's signature is invalid
+// - 403 Forbidden: if the session holds no valid step-up for adding a key
 // - 404 Not Found: if the user does not exist
-// - 409 Conflict: if the user already has the maximum number of public keys or the label already exists
+// - 409 Conflict: if the user already has the maximum number of public keys, the label already exists or the key has been revoked, or the keys kept being changed by other requests
 // - 500 Internal Server Error: if there is an error adding the public key or sending the response
+// - 503 Service Unavailable: if the database cannot be reached
+// - 504 Gateway Timeout: if the database does not respond in time
 // - 200 OK: if the public key is added successfully
 func AddPublicKeyHandler(w http.ResponseWriter, r *http.Request) {
 
@@ -102,27 +165,41 @@ func AddPublicKeyHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if len(newPubKey) != ed25519.PublicKeySize {
+		http.Error(w, "Public key must be 32 bytes", http.StatusBadRequest)
+		return
+	}
+
 	fmt.Printf("Received request to add public key for user: %s\n", username)
 
-	userExists, err := UserRepo.GetUser(username)
+	if !useStepUp(w, r, username, internal.PurposeAddKey) {
+		return
+	}
+
+	userExists, err := UserRepo.GetUser(r.Context(), username)
+	if sendDatabaseError(w, err) {
+		return
+	}
 	if userExists == nil || err != nil {
 		http.Error(w, "User not found", http.StatusNotFound)
 		return
 	}
 
-	_, err = UserRepo.AddPublicKey(username, newPubKey, label)
+	// The new key must sign a challenge, so that only keys the user controls can be added
+	if err := internal.VerifyPossession(r.Context(), username, requestBody.ChallengeID, internal.PurposeNewKey, newPubKey, requestBody.Signature); err != nil {
+		fmt.Printf("Proof of possession failed for new key of user %s: %v\n", username, err)
+		http.Error(w, "Invalid proof of possession for the new key", http.StatusUnauthorized)
+		return
+	}
+
+	signerApp := util.SignerApp{Name: requestBody.AppName, Digest: requestBody.AppDigest}
+
+	err = UserRepo.AddPublicKey(r.Context(), username, newPubKey, label, signerApp)
 	if err != nil {
-		if err.Error() == "user already has the maximum number of public keys" {
-			http.Error(w, err.Error(), http.StatusConflict)
-		} else if err.Error() == "public key already exists for the user" {
-			http.Error(w, err.Error(), http.StatusConflict)
-		} else if err.Error() == "label already exists for the user" {
-			http.Error(w, err.Error(), http.StatusConflict)
-		} else {
-			http.Error(w, "Unable to add public key", http.StatusInternalServerError)
-		}
+		sendAddPublicKeyError(w, err)
 		return
 	}
+	audit.Record(r, audit.EventKeyAdded, username, label, "")
 
 	// Send the response
 	response := map[string]string{"message": "Public key added successfully"}
@@ -130,14 +207,20 @@ func AddPublicKeyHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 // RemovePublicKeyHandler handles the removal of a public key for a user
-// It expects a POST request with a JSON body containing the username and the public key to be removed
+// It expects a POST request with a JSON body containing the label of the public key to be removed
+// The key is revoked rather than deleted, so it stays visible in the key listing and cannot be added again
+// The session must hold a step-up for "remove-key" made with a registered key (see StepUpHandler)
+// Every session authenticated with the removed key is ended, including the current one
 //
 // Possible responses:
 // - 405 Method Not Allowed: if the request method is not POST
 // - 400 Bad Request: if the request body is invalid or cannot be parsed
+// - 403 Forbidden: if the session holds no valid step-up for removing a key
 // - 404 Not Found: if the user does not exist or the label is not found
-// - 409 Conflict: if the user has only one public key
+// - 409 Conflict: if the key is the user's only active public key, or the keys kept being changed by other requests
 // - 500 Internal Server Error: if there is an error removing the public key or sending the response
+// - 503 Service Unavailable: if the database cannot be reached
+// - 504 Gateway Timeout: if the database does not respond in time
 // - 200 OK: if the public key is removed successfully
 func RemovePublicKeyHandler(w http.ResponseWriter, r *http.Request) {
 
@@ -170,6 +253,7 @@ func RemovePublicKeyHandler(w http.ResponseWriter, r *http.Request) {
 
 	if label == "" {
 		http.Error(w, "Label cannot be empty", http.StatusBadRequest)
+		return
 	}
 
 	if username == "" {
@@ -179,26 +263,301 @@ func RemovePublicKeyHandler(w http.ResponseWriter, r *http.Request) {
 
 	fmt.Printf("Received request to remove public key for user: %s\n", username)
 
-	userExists, err := UserRepo.GetUser(username)
+	if !useStepUp(w, r, username, internal.PurposeRemoveKey) {
+		return
+	}
+
+	userExists, err := UserRepo.GetUser(r.Context(), username)
+	if sendDatabaseError(w, err) {
+		return
+	}
 	if userExists == nil || err != nil {
 		http.Error(w, "User not found", http.StatusNotFound)
 		return
 	}
 
-	_, err = UserRepo.RemovePublicKey(username, label)
+	err = UserRepo.RemovePublicKey(r.Context(), username, label)
+	if sendDatabaseError(w, err) {
+		return
+	}
 	if err != nil {
-		if err.Error() == "user must have at least two public keys to remove one" {
+		if errors.Is(err, util.ErrLastActiveKey) || errors.Is(err, util.ErrConcurrentUpdate) {
 			http.Error(w, err.Error(), http.StatusConflict)
-		} else if err.Error() == "specified public key to be removed is not found" {
+		} else if errors.Is(err, util.ErrKeyNotFound) {
 			http.Error(w, err.Error(), http.StatusNotFound)
 		} else {
 			http.Error(w, "Unable to remove public key", http.StatusInternalServerError)
 		}
 		return
 	}
+	audit.Record(r, audit.EventKeyRemoved, username, label, "")
+
+	// Sessions authenticated with the removed key are ended on all devices
+	endKeySessions(w, r, username, label)
 
 	// Send the response
 	response := map[string]string{"message": "Public key removed successfully"}
 	sendJSONResponse(w, http.StatusOK, response)
 
 }
+
+// RenamePublicKeyHandler handles the renaming of a public key for a user
+// It expects a POST request with a JSON body containing the current label and the new label of the public key
+// If the current session was authenticated with the renamed key, the session is updated to the new label
+//
+// Possible responses:
+// - 405 Method Not Allowed: if the request method is not POST
+// - 400 Bad Request: if the request body is invalid or cannot be parsed, or the input is not sanitized
+// - 404 Not Found: if the user does not exist or the label is not found
+// - 409 Conflict: if the new label already exists, or the keys kept being changed by other requests
+// - 500 Internal Server Error: if there is an error renaming the public key or sending the response
+// - 503 Service Unavailable: if the database cannot be reached
+// - 504 Gateway Timeout: if the database does not respond in time
+// - 200 OK: if the public key is renamed successfully
+func RenamePublicKeyHandler(w http.ResponseWriter, r *http.Request) {
+
+	// Get the authenticated user
+	username, err := getAuthenticatedUser(r)
+
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	requestBody := structs.RenamePublicKeyRequest{}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if err := json.Unmarshal(body, &requestBody); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if requestBody.Label == "" || requestBody.NewLabel == "" {
+		http.Error(w, "Label cannot be empty", http.StatusBadRequest)
+		return
+	}
+
+	fmt.Printf("Received request to rename public key %s for user: %s\n", requestBody.Label, username)
+
+	userExists, err := UserRepo.GetUser(r.Context(), username)
+	if sendDatabaseError(w, err) {
+		return
+	}
+	if userExists == nil || err != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	err = UserRepo.RenamePublicKey(r.Context(), username, requestBody.Label, requestBody.NewLabel)
+	if sendDatabaseError(w, err) {
+		return
+	}
+	if err != nil {
+		if sanitizationErr, ok := err.(*structs.ErrorInputNotSanitized); ok {
+			http.Error(w, sanitizationErr.Error(), http.StatusBadRequest)
+		} else if errors.Is(err, util.ErrKeyNotFound) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+		} else if errors.Is(err, util.ErrLabelExists) || errors.Is(err, util.ErrConcurrentUpdate) {
+			http.Error(w, err.Error(), http.StatusConflict)
+		} else {
+			http.Error(w, "Unable to rename public key", http.StatusInternalServerError)
+		}
+		return
+	}
+	audit.Record(r, audit.EventKeyRenamed, username, requestBody.NewLabel, requestBody.Label)
+
+	// Keep the sessions pointing at the key they were authenticated with, so that they end when the key is removed
+	if err := session_util.RenameSessionKey(r.Context(), username, requestBody.Label, requestBody.NewLabel); err != nil {
+		fmt.Printf("Unable to update key label of sessions for user %s: %v\n", username, err)
+	}
+	if keyLabel, err := session_util.GetSessionKeyLabel(r); err == nil && keyLabel == requestBody.Label {
+		if err := session_util.UpdateSessionKeyLabel(w, r, requestBody.NewLabel); err != nil {
+			fmt.Printf("Unable to update key label in session for user %s: %v\n", username, err)
+		}
+	}
+
+	// Send the response
+	response := map[string]string{"message": "Public key renamed successfully"}
+	sendJSONResponse(w, http.StatusOK, response)
+}
+
+// SuspendPublicKeyHandler handles the suspension of a public key for a user
+// It expects a POST request with a JSON body containing the label of the public key to be suspended and an optional reason
+// A suspended key cannot be used to log in until it is reactivated, and every session authenticated with it is ended
+// The session must hold a step-up for "suspend-key" made with a registered key (see StepUpHandler)
+//
+// Possible responses:
+// - 405 Method Not Allowed: if the request method is not POST
+// - 400 Bad Request: if the request body is invalid or cannot be parsed, or the input is not sanitized
+// - 403 Forbidden: if the session holds no valid step-up for suspending a key
+// - 404 Not Found: if the user does not exist or the label is not found
+// - 409 Conflict: if the key is not active or is the user's only active public key, or the keys kept being changed by other requests
+// - 500 Internal Server Error: if there is an error suspending the public key or sending the response
+// - 503 Service Unavailable: if the database cannot be reached
+// - 504 Gateway Timeout: if the database does not respond in time
+// - 200 OK: if the public key is suspended successfully
+func SuspendPublicKeyHandler(w http.ResponseWriter, r *http.Request) {
+
+	// Get the authenticated user
+	username, err := getAuthenticatedUser(r)
+
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	requestBody := structs.SuspendPublicKeyRequest{}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if err := json.Unmarshal(body, &requestBody); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if requestBody.Label == "" {
+		http.Error(w, "Label cannot be empty", http.StatusBadRequest)
+		return
+	}
+
+	fmt.Printf("Received request to suspend public key %s for user: %s\n", requestBody.Label, username)
+
+	if !useStepUp(w, r, username, internal.PurposeSuspendKey) {
+		return
+	}
+
+	userExists, err := UserRepo.GetUser(r.Context(), username)
+	if sendDatabaseError(w, err) {
+		return
+	}
+	if userExists == nil || err != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	err = UserRepo.SuspendPublicKey(r.Context(), username, requestBody.Label, requestBody.Reason)
+	if sendDatabaseError(w, err) {
+		return
+	}
+	if err != nil {
+		if sanitizationErr, ok := err.(*structs.ErrorInputNotSanitized); ok {
+			http.Error(w, sanitizationErr.Error(), http.StatusBadRequest)
+		} else if errors.Is(err, util.ErrKeyNotFound) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+		} else if errors.Is(err, util.ErrKeyNotActive) || errors.Is(err, util.ErrLastActiveKey) || errors.Is(err, util.ErrConcurrentUpdate) {
+			http.Error(w, err.Error(), http.StatusConflict)
+		} else {
+			http.Error(w, "Unable to suspend public key", http.StatusInternalServerError)
+		}
+		return
+	}
+	audit.Record(r, audit.EventKeySuspended, username, requestBody.Label, requestBody.Reason)
+
+	// Sessions authenticated with the suspended key are ended on all devices
+	endKeySessions(w, r, username, requestBody.Label)
+
+	// Send the response
+	response := map[string]string{"message": "Public key suspended successfully"}
+	sendJSONResponse(w, http.StatusOK, response)
+}
+
+// ReactivatePublicKeyHandler handles the reactivation of a suspended public key for a user
+// It expects a POST request with a JSON body containing the label of the public key to be reactivated
+// The session must hold a step-up for "reactivate-key" made with a registered key (see StepUpHandler)
+//
+// Possible responses:
+// - 405 Method Not Allowed: if the request method is not POST
+// - 400 Bad Request: if the request body is invalid or cannot be parsed, or the input is not sanitized
+// - 403 Forbidden: if the session holds no valid step-up for reactivating a key
+// - 404 Not Found: if the user does not exist or the label is not found
+// - 409 Conflict: if the key is not suspended, or the keys kept being changed by other requests
+// - 500 Internal Server Error: if there is an error reactivating the public key or sending the response
+// - 503 Service Unavailable: if the database cannot be reached
+// - 504 Gateway Timeout: if the database does not respond in time
+// - 200 OK: if the public key is reactivated successfully
+func ReactivatePublicKeyHandler(w http.ResponseWriter, r *http.Request) {
+
+	// Get the authenticated user
+	username, err := getAuthenticatedUser(r)
+
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	requestBody := structs.ReactivatePublicKeyRequest{}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if err := json.Unmarshal(body, &requestBody); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if requestBody.Label == "" {
+		http.Error(w, "Label cannot be empty", http.StatusBadRequest)
+		return
+	}
+
+	fmt.Printf("Received request to reactivate public key %s for user: %s\n", requestBody.Label, username)
+
+	if !useStepUp(w, r, username, internal.PurposeReactivateKey) {
+		return
+	}
+
+	userExists, err := UserRepo.GetUser(r.Context(), username)
+	if sendDatabaseError(w, err) {
+		return
+	}
+	if userExists == nil || err != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	err = UserRepo.ReactivatePublicKey(r.Context(), username, requestBody.Label)
+	if sendDatabaseError(w, err) {
+		return
+	}
+	if err != nil {
+		if sanitizationErr, ok := err.(*structs.ErrorInputNotSanitized); ok {
+			http.Error(w, sanitizationErr.Error(), http.StatusBadRequest)
+		} else if errors.Is(err, util.ErrKeyNotFound) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+		} else if errors.Is(err, util.ErrKeyNotSuspended) || errors.Is(err, util.ErrConcurrentUpdate) {
+			http.Error(w, err.Error(), http.StatusConflict)
+		} else {
+			http.Error(w, "Unable to reactivate public key", http.StatusInternalServerError)
+		}
+		return
+	}
+	audit.Record(r, audit.EventKeyReactivated, username, requestBody.Label, "")
+
+	// Send the response
+	response := map[string]string{"message": "Public key reactivated successfully"}
+	sendJSONResponse(w, http.StatusOK, response)
+}
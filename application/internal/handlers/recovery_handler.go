@@ -0,0 +1,294 @@
+package handlers
+
+import (
+	"chalmers/tkey-group22/application/internal"
+	"chalmers/tkey-group22/application/internal/audit"
+	"chalmers/tkey-group22/application/internal/ratelimit"
+	"chalmers/tkey-group22/application/internal/session_util"
+	"chalmers/tkey-group22/application/internal/structs"
+	"chalmers/tkey-group22/application/internal/util"
+	"crypto/ed25519"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// RecoverHandler starts the recovery of an account whose keys have all been lost
+// It expects a POST request with a JSON body containing the username and one of the user's recovery codes.
+// The code is used up, and the session may only be used to enroll a new key within session_util.RecoveryValidDuration.
+// Invalid codes are counted towards the lockout of the username, see ratelimit.RecordFailure.
+//
+// Possible responses:
+// - 405 Method Not Allowed: if the request method is not POST
+// - 400 Bad Request: if the request body is invalid or the username is not sanitized
+// - 401 Unauthorized: if the user does not exist or the recovery code is not valid
+// - 500 Internal Server Error: if the code cannot be checked or the session cannot be saved
+// - 503 Service Unavailable: if the database cannot be reached
+// - 504 Gateway Timeout: if the database does not respond in time
+// - 200 OK: if the code was valid and a new key can be enrolled
+func RecoverHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	requestBody := structs.RecoverRequest{}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if err := json.Unmarshal(body, &requestBody); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	username := requestBody.Username
+	if username == "" || requestBody.Code == "" {
+		http.Error(w, "Username and recovery code cannot be empty", http.StatusBadRequest)
+		return
+	}
+
+	used, err := UserRepo.UseRecoveryCode(r.Context(), username, internal.HashRecoveryCode(requestBody.Code))
+	if sendDatabaseError(w, err) {
+		return
+	}
+	if sanitizationErr, ok := err.(*structs.ErrorInputNotSanitized); ok {
+		http.Error(w, sanitizationErr.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		fmt.Printf("Unable to check recovery code for user %s: %v\n", username, err)
+		http.Error(w, "Unable to check recovery code", http.StatusInternalServerError)
+		return
+	}
+
+	// Unknown users and invalid codes get the same response
+	if !used {
+		fmt.Printf("Invalid recovery code for user: %s\n", username)
+		ratelimit.RecordFailure(username)
+		audit.Record(r, audit.EventRecoveryFailed, username, "", "")
+		http.Error(w, "Invalid username or recovery code", http.StatusUnauthorized)
+		return
+	}
+
+	ratelimit.RecordSuccess(username)
+
+	if err := session_util.SetRecoverySession(w, r, username); err != nil {
+		http.Error(w, "Failed to set session", http.StatusInternalServerError)
+		return
+	}
+
+	fmt.Printf("User %s used a recovery code\n", username)
+	audit.Record(r, audit.EventRecoveryCodeUsed, username, "", "")
+
+	response := map[string]string{"message": "Recovery code accepted, enroll a new key to continue"}
+	sendJSONResponse(w, http.StatusOK, response)
+}
+
+// RecoveryChallengeHandler issues the challenge the new key signs when it is enrolled during recovery
+// It expects a POST request from a recovery session with a JSON body optionally containing the origin.
+//
+// Possible responses:
+// - 401 Unauthorized: if there is no recovery in progress or it has expired
+// - 405 Method Not Allowed: if the request method is not POST
+// - 400 Bad Request: if the request body is invalid or the origin is not allowed
+// - 429 Too Many Requests: if the user already has too many outstanding challenges
+// - 500 Internal Server Error: if there is an error creating the challenge
+// - 200 OK: with the challenge ID, the challenge and the server's signature over it
+func RecoveryChallengeHandler(w http.ResponseWriter, r *http.Request) {
+	username, err := session_util.GetRecoveryUsername(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	requestBody := structs.RecoveryChallengeRequest{}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if err := json.Unmarshal(body, &requestBody); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	origin := requestOrigin(r, requestBody.Origin)
+
+	challenge, err := internal.GenerateChallenge(r.Context(), username, internal.PurposeNewKey, origin)
+	if err == internal.ErrOriginNotAllowed {
+		http.Error(w, "Origin not allowed", http.StatusBadRequest)
+		return
+	}
+	if err == internal.ErrTooManyChallenges {
+		http.Error(w, "Too many active challenges, try again later", http.StatusTooManyRequests)
+		return
+	}
+	if err != nil {
+		fmt.Printf("Unable to generate recovery challenge for user: %s: %v\n", username, err)
+		http.Error(w, "Unable to create challenge", http.StatusInternalServerError)
+		return
+	}
+	audit.Record(r, audit.EventChallengeIssued, username, "", internal.PurposeNewKey)
+
+	response, err := newChallengeResponse(challenge)
+	if err != nil {
+		fmt.Printf("Unable to sign challenge for user: %s: %v\n", username, err)
+		http.Error(w, "Unable to create challenge", http.StatusInternalServerError)
+		return
+	}
+
+	sendJSONResponse(w, http.StatusOK, response)
+}
+
+// RecoveryEnrollHandler enrolls a new key for a user that is recovering their account
+// It expects a POST request from a recovery session with the same JSON body as AddPublicKeyHandler,
+// where the challenge comes from RecoveryChallengeHandler. The lost keys are revoked when the new key is added,
+// and every existing session of the user is ended. Once the key is added the user is logged in with it.
+//
+// Possible responses:
+// - 401 Unauthorized: if there is no recovery in progress, it has expired or the proof of possession is invalid
+// - 405 Method Not Allowed: if the request method is not POST
+// - 400 Bad Request: if the request body is invalid, the label is empty or the key is not a 32 byte ed25519 key
+// - 409 Conflict: if the key cannot be added to the user
+// - 500 Internal Server Error: if there is an error adding the key, ending the existing sessions or saving the session
+// - 503 Service Unavailable: if the database cannot be reached
+// - 504 Gateway Timeout: if the database does not respond in time
+// - 200 OK: if the key was added and the user is logged in
+func RecoveryEnrollHandler(w http.ResponseWriter, r *http.Request) {
+	username, err := session_util.GetRecoveryUsername(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	requestBody := structs.AddPublicKeyRequest{}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if err := json.Unmarshal(body, &requestBody); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	newPubKey := requestBody.Pubkey
+	label := requestBody.Label
+
+	if label == "" {
+		http.Error(w, "Label cannot be empty", http.StatusBadRequest)
+		return
+	}
+
+	if len(newPubKey) != ed25519.PublicKeySize {
+		http.Error(w, "Public key must be 32 bytes", http.StatusBadRequest)
+		return
+	}
+
+	// The new key must sign a challenge, so that only keys the user controls can be added
+	if err := internal.VerifyPossession(r.Context(), username, requestBody.ChallengeID, internal.PurposeNewKey, newPubKey, requestBody.Signature); err != nil {
+		fmt.Printf("Proof of possession failed for recovery key of user %s: %v\n", username, err)
+		http.Error(w, "Invalid proof of possession for the new key", http.StatusUnauthorized)
+		return
+	}
+
+	signerApp := util.SignerApp{Name: requestBody.AppName, Digest: requestBody.AppDigest}
+
+	revokedLabels, err := UserRepo.RecoverPublicKey(r.Context(), username, newPubKey, label, signerApp)
+	if err != nil {
+		sendAddPublicKeyError(w, err)
+		return
+	}
+	for _, revokedLabel := range revokedLabels {
+		audit.Record(r, audit.EventKeyRemoved, username, revokedLabel, "recovery")
+	}
+	audit.Record(r, audit.EventKeyAdded, username, label, "recovery")
+
+	// Whoever has the lost keys may still be logged in with them
+	revoked, err := session_util.RevokeUserSessions(r.Context(), username)
+	if err != nil {
+		fmt.Printf("Unable to revoke sessions of user %s: %v\n", username, err)
+		http.Error(w, "Unable to end existing sessions", http.StatusInternalServerError)
+		return
+	}
+	fmt.Printf("Revoked %d sessions of user %s during recovery\n", revoked, username)
+
+	if err := session_util.CompleteRecovery(w, r, username, label); err != nil {
+		http.Error(w, "Failed to set session", http.StatusInternalServerError)
+		return
+	}
+
+	fmt.Printf("User %s recovered their account with new key %s\n", username, label)
+
+	response := map[string]string{"message": "Public key added successfully"}
+	sendJSONResponse(w, http.StatusOK, response)
+}
+
+// RegenerateRecoveryCodesHandler replaces the recovery codes of the authenticated user with new ones
+// It expects a POST request and requires a "recovery-codes" step-up, see StepUpHandler.
+// All previous codes stop working.
+//
+// Possible responses:
+// - 401 Unauthorized: if the user is not authenticated
+// - 403 Forbidden: if the user has not stepped up for the operation
+// - 405 Method Not Allowed: if the request method is not POST
+// - 500 Internal Server Error: if the codes cannot be generated or stored
+// - 503 Service Unavailable: if the database cannot be reached
+// - 504 Gateway Timeout: if the database does not respond in time
+// - 200 OK: with the new recovery codes
+func RegenerateRecoveryCodesHandler(w http.ResponseWriter, r *http.Request) {
+
+	// Get the authenticated user
+	username, err := getAuthenticatedUser(r)
+
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !useStepUp(w, r, username, internal.PurposeRecoveryCodes) {
+		return
+	}
+
+	codes, hashes, err := internal.GenerateRecoveryCodes()
+	if err != nil {
+		fmt.Printf("Unable to generate recovery codes for user %s: %v\n", username, err)
+		http.Error(w, "Unable to generate recovery codes", http.StatusInternalServerError)
+		return
+	}
+
+	if err := UserRepo.SetRecoveryCodes(r.Context(), username, hashes); err != nil {
+		fmt.Printf("Unable to store recovery codes for user %s: %v\n", username, err)
+		if sendDatabaseError(w, err) {
+			return
+		}
+		http.Error(w, "Unable to generate recovery codes", http.StatusInternalServerError)
+		return
+	}
+
+	fmt.Printf("User %s generated new recovery codes\n", username)
+
+	response := structs.RecoveryCodesResponse{RecoveryCodes: codes}
+	sendJSONResponse(w, http.StatusOK, response)
+}
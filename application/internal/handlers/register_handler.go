@@ -1,24 +1,117 @@
 package handlers
 
 import (
+	"chalmers/tkey-group22/application/internal"
+	"chalmers/tkey-group22/application/internal/audit"
 	"chalmers/tkey-group22/application/internal/structs"
+	"chalmers/tkey-group22/application/internal/util"
+	"crypto/ed25519"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
-
-	"go.mongodb.org/mongo-driver/mongo"
 )
 
-// RegisterHandler handles the user registration process
-// It expects a POST request with a JSON body containing the username and public key with label of the user to be registered
+// RegisterChallengeHandler handles the first step of the user registration process
+// It expects a POST request with a JSON body containing the username to be registered and optionally the origin
+// the challenge should be bound to. The returned challenge must be signed with the key the user registers with.
 //
 // Possible responses:
 // - 405 Method Not Allowed: if the request method is not POST
-// - 400 Bad Request: if the request body is invalid or cannot be parsed
+// - 400 Bad Request: if the request body is invalid, the username is not sanitized or the origin is not allowed
+// - 409 Conflict: if the user already exists
+// - 429 Too Many Requests: if there are too many outstanding challenges for the username
+// - 500 Internal Server Error: if there is an error creating the challenge
+// - 503 Service Unavailable: if the database cannot be reached
+// - 504 Gateway Timeout: if the database does not respond in time
+// - 200 OK: with the challenge ID, the challenge and the server's signature over it
+func RegisterChallengeHandler(w http.ResponseWriter, r *http.Request) {
+	// Ensure it is a POST request
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Parse request body
+	requestBody := structs.RegisterChallengeRequest{}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if err := json.Unmarshal(body, &requestBody); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	username := requestBody.Username
+	if username == "" {
+		http.Error(w, "Username cannot be empty", http.StatusBadRequest)
+		return
+	}
+
+	// Check if user already exists
+	userExists, err := UserRepo.GetUser(r.Context(), username)
+	if sendDatabaseError(w, err) {
+		return
+	}
+
+	// Checks for sanitization error
+	if _, ok := err.(*structs.ErrorInputNotSanitized); ok {
+		errMsg := err.(*structs.ErrorInputNotSanitized).Error()
+		http.Error(w, errMsg, http.StatusBadRequest)
+		return
+	}
+
+	if userExists != nil || !errors.Is(err, util.ErrUserNotFound) {
+		http.Error(w, "User already exists", http.StatusConflict)
+		return
+	}
+
+	origin := requestOrigin(r, requestBody.Origin)
+
+	challenge, err := internal.GenerateChallenge(r.Context(), username, internal.PurposeRegister, origin)
+	if err == internal.ErrOriginNotAllowed {
+		http.Error(w, "Origin not allowed", http.StatusBadRequest)
+		return
+	}
+	if err == internal.ErrTooManyChallenges {
+		http.Error(w, "Too many active registration attempts, try again later", http.StatusTooManyRequests)
+		return
+	}
+	if err != nil {
+		fmt.Printf("Unable to generate registration challenge for user: %s: %v\n", username, err)
+		http.Error(w, "Unable to create challenge", http.StatusInternalServerError)
+		return
+	}
+	audit.Record(r, audit.EventChallengeIssued, username, "", internal.PurposeRegister)
+
+	response, err := newChallengeResponse(challenge)
+	if err != nil {
+		fmt.Printf("Unable to sign challenge for user: %s: %v\n", username, err)
+		http.Error(w, "Unable to create challenge", http.StatusInternalServerError)
+		return
+	}
+
+	sendJSONResponse(w, http.StatusOK, response)
+}
+
+// RegisterHandler handles the second step of the user registration process
+// It expects a POST request with a JSON body containing the username and public key with label of the user to be registered,
+// the ID of a challenge from RegisterChallengeHandler and a signature over it made with the key, proving possession of the key,
+// and optionally the name and digest of the TKey signer app that produced the key
+//
+// Possible responses:
+// - 405 Method Not Allowed: if the request method is not POST
+// - 400 Bad Request: if the request body is invalid or cannot be parsed, or the key is not a 32 byte ed25519 key
+// - 401 Unauthorized: if the signature over the registration challenge is invalid
 // - 409 Conflict: if the user already exists
 // - 500 Internal Server Error: if there is an error creating the user or sending the response
-// - 200 OK: if the user is registered successfully
+// - 503 Service Unavailable: if the database cannot be reached
+// - 504 Gateway Timeout: if the database does not respond in time
+// - 200 OK: with the user's one-time recovery codes if the user is registered successfully
 func RegisterHandler(w http.ResponseWriter, r *http.Request) {
 	// Ensure it is a POST request
 	if r.Method != http.MethodPost {
@@ -42,11 +135,15 @@ func RegisterHandler(w http.ResponseWriter, r *http.Request) {
 	username := requestBody.Username
 	pubkey := requestBody.Pubkey
 	label := requestBody.Label
+	signerApp := util.SignerApp{Name: requestBody.AppName, Digest: requestBody.AppDigest}
 
 	fmt.Printf("Received registration request for user: %s\n", username)
 
 	// Check if user already exists
-	userExists, err := UserRepo.GetUser(username)
+	userExists, err := UserRepo.GetUser(r.Context(), username)
+	if sendDatabaseError(w, err) {
+		return
+	}
 
 	// Checks for sanitization error
 	if _, ok := err.(*structs.ErrorInputNotSanitized); ok {
@@ -56,14 +153,29 @@ func RegisterHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if userExists != nil || err != mongo.ErrNoDocuments {
+	if userExists != nil || !errors.Is(err, util.ErrUserNotFound) {
 		fmt.Printf("User already exists: %s\n", username)
 		http.Error(w, "User already exists", http.StatusConflict)
 		return
 	}
 
+	if len(pubkey) != ed25519.PublicKeySize {
+		http.Error(w, "Public key must be 32 bytes", http.StatusBadRequest)
+		return
+	}
+
+	// The key must sign the registration challenge, so that only keys the user controls can be registered
+	if err := internal.VerifyPossession(r.Context(), username, requestBody.ChallengeID, internal.PurposeRegister, pubkey, requestBody.Signature); err != nil {
+		fmt.Printf("Proof of possession failed for registration of user %s: %v\n", username, err)
+		http.Error(w, "Invalid proof of possession for the public key", http.StatusUnauthorized)
+		return
+	}
+
 	// Store new user data
-	user, err := UserRepo.CreateUser(username, pubkey, label)
+	user, err := UserRepo.CreateUser(r.Context(), username, pubkey, label, signerApp)
+	if sendDatabaseError(w, err) {
+		return
+	}
 
 	// Checks for sanitization error
 	if _, ok := err.(*structs.ErrorInputNotSanitized); ok {
@@ -73,14 +185,33 @@ func RegisterHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// The username may have been taken since it was checked
+	if errors.Is(err, util.ErrUserExists) {
+		fmt.Printf("User already exists: %s\n", username)
+		http.Error(w, "User already exists", http.StatusConflict)
+		return
+	}
+
 	// Check for other errors
 	if err != nil || user == nil {
 		fmt.Printf("Error creating user: %v\n", err)
 		http.Error(w, "Unable to create user", http.StatusInternalServerError)
 		return
 	}
+	audit.Record(r, audit.EventRegister, username, label, "")
+
+	// The recovery codes are only shown now. If they cannot be stored the user can generate new ones after logging in.
+	response := structs.RegisterResponse{Message: "User registered successfully", RecoveryCodes: []string{}}
+	codes, hashes, err := internal.GenerateRecoveryCodes()
+	if err == nil {
+		err = UserRepo.SetRecoveryCodes(r.Context(), username, hashes)
+	}
+	if err != nil {
+		fmt.Printf("Unable to create recovery codes for user %s: %v\n", username, err)
+	} else {
+		response.RecoveryCodes = codes
+	}
 
 	// Send the response
-	response := map[string]string{"message": "User registered successfully"}
 	sendJSONResponse(w, http.StatusOK, response)
 }
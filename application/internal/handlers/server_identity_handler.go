@@ -0,0 +1,33 @@
+package handlers
+
+import (
+	"chalmers/tkey-group22/application/internal"
+	"chalmers/tkey-group22/application/internal/structs"
+	"net/http"
+)
+
+// ServerPublicKeyHandler publishes the public part of the server identity key
+// The TKey client pins this key on first use and uses it to verify the signature of every challenge
+//
+// Possible responses:
+// - 405 Method Not Allowed: if the request method is not GET
+// - 500 Internal Server Error: if the server identity key is not loaded
+// - 200 OK: with the public key in the response body
+func ServerPublicKeyHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	pubkey := internal.ServerPublicKey()
+	if pubkey == nil {
+		http.Error(w, "Server identity not available", http.StatusInternalServerError)
+		return
+	}
+
+	response := structs.ServerPublicKeyResponse{
+		PublicKey: pubkey,
+		Algorithm: "Ed25519",
+	}
+	sendJSONResponse(w, http.StatusOK, response)
+}
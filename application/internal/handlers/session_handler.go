@@ -0,0 +1,165 @@
+package handlers
+
+import (
+	"chalmers/tkey-group22/application/internal/session_util"
+	"chalmers/tkey-group22/application/internal/structs"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// ListSessionsHandler handles the listing of the active sessions of a user
+// It expects a GET request from an authenticated session
+//
+// Possible responses:
+// - 401 Unauthorized: if the user is not authenticated
+// - 405 Method Not Allowed: if the request method is not GET
+// - 500 Internal Server Error: if the sessions cannot be read
+// - 200 OK: with the type, device, IP address, key label and times of every session, marking the current one
+func ListSessionsHandler(w http.ResponseWriter, r *http.Request) {
+
+	// Get the authenticated user
+	username, err := getAuthenticatedUser(r)
+
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	records, err := session_util.ListSessions(r.Context(), username)
+	if err != nil {
+		fmt.Printf("Unable to list sessions for user %s: %v\n", username, err)
+		http.Error(w, "Unable to list sessions", http.StatusInternalServerError)
+		return
+	}
+
+	currentID := session_util.GetSessionID(r)
+	sessions := make([]structs.SessionInfo, len(records))
+	for i, record := range records {
+		sessionType := "browser"
+		if record.Type == session_util.SessionTypeToken {
+			sessionType = session_util.SessionTypeToken
+		}
+		sessions[i] = structs.SessionInfo{
+			ID:        record.ID,
+			Type:      sessionType,
+			Current:   record.ID == currentID,
+			KeyLabel:  record.KeyLabel,
+			UserAgent: record.UserAgent,
+			IP:        record.IP,
+			CreatedAt: record.CreatedAt.UTC(),
+			LastSeen:  record.LastSeen.UTC(),
+			ExpiresAt: record.ExpiresAt.UTC(),
+		}
+	}
+
+	sendJSONResponse(w, http.StatusOK, structs.ListSessionsResponse{Sessions: sessions})
+}
+
+// RevokeSessionHandler handles the revocation of one of the user's sessions, e.g. on a lost device
+// It expects a POST request with a JSON body containing the ID of the session as listed by ListSessionsHandler.
+// Revoking the current session logs the user out.
+//
+// Possible responses:
+// - 401 Unauthorized: if the user is not authenticated
+// - 405 Method Not Allowed: if the request method is not POST
+// - 400 Bad Request: if the request body is invalid or the ID is empty
+// - 404 Not Found: if the user has no session with the ID
+// - 500 Internal Server Error: if the session cannot be revoked
+// - 200 OK: if the session was revoked
+func RevokeSessionHandler(w http.ResponseWriter, r *http.Request) {
+
+	// Get the authenticated user
+	username, err := getAuthenticatedUser(r)
+
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	requestBody := structs.RevokeSessionRequest{}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if err := json.Unmarshal(body, &requestBody); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if requestBody.ID == "" {
+		http.Error(w, "Session ID cannot be empty", http.StatusBadRequest)
+		return
+	}
+
+	if requestBody.ID == session_util.GetSessionID(r) {
+		if err := session_util.TerminateSession(w, r); err != nil {
+			http.Error(w, "Unable to revoke session", http.StatusInternalServerError)
+			return
+		}
+	} else {
+		revoked, err := session_util.RevokeSession(r.Context(), username, requestBody.ID)
+		if err != nil {
+			fmt.Printf("Unable to revoke session of user %s: %v\n", username, err)
+			http.Error(w, "Unable to revoke session", http.StatusInternalServerError)
+			return
+		}
+		if !revoked {
+			http.Error(w, "Session not found", http.StatusNotFound)
+			return
+		}
+	}
+
+	fmt.Printf("User %s revoked a session\n", username)
+
+	response := map[string]string{"message": "Session revoked successfully"}
+	sendJSONResponse(w, http.StatusOK, response)
+}
+
+// RevokeOtherSessionsHandler handles the revocation of all of the user's sessions except the current one
+// It expects a POST request from an authenticated session
+//
+// Possible responses:
+// - 401 Unauthorized: if the user is not authenticated
+// - 405 Method Not Allowed: if the request method is not POST
+// - 500 Internal Server Error: if the sessions cannot be revoked
+// - 200 OK: with the number of sessions that were revoked
+func RevokeOtherSessionsHandler(w http.ResponseWriter, r *http.Request) {
+
+	// Get the authenticated user
+	username, err := getAuthenticatedUser(r)
+
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	revoked, err := session_util.RevokeOtherSessions(r, username)
+	if err != nil {
+		fmt.Printf("Unable to revoke sessions of user %s: %v\n", username, err)
+		http.Error(w, "Unable to revoke sessions", http.StatusInternalServerError)
+		return
+	}
+
+	fmt.Printf("User %s revoked %d other sessions\n", username, revoked)
+
+	sendJSONResponse(w, http.StatusOK, structs.RevokeSessionsResponse{Revoked: revoked})
+}
@@ -0,0 +1,162 @@
+package handlers
+
+import (
+	"chalmers/tkey-group22/application/internal"
+	"chalmers/tkey-group22/application/internal/audit"
+	"chalmers/tkey-group22/application/internal/session_util"
+	"chalmers/tkey-group22/application/internal/structs"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// stepUpPurposes are the purposes a step-up challenge can be requested for by an authenticated user
+var stepUpPurposes = map[string]bool{
+	internal.PurposeAddKey:    true,
+	internal.PurposeRemoveKey: true,
+	internal.PurposeNewKey:    true,
+
+	internal.PurposeRecoveryCodes: true,
+	internal.PurposeSuspendKey:    true,
+	internal.PurposeReactivateKey: true,
+}
+
+// StepUpChallengeHandler issues a challenge for a sensitive operation to the authenticated user
+// It expects a POST request with a JSON body containing the purpose of the challenge and optionally the origin.
+// The purpose is one of "add-key", "remove-key", "suspend-key", "reactivate-key" or "recovery-codes", which must be signed by a registered key, or "new-key",
+// which must be signed by the key that is being added.
+//
+// Possible responses:
+// - 401 Unauthorized: if the user is not authenticated
+// - 405 Method Not Allowed: if the request method is not POST
+// - 400 Bad Request: if the request body is invalid, the purpose is unknown or the origin is not allowed
+// - 429 Too Many Requests: if the user already has too many outstanding challenges
+// - 500 Internal Server Error: if there is an error creating the challenge
+// - 200 OK: with the challenge ID, the challenge and the server's signature over it
+func StepUpChallengeHandler(w http.ResponseWriter, r *http.Request) {
+
+	// Get the authenticated user
+	username, err := getAuthenticatedUser(r)
+
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	requestBody := structs.StepUpChallengeRequest{}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if err := json.Unmarshal(body, &requestBody); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if !stepUpPurposes[requestBody.Purpose] {
+		http.Error(w, "Invalid purpose", http.StatusBadRequest)
+		return
+	}
+
+	origin := requestOrigin(r, requestBody.Origin)
+
+	challenge, err := internal.GenerateChallenge(r.Context(), username, requestBody.Purpose, origin)
+	if err == internal.ErrOriginNotAllowed {
+		http.Error(w, "Origin not allowed", http.StatusBadRequest)
+		return
+	}
+	if err == internal.ErrTooManyChallenges {
+		http.Error(w, "Too many active challenges, try again later", http.StatusTooManyRequests)
+		return
+	}
+	if err != nil {
+		fmt.Printf("Unable to generate %s challenge for user: %s: %v\n", requestBody.Purpose, username, err)
+		http.Error(w, "Unable to create challenge", http.StatusInternalServerError)
+		return
+	}
+	audit.Record(r, audit.EventChallengeIssued, username, "", requestBody.Purpose)
+
+	response, err := newChallengeResponse(challenge)
+	if err != nil {
+		fmt.Printf("Unable to sign challenge for user: %s: %v\n", username, err)
+		http.Error(w, "Unable to create challenge", http.StatusInternalServerError)
+		return
+	}
+
+	sendJSONResponse(w, http.StatusOK, response)
+}
+
+// StepUpHandler verifies a step-up signature and authorizes one sensitive operation in the session
+// It expects a POST request with a JSON body containing the purpose ("add-key", "remove-key", "suspend-key", "reactivate-key" or "recovery-codes"), the challenge ID
+// and a signature over the challenge made by one of the user's active keys.
+// The authorization can be used once within session_util.StepUpValidDuration. It is used up when the operation is attempted, even if the operation fails.
+//
+// Possible responses:
+// - 401 Unauthorized: if the user is not authenticated or the signature is invalid
+// - 405 Method Not Allowed: if the request method is not POST
+// - 400 Bad Request: if the request body is invalid or the purpose cannot be stepped up to
+// - 500 Internal Server Error: if the session cannot be saved
+// - 503 Service Unavailable: if the database cannot be reached
+// - 504 Gateway Timeout: if the database does not respond in time
+// - 200 OK: if the signature is valid
+func StepUpHandler(w http.ResponseWriter, r *http.Request) {
+
+	// Get the authenticated user
+	username, err := getAuthenticatedUser(r)
+
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	requestBody := structs.StepUpRequest{}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if err := json.Unmarshal(body, &requestBody); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	// Possession of a new key is proven directly to the operation that adds it
+	if !stepUpPurposes[requestBody.Purpose] || requestBody.Purpose == internal.PurposeNewKey {
+		http.Error(w, "Invalid purpose", http.StatusBadRequest)
+		return
+	}
+
+	publicKey, err := internal.VerifySignature(r.Context(), username, requestBody.ChallengeID, requestBody.Purpose, requestBody.Signature, UserRepo)
+	if sendDatabaseError(w, err) {
+		return
+	}
+	if publicKey == nil {
+		fmt.Printf("Step-up for %s failed for user %s: %v\n", requestBody.Purpose, username, err)
+		http.Error(w, "Invalid signature", http.StatusUnauthorized)
+		return
+	}
+
+	if err := session_util.SetStepUp(w, r, requestBody.Purpose); err != nil {
+		http.Error(w, "Failed to set session", http.StatusInternalServerError)
+		return
+	}
+
+	fmt.Printf("User %s stepped up for %s with key %s\n", username, requestBody.Purpose, publicKey.Label)
+
+	response := map[string]string{"message": "Step-up successful"}
+	sendJSONResponse(w, http.StatusOK, response)
+}
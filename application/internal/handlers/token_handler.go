@@ -0,0 +1,101 @@
+package handlers
+
+import (
+	"chalmers/tkey-group22/application/internal/session_util"
+	"chalmers/tkey-group22/application/internal/structs"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// RefreshTokenHandler exchanges a refresh token for a new access token and refresh token
+// It expects a POST request with a JSON body containing the refresh token that was last issued.
+// The refresh token can only be used once, using it again revokes the tokens.
+//
+// Possible responses:
+// - 405 Method Not Allowed: if the request method is not POST
+// - 400 Bad Request: if the request body is invalid or cannot be parsed
+// - 401 Unauthorized: if the refresh token is invalid, expired or revoked
+// - 500 Internal Server Error: if the tokens cannot be issued
+// - 200 OK: with the new tokens in the response body
+func RefreshTokenHandler(w http.ResponseWriter, r *http.Request) {
+	refreshToken, ok := readRefreshToken(w, r)
+	if !ok {
+		return
+	}
+
+	tokens, err := session_util.RefreshTokens(r, refreshToken)
+	if err == session_util.ErrInvalidToken {
+		http.Error(w, "Invalid refresh token", http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		fmt.Printf("Unable to refresh tokens: %v\n", err)
+		http.Error(w, "Failed to refresh tokens", http.StatusInternalServerError)
+		return
+	}
+
+	sendTokenResponse(w, tokens)
+}
+
+// RevokeTokenHandler revokes a refresh token together with the access tokens issued with it
+// It expects a POST request with a JSON body containing the refresh token, and is how a token client logs out.
+// An unknown token is not an error, since the outcome is the same.
+//
+// Possible responses:
+// - 405 Method Not Allowed: if the request method is not POST
+// - 400 Bad Request: if the request body is invalid or cannot be parsed
+// - 500 Internal Server Error: if the tokens cannot be revoked
+// - 200 OK: if the tokens are revoked
+func RevokeTokenHandler(w http.ResponseWriter, r *http.Request) {
+	refreshToken, ok := readRefreshToken(w, r)
+	if !ok {
+		return
+	}
+
+	if err := session_util.RevokeToken(r.Context(), refreshToken); err != nil && err != session_util.ErrInvalidToken {
+		fmt.Printf("Unable to revoke token: %v\n", err)
+		http.Error(w, "Failed to revoke token", http.StatusInternalServerError)
+		return
+	}
+
+	response := map[string]string{"message": "Token revoked successfully"}
+	sendJSONResponse(w, http.StatusOK, response)
+}
+
+// Helper function to read the refresh token from a POST request, responding with an error if there is none
+func readRefreshToken(w http.ResponseWriter, r *http.Request) (string, bool) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return "", false
+	}
+
+	requestBody := structs.RefreshTokenRequest{}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return "", false
+	}
+
+	if err := json.Unmarshal(body, &requestBody); err != nil || requestBody.RefreshToken == "" {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return "", false
+	}
+
+	return requestBody.RefreshToken, true
+}
+
+// Helper function to send newly issued bearer tokens
+// The tokens must not be cached by the client or any proxy
+func sendTokenResponse(w http.ResponseWriter, tokens *session_util.TokenPair) {
+	response := structs.TokenResponse{
+		AccessToken:  tokens.AccessToken,
+		RefreshToken: tokens.RefreshToken,
+		TokenType:    "Bearer",
+		ExpiresIn:    tokens.ExpiresIn,
+		Scope:        tokens.Scope,
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	sendJSONResponse(w, http.StatusOK, response)
+}
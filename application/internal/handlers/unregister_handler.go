@@ -1,11 +1,12 @@
 package handlers
 
 import (
+	"chalmers/tkey-group22/application/internal/audit"
 	"chalmers/tkey-group22/application/internal/session_util"
+	"chalmers/tkey-group22/application/internal/util"
+	"errors"
 	"fmt"
 	"net/http"
-
-	"go.mongodb.org/mongo-driver/mongo"
 )
 
 // UnregisterHandler handles user unregistration requests.
@@ -48,25 +49,38 @@ func UnregisterHandler(w http.ResponseWriter, r *http.Request) {
 	fmt.Printf("Received unregistration request from user: %s\n", username)
 
 	// Check that the user exists in the database
-	userExists, err := UserRepo.GetUser(username)
-	if userExists == nil || err == mongo.ErrNoDocuments {
+	userExists, err := UserRepo.GetUser(r.Context(), username)
+	if sendDatabaseError(w, err) {
+		return
+	}
+	if userExists == nil || errors.Is(err, util.ErrUserNotFound) {
 		fmt.Printf("User does not exist: %s\n", username)
 		http.Error(w, "Could not unregister. User does not exist", http.StatusNotFound)
 		return
 	}
 
 	// Delete user from the database
-	user, err := UserRepo.DeleteUser(username)
-	if err != nil || user == nil {
+	err = UserRepo.DeleteUser(r.Context(), username)
+	if sendDatabaseError(w, err) {
+		return
+	}
+	if err != nil {
 		fmt.Printf("Error deleting user: %v\n", err)
 		http.Error(w, "Unable to delete user", http.StatusInternalServerError)
 		return
 	}
+	audit.Record(r, audit.EventUnregister, username, "", "")
+
+	// End the sessions of the user on every device, not only this one
+	if _, err := session_util.RevokeUserSessions(r.Context(), username); err != nil {
+		fmt.Printf("Unable to revoke sessions of user %s: %v\n", username, err)
+	}
 
 	err = session_util.TerminateSession(w, r)
 
 	if err != nil {
 		http.Error(w, "Unable to terminate session", http.StatusInternalServerError)
+		return
 	}
 
 	// Send success response
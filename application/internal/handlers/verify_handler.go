@@ -2,6 +2,8 @@ package handlers
 
 import (
 	"chalmers/tkey-group22/application/internal"
+	"chalmers/tkey-group22/application/internal/audit"
+	"chalmers/tkey-group22/application/internal/ratelimit"
 	"chalmers/tkey-group22/application/internal/session_util"
 	"chalmers/tkey-group22/application/internal/structs"
 	"encoding/json"
@@ -12,14 +14,21 @@ import (
 
 // VerifyHandler handles the verification of a user's signature. If the signiture is valid it
 // will set add the user to the session storage and return a cookie in the response.
-// It expects a POST request with a JSON body containing "username" and "signature" fields
+// The label of the key that made the signature is stored in the session and its last use is recorded.
+// It expects a POST request with a JSON body containing "username", "challenge_id" and "signature" fields
+// If "issue_tokens" is set, an access token and a refresh token with the scopes in "scope" are returned instead of
+// setting a session cookie, for clients such as scripts and the TKey client that cannot use cookies.
+// Failed signatures are counted towards the lockout of the username, see ratelimit.RecordFailure.
 //
 // Possible responses:
 // - 405 Method Not Allowed: if the request method is not POST
-// - 400 Bad Request: if the request body is invalid or cannot be parsed
-// - 404 Not Found: if the user does not exist
-// - 401 Unauthorized: if the signature is invalid
-// - 200 OK: if the signature is valid
+// - 400 Bad Request: if the request body is invalid or cannot be parsed, or a requested scope is unknown
+// - 404 Not Found: if there is no active challenge with the ID
+// - 401 Unauthorized: if the signature is invalid, including when the user does not exist
+// - 500 Internal Server Error: if the session cannot be set or the tokens cannot be issued
+// - 503 Service Unavailable: if the database cannot be reached
+// - 504 Gateway Timeout: if the database does not respond in time
+// - 200 OK: if the signature is valid, with the tokens in the response body if they were requested
 func VerifyHandler(w http.ResponseWriter, r *http.Request) {
 	// Ensure it is a POST request
 	if r.Method != http.MethodPost {
@@ -40,32 +49,62 @@ func VerifyHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Check if the specified user is found
-	userExists, err := UserRepo.GetUser(requestBody.Username)
-
-	if userExists == nil || err != nil {
-		http.Error(w, "User not found", http.StatusNotFound)
-		return
+	// An unknown scope is rejected before the challenge is used up
+	if requestBody.IssueTokens {
+		if _, err := session_util.ParseScope(requestBody.Scope); err != nil {
+			http.Error(w, "Invalid scope", http.StatusBadRequest)
+			return
+		}
 	}
 
-	// Check if publicKey has an active challenge
-	if !internal.HasActiveChallenge(requestBody.Username) {
+	// Check if the challenge is still active
+	if !internal.HasActiveChallenge(r.Context(), requestBody.ChallengeID) {
 		http.Error(w, "No active challenge found for the user", http.StatusNotFound)
 		return
 	}
 
+	loginType := audit.LoginSession
+	if requestBody.IssueTokens {
+		loginType = audit.LoginTokens
+	}
+
 	// Verify the signed response
-	valid, err := internal.VerifySignature(requestBody.Username, requestBody.Signature, UserRepo)
-	if !valid {
+	// A user that does not exist has no keys, so the response is the same as for a wrong signature
+	publicKey, err := internal.VerifySignature(r.Context(), requestBody.Username, requestBody.ChallengeID, internal.PurposeLogin, requestBody.Signature, UserRepo)
+	if sendDatabaseError(w, err) {
+		return
+	}
+	if publicKey == nil {
 		fmt.Println(err)
+		ratelimit.RecordFailure(requestBody.Username)
+		audit.Record(r, audit.EventLoginFailed, requestBody.Username, "", loginType)
 		http.Error(w, "Invalid signature!!!", http.StatusUnauthorized)
 		return
 	}
+	ratelimit.RecordSuccess(requestBody.Username)
+
+	// A failure to record the key use should not stop the user from logging in
+	if err := UserRepo.RecordKeyUse(r.Context(), requestBody.Username, publicKey.Label); err != nil {
+		fmt.Printf("Unable to record use of key %s for user %s: %v\n", publicKey.Label, requestBody.Username, err)
+	}
+
+	if requestBody.IssueTokens {
+		tokens, err := session_util.IssueTokens(r, requestBody.Username, publicKey.Label, requestBody.Scope)
+		if err != nil {
+			fmt.Printf("Unable to issue tokens for user %s: %v\n", requestBody.Username, err)
+			http.Error(w, "Failed to issue tokens", http.StatusInternalServerError)
+			return
+		}
+		audit.Record(r, audit.EventLoginSucceeded, requestBody.Username, publicKey.Label, loginType)
+		sendTokenResponse(w, tokens)
+		return
+	}
 
-	if err := session_util.SetSession(w, r, requestBody.Username); err != nil {
+	if err := session_util.SetSession(w, r, requestBody.Username, publicKey.Label); err != nil {
 		http.Error(w, "Failed to set session", http.StatusInternalServerError)
 		return
 	}
+	audit.Record(r, audit.EventLoginSucceeded, requestBody.Username, publicKey.Label, loginType)
 
 	// We don't expect a response body here, so commenting this out for the while
 	// sendJSONResponse(w, http.StatusOK, nil)
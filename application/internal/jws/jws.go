@@ -0,0 +1,159 @@
+// Package jws creates and verifies compact JSON Web Signatures made with ed25519 keys (RFC 7515, RFC 8037)
+package jws
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+)
+
+// Algorithm is the JWS algorithm name of ed25519 signatures
+const Algorithm = "EdDSA"
+
+// ErrInvalidToken is returned when a token is malformed or its signature is not valid
+var ErrInvalidToken = errors.New("invalid token")
+
+// Header is the protected header of a JWS
+type Header struct {
+	Algorithm string `json:"alg"`           // Always Algorithm
+	Type      string `json:"typ,omitempty"` // Media type of the token, e.g. "JWT"
+	KeyID     string `json:"kid,omitempty"` // ID of the key that made the signature, see KeyID
+}
+
+// Signer makes an ed25519 signature over a message, e.g. internal.SignWithServerIdentity
+type Signer func(message []byte) ([]byte, error)
+
+// Sign encodes the claims as JSON and signs them
+// The algorithm of the header is always set to Algorithm.
+//
+// Parameters:
+//   - header: The header of the token
+//   - claims: The claims to sign, encoded with encoding/json
+//   - sign: The function making the signature
+//
+// Returns:
+//   - string: The token in compact serialization
+//   - error: An error if the claims cannot be encoded or the signature cannot be made
+func Sign(header Header, claims interface{}, sign Signer) (string, error) {
+	header.Algorithm = Algorithm
+
+	encodedHeader, err := json.Marshal(header)
+	if err != nil {
+		return "", err
+	}
+	encodedClaims, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	signingInput := encode(encodedHeader) + "." + encode(encodedClaims)
+	signature, err := sign([]byte(signingInput))
+	if err != nil {
+		return "", err
+	}
+
+	return signingInput + "." + encode(signature), nil
+}
+
+// Verify checks the signature of a token and decodes its claims
+// Only the signature and the algorithm are checked, the caller must validate the header type and the claims.
+//
+// Parameters:
+//   - token: The token in compact serialization
+//   - pubkey: The ed25519 public key that must have made the signature
+//   - claims: A pointer to decode the claims into
+//
+// Returns:
+//   - *Header: The header of the token
+//   - error: ErrInvalidToken if the token is malformed or the signature is not valid
+func Verify(token string, pubkey ed25519.PublicKey, claims interface{}) (*Header, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 || len(pubkey) != ed25519.PublicKeySize {
+		return nil, ErrInvalidToken
+	}
+
+	encodedHeader, err := decode(parts[0])
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	var header Header
+	if err := json.Unmarshal(encodedHeader, &header); err != nil || header.Algorithm != Algorithm {
+		return nil, ErrInvalidToken
+	}
+
+	signature, err := decode(parts[2])
+	if err != nil || !ed25519.Verify(pubkey, []byte(parts[0]+"."+parts[1]), signature) {
+		return nil, ErrInvalidToken
+	}
+
+	encodedClaims, err := decode(parts[1])
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	if err := json.Unmarshal(encodedClaims, claims); err != nil {
+		return nil, ErrInvalidToken
+	}
+
+	return &header, nil
+}
+
+// JWK is an ed25519 public key as a JSON Web Key (RFC 8037)
+type JWK struct {
+	KeyType   string `json:"kty"` // Always "OKP"
+	Curve     string `json:"crv"` // Always "Ed25519"
+	X         string `json:"x"`   // The public key encoded in base64url
+	KeyID     string `json:"kid"` // See KeyID
+	Use       string `json:"use"` // Always "sig"
+	Algorithm string `json:"alg"` // Always Algorithm
+}
+
+// JWKSet is a set of JSON Web Keys, as published at a JWKS endpoint
+type JWKSet struct {
+	Keys []JWK `json:"keys"`
+}
+
+// NewJWK returns the JSON Web Key of an ed25519 public key
+//
+// Parameters:
+//   - pubkey: The public key
+//
+// Returns:
+//   - JWK: The key as a JWK
+func NewJWK(pubkey ed25519.PublicKey) JWK {
+	return JWK{
+		KeyType:   "OKP",
+		Curve:     "Ed25519",
+		X:         encode(pubkey),
+		KeyID:     KeyID(pubkey),
+		Use:       "sig",
+		Algorithm: Algorithm,
+	}
+}
+
+// KeyID returns the JWK thumbprint of an ed25519 public key (RFC 7638)
+// It changes whenever the key changes, so relying parties can tell which key signed a token.
+//
+// Parameters:
+//   - pubkey: The public key
+//
+// Returns:
+//   - string: The thumbprint encoded in base64url
+func KeyID(pubkey ed25519.PublicKey) string {
+	// The required members in lexicographic order, without whitespace
+	thumbprintInput := `{"crv":"Ed25519","kty":"OKP","x":"` + encode(pubkey) + `"}`
+	thumbprint := sha256.Sum256([]byte(thumbprintInput))
+	return encode(thumbprint[:])
+}
+
+// encode encodes bytes in unpadded base64url, as used throughout JWS
+func encode(data []byte) string {
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// decode decodes unpadded base64url
+func decode(data string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(data)
+}
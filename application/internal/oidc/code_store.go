@@ -0,0 +1,156 @@
+package oidc
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// ErrInvalidCode is returned when an authorization code does not exist, has expired or was already used
+var ErrInvalidCode = errors.New("invalid or expired authorization code")
+
+// CodeStore is the storage for issued authorization codes
+// Implementations must be safe for concurrent use and Take must remove the code atomically,
+// so that a code can only be redeemed once even when several backend replicas share the store
+type CodeStore interface {
+	// Put stores the authorization under the given key
+	Put(key string, authorization *Authorization) error
+	// Take removes and returns the unexpired authorization stored under the given key, or ErrInvalidCode
+	Take(key string) (*Authorization, error)
+}
+
+// MemoryCodeStore keeps authorization codes in a map in the memory of the running process
+// It is only suitable when a single backend instance is running
+type MemoryCodeStore struct {
+	codes map[string]*Authorization
+	lock  sync.Mutex
+}
+
+// NewMemoryCodeStore creates an empty in-memory code store
+//
+// Returns:
+//   - *MemoryCodeStore: A pointer to the new store
+func NewMemoryCodeStore() *MemoryCodeStore {
+	return &MemoryCodeStore{codes: make(map[string]*Authorization)}
+}
+
+// Put stores the authorization under the given key
+// Codes are short-lived, so expired codes are removed whenever a new one is stored
+//
+// Parameters:
+//   - key: The key to store the authorization under
+//   - authorization: The authorization the code grants
+//
+// Returns:
+//   - error: Always nil
+func (store *MemoryCodeStore) Put(key string, authorization *Authorization) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	now := time.Now()
+	for existing, stored := range store.codes {
+		if now.After(stored.ExpiresAt) {
+			delete(store.codes, existing)
+		}
+	}
+	store.codes[key] = authorization
+	return nil
+}
+
+// Take removes and returns the unexpired authorization stored under the given key
+//
+// Parameters:
+//   - key: The key the authorization is stored under
+//
+// Returns:
+//   - *Authorization: The stored authorization
+//   - error: ErrInvalidCode if there is no unexpired authorization for the key
+func (store *MemoryCodeStore) Take(key string) (*Authorization, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	authorization, exists := store.codes[key]
+	if !exists {
+		return nil, ErrInvalidCode
+	}
+	delete(store.codes, key)
+
+	if time.Now().After(authorization.ExpiresAt) {
+		return nil, ErrInvalidCode
+	}
+	return authorization, nil
+}
+
+// codeCollection is the MongoDB collection used by MongoCodeStore
+const codeCollection = "oidc_codes"
+
+// MongoCodeStore keeps authorization codes in a MongoDB collection
+// It allows a code issued by one backend replica to be redeemed at another
+type MongoCodeStore struct {
+	db *mongo.Database
+}
+
+// NewMongoCodeStore creates a code store backed by the given database
+// The TTL index used to remove expired codes is created by the database migrations, see db.MongoMigrations.
+//
+// Parameters:
+//   - db: The MongoDB database reference
+//
+// Returns:
+//   - *MongoCodeStore: A pointer to the new store
+func NewMongoCodeStore(db *mongo.Database) *MongoCodeStore {
+	return &MongoCodeStore{db: db}
+}
+
+// codeDocument is the representation of a stored authorization code in MongoDB
+type codeDocument struct {
+	Key           string `bson:"_id"`
+	Authorization `bson:",inline"`
+}
+
+// Put stores the authorization under the given key
+//
+// Parameters:
+//   - key: The key to store the authorization under
+//   - authorization: The authorization the code grants
+//
+// Returns:
+//   - error: An error if the code could not be stored
+func (store *MongoCodeStore) Put(key string, authorization *Authorization) error {
+	collection := store.db.Collection(codeCollection)
+
+	_, err := collection.InsertOne(context.Background(), codeDocument{Key: key, Authorization: *authorization})
+	return err
+}
+
+// Take removes and returns the unexpired authorization stored under the given key
+// The find and delete happen in a single operation, so only one replica can redeem a code
+//
+// Parameters:
+//   - key: The key the authorization is stored under
+//
+// Returns:
+//   - *Authorization: The stored authorization
+//   - error: ErrInvalidCode if there is no unexpired authorization for the key, or the database error
+func (store *MongoCodeStore) Take(key string) (*Authorization, error) {
+	collection := store.db.Collection(codeCollection)
+
+	var document codeDocument
+	err := collection.FindOneAndDelete(context.Background(), bson.M{"_id": key}).Decode(&document)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrInvalidCode
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// MongoDB only removes expired documents periodically
+	if time.Now().After(document.ExpiresAt) {
+		return nil, ErrInvalidCode
+	}
+	return &document.Authorization, nil
+}
@@ -0,0 +1,237 @@
+// Package oidc implements an OpenID Connect provider, letting other applications log their users in with a TKey
+// Users authenticate with the regular TKey login, after which the provider issues an authorization code
+// that the application exchanges for an ID token signed with the server identity key.
+package oidc
+
+import (
+	"chalmers/tkey-group22/application/internal"
+	"chalmers/tkey-group22/application/internal/jws"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"time"
+)
+
+var (
+	Issuer            = "http://localhost:3000/api/oidc" // Identifier of the provider, the URL the endpoints are served under
+	LoginURL          = "/"                              // Page where users are sent to log in with their TKey during authorization
+	CodeValidDuration = time.Minute                      // Authorization codes must be redeemed within a minute
+	TokenLifetime     = 10 * time.Minute                 // ID tokens and access tokens are valid for 10 minutes
+)
+
+// Codes is the store that holds the issued authorization codes
+// It defaults to an in-memory store and can be replaced at startup, e.g. with a MongoCodeStore
+var Codes CodeStore = NewMemoryCodeStore()
+
+// Scopes that can be requested
+const (
+	ScopeOpenID  = "openid"  // Required in every request
+	ScopeProfile = "profile" // Adds the username to the ID token and the user info
+)
+
+// Types of the tokens, set in their header so one type of token cannot be used as another
+const (
+	idTokenType     = "JWT"
+	accessTokenType = "at+jwt"
+)
+
+// ErrInvalidAccessToken is returned when an access token is malformed, expired or not issued by this provider
+var ErrInvalidAccessToken = errors.New("invalid access token")
+
+// Authorization is what a user granted a client by logging in, held until the client redeems its code
+type Authorization struct {
+	ClientID      string    `bson:"clientId"`                // Client the code was issued to
+	RedirectURI   string    `bson:"redirectUri"`             // Redirect URI given in the authorization request
+	Username      string    `bson:"username"`                // User who logged in
+	Scope         string    `bson:"scope"`                   // Space separated scopes that were granted
+	Nonce         string    `bson:"nonce,omitempty"`         // Nonce given by the client, repeated in the ID token
+	CodeChallenge string    `bson:"codeChallenge,omitempty"` // PKCE code challenge given by the client, method S256
+	AuthTime      time.Time `bson:"authTime"`                // When the user touched the TKey
+	ExpiresAt     time.Time `bson:"expiresAt"`               // When the code stops being valid
+}
+
+// IDTokenClaims are the claims of an ID token
+type IDTokenClaims struct {
+	Issuer            string `json:"iss"`
+	Subject           string `json:"sub"`
+	Audience          string `json:"aud"`
+	ExpiresAt         int64  `json:"exp"`
+	IssuedAt          int64  `json:"iat"`
+	AuthTime          int64  `json:"auth_time"`
+	Nonce             string `json:"nonce,omitempty"`
+	PreferredUsername string `json:"preferred_username,omitempty"`
+}
+
+// AccessTokenClaims are the claims of an access token for the user info endpoint
+type AccessTokenClaims struct {
+	Issuer    string `json:"iss"`
+	Subject   string `json:"sub"`
+	Audience  string `json:"aud"`
+	ClientID  string `json:"client_id"`
+	Scope     string `json:"scope"`
+	ExpiresAt int64  `json:"exp"`
+	IssuedAt  int64  `json:"iat"`
+}
+
+// HasScope reports whether a space separated list of scopes contains the scope
+//
+// Parameters:
+//   - scopes: The space separated scopes, e.g. "openid profile"
+//   - scope: The scope to look for
+//
+// Returns:
+//   - bool: True if the scope is in the list
+func HasScope(scopes string, scope string) bool {
+	for _, requested := range strings.Fields(scopes) {
+		if requested == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// IssueCode stores the authorization and returns a new authorization code for it
+// The code expires after CodeValidDuration and can only be redeemed once.
+//
+// Parameters:
+//   - authorization: What the user granted the client, its expiry is set here
+//
+// Returns:
+//   - string: The authorization code to send to the client
+//   - error: An error if the random generation fails or the code cannot be stored
+func IssueCode(authorization *Authorization) (string, error) {
+	code := make([]byte, 32)
+	if _, err := rand.Read(code); err != nil {
+		return "", err
+	}
+	encodedCode := base64.RawURLEncoding.EncodeToString(code)
+
+	authorization.ExpiresAt = time.Now().Add(CodeValidDuration)
+	if err := Codes.Put(hashCode(encodedCode), authorization); err != nil {
+		return "", err
+	}
+	return encodedCode, nil
+}
+
+// RedeemCode takes the authorization of a code, checking that it is redeemed by the client it was issued to
+// The code is removed whether or not the checks pass, so it can only be tried once.
+//
+// Parameters:
+//   - code: The authorization code
+//   - clientID: The authenticated client redeeming the code
+//   - redirectURI: The redirect URI given in the token request, which must be the one of the authorization request
+//   - codeVerifier: The PKCE code verifier, required if the authorization request had a code challenge
+//
+// Returns:
+//   - *Authorization: The authorization the code was issued for
+//   - error: ErrInvalidCode if the code is not valid for the request, or the error of the code store
+func RedeemCode(code string, clientID string, redirectURI string, codeVerifier string) (*Authorization, error) {
+	authorization, err := Codes.Take(hashCode(code))
+	if err != nil {
+		return nil, err
+	}
+
+	if authorization.ClientID != clientID || authorization.RedirectURI != redirectURI {
+		return nil, ErrInvalidCode
+	}
+
+	if authorization.CodeChallenge != "" || codeVerifier != "" {
+		verifierHash := sha256.Sum256([]byte(codeVerifier))
+		expected := base64.RawURLEncoding.EncodeToString(verifierHash[:])
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(authorization.CodeChallenge)) != 1 {
+			return nil, ErrInvalidCode
+		}
+	}
+
+	return authorization, nil
+}
+
+// NewIDToken issues an ID token for the authorization, signed with the server identity key
+//
+// Parameters:
+//   - authorization: The redeemed authorization
+//
+// Returns:
+//   - string: The ID token
+//   - error: An error if the token cannot be signed
+func NewIDToken(authorization *Authorization) (string, error) {
+	now := time.Now()
+	claims := IDTokenClaims{
+		Issuer:    Issuer,
+		Subject:   authorization.Username,
+		Audience:  authorization.ClientID,
+		ExpiresAt: now.Add(TokenLifetime).Unix(),
+		IssuedAt:  now.Unix(),
+		AuthTime:  authorization.AuthTime.Unix(),
+		Nonce:     authorization.Nonce,
+	}
+	if HasScope(authorization.Scope, ScopeProfile) {
+		claims.PreferredUsername = authorization.Username
+	}
+
+	return signToken(idTokenType, claims)
+}
+
+// NewAccessToken issues an access token for the user info endpoint, signed with the server identity key
+//
+// Parameters:
+//   - authorization: The redeemed authorization
+//
+// Returns:
+//   - string: The access token
+//   - error: An error if the token cannot be signed
+func NewAccessToken(authorization *Authorization) (string, error) {
+	now := time.Now()
+	claims := AccessTokenClaims{
+		Issuer:    Issuer,
+		Subject:   authorization.Username,
+		Audience:  Issuer,
+		ClientID:  authorization.ClientID,
+		Scope:     authorization.Scope,
+		ExpiresAt: now.Add(TokenLifetime).Unix(),
+		IssuedAt:  now.Unix(),
+	}
+
+	return signToken(accessTokenType, claims)
+}
+
+// ParseAccessToken verifies an access token issued by NewAccessToken
+//
+// Parameters:
+//   - token: The access token
+//
+// Returns:
+//   - *AccessTokenClaims: The claims of the token
+//   - error: ErrInvalidAccessToken if the token is not a valid, unexpired access token of this provider
+func ParseAccessToken(token string) (*AccessTokenClaims, error) {
+	var claims AccessTokenClaims
+	header, err := jws.Verify(token, internal.ServerPublicKey(), &claims)
+	if err != nil || header.Type != accessTokenType {
+		return nil, ErrInvalidAccessToken
+	}
+
+	if claims.Issuer != Issuer || claims.Audience != Issuer || time.Now().Unix() >= claims.ExpiresAt {
+		return nil, ErrInvalidAccessToken
+	}
+
+	return &claims, nil
+}
+
+// signToken signs the claims with the server identity key
+func signToken(tokenType string, claims interface{}) (string, error) {
+	header := jws.Header{
+		Type:  tokenType,
+		KeyID: jws.KeyID(internal.ServerPublicKey()),
+	}
+	return jws.Sign(header, claims, internal.SignWithServerIdentity)
+}
+
+// hashCode returns the key a code is stored under, so the stored codes cannot be redeemed
+func hashCode(code string) string {
+	hash := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(hash[:])
+}
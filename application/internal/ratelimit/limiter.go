@@ -0,0 +1,193 @@
+// Package ratelimit throttles the unauthenticated login and recovery endpoints
+// Requests are limited with token buckets per IP address and per username, and a username is locked
+// for a while after too many failed signatures or recovery codes. The state is kept in the memory of each backend replica.
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// cleanupInterval is how often idle buckets and old failures are forgotten
+const cleanupInterval = time.Minute
+
+// Limiter is a set of token buckets, one per key
+// Each bucket holds up to Rate.Requests tokens and is refilled at Rate.Requests per Rate.Per,
+// so a client may send a burst of requests and is then limited to the rate.
+type Limiter struct {
+	rate        Rate
+	buckets     map[string]*bucket
+	lastCleanup time.Time
+	lock        sync.Mutex
+}
+
+// bucket is the token bucket of a single key
+type bucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// NewLimiter creates a limiter with empty state
+//
+// Parameters:
+//   - rate: How many requests each key may make and how fast they are refilled
+//
+// Returns:
+//   - *Limiter: A pointer to the new limiter
+func NewLimiter(rate Rate) *Limiter {
+	return &Limiter{rate: rate, buckets: make(map[string]*bucket), lastCleanup: time.Now()}
+}
+
+// Allow takes a token from the bucket of the key, if there is one
+//
+// Parameters:
+//   - key: The key to limit, e.g. an IP address
+//
+// Returns:
+//   - bool: True if the request is allowed
+//   - time.Duration: How long until the next token is available, if the request is not allowed
+func (limiter *Limiter) Allow(key string) (bool, time.Duration) {
+	limiter.lock.Lock()
+	defer limiter.lock.Unlock()
+
+	now := time.Now()
+	limiter.cleanup(now)
+
+	capacity := float64(limiter.rate.Requests)
+	refill := capacity / limiter.rate.Per.Seconds()
+
+	current, exists := limiter.buckets[key]
+	if !exists {
+		current = &bucket{tokens: capacity, updated: now}
+		limiter.buckets[key] = current
+	}
+	current.tokens = min(capacity, current.tokens+now.Sub(current.updated).Seconds()*refill)
+	current.updated = now
+
+	if current.tokens < 1 {
+		return false, time.Duration((1 - current.tokens) / refill * float64(time.Second))
+	}
+	current.tokens--
+	return true, 0
+}
+
+// cleanup forgets the buckets that have been refilled completely, since they are the same as a new bucket
+// The caller must hold the lock
+func (limiter *Limiter) cleanup(now time.Time) {
+	if now.Sub(limiter.lastCleanup) < cleanupInterval {
+		return
+	}
+	limiter.lastCleanup = now
+
+	for key, idle := range limiter.buckets {
+		if now.Sub(idle.updated) >= limiter.rate.Per {
+			delete(limiter.buckets, key)
+		}
+	}
+}
+
+// Lockout counts failed signatures per key and locks a key that has too many of them
+// Failures are forgotten when the lock expires, after a successful login, or when there has been
+// no failure for the duration of the lock.
+type Lockout struct {
+	maxFailures int
+	duration    time.Duration
+	entries     map[string]*lockoutEntry
+	lastCleanup time.Time
+	lock        sync.Mutex
+}
+
+// lockoutEntry is the failures of a single key
+type lockoutEntry struct {
+	failures    int
+	lastFailure time.Time
+	lockedUntil time.Time
+}
+
+// NewLockout creates a lockout with empty state
+//
+// Parameters:
+//   - maxFailures: The number of failures after which a key is locked
+//   - duration: How long a key is locked
+//
+// Returns:
+//   - *Lockout: A pointer to the new lockout
+func NewLockout(maxFailures int, duration time.Duration) *Lockout {
+	return &Lockout{maxFailures: maxFailures, duration: duration, entries: make(map[string]*lockoutEntry), lastCleanup: time.Now()}
+}
+
+// Locked reports how long the key is still locked
+//
+// Parameters:
+//   - key: The key to check, e.g. a username
+//
+// Returns:
+//   - time.Duration: The time until the lock expires, or 0 if the key is not locked
+func (lockout *Lockout) Locked(key string) time.Duration {
+	lockout.lock.Lock()
+	defer lockout.lock.Unlock()
+
+	entry, exists := lockout.entries[key]
+	if !exists {
+		return 0
+	}
+	remaining := time.Until(entry.lockedUntil)
+	if remaining <= 0 {
+		return 0
+	}
+	return remaining
+}
+
+// RecordFailure counts a failed signature for the key, locking it when it reaches the maximum number of failures
+//
+// Parameters:
+//   - key: The key the signature failed for
+//
+// Returns:
+//   - bool: True if the key is locked now
+func (lockout *Lockout) RecordFailure(key string) bool {
+	lockout.lock.Lock()
+	defer lockout.lock.Unlock()
+
+	now := time.Now()
+	lockout.cleanup(now)
+
+	entry, exists := lockout.entries[key]
+	if !exists || now.Sub(entry.lastFailure) >= lockout.duration || (!entry.lockedUntil.IsZero() && now.After(entry.lockedUntil)) {
+		entry = &lockoutEntry{}
+		lockout.entries[key] = entry
+	}
+	entry.failures++
+	entry.lastFailure = now
+	if entry.failures >= lockout.maxFailures {
+		entry.lockedUntil = now.Add(lockout.duration)
+		return true
+	}
+	return false
+}
+
+// Reset forgets the failures of the key
+//
+// Parameters:
+//   - key: The key that logged in successfully
+func (lockout *Lockout) Reset(key string) {
+	lockout.lock.Lock()
+	defer lockout.lock.Unlock()
+
+	delete(lockout.entries, key)
+}
+
+// cleanup forgets the keys whose failures and lock have expired
+// The caller must hold the lock
+func (lockout *Lockout) cleanup(now time.Time) {
+	if now.Sub(lockout.lastCleanup) < cleanupInterval {
+		return
+	}
+	lockout.lastCleanup = now
+
+	for key, entry := range lockout.entries {
+		if now.Sub(entry.lastFailure) >= lockout.duration && now.After(entry.lockedUntil) {
+			delete(lockout.entries, key)
+		}
+	}
+}
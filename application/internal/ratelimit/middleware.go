@@ -0,0 +1,117 @@
+package ratelimit
+
+import (
+	"bytes"
+	"chalmers/tkey-group22/application/internal/session_util"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// maxPeekedBody is how much of a request body the middleware reads to find the username
+const maxPeekedBody = 64 << 10
+
+var (
+	ipLimiter   = NewLimiter(DefaultPolicy().PerIP)
+	userLimiter = NewLimiter(DefaultPolicy().PerUser)
+	failures    = NewLockout(DefaultPolicy().MaxFailures, DefaultPolicy().LockoutDuration)
+)
+
+// Configure applies a policy, forgetting all requests and failures counted so far
+//
+// Parameters:
+//   - policy: The policy to apply, see LoadPolicy
+func Configure(policy Policy) {
+	ipLimiter = NewLimiter(policy.PerIP)
+	userLimiter = NewLimiter(policy.PerUser)
+	failures = NewLockout(policy.MaxFailures, policy.LockoutDuration)
+}
+
+// Middleware throttles an unauthenticated login or recovery endpoint
+// Requests are limited per IP address and per username, the latter read from the "username" field of the JSON body.
+// Requests for a username that is locked after too many failed signatures or recovery codes are refused, whether or not the user exists,
+// so the responses do not tell which usernames are registered.
+//
+// Possible responses, in addition to those of the next handler:
+// - 429 Too Many Requests: with a Retry-After header, if the limit is reached or the username is locked
+//
+// Parameters:
+// - next: The handler of the endpoint.
+//
+// Returns:
+// - http.Handler: A handler that wraps the provided handler with rate limiting.
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip := session_util.ClientIP(r)
+		if allowed, retryAfter := ipLimiter.Allow(ip); !allowed {
+			fmt.Printf("Rate limited login requests from %s\n", ip)
+			tooManyRequests(w, retryAfter)
+			return
+		}
+
+		username := peekUsername(r)
+		if username != "" {
+			if remaining := failures.Locked(username); remaining > 0 {
+				tooManyRequests(w, remaining)
+				return
+			}
+			if allowed, retryAfter := userLimiter.Allow(username); !allowed {
+				fmt.Printf("Rate limited login requests for user %s\n", username)
+				tooManyRequests(w, retryAfter)
+				return
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// RecordFailure counts a failed signature or recovery code for the username, which is locked after too many of them
+// Failures are counted for usernames that do not exist as well, so a lock does not tell that a user exists.
+//
+// Parameters:
+//   - username: The username the signature failed for
+func RecordFailure(username string) {
+	if failures.RecordFailure(username) {
+		fmt.Printf("Locked logins for user %s after too many failures\n", username)
+	}
+}
+
+// RecordSuccess forgets the failed signatures of a user who logged in
+//
+// Parameters:
+//   - username: The user who logged in
+func RecordSuccess(username string) {
+	failures.Reset(username)
+}
+
+// peekUsername returns the "username" field of a JSON request body, leaving the body for the next handler to read
+func peekUsername(r *http.Request) string {
+	if r.Body == nil {
+		return ""
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxPeekedBody))
+	r.Body.Close()
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	if err != nil {
+		return ""
+	}
+
+	var request struct {
+		Username string `json:"username"`
+	}
+	if err := json.Unmarshal(body, &request); err != nil {
+		return ""
+	}
+	return request.Username
+}
+
+// tooManyRequests responds that the client must wait before trying again
+func tooManyRequests(w http.ResponseWriter, retryAfter time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	http.Error(w, "Too many login attempts, try again later", http.StatusTooManyRequests)
+}
@@ -0,0 +1,118 @@
+package ratelimit
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Rate is a number of requests per period
+type Rate struct {
+	Requests int
+	Per      time.Duration
+}
+
+// Policy decides how many login requests are allowed and when a username is locked
+type Policy struct {
+	PerIP           Rate          // Requests a single IP address may make
+	PerUser         Rate          // Requests that may be made for a single username, from any IP address
+	MaxFailures     int           // Failed signatures after which a username is locked
+	LockoutDuration time.Duration // How long a username is locked
+}
+
+// DefaultPolicy returns the policy used when nothing is configured
+// A login takes two requests, one for the challenge and one for the signature.
+//
+// Returns:
+//   - Policy: the default policy.
+func DefaultPolicy() Policy {
+	return Policy{
+		PerIP:           Rate{Requests: 30, Per: time.Minute},
+		PerUser:         Rate{Requests: 10, Per: time.Minute},
+		MaxFailures:     5,
+		LockoutDuration: 15 * time.Minute,
+	}
+}
+
+// LoadPolicy reads the rate limiting policy from the environment
+// Rates are given as a number of requests per second, minute or hour, e.g. "30/m".
+// Durations are given in the format of time.ParseDuration, e.g. "15m".
+//
+//   - RATE_LIMIT_PER_IP: requests per IP address
+//   - RATE_LIMIT_PER_USER: requests per username
+//   - LOCKOUT_MAX_FAILURES: failed signatures before a username is locked
+//   - LOCKOUT_DURATION: how long a username is locked
+//
+// Returns:
+//   - Policy: the configured policy.
+//   - error: an error if a setting is invalid.
+func LoadPolicy() (Policy, error) {
+	policy := DefaultPolicy()
+
+	if value := os.Getenv("RATE_LIMIT_PER_IP"); value != "" {
+		rate, err := ParseRate(value)
+		if err != nil {
+			return policy, fmt.Errorf("invalid RATE_LIMIT_PER_IP: %s", value)
+		}
+		policy.PerIP = rate
+	}
+
+	if value := os.Getenv("RATE_LIMIT_PER_USER"); value != "" {
+		rate, err := ParseRate(value)
+		if err != nil {
+			return policy, fmt.Errorf("invalid RATE_LIMIT_PER_USER: %s", value)
+		}
+		policy.PerUser = rate
+	}
+
+	if value := os.Getenv("LOCKOUT_MAX_FAILURES"); value != "" {
+		maxFailures, err := strconv.Atoi(value)
+		if err != nil || maxFailures <= 0 {
+			return policy, fmt.Errorf("invalid LOCKOUT_MAX_FAILURES: %s", value)
+		}
+		policy.MaxFailures = maxFailures
+	}
+
+	if value := os.Getenv("LOCKOUT_DURATION"); value != "" {
+		duration, err := time.ParseDuration(value)
+		if err != nil || duration <= 0 {
+			return policy, fmt.Errorf("invalid LOCKOUT_DURATION: %s", value)
+		}
+		policy.LockoutDuration = duration
+	}
+
+	return policy, nil
+}
+
+// ParseRate parses a rate such as "30/m"
+// The period is "s", "m" or "h", or a duration such as "10m".
+//
+// Parameters:
+//   - value: The rate to parse
+//
+// Returns:
+//   - Rate: The parsed rate
+//   - error: An error if the rate is malformed or not positive
+func ParseRate(value string) (Rate, error) {
+	requests, period, found := strings.Cut(strings.TrimSpace(value), "/")
+	if !found {
+		return Rate{}, fmt.Errorf("rate must be given as requests/period")
+	}
+
+	count, err := strconv.Atoi(requests)
+	if err != nil || count <= 0 {
+		return Rate{}, fmt.Errorf("invalid number of requests: %s", requests)
+	}
+
+	if period == "s" || period == "m" || period == "h" {
+		period = "1" + period
+	}
+	per, err := time.ParseDuration(period)
+	if err != nil || per <= 0 {
+		return Rate{}, fmt.Errorf("invalid period: %s", period)
+	}
+
+	return Rate{Requests: count, Per: per}, nil
+}
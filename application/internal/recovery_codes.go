@@ -0,0 +1,65 @@
+package internal
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/hex"
+	"strings"
+)
+
+// RecoveryCodeCount is the number of recovery codes generated for a user at a time
+const RecoveryCodeCount = 10
+
+// recoveryCodeBytes is the amount of randomness in each recovery code, giving 80 bit codes
+const recoveryCodeBytes = 10
+
+// recoveryCodeEncoding encodes recovery codes with lower case letters and digits that are not easily confused
+var recoveryCodeEncoding = base32.NewEncoding("abcdefghijkmnpqrstuvwxyz23456789").WithPadding(base32.NoPadding)
+
+// GenerateRecoveryCodes generates a new set of one-time recovery codes
+// The codes are shown to the user once, only their hashes are stored.
+//
+// Returns:
+//   - []string: The recovery codes, formatted in groups of four characters, e.g. "abcd-efgh-jkmn-pqrs"
+//   - []string: The hashes of the codes as returned by HashRecoveryCode
+//   - error: An error if random bytes cannot be generated
+func GenerateRecoveryCodes() ([]string, []string, error) {
+	codes := make([]string, 0, RecoveryCodeCount)
+	hashes := make([]string, 0, RecoveryCodeCount)
+
+	for i := 0; i < RecoveryCodeCount; i++ {
+		random := make([]byte, recoveryCodeBytes)
+		if _, err := rand.Read(random); err != nil {
+			return nil, nil, err
+		}
+
+		encoded := recoveryCodeEncoding.EncodeToString(random)
+		groups := make([]string, 0, len(encoded)/4)
+		for j := 0; j < len(encoded); j += 4 {
+			groups = append(groups, encoded[j:j+4])
+		}
+
+		code := strings.Join(groups, "-")
+		codes = append(codes, code)
+		hashes = append(hashes, HashRecoveryCode(code))
+	}
+
+	return codes, hashes, nil
+}
+
+// HashRecoveryCode hashes a recovery code for storage and lookup
+// Dashes, spaces and case are ignored, so that codes typed in by the user match the ones that were generated.
+//
+// Parameters:
+//   - code: The recovery code as entered by the user
+//
+// Returns:
+//   - string: The SHA-256 hash of the normalized code, encoded in hex
+func HashRecoveryCode(code string) string {
+	normalized := strings.ToLower(code)
+	normalized = strings.NewReplacer("-", "", " ", "").Replace(normalized)
+
+	hash := sha256.Sum256([]byte(normalized))
+	return hex.EncodeToString(hash[:])
+}
@@ -0,0 +1,101 @@
+package internal
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// serverKey is the ed25519 identity key of the backend
+// It signs every challenge so that the TKey client can tell the real server from an impostor
+var serverKey ed25519.PrivateKey
+
+// InitServerIdentity loads the server identity key
+// If seed is set it is used as the key, which lets several replicas share the same identity.
+// Otherwise the key is read from the file at path, and a new key is generated and written there if the file does not exist.
+//
+// Parameters:
+//   - seed: A base64 encoded 32 byte ed25519 seed, or empty to use the key file
+//   - path: The path of the key file holding a base64 encoded seed
+//
+// Returns:
+//   - error: An error if the key cannot be decoded, read or written
+func InitServerIdentity(seed string, path string) error {
+	if seed == "" {
+		content, err := os.ReadFile(path)
+		if errors.Is(err, os.ErrNotExist) {
+			return generateServerIdentity(path)
+		}
+		if err != nil {
+			return err
+		}
+		seed = string(content)
+	}
+
+	seedBytes, err := base64.StdEncoding.DecodeString(strings.TrimSpace(seed))
+	if err != nil {
+		return fmt.Errorf("invalid server identity key: %w", err)
+	}
+	if len(seedBytes) != ed25519.SeedSize {
+		return fmt.Errorf("invalid server identity key: expected %d bytes, got %d", ed25519.SeedSize, len(seedBytes))
+	}
+
+	serverKey = ed25519.NewKeyFromSeed(seedBytes)
+	return nil
+}
+
+// generateServerIdentity generates a new server identity key and writes its seed to the file at path
+// The file is only readable by the owner
+func generateServerIdentity(path string) error {
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+
+	encodedSeed := base64.StdEncoding.EncodeToString(privateKey.Seed())
+	if err := os.WriteFile(path, []byte(encodedSeed+"\n"), 0600); err != nil {
+		return fmt.Errorf("unable to write server identity key: %w", err)
+	}
+
+	fmt.Printf("Generated new server identity key in %s\n", path)
+	serverKey = privateKey
+	return nil
+}
+
+// SetServerIdentity replaces the server identity key
+//
+// Parameters:
+//   - key: The ed25519 private key to use
+func SetServerIdentity(key ed25519.PrivateKey) {
+	serverKey = key
+}
+
+// ServerPublicKey returns the public part of the server identity key, or nil if it is not loaded
+//
+// Returns:
+//   - ed25519.PublicKey: The server's public key
+func ServerPublicKey() ed25519.PublicKey {
+	if serverKey == nil {
+		return nil
+	}
+	return serverKey.Public().(ed25519.PublicKey)
+}
+
+// SignWithServerIdentity signs a message, such as an encoded challenge payload, with the server identity key
+//
+// Parameters:
+//   - message: The message to sign
+//
+// Returns:
+//   - []byte: The ed25519 signature
+//   - error: An error if the server identity key has not been loaded
+func SignWithServerIdentity(message []byte) ([]byte, error) {
+	if serverKey == nil {
+		return nil, errors.New("server identity key is not loaded")
+	}
+	return ed25519.Sign(serverKey, message), nil
+}
@@ -0,0 +1,408 @@
+package session_util
+
+import (
+	"bytes"
+	"chalmers/tkey-group22/application/internal"
+	"chalmers/tkey-group22/application/internal/jws"
+	"context"
+	"crypto/subtle"
+	"encoding/gob"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Scopes a bearer token can be issued with
+// A route only accepts bearer tokens with the scope it was registered with in AllowBearer
+const (
+	ScopeNotes   = "notes"   // Reading and writing the user's notes
+	ScopeAccount = "account" // Reading the user's account, keys and sessions
+)
+
+var validScopes = map[string]bool{
+	ScopeNotes:   true,
+	ScopeAccount: true,
+}
+
+// AccessTokenLifetime is how long an access token can be used before it must be refreshed
+var AccessTokenLifetime = 5 * time.Minute
+
+// SessionTypeToken is the type of the session behind a pair of bearer tokens
+// The refresh token is kept on the server like a browser session, so it is listed and revoked together with them,
+// and ends when the key it was issued with is removed or the account is deleted.
+const SessionTypeToken = "token"
+
+// accessTokenType and accessTokenAudience tell access tokens apart from any other token signed by the server
+const (
+	accessTokenType     = "at+jwt"
+	accessTokenAudience = "tkey-passwordless-authentication api"
+)
+
+// ErrInvalidToken is returned when a bearer token is malformed, expired or revoked
+var ErrInvalidToken = errors.New("invalid or expired token")
+
+// ErrInvalidScope is returned when tokens are requested with an unknown scope
+var ErrInvalidScope = errors.New("invalid scope")
+
+// errTokenSessionChanged is returned by issueTokenPair when the session was refreshed by another request in the meantime
+var errTokenSessionChanged = errors.New("token session was changed by another request")
+
+// maxPreviousRefreshTokens is how many earlier refresh tokens of a session are remembered to recognize their reuse
+// A session refreshed every AccessTokenLifetime stays well below it within the default absolute lifetime.
+const maxPreviousRefreshTokens = 200
+
+// refreshTokenState is what a presented refresh token is to the session it names
+type refreshTokenState int
+
+const (
+	refreshTokenUnknown refreshTokenState = iota // Never issued for the session, e.g. guessed
+	refreshTokenCurrent                          // The token the session can be refreshed with
+	refreshTokenReused                           // Issued for the session earlier and already used
+)
+
+// AccessTokenClaims are the claims of an access token
+type AccessTokenClaims struct {
+	Audience  string `json:"aud"`
+	Subject   string `json:"sub"`       // User the token was issued to
+	SessionID string `json:"sid"`       // ID of the session the token belongs to, revoking it revokes the token; the refresh token cannot be derived from it
+	Scope     string `json:"scope"`     // Space separated scopes
+	AuthTime  int64  `json:"auth_time"` // When the user touched the TKey
+	ExpiresAt int64  `json:"exp"`
+	IssuedAt  int64  `json:"iat"`
+}
+
+// TokenPair is an access token together with the refresh token used to get a new one
+type TokenPair struct {
+	AccessToken  string
+	RefreshToken string
+	ExpiresIn    int
+	Scope        string
+}
+
+// bearerContextKey is the key of the bearer authentication in the context of a request
+type bearerContextKey struct{}
+
+// bearerAuth is what SessionMiddleware learned from the bearer token of a request
+type bearerAuth struct {
+	claims *AccessTokenClaims
+	record *SessionRecord
+}
+
+// ParseScope checks a requested space separated list of scopes
+// No scope gives all scopes.
+//
+// Parameters:
+//   - scope: The requested scopes, e.g. "notes account"
+//
+// Returns:
+//   - string: The scopes in a normalized form
+//   - error: ErrInvalidScope if a scope is unknown
+func ParseScope(scope string) (string, error) {
+	requested := strings.Fields(scope)
+	if len(requested) == 0 {
+		return ScopeNotes + " " + ScopeAccount, nil
+	}
+	for _, name := range requested {
+		if !validScopes[name] {
+			return "", ErrInvalidScope
+		}
+	}
+	return strings.Join(requested, " "), nil
+}
+
+// IssueTokens creates a token session for the user and returns its first pair of tokens
+// The tokens can be refreshed until the absolute lifetime of the session policy has passed,
+// after which the user must touch the TKey again.
+//
+// Parameters:
+//   - r: *http.Request the tokens are issued for, to record the device and IP address.
+//   - username: string representing the user who logged in.
+//   - keyLabel: string representing the label of the key the user logged in with.
+//   - scope: string representing the requested scopes, see ParseScope.
+//
+// Returns:
+//   - *TokenPair: the access and refresh token.
+//   - error: ErrInvalidScope if a scope is unknown, or an error if the session cannot be stored or the token signed.
+func IssueTokens(r *http.Request, username string, keyLabel string, scope string) (*TokenPair, error) {
+	scope, err := ParseScope(scope)
+	if err != nil {
+		return nil, err
+	}
+
+	sessionToken, err := newSessionToken()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	record := &SessionRecord{
+		ID:        hashSessionToken(sessionToken),
+		Type:      SessionTypeToken,
+		Username:  username,
+		KeyLabel:  keyLabel,
+		UserAgent: r.UserAgent(),
+		IP:        ClientIP(r),
+		CreatedAt: now,
+		LastSeen:  now,
+		ExpiresAt: Policy.expiresAt(now),
+	}
+	values := map[interface{}]interface{}{
+		"authenticatedAt": now.Unix(),
+		"scope":           scope,
+	}
+
+	return issueTokenPair(r.Context(), record, values, sessionToken, nil)
+}
+
+// RefreshTokens exchanges a refresh token for a new pair of tokens
+// Every refresh token can only be used once. Using an earlier refresh token of the session again means it was copied,
+// so the session is revoked and neither the thief nor the user can use it any longer.
+// A token that was never issued is only refused, so guessing cannot be used to end someone else's session.
+//
+// Parameters:
+//   - r: *http.Request the tokens are refreshed with, to record the device and IP address.
+//   - refreshToken: string representing the refresh token.
+//
+// Returns:
+//   - *TokenPair: the new access and refresh token.
+//   - error: ErrInvalidToken if the refresh token is not valid, or an error if the session cannot be stored.
+func RefreshTokens(r *http.Request, refreshToken string) (*TokenPair, error) {
+	record, values, handle, err := loadTokenSession(r.Context(), refreshToken)
+	if err != nil {
+		return nil, err
+	}
+
+	switch checkRefreshToken(values, refreshToken) {
+	case refreshTokenUnknown:
+		return nil, ErrInvalidToken
+	case refreshTokenReused:
+		Store.Backend.Delete(r.Context(), record.ID)
+		return nil, ErrInvalidToken
+	}
+
+	// The current token becomes an earlier one, the oldest earlier tokens are forgotten
+	previousHashes, _ := values["previousRefreshHashes"].([]string)
+	previousHashes = append(previousHashes, values["refreshHash"].(string))
+	if len(previousHashes) > maxPreviousRefreshTokens {
+		previousHashes = previousHashes[len(previousHashes)-maxPreviousRefreshTokens:]
+	}
+	values["previousRefreshHashes"] = previousHashes
+
+	record.UserAgent = r.UserAgent()
+	record.IP = ClientIP(r)
+	record.LastSeen = time.Now()
+	tokens, err := issueTokenPair(r.Context(), record, values, handle, record.Data)
+	if err == errTokenSessionChanged {
+		// Another request refreshed with the same token first, so the token was used twice
+		Store.Backend.Delete(r.Context(), record.ID)
+		return nil, ErrInvalidToken
+	}
+	return tokens, err
+}
+
+// RevokeToken ends the token session of a refresh token, so neither it nor its access tokens can be used again
+// Earlier refresh tokens of the session revoke it as well, since using them again means they were copied.
+//
+// Parameters:
+//   - ctx: the context of the request.
+//   - refreshToken: string representing the refresh token.
+//
+// Returns:
+//   - error: ErrInvalidToken if the refresh token was not issued for a session, or an error if it cannot be removed.
+func RevokeToken(ctx context.Context, refreshToken string) error {
+	record, values, _, err := loadTokenSession(ctx, refreshToken)
+	if err != nil {
+		return err
+	}
+	if checkRefreshToken(values, refreshToken) == refreshTokenUnknown {
+		return ErrInvalidToken
+	}
+	return Store.Backend.Delete(ctx, record.ID)
+}
+
+// AllowBearer lets a route be used with a bearer token that has the given scope
+// Routes that are not wrapped in AllowBearer only accept the session cookie.
+// It must wrap SessionMiddleware, e.g. AllowBearer(ScopeNotes, SessionMiddleware(handler)).
+//
+// Parameters:
+//   - scope: The scope the token must have.
+//   - next: The handler of the route.
+//
+// Returns:
+//   - http.Handler: A handler that marks the request as accepting bearer tokens.
+func AllowBearer(scope string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), allowBearerContextKey{}, scope)))
+	})
+}
+
+// allowBearerContextKey is the key of the scope set by AllowBearer in the context of a request
+type allowBearerContextKey struct{}
+
+// bearerToken returns the bearer token in the Authorization header of the request, if there is one
+func bearerToken(r *http.Request) (string, bool) {
+	token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return strings.TrimSpace(token), found
+}
+
+// authenticateBearer verifies the access token of a request for a route that accepts bearer tokens with the given scope
+//
+// Returns:
+//   - *bearerAuth: the verified token and its session.
+//   - error: ErrInvalidToken if the token is not valid, ErrInvalidScope if it does not have the scope,
+//     or an error if the session cannot be read.
+func authenticateBearer(ctx context.Context, token string, scope string) (*bearerAuth, error) {
+	var claims AccessTokenClaims
+	header, err := jws.Verify(token, internal.ServerPublicKey(), &claims)
+	if err != nil || header.Type != accessTokenType || claims.Audience != accessTokenAudience {
+		return nil, ErrInvalidToken
+	}
+	if time.Now().Unix() >= claims.ExpiresAt {
+		return nil, ErrInvalidToken
+	}
+
+	// The token is only valid as long as its session has not been revoked
+	record, err := Store.Backend.Load(ctx, claims.SessionID)
+	if err == ErrSessionNotFound {
+		return nil, ErrInvalidToken
+	}
+	if err != nil {
+		return nil, err
+	}
+	if record.Type != SessionTypeToken || record.Username != claims.Subject {
+		return nil, ErrInvalidToken
+	}
+
+	if !hasScope(claims.Scope, scope) {
+		return nil, ErrInvalidScope
+	}
+
+	if time.Since(record.LastSeen) > lastSeenInterval {
+		Store.Backend.Touch(ctx, record.ID, time.Now())
+	}
+
+	return &bearerAuth{claims: &claims, record: record}, nil
+}
+
+// getBearerAuth returns the bearer authentication of a request that SessionMiddleware authenticated with a token
+func getBearerAuth(r *http.Request) *bearerAuth {
+	auth, _ := r.Context().Value(bearerContextKey{}).(*bearerAuth)
+	return auth
+}
+
+// issueTokenPair gives a token session a new refresh token and signs a new access token for it
+// A new session is stored when previousData is nil. Otherwise the session is only stored if its data is still
+// previousData, and errTokenSessionChanged is returned if it is not.
+func issueTokenPair(ctx context.Context, record *SessionRecord, values map[interface{}]interface{}, handle string, previousData []byte) (*TokenPair, error) {
+	secret, err := newSessionToken()
+	if err != nil {
+		return nil, err
+	}
+	// The session is found by the handle, whose hash is the session ID, while only the hash of the whole token is stored
+	refreshToken := handle + "." + secret
+	values["refreshHash"] = hashSessionToken(refreshToken)
+
+	var data bytes.Buffer
+	if err := gob.NewEncoder(&data).Encode(values); err != nil {
+		return nil, err
+	}
+	record.Data = data.Bytes()
+	if previousData == nil {
+		if err := Store.Backend.Save(ctx, record); err != nil {
+			return nil, err
+		}
+	} else {
+		replaced, err := Store.Backend.Replace(ctx, record, previousData)
+		if err != nil {
+			return nil, err
+		}
+		if !replaced {
+			return nil, errTokenSessionChanged
+		}
+	}
+
+	scope, _ := values["scope"].(string)
+	authenticatedAt, _ := values["authenticatedAt"].(int64)
+	now := time.Now()
+	claims := AccessTokenClaims{
+		Audience:  accessTokenAudience,
+		Subject:   record.Username,
+		SessionID: record.ID,
+		Scope:     scope,
+		AuthTime:  authenticatedAt,
+		ExpiresAt: now.Add(AccessTokenLifetime).Unix(),
+		IssuedAt:  now.Unix(),
+	}
+	header := jws.Header{Type: accessTokenType, KeyID: jws.KeyID(internal.ServerPublicKey())}
+	accessToken, err := jws.Sign(header, claims, internal.SignWithServerIdentity)
+	if err != nil {
+		return nil, err
+	}
+
+	return &TokenPair{
+		AccessToken:  accessToken,
+		RefreshToken: refreshToken,
+		ExpiresIn:    int(AccessTokenLifetime.Seconds()),
+		Scope:        scope,
+	}, nil
+}
+
+// loadTokenSession returns the token session a refresh token belongs to, and the handle it is found by,
+// whether or not the token is one that was issued for the session
+func loadTokenSession(ctx context.Context, refreshToken string) (*SessionRecord, map[interface{}]interface{}, string, error) {
+	handle, _, found := strings.Cut(refreshToken, ".")
+	if !found {
+		return nil, nil, "", ErrInvalidToken
+	}
+
+	record, err := Store.Backend.Load(ctx, hashSessionToken(handle))
+	if err == ErrSessionNotFound {
+		return nil, nil, "", ErrInvalidToken
+	}
+	if err != nil {
+		return nil, nil, "", err
+	}
+	if record.Type != SessionTypeToken {
+		return nil, nil, "", ErrInvalidToken
+	}
+
+	values := map[interface{}]interface{}{}
+	if err := gob.NewDecoder(bytes.NewReader(record.Data)).Decode(&values); err != nil {
+		return nil, nil, "", ErrInvalidToken
+	}
+	return record, values, handle, nil
+}
+
+// checkRefreshToken compares a refresh token with the current and earlier refresh tokens of its session
+// Every stored hash is compared in constant time.
+func checkRefreshToken(values map[interface{}]interface{}, refreshToken string) refreshTokenState {
+	hash := []byte(hashSessionToken(refreshToken))
+
+	currentHash, _ := values["refreshHash"].(string)
+	if subtle.ConstantTimeCompare([]byte(currentHash), hash) == 1 {
+		return refreshTokenCurrent
+	}
+
+	reused := false
+	previousHashes, _ := values["previousRefreshHashes"].([]string)
+	for _, previousHash := range previousHashes {
+		if subtle.ConstantTimeCompare([]byte(previousHash), hash) == 1 {
+			reused = true
+		}
+	}
+	if reused {
+		return refreshTokenReused
+	}
+	return refreshTokenUnknown
+}
+
+// hasScope reports whether a space separated list of scopes contains the scope
+func hasScope(scopes string, scope string) bool {
+	for _, granted := range strings.Fields(scopes) {
+		if granted == scope {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,36 @@
+package session_util
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// TrustProxyHeaders makes ClientIP use the address a reverse proxy appended to the X-Forwarded-For header
+// It must only be enabled when the backend cannot be reached without going through exactly one proxy,
+// since the header is otherwise set by the client
+var TrustProxyHeaders = false
+
+// ClientIP returns the IP address of the client that made the request
+//
+// Parameters:
+//   - r: *http.Request to get the address from.
+//
+// Returns:
+//   - string: the IP address of the client.
+func ClientIP(r *http.Request) string {
+	if TrustProxyHeaders {
+		if forwardedFor := r.Header.Get("X-Forwarded-For"); forwardedFor != "" {
+			// The proxy appends the address it received the request from to whatever the client sent,
+			// so only the last address can be trusted
+			addresses := strings.Split(forwardedFor, ",")
+			return strings.TrimSpace(addresses[len(addresses)-1])
+		}
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
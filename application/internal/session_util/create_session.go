@@ -3,37 +3,41 @@ package session_util
 import (
 	"fmt"
 	"net/http"
-
-	"github.com/gorilla/sessions"
+	"time"
 )
 
 // SetSession creates a new session for the given username and saves it in the session store.
-// It sets various session options such as path, max age, HttpOnly, Secure, and SameSite mode.
+// The session lasts for the idle timeout of the session policy, which SessionMiddleware extends while the session is used,
+// but at most for the absolute lifetime of the policy. The cookie flags are also taken from the policy.
 //
 // Parameters:
 //   - w: http.ResponseWriter to write the session cookie to the response.
 //   - r: *http.Request to get the session from the request.
 //   - username: string representing the username to be stored in the session.
+//   - keyLabel: string representing the label of the public key the user authenticated with.
 //
 // Returns:
 //   - error: an error if there is an issue getting or saving the session, otherwise nil.
 
-func SetSession(w http.ResponseWriter, r *http.Request, username string) error {
+func SetSession(w http.ResponseWriter, r *http.Request, username string, keyLabel string) error {
 	session, err := Store.Get(r, "session-name")
 	if err != nil {
 		fmt.Println("Error getting session:", err)
 		return err
 	}
 
+	// A session token from before the login cannot be used after it
+	if err := Store.Renew(r.Context(), session); err != nil {
+		fmt.Println("Error renewing session:", err)
+		return err
+	}
+
 	session.Values["username"] = username
+	session.Values["keyLabel"] = keyLabel
+	session.Values["authenticatedAt"] = time.Now().Unix()
+	session.Values["refreshedAt"] = time.Now().Unix()
 
-	session.Options = &sessions.Options{
-		Path:     "/",
-		MaxAge:   3600,
-		HttpOnly: true,
-		Secure:   false,
-		SameSite: http.SameSiteLaxMode,
-	}
+	session.Options = Policy.cookieOptions(Policy.IdleTimeout)
 
 	if err := session.Save(r, w); err != nil {
 		fmt.Println("Error saving session:", err)
@@ -42,3 +46,23 @@ func SetSession(w http.ResponseWriter, r *http.Request, username string) error {
 
 	return nil
 }
+
+// UpdateSessionKeyLabel replaces the label of the key stored in the session, e.g. after the key was renamed.
+// The other session values and options are kept.
+//
+// Parameters:
+//   - w: http.ResponseWriter to write the session cookie to the response.
+//   - r: *http.Request to get the session from the request.
+//   - keyLabel: string representing the new label of the key the user authenticated with.
+//
+// Returns:
+//   - error: an error if there is an issue getting or saving the session, otherwise nil.
+func UpdateSessionKeyLabel(w http.ResponseWriter, r *http.Request, keyLabel string) error {
+	session, err := Store.Get(r, "session-name")
+	if err != nil {
+		return err
+	}
+
+	session.Values["keyLabel"] = keyLabel
+	return session.Save(r, w)
+}
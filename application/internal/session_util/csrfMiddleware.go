@@ -2,24 +2,111 @@ package session_util
 
 import (
 	"net/http"
-	"os"
 
 	"github.com/gorilla/csrf"
+	"github.com/gorilla/securecookie"
 )
 
+// csrfCookieName is the name of the cookie holding the CSRF token
+const csrfCookieName = "_gorilla_csrf"
+
+// csrfMaxAge is how long the CSRF cookie lasts in seconds, the default of gorilla/csrf
+const csrfMaxAge = 12 * 60 * 60
+
 var CsrfMiddleware func(http.Handler) http.Handler
 
-func InitCSRF() {
-	csrfKey := os.Getenv("CSRF_KEY")
-	if csrfKey == "" {
-		panic("CSRF_KEY is not set")
+// InitCSRF creates the CSRF middleware
+// The CSRF cookie is signed with the keys in CSRF_KEYS, or with CSRF_KEY if only one key is used.
+// See LoadSecretKeys for how the keys are rotated.
+//
+// Returns:
+//   - error: An error if no CSRF key is set or a key is too weak
+func InitCSRF() error {
+	keys, err := LoadSecretKeys("CSRF_KEYS", "CSRF_KEY")
+	if err != nil {
+		return err
 	}
 
-	CsrfMiddleware = csrf.Protect(
-		[]byte(csrfKey),
+	protect := csrf.Protect(
+		keys[0],
 		csrf.Secure(true),
 		csrf.Path("/"),
 		csrf.HttpOnly(true),
 		csrf.SameSite(csrf.SameSiteLaxMode),
+		csrf.CookieName(csrfCookieName),
+		csrf.MaxAge(csrfMaxAge),
 	)
+	resign := resignCSRFCookie(keys)
+
+	CsrfMiddleware = func(next http.Handler) http.Handler {
+		return resign(protect(next))
+	}
+	return nil
+}
+
+// resignCSRFCookie returns a middleware that signs a CSRF cookie signed with a previous key again with the current key
+// gorilla/csrf only accepts a single key, so without it every CSRF token would stop working when the key is rotated.
+// The token in the cookie is kept, so tokens the client already received stay valid.
+//
+// Parameters:
+//   - keys: The CSRF keys, the current key first
+//
+// Returns:
+//   - func(http.Handler) http.Handler: The middleware
+func resignCSRFCookie(keys [][]byte) func(http.Handler) http.Handler {
+	codecs := make([]*securecookie.SecureCookie, len(keys))
+	for i, key := range keys {
+		// The same encoding as gorilla/csrf uses for its cookie
+		codecs[i] = securecookie.New(key, nil)
+		codecs[i].SetSerializer(securecookie.JSONEncoder{})
+		codecs[i].MaxAge(csrfMaxAge)
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			cookie, err := r.Cookie(csrfCookieName)
+			if err != nil || len(codecs) == 1 {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			var token []byte
+			if codecs[0].Decode(csrfCookieName, cookie.Value, &token) == nil {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			for _, previous := range codecs[1:] {
+				if previous.Decode(csrfCookieName, cookie.Value, &token) != nil {
+					continue
+				}
+				encoded, err := codecs[0].Encode(csrfCookieName, token)
+				if err != nil {
+					break
+				}
+
+				// Replace the cookie of the request and make the client store the newly signed cookie
+				cookies := r.Cookies()
+				r.Header.Del("Cookie")
+				for _, c := range cookies {
+					if c.Name == csrfCookieName {
+						c.Value = encoded
+					}
+					r.AddCookie(c)
+				}
+				http.SetCookie(w, &http.Cookie{
+					Name:     csrfCookieName,
+					Value:    encoded,
+					Path:     "/",
+					MaxAge:   csrfMaxAge,
+					Secure:   true,
+					HttpOnly: true,
+					SameSite: http.SameSiteLaxMode,
+				})
+				break
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
 }
@@ -3,10 +3,16 @@ package session_util
 import (
 	"fmt"
 	"net/http"
+	"time"
 )
 
 // Get the username field from the session
+// For a request authenticated with a bearer token it is the user the token was issued to
 func GetSessionUsername(r *http.Request) (string, error) {
+	if auth := getBearerAuth(r); auth != nil {
+		return auth.claims.Subject, nil
+	}
+
 	session, _ := Store.Get(r, "session-name")
 	username, ok := session.Values["username"].(string)
 	if !ok {
@@ -15,3 +21,31 @@ func GetSessionUsername(r *http.Request) (string, error) {
 		return username, nil
 	}
 }
+
+// Get the label of the public key the session was authenticated with
+func GetSessionKeyLabel(r *http.Request) (string, error) {
+	if auth := getBearerAuth(r); auth != nil {
+		return auth.record.KeyLabel, nil
+	}
+
+	session, _ := Store.Get(r, "session-name")
+	keyLabel, ok := session.Values["keyLabel"].(string)
+	if !ok {
+		return "", fmt.Errorf("key label not found in session")
+	}
+	return keyLabel, nil
+}
+
+// Get the time the session was authenticated
+func GetSessionAuthenticatedAt(r *http.Request) (time.Time, error) {
+	if auth := getBearerAuth(r); auth != nil {
+		return time.Unix(auth.claims.AuthTime, 0), nil
+	}
+
+	session, _ := Store.Get(r, "session-name")
+	authenticatedAt, ok := session.Values["authenticatedAt"].(int64)
+	if !ok {
+		return time.Time{}, fmt.Errorf("authentication time not found in session")
+	}
+	return time.Unix(authenticatedAt, 0), nil
+}
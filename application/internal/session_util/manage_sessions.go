@@ -0,0 +1,124 @@
+package session_util
+
+import (
+	"context"
+	"net/http"
+)
+
+// GetSessionID returns the ID the session of the request is stored under
+// For a request authenticated with a bearer token it is the ID of the token session.
+//
+// Parameters:
+//   - r: *http.Request to get the session from.
+//
+// Returns:
+//   - string: the ID of the session, or an empty string if the session has not been saved.
+func GetSessionID(r *http.Request) string {
+	if auth := getBearerAuth(r); auth != nil {
+		return auth.record.ID
+	}
+
+	session, _ := Store.Get(r, "session-name")
+	if session.ID == "" {
+		return ""
+	}
+	return hashSessionToken(session.ID)
+}
+
+// ListSessions returns the active sessions of the given user
+//
+// Parameters:
+//   - ctx: the context of the request.
+//   - username: string representing the user to list the sessions of.
+//
+// Returns:
+//   - []SessionRecord: the sessions of the user, most recently used first.
+//   - error: an error if the sessions cannot be read.
+func ListSessions(ctx context.Context, username string) ([]SessionRecord, error) {
+	return Store.Backend.ListForUser(ctx, username)
+}
+
+// RevokeSession ends a session of the given user, so that its cookie can no longer be used
+//
+// Parameters:
+//   - ctx: the context of the request.
+//   - username: string representing the user the session must belong to.
+//   - id: string representing the ID of the session.
+//
+// Returns:
+//   - bool: true if the session was found and revoked, false if the user has no such session.
+//   - error: an error if the session cannot be read or removed.
+func RevokeSession(ctx context.Context, username string, id string) (bool, error) {
+	record, err := Store.Backend.Load(ctx, id)
+	if err == ErrSessionNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	if record.Username != username {
+		return false, nil
+	}
+
+	return true, Store.Backend.Delete(ctx, id)
+}
+
+// RevokeOtherSessions ends all sessions of the given user except the one of the request
+//
+// Parameters:
+//   - r: *http.Request to get the session to keep from.
+//   - username: string representing the user to revoke the sessions of.
+//
+// Returns:
+//   - int: the number of sessions that were revoked.
+//   - error: an error if the sessions cannot be removed.
+func RevokeOtherSessions(r *http.Request, username string) (int, error) {
+	return Store.Backend.DeleteForUser(r.Context(), username, GetSessionID(r))
+}
+
+// RevokeUserSessions ends every session of the given user on all devices, e.g. when the account is deleted
+// The sessions are revoked even if the client goes away, since the change that requires it has already been made.
+//
+// Parameters:
+//   - ctx: the context of the request.
+//   - username: string representing the user to revoke the sessions of.
+//
+// Returns:
+//   - int: the number of sessions that were revoked.
+//   - error: an error if the sessions cannot be removed.
+func RevokeUserSessions(ctx context.Context, username string) (int, error) {
+	return Store.Backend.DeleteForUser(context.WithoutCancel(ctx), username, "")
+}
+
+// RevokeKeySessions ends every session of the given user that was authenticated with the given key,
+// e.g. when the key is removed or suspended
+// The sessions are revoked even if the client goes away, since the key has already been changed.
+//
+// Parameters:
+//   - ctx: the context of the request.
+//   - username: string representing the user the key belongs to.
+//   - keyLabel: string representing the label of the key.
+//
+// Returns:
+//   - int: the number of sessions that were revoked.
+//   - error: an error if the sessions cannot be removed.
+func RevokeKeySessions(ctx context.Context, username string, keyLabel string) (int, error) {
+	return Store.Backend.DeleteForKey(context.WithoutCancel(ctx), username, keyLabel)
+}
+
+// RenameSessionKey updates the sessions that were authenticated with a key after the key was renamed,
+// so that they are still revoked together with the key
+// The sessions are updated even if the client goes away, since the key has already been renamed.
+//
+// Parameters:
+//   - ctx: the context of the request.
+//   - username: string representing the user the key belongs to.
+//   - keyLabel: string representing the old label of the key.
+//   - newKeyLabel: string representing the new label of the key.
+//
+// Returns:
+//   - error: an error if the sessions cannot be updated.
+func RenameSessionKey(ctx context.Context, username string, keyLabel string, newKeyLabel string) error {
+	return Store.Backend.RelabelKey(context.WithoutCancel(ctx), username, keyLabel, newKeyLabel)
+}
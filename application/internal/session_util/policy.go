@@ -0,0 +1,142 @@
+package session_util
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gorilla/sessions"
+)
+
+// SessionPolicy decides how long sessions last and how the session cookie is protected
+type SessionPolicy struct {
+	IdleTimeout      time.Duration // A session ends when it has not been used for this long
+	AbsoluteLifetime time.Duration // A session ends this long after the user touched the TKey, however much it is used
+	Secure           bool          // Only send the session cookie over HTTPS
+	SameSite         http.SameSite // SameSite mode of the session cookie
+}
+
+// Policy is the session policy in use, see LoadSessionPolicy
+var Policy = DefaultSessionPolicy()
+
+// refreshInterval is how often SessionMiddleware extends the idle timeout of a session that is in use
+const refreshInterval = time.Minute
+
+// DefaultSessionPolicy returns the policy used when nothing is configured
+// It is suitable for development over plain HTTP.
+//
+// Returns:
+//   - SessionPolicy: the default policy.
+func DefaultSessionPolicy() SessionPolicy {
+	return SessionPolicy{
+		IdleTimeout:      time.Hour,
+		AbsoluteLifetime: 12 * time.Hour,
+		Secure:           false,
+		SameSite:         http.SameSiteLaxMode,
+	}
+}
+
+// LoadSessionPolicy reads the session policy from the environment
+// Durations are given in the format of time.ParseDuration, e.g. "30m".
+// The cookie is Secure by default when APP_ENV is "production".
+//
+//   - SESSION_IDLE_TIMEOUT: how long an unused session lasts
+//   - SESSION_ABSOLUTE_LIFETIME: how long a session lasts at most
+//   - SESSION_COOKIE_SECURE: "true" or "false"
+//   - SESSION_COOKIE_SAMESITE: "lax", "strict" or "none"
+//
+// Returns:
+//   - SessionPolicy: the configured policy.
+//   - error: an error if a setting is invalid.
+func LoadSessionPolicy() (SessionPolicy, error) {
+	policy := DefaultSessionPolicy()
+	policy.Secure = os.Getenv("APP_ENV") == "production"
+
+	if value := os.Getenv("SESSION_IDLE_TIMEOUT"); value != "" {
+		idleTimeout, err := time.ParseDuration(value)
+		if err != nil || idleTimeout <= 0 {
+			return policy, fmt.Errorf("invalid SESSION_IDLE_TIMEOUT: %s", value)
+		}
+		policy.IdleTimeout = idleTimeout
+	}
+
+	if value := os.Getenv("SESSION_ABSOLUTE_LIFETIME"); value != "" {
+		absoluteLifetime, err := time.ParseDuration(value)
+		if err != nil || absoluteLifetime <= 0 {
+			return policy, fmt.Errorf("invalid SESSION_ABSOLUTE_LIFETIME: %s", value)
+		}
+		policy.AbsoluteLifetime = absoluteLifetime
+	}
+
+	if policy.AbsoluteLifetime < policy.IdleTimeout {
+		return policy, fmt.Errorf("SESSION_ABSOLUTE_LIFETIME cannot be shorter than SESSION_IDLE_TIMEOUT")
+	}
+
+	switch value := os.Getenv("SESSION_COOKIE_SECURE"); value {
+	case "":
+	case "true":
+		policy.Secure = true
+	case "false":
+		policy.Secure = false
+	default:
+		return policy, fmt.Errorf("invalid SESSION_COOKIE_SECURE: %s", value)
+	}
+
+	switch value := strings.ToLower(os.Getenv("SESSION_COOKIE_SAMESITE")); value {
+	case "", "lax":
+		policy.SameSite = http.SameSiteLaxMode
+	case "strict":
+		policy.SameSite = http.SameSiteStrictMode
+	case "none":
+		policy.SameSite = http.SameSiteNoneMode
+	default:
+		return policy, fmt.Errorf("invalid SESSION_COOKIE_SAMESITE: %s", value)
+	}
+
+	// Browsers reject SameSite=None cookies that are not Secure
+	if policy.SameSite == http.SameSiteNoneMode && !policy.Secure {
+		return policy, fmt.Errorf("SESSION_COOKIE_SAMESITE=none requires SESSION_COOKIE_SECURE=true")
+	}
+
+	return policy, nil
+}
+
+// cookieOptions returns the options of a session cookie that lasts for maxAge
+func (policy SessionPolicy) cookieOptions(maxAge time.Duration) *sessions.Options {
+	return &sessions.Options{
+		Path:     "/",
+		MaxAge:   int(maxAge.Seconds()),
+		HttpOnly: true,
+		Secure:   policy.Secure,
+		SameSite: policy.SameSite,
+	}
+}
+
+// expiresAt returns when a session authenticated at the given time must end, however much it is used
+func (policy SessionPolicy) expiresAt(authenticatedAt time.Time) time.Time {
+	return authenticatedAt.Add(policy.AbsoluteLifetime)
+}
+
+// sessionExpired reports whether the session has passed the absolute lifetime of the policy
+func sessionExpired(session *sessions.Session) bool {
+	authenticatedAt, ok := session.Values["authenticatedAt"].(int64)
+	if !ok {
+		return false
+	}
+	return time.Now().After(Policy.expiresAt(time.Unix(authenticatedAt, 0)))
+}
+
+// refreshSession extends the idle timeout of a session that is in use
+// To avoid a write on every request the session is saved at most once per refreshInterval.
+func refreshSession(w http.ResponseWriter, r *http.Request, session *sessions.Session) error {
+	refreshedAt, _ := session.Values["refreshedAt"].(int64)
+	if time.Since(time.Unix(refreshedAt, 0)) < refreshInterval {
+		return nil
+	}
+
+	session.Values["refreshedAt"] = time.Now().Unix()
+	session.Options = Policy.cookieOptions(Policy.IdleTimeout)
+	return session.Save(r, w)
+}
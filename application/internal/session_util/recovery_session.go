@@ -0,0 +1,87 @@
+package session_util
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// RecoveryValidDuration is how long a user that logged in with a recovery code has to enroll a new key
+var RecoveryValidDuration = time.Duration(10) * time.Minute
+
+// SetRecoverySession starts a recovery session for the given username after a recovery code was used.
+// A recovery session does not authenticate the user, it only allows a new key to be enrolled within
+// RecoveryValidDuration. Any values of a previous session are removed.
+//
+// Parameters:
+//   - w: http.ResponseWriter to write the session cookie to the response.
+//   - r: *http.Request to get the session from the request.
+//   - username: string representing the user that is recovering their account.
+//
+// Returns:
+//   - error: an error if there is an issue getting or saving the session, otherwise nil.
+func SetRecoverySession(w http.ResponseWriter, r *http.Request, username string) error {
+	session, err := Store.Get(r, "session-name")
+	if err != nil {
+		return err
+	}
+
+	if err := Store.Renew(r.Context(), session); err != nil {
+		return err
+	}
+	for key := range session.Values {
+		delete(session.Values, key)
+	}
+	session.Values["recoveryUsername"] = username
+	session.Values["recoveryAt"] = time.Now().Unix()
+
+	session.Options = Policy.cookieOptions(RecoveryValidDuration)
+
+	return session.Save(r, w)
+}
+
+// GetRecoveryUsername returns the user of the recovery session, if the session is one and has not expired
+//
+// Parameters:
+//   - r: *http.Request to get the session from the request.
+//
+// Returns:
+//   - string: the username of the user that is recovering their account.
+//   - error: an error if there is no recovery session or it has expired.
+func GetRecoveryUsername(r *http.Request) (string, error) {
+	session, _ := Store.Get(r, "session-name")
+
+	username, ok := session.Values["recoveryUsername"].(string)
+	if !ok || username == "" {
+		return "", fmt.Errorf("no recovery in progress")
+	}
+
+	recoveryAt, ok := session.Values["recoveryAt"].(int64)
+	if !ok || time.Since(time.Unix(recoveryAt, 0)) > RecoveryValidDuration {
+		return "", fmt.Errorf("recovery has expired")
+	}
+
+	return username, nil
+}
+
+// CompleteRecovery turns the recovery session into a regular session once a new key has been enrolled
+//
+// Parameters:
+//   - w: http.ResponseWriter to write the session cookie to the response.
+//   - r: *http.Request to get the session from the request.
+//   - username: string representing the user that recovered their account.
+//   - keyLabel: string representing the label of the newly enrolled key.
+//
+// Returns:
+//   - error: an error if there is an issue getting or saving the session, otherwise nil.
+func CompleteRecovery(w http.ResponseWriter, r *http.Request, username string, keyLabel string) error {
+	session, err := Store.Get(r, "session-name")
+	if err != nil {
+		return err
+	}
+
+	delete(session.Values, "recoveryUsername")
+	delete(session.Values, "recoveryAt")
+
+	return SetSession(w, r, username, keyLabel)
+}
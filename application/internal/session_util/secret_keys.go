@@ -0,0 +1,83 @@
+package session_util
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// MinSecretKeyLength is the minimum length in bytes of a session or CSRF key
+const MinSecretKeyLength = 32
+
+// minSecretKeyVariety is the minimum number of different bytes in a session or CSRF key
+// It refuses keys such as a repeated character, which are long enough but easy to guess
+const minSecretKeyVariety = 8
+
+// LoadSecretKeys reads the keys used to sign cookies from the environment
+// The list variable holds comma separated keys, the current key first followed by previous keys.
+// New cookies are signed with the current key while cookies signed with a previous key are still accepted,
+// so a key can be rotated by putting a new key first and removing the oldest one later.
+// If the list variable is not set, the single key variable is used instead.
+//
+// Parameters:
+//   - listName: The name of the variable holding the list of keys, e.g. "SESSION_KEYS"
+//   - singleName: The name of the variable holding a single key, e.g. "SESSION_KEY"
+//
+// Returns:
+//   - [][]byte: The keys, the current key first
+//   - error: An error if no key is set or a key is too weak
+func LoadSecretKeys(listName string, singleName string) ([][]byte, error) {
+	name := listName
+	value := os.Getenv(listName)
+	if value == "" {
+		name = singleName
+		value = os.Getenv(singleName)
+	}
+	if strings.TrimSpace(value) == "" {
+		return nil, fmt.Errorf("%s is not set in the environment", listName)
+	}
+
+	keys := [][]byte{}
+	for i, key := range strings.Split(value, ",") {
+		key = strings.TrimSpace(key)
+		if err := checkSecretKey([]byte(key)); err != nil {
+			return nil, fmt.Errorf("key %d in %s is %v", i+1, name, err)
+		}
+		for _, existing := range keys {
+			if bytes.Equal(existing, []byte(key)) {
+				return nil, fmt.Errorf("key %d in %s is listed twice", i+1, name)
+			}
+		}
+		keys = append(keys, []byte(key))
+	}
+
+	return keys, nil
+}
+
+// checkSecretKey returns an error describing why a key is too weak to sign cookies with
+func checkSecretKey(key []byte) error {
+	if len(key) < MinSecretKeyLength {
+		return fmt.Errorf("too short, it must be at least %d bytes", MinSecretKeyLength)
+	}
+
+	variety := map[byte]bool{}
+	for _, b := range key {
+		variety[b] = true
+	}
+	if len(variety) < minSecretKeyVariety {
+		return fmt.Errorf("too predictable, use a randomly generated key")
+	}
+
+	return nil
+}
+
+// keyPairs turns a list of keys into the key pairs of securecookie.CodecsFromPairs
+// Each key only signs cookies, so every key is paired with an empty encryption key.
+func keyPairs(keys [][]byte) [][]byte {
+	pairs := make([][]byte, 0, 2*len(keys))
+	for _, key := range keys {
+		pairs = append(pairs, key, nil)
+	}
+	return pairs
+}
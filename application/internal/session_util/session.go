@@ -1,19 +1,23 @@
 package session_util
 
-import (
-	"fmt"
-	"os"
+// Store holds the sessions of all users on the server, see ServerStore
+var Store *ServerStore
 
-	"github.com/gorilla/sessions"
-)
-
-var Store *sessions.CookieStore
-
-func InitSession() {
-	sessionKey := os.Getenv("SESSION_KEY")
-	if sessionKey == "" {
-		fmt.Println("SESSION_KEY is not set in the environment")
-	} else {
-		Store = sessions.NewCookieStore([]byte(sessionKey))
+// InitSession creates the session store using the given backend
+// The session cookie is signed with the keys in SESSION_KEYS, or with SESSION_KEY if only one key is used.
+// See LoadSecretKeys for how the keys are rotated.
+//
+// Parameters:
+//   - backend: The SessionBackend to keep the sessions in
+//
+// Returns:
+//   - error: An error if no session key is set or a key is too weak
+func InitSession(backend SessionBackend) error {
+	keys, err := LoadSecretKeys("SESSION_KEYS", "SESSION_KEY")
+	if err != nil {
+		return err
 	}
+
+	Store = NewServerStore(backend, keyPairs(keys)...)
+	return nil
 }
@@ -0,0 +1,486 @@
+package session_util
+
+import (
+	"bytes"
+	"chalmers/tkey-group22/application/internal/util"
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// MemorySessionBackend keeps sessions in a map in the memory of the running process
+// It is only suitable for tests and when a single backend instance is running
+type MemorySessionBackend struct {
+	sessions map[string]SessionRecord
+	lock     sync.Mutex
+}
+
+// NewMemorySessionBackend creates an empty in-memory session backend
+//
+// Returns:
+//   - *MemorySessionBackend: A pointer to the new backend
+func NewMemorySessionBackend() *MemorySessionBackend {
+	return &MemorySessionBackend{sessions: make(map[string]SessionRecord)}
+}
+
+// Load returns the unexpired session with the given ID
+//
+// Parameters:
+//   - ctx: The context of the request
+//   - id: The ID of the session
+//
+// Returns:
+//   - *SessionRecord: The stored session
+//   - error: ErrSessionNotFound if there is no unexpired session with the ID
+func (backend *MemorySessionBackend) Load(ctx context.Context, id string) (*SessionRecord, error) {
+	backend.lock.Lock()
+	defer backend.lock.Unlock()
+
+	record, exists := backend.sessions[id]
+	if !exists || time.Now().After(record.ExpiresAt) {
+		delete(backend.sessions, id)
+		return nil, ErrSessionNotFound
+	}
+	return &record, nil
+}
+
+// Save stores the session, keeping the creation time if it already exists
+//
+// Parameters:
+//   - ctx: The context of the request
+//   - record: The session to store
+//
+// Returns:
+//   - error: Always nil
+func (backend *MemorySessionBackend) Save(ctx context.Context, record *SessionRecord) error {
+	backend.lock.Lock()
+	defer backend.lock.Unlock()
+
+	saved := *record
+	if existing, exists := backend.sessions[record.ID]; exists {
+		saved.CreatedAt = existing.CreatedAt
+	}
+	backend.sessions[record.ID] = saved
+	return nil
+}
+
+// Replace stores the session only if it exists and its data has not changed since it was loaded
+// Two requests that change the same session based on the same read cannot both succeed.
+//
+// Parameters:
+//   - ctx: The context of the request
+//   - record: The session to store
+//   - previousData: The data of the session when it was loaded
+//
+// Returns:
+//   - bool: True if the session was stored
+//   - error: Always nil
+func (backend *MemorySessionBackend) Replace(ctx context.Context, record *SessionRecord, previousData []byte) (bool, error) {
+	backend.lock.Lock()
+	defer backend.lock.Unlock()
+
+	existing, exists := backend.sessions[record.ID]
+	if !exists || !bytes.Equal(existing.Data, previousData) {
+		return false, nil
+	}
+	saved := *record
+	saved.CreatedAt = existing.CreatedAt
+	backend.sessions[record.ID] = saved
+	return true, nil
+}
+
+// Touch updates the last seen time of the session
+//
+// Parameters:
+//   - ctx: The context of the request
+//   - id: The ID of the session
+//   - lastSeen: The time the session was used
+//
+// Returns:
+//   - error: Always nil
+func (backend *MemorySessionBackend) Touch(ctx context.Context, id string, lastSeen time.Time) error {
+	backend.lock.Lock()
+	defer backend.lock.Unlock()
+
+	if record, exists := backend.sessions[id]; exists {
+		record.LastSeen = lastSeen
+		backend.sessions[id] = record
+	}
+	return nil
+}
+
+// Delete removes the session with the given ID
+//
+// Parameters:
+//   - ctx: The context of the request
+//   - id: The ID of the session
+//
+// Returns:
+//   - error: Always nil
+func (backend *MemorySessionBackend) Delete(ctx context.Context, id string) error {
+	backend.lock.Lock()
+	defer backend.lock.Unlock()
+
+	delete(backend.sessions, id)
+	return nil
+}
+
+// ListForUser returns the unexpired sessions of the given user, most recently used first
+//
+// Parameters:
+//   - ctx: The context of the request
+//   - username: The user to list sessions for
+//
+// Returns:
+//   - []SessionRecord: The sessions of the user
+//   - error: Always nil
+func (backend *MemorySessionBackend) ListForUser(ctx context.Context, username string) ([]SessionRecord, error) {
+	backend.lock.Lock()
+	defer backend.lock.Unlock()
+
+	records := []SessionRecord{}
+	now := time.Now()
+	for _, record := range backend.sessions {
+		if record.Username == username && now.Before(record.ExpiresAt) {
+			records = append(records, record)
+		}
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].LastSeen.After(records[j].LastSeen) })
+	return records, nil
+}
+
+// DeleteForUser removes all sessions of the given user except the one with exceptID
+//
+// Parameters:
+//   - ctx: The context of the request
+//   - username: The user to remove sessions for
+//   - exceptID: The ID of a session to keep, may be empty
+//
+// Returns:
+//   - int: The number of sessions that were removed
+//   - error: Always nil
+func (backend *MemorySessionBackend) DeleteForUser(ctx context.Context, username string, exceptID string) (int, error) {
+	backend.lock.Lock()
+	defer backend.lock.Unlock()
+
+	removed := 0
+	for id, record := range backend.sessions {
+		if record.Username == username && id != exceptID {
+			delete(backend.sessions, id)
+			removed++
+		}
+	}
+	return removed, nil
+}
+
+// DeleteForKey removes all sessions of the given user that were authenticated with the given key
+//
+// Parameters:
+//   - ctx: The context of the request
+//   - username: The user to remove sessions for
+//   - keyLabel: The label of the key the sessions were authenticated with
+//
+// Returns:
+//   - int: The number of sessions that were removed
+//   - error: Always nil
+func (backend *MemorySessionBackend) DeleteForKey(ctx context.Context, username string, keyLabel string) (int, error) {
+	backend.lock.Lock()
+	defer backend.lock.Unlock()
+
+	removed := 0
+	for id, record := range backend.sessions {
+		if record.Username == username && record.KeyLabel == keyLabel {
+			delete(backend.sessions, id)
+			removed++
+		}
+	}
+	return removed, nil
+}
+
+// RelabelKey updates the key label of all sessions of the given user that were authenticated with a renamed key
+//
+// Parameters:
+//   - ctx: The context of the request
+//   - username: The user the key belongs to
+//   - keyLabel: The old label of the key
+//   - newKeyLabel: The new label of the key
+//
+// Returns:
+//   - error: Always nil
+func (backend *MemorySessionBackend) RelabelKey(ctx context.Context, username string, keyLabel string, newKeyLabel string) error {
+	backend.lock.Lock()
+	defer backend.lock.Unlock()
+
+	for id, record := range backend.sessions {
+		if record.Username == username && record.KeyLabel == keyLabel {
+			record.KeyLabel = newKeyLabel
+			backend.sessions[id] = record
+		}
+	}
+	return nil
+}
+
+// sessionCollection is the MongoDB collection used by MongoSessionBackend
+const sessionCollection = "sessions"
+
+// MongoSessionBackend keeps sessions in a MongoDB collection
+// It allows several backend replicas to share sessions, and a session revoked on one
+// instance is immediately invalid on all of them
+type MongoSessionBackend struct {
+	db *mongo.Database
+}
+
+// NewMongoSessionBackend creates a session backend using the given database
+// The TTL index used to expire sessions and the index used to find a user's sessions are created
+// by the database migrations, see db.MongoMigrations.
+//
+// Parameters:
+//   - db: The MongoDB database reference
+//
+// Returns:
+//   - *MongoSessionBackend: A pointer to the new backend
+func NewMongoSessionBackend(db *mongo.Database) *MongoSessionBackend {
+	return &MongoSessionBackend{db: db}
+}
+
+// Load returns the unexpired session with the given ID
+// MongoDB only removes expired documents periodically, so the expiry is checked in the query
+//
+// Parameters:
+//   - ctx: The context of the request
+//   - id: The ID of the session
+//
+// Returns:
+//   - *SessionRecord: The stored session
+//   - error: ErrSessionNotFound if there is no unexpired session with the ID, or the database error
+func (backend *MongoSessionBackend) Load(ctx context.Context, id string) (*SessionRecord, error) {
+	ctx, cancel := util.OperationContext(ctx)
+	defer cancel()
+
+	collection := backend.db.Collection(sessionCollection)
+
+	var record SessionRecord
+	filter := bson.M{"_id": id, "expiresAt": bson.M{"$gt": time.Now()}}
+	err := collection.FindOne(ctx, filter).Decode(&record)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrSessionNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &record, nil
+}
+
+// Save stores the session, keeping the creation time if it already exists
+//
+// Parameters:
+//   - ctx: The context of the request
+//   - record: The session to store
+//
+// Returns:
+//   - error: An error if the session could not be stored
+func (backend *MongoSessionBackend) Save(ctx context.Context, record *SessionRecord) error {
+	ctx, cancel := util.OperationContext(ctx)
+	defer cancel()
+
+	collection := backend.db.Collection(sessionCollection)
+
+	filter := bson.M{"_id": record.ID}
+	update := bson.M{
+		"$set": bson.M{
+			"type":      record.Type,
+			"username":  record.Username,
+			"keyLabel":  record.KeyLabel,
+			"data":      record.Data,
+			"userAgent": record.UserAgent,
+			"ip":        record.IP,
+			"lastSeen":  record.LastSeen,
+			"expiresAt": record.ExpiresAt,
+		},
+		"$setOnInsert": bson.M{
+			"createdAt": record.CreatedAt,
+		},
+	}
+
+	_, err := collection.UpdateOne(ctx, filter, update, options.Update().SetUpsert(true))
+	return err
+}
+
+// Replace stores the session only if it exists and its data has not changed since it was loaded
+// The data is compared in the same update that stores the session, so it is atomic across replicas.
+//
+// Parameters:
+//   - ctx: The context of the request
+//   - record: The session to store
+//   - previousData: The data of the session when it was loaded
+//
+// Returns:
+//   - bool: True if the session was stored
+//   - error: An error if the update fails
+func (backend *MongoSessionBackend) Replace(ctx context.Context, record *SessionRecord, previousData []byte) (bool, error) {
+	ctx, cancel := util.OperationContext(ctx)
+	defer cancel()
+
+	collection := backend.db.Collection(sessionCollection)
+
+	filter := bson.M{"_id": record.ID, "data": previousData}
+	update := bson.M{
+		"$set": bson.M{
+			"keyLabel":  record.KeyLabel,
+			"data":      record.Data,
+			"userAgent": record.UserAgent,
+			"ip":        record.IP,
+			"lastSeen":  record.LastSeen,
+			"expiresAt": record.ExpiresAt,
+		},
+	}
+
+	result, err := collection.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return false, err
+	}
+	return result.MatchedCount == 1, nil
+}
+
+// Touch updates the last seen time of the session
+//
+// Parameters:
+//   - ctx: The context of the request
+//   - id: The ID of the session
+//   - lastSeen: The time the session was used
+//
+// Returns:
+//   - error: An error if the update fails
+func (backend *MongoSessionBackend) Touch(ctx context.Context, id string, lastSeen time.Time) error {
+	ctx, cancel := util.OperationContext(ctx)
+	defer cancel()
+
+	collection := backend.db.Collection(sessionCollection)
+
+	filter := bson.M{"_id": id}
+	update := bson.M{"$set": bson.M{"lastSeen": lastSeen}}
+	_, err := collection.UpdateOne(ctx, filter, update)
+	return err
+}
+
+// Delete removes the session with the given ID
+//
+// Parameters:
+//   - ctx: The context of the request
+//   - id: The ID of the session
+//
+// Returns:
+//   - error: An error if the deletion fails
+func (backend *MongoSessionBackend) Delete(ctx context.Context, id string) error {
+	ctx, cancel := util.OperationContext(ctx)
+	defer cancel()
+
+	collection := backend.db.Collection(sessionCollection)
+
+	_, err := collection.DeleteOne(ctx, bson.M{"_id": id})
+	return err
+}
+
+// ListForUser returns the unexpired sessions of the given user, most recently used first
+//
+// Parameters:
+//   - ctx: The context of the request
+//   - username: The user to list sessions for
+//
+// Returns:
+//   - []SessionRecord: The sessions of the user
+//   - error: An error if the query fails
+func (backend *MongoSessionBackend) ListForUser(ctx context.Context, username string) ([]SessionRecord, error) {
+	ctx, cancel := util.OperationContext(ctx)
+	defer cancel()
+
+	collection := backend.db.Collection(sessionCollection)
+
+	filter := bson.M{"username": username, "expiresAt": bson.M{"$gt": time.Now()}}
+	cursor, err := collection.Find(ctx, filter, options.Find().SetSort(bson.D{{Key: "lastSeen", Value: -1}}))
+	if err != nil {
+		return nil, err
+	}
+
+	records := []SessionRecord{}
+	if err := cursor.All(ctx, &records); err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+// DeleteForUser removes all sessions of the given user except the one with exceptID
+//
+// Parameters:
+//   - ctx: The context of the request
+//   - username: The user to remove sessions for
+//   - exceptID: The ID of a session to keep, may be empty
+//
+// Returns:
+//   - int: The number of sessions that were removed
+//   - error: An error if the deletion fails
+func (backend *MongoSessionBackend) DeleteForUser(ctx context.Context, username string, exceptID string) (int, error) {
+	ctx, cancel := util.OperationContext(ctx)
+	defer cancel()
+
+	collection := backend.db.Collection(sessionCollection)
+
+	filter := bson.M{"username": username, "_id": bson.M{"$ne": exceptID}}
+	result, err := collection.DeleteMany(ctx, filter)
+	if err != nil {
+		return 0, err
+	}
+	return int(result.DeletedCount), nil
+}
+
+// DeleteForKey removes all sessions of the given user that were authenticated with the given key
+//
+// Parameters:
+//   - ctx: The context of the request
+//   - username: The user to remove sessions for
+//   - keyLabel: The label of the key the sessions were authenticated with
+//
+// Returns:
+//   - int: The number of sessions that were removed
+//   - error: An error if the deletion fails
+func (backend *MongoSessionBackend) DeleteForKey(ctx context.Context, username string, keyLabel string) (int, error) {
+	ctx, cancel := util.OperationContext(ctx)
+	defer cancel()
+
+	collection := backend.db.Collection(sessionCollection)
+
+	filter := bson.M{"username": username, "keyLabel": keyLabel}
+	result, err := collection.DeleteMany(ctx, filter)
+	if err != nil {
+		return 0, err
+	}
+	return int(result.DeletedCount), nil
+}
+
+// RelabelKey updates the key label of all sessions of the given user that were authenticated with a renamed key
+//
+// Parameters:
+//   - ctx: The context of the request
+//   - username: The user the key belongs to
+//   - keyLabel: The old label of the key
+//   - newKeyLabel: The new label of the key
+//
+// Returns:
+//   - error: An error if the update fails
+func (backend *MongoSessionBackend) RelabelKey(ctx context.Context, username string, keyLabel string, newKeyLabel string) error {
+	ctx, cancel := util.OperationContext(ctx)
+	defer cancel()
+
+	collection := backend.db.Collection(sessionCollection)
+
+	filter := bson.M{"username": username, "keyLabel": keyLabel}
+	update := bson.M{"$set": bson.M{"keyLabel": newKeyLabel}}
+	_, err := collection.UpdateMany(ctx, filter, update)
+	return err
+}
@@ -0,0 +1,272 @@
+package session_util
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+)
+
+// ErrSessionNotFound is returned by a SessionBackend when no unexpired session exists for an ID
+var ErrSessionNotFound = errors.New("session not found")
+
+// ErrSessionChanged is returned by ServerStore.Save when the session was changed or ended by another request
+// since it was loaded, in which case it is not stored
+var ErrSessionChanged = errors.New("session was changed or ended by another request")
+
+// lastSeenInterval is how often the last seen time of a session is updated while it is being used
+const lastSeenInterval = time.Minute
+
+// loadedDataKey is the key of the session values under which ServerStore keeps the data the session was loaded with
+// It is never stored, it lets Save tell whether another request changed or ended the session in the meantime.
+type loadedDataKey struct{}
+
+// SessionRecord is a session as it is kept by a SessionBackend
+// The ID is the SHA-256 hash of the token in the session cookie, so the stored sessions cannot be used to
+// forge a cookie. The username, key label, device and IP are kept outside of the encoded values so that
+// a user's sessions can be listed and revoked.
+type SessionRecord struct {
+	ID        string    `bson:"_id"`                 // SHA-256 hash of the session token encoded in hex
+	Type      string    `bson:"type,omitempty"`      // Empty for a browser session, SessionTypeToken for bearer tokens
+	Username  string    `bson:"username,omitempty"`  // User the session is authenticated as, empty before login
+	KeyLabel  string    `bson:"keyLabel,omitempty"`  // Label of the key the session was authenticated with
+	Data      []byte    `bson:"data"`                // The gob encoded session values
+	UserAgent string    `bson:"userAgent,omitempty"` // User agent of the device that last saved the session
+	IP        string    `bson:"ip,omitempty"`        // IP address of the device that last saved the session
+	CreatedAt time.Time `bson:"createdAt"`           // When the session was first saved
+	LastSeen  time.Time `bson:"lastSeen"`            // When the session was last used
+	ExpiresAt time.Time `bson:"expiresAt"`           // When the session stops being valid
+}
+
+// SessionBackend is the storage for server-side sessions
+// Implementations must be safe for concurrent use
+type SessionBackend interface {
+	// Load returns the unexpired session with the given ID, or ErrSessionNotFound
+	Load(ctx context.Context, id string) (*SessionRecord, error)
+	// Save stores the session, keeping the creation time if it already exists
+	Save(ctx context.Context, record *SessionRecord) error
+	// Replace stores the session only if its data is still previousData, and reports whether it was stored
+	Replace(ctx context.Context, record *SessionRecord, previousData []byte) (bool, error)
+	// Touch updates the last seen time of the session
+	Touch(ctx context.Context, id string, lastSeen time.Time) error
+	// Delete removes the session with the given ID, if it exists
+	Delete(ctx context.Context, id string) error
+	// ListForUser returns the unexpired sessions of the given user
+	ListForUser(ctx context.Context, username string) ([]SessionRecord, error)
+	// DeleteForUser removes all sessions of the given user except the one with exceptID and returns how many were removed
+	DeleteForUser(ctx context.Context, username string, exceptID string) (int, error)
+	// DeleteForKey removes all sessions of the given user that were authenticated with the key with the given label
+	DeleteForKey(ctx context.Context, username string, keyLabel string) (int, error)
+	// RelabelKey updates the key label of all sessions of the given user that were authenticated with a renamed key
+	RelabelKey(ctx context.Context, username string, keyLabel string, newKeyLabel string) error
+}
+
+// ServerStore is a sessions.Store that keeps session values on the server
+// The cookie only holds a random token, signed with the session keys, that identifies the session.
+// Since the session lives on the server it can be listed and revoked, and a revoked session
+// cannot be used again even if its cookie was copied.
+type ServerStore struct {
+	Backend SessionBackend
+	Codecs  []securecookie.Codec
+	Options *sessions.Options // default configuration for new sessions
+}
+
+// NewServerStore creates a session store backed by the given backend
+// The key pairs are used to sign the session cookie in the same way as for sessions.NewCookieStore.
+//
+// Parameters:
+//   - backend: The SessionBackend to keep the sessions in
+//   - keyPairs: Authentication and optional encryption keys for the session cookie
+//
+// Returns:
+//   - *ServerStore: A pointer to the new store
+func NewServerStore(backend SessionBackend, keyPairs ...[]byte) *ServerStore {
+	return &ServerStore{
+		Backend: backend,
+		Codecs:  securecookie.CodecsFromPairs(keyPairs...),
+		Options: Policy.cookieOptions(Policy.IdleTimeout),
+	}
+}
+
+// Get returns the named session for the request, loading it at most once per request
+func (store *ServerStore) Get(r *http.Request, name string) (*sessions.Session, error) {
+	return sessions.GetRegistry(r).Get(store, name)
+}
+
+// New loads the session identified by the session cookie of the request
+// A missing, invalid, expired or revoked cookie gives a new empty session, so the user can simply log in again.
+// An error is only returned if the backend cannot be reached.
+func (store *ServerStore) New(r *http.Request, name string) (*sessions.Session, error) {
+	session := sessions.NewSession(store, name)
+	options := *store.Options
+	session.Options = &options
+	session.IsNew = true
+
+	cookie, err := r.Cookie(name)
+	if err != nil {
+		return session, nil
+	}
+
+	var token string
+	if err := securecookie.DecodeMulti(name, cookie.Value, &token, store.Codecs...); err != nil {
+		return session, nil
+	}
+
+	id := hashSessionToken(token)
+	record, err := store.Backend.Load(r.Context(), id)
+	if err == ErrSessionNotFound {
+		return session, nil
+	}
+	if err != nil {
+		return session, err
+	}
+
+	if err := gob.NewDecoder(bytes.NewReader(record.Data)).Decode(&session.Values); err != nil {
+		return session, nil
+	}
+	session.ID = token
+	session.IsNew = false
+	session.Values[loadedDataKey{}] = record.Data
+
+	// The key label is kept up to date on the record when the key is renamed
+	if record.KeyLabel != "" {
+		session.Values["keyLabel"] = record.KeyLabel
+	}
+
+	if time.Since(record.LastSeen) > lastSeenInterval {
+		store.Backend.Touch(r.Context(), id, time.Now())
+	}
+
+	return session, nil
+}
+
+// Save stores the session on the server and sets the session cookie
+// An authenticated session never lasts beyond the absolute lifetime of the session policy, whatever its MaxAge.
+// A session with a negative MaxAge is removed from the server and its cookie is deleted.
+// Only a new or renewed session is inserted. An existing session is only updated if no other request changed
+// or ended it since it was loaded, otherwise ErrSessionChanged is returned, so a revoked session is never stored again.
+func (store *ServerStore) Save(r *http.Request, w http.ResponseWriter, session *sessions.Session) error {
+	if authenticatedAt, ok := session.Values["authenticatedAt"].(int64); ok && session.Options.MaxAge > 0 {
+		remaining := time.Until(Policy.expiresAt(time.Unix(authenticatedAt, 0)))
+		if remaining < time.Duration(session.Options.MaxAge)*time.Second {
+			options := *session.Options
+			options.MaxAge = int(remaining.Seconds())
+			if options.MaxAge <= 0 {
+				options.MaxAge = -1
+			}
+			session.Options = &options
+		}
+	}
+
+	if session.Options.MaxAge < 0 {
+		if session.ID != "" {
+			if err := store.Backend.Delete(r.Context(), hashSessionToken(session.ID)); err != nil {
+				return err
+			}
+		}
+		http.SetCookie(w, sessions.NewCookie(session.Name(), "", session.Options))
+		return nil
+	}
+
+	isNew := session.ID == ""
+	if isNew {
+		token, err := newSessionToken()
+		if err != nil {
+			return err
+		}
+		session.ID = token
+	}
+
+	previousData, _ := session.Values[loadedDataKey{}].([]byte)
+	values := make(map[interface{}]interface{}, len(session.Values))
+	for key, value := range session.Values {
+		if _, ok := key.(loadedDataKey); !ok {
+			values[key] = value
+		}
+	}
+
+	var data bytes.Buffer
+	if err := gob.NewEncoder(&data).Encode(values); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	record := &SessionRecord{
+		ID:        hashSessionToken(session.ID),
+		Data:      data.Bytes(),
+		UserAgent: r.UserAgent(),
+		IP:        ClientIP(r),
+		CreatedAt: now,
+		LastSeen:  now,
+		ExpiresAt: now.Add(time.Duration(session.Options.MaxAge) * time.Second),
+	}
+	record.Username, _ = session.Values["username"].(string)
+	record.KeyLabel, _ = session.Values["keyLabel"].(string)
+
+	if isNew {
+		if err := store.Backend.Save(r.Context(), record); err != nil {
+			return err
+		}
+	} else {
+		replaced, err := store.Backend.Replace(r.Context(), record, previousData)
+		if err != nil {
+			return err
+		}
+		if !replaced {
+			return ErrSessionChanged
+		}
+	}
+	session.Values[loadedDataKey{}] = record.Data
+
+	encoded, err := securecookie.EncodeMulti(session.Name(), session.ID, store.Codecs...)
+	if err != nil {
+		return err
+	}
+	http.SetCookie(w, sessions.NewCookie(session.Name(), encoded, session.Options))
+	return nil
+}
+
+// Renew removes the session from the server and gives it a new token when it is saved next
+// The values are kept. Renewing the session on login prevents a token set before login from being used after it.
+//
+// Parameters:
+//   - ctx: The context of the request
+//   - session: The session to renew
+//
+// Returns:
+//   - error: An error if the old session could not be removed
+func (store *ServerStore) Renew(ctx context.Context, session *sessions.Session) error {
+	if session.ID == "" {
+		return nil
+	}
+	if err := store.Backend.Delete(ctx, hashSessionToken(session.ID)); err != nil {
+		return err
+	}
+	session.ID = ""
+	delete(session.Values, loadedDataKey{})
+	return nil
+}
+
+// newSessionToken generates a random session token
+func newSessionToken() (string, error) {
+	token := make([]byte, 32)
+	if _, err := rand.Read(token); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(token), nil
+}
+
+// hashSessionToken returns the ID a session is stored under
+func hashSessionToken(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
@@ -0,0 +1,72 @@
+package session_util
+
+import (
+	"net/http"
+	"time"
+)
+
+// StepUpValidDuration is how long a step-up authentication can be used after the signature was verified
+// It is long enough to swap TKeys when adding a new key, but short enough to limit the use of a stolen cookie
+var StepUpValidDuration = time.Duration(2) * time.Minute
+
+// SetStepUp records in the session that the user has just signed a step-up challenge for the given purpose.
+// The step-up can be used once, for that purpose only, within StepUpValidDuration.
+//
+// Parameters:
+//   - w: http.ResponseWriter to write the session cookie to the response.
+//   - r: *http.Request to get the session from the request.
+//   - purpose: string representing what the step-up authorizes, e.g. "add-key".
+//
+// Returns:
+//   - error: an error if there is an issue getting or saving the session, otherwise nil.
+func SetStepUp(w http.ResponseWriter, r *http.Request, purpose string) error {
+	session, err := Store.Get(r, "session-name")
+	if err != nil {
+		return err
+	}
+
+	session.Values["stepUpPurpose"] = purpose
+	session.Values["stepUpAt"] = time.Now().Unix()
+	return session.Save(r, w)
+}
+
+// UseStepUp takes the step-up for the given purpose out of the session, before the operation it authorizes is performed
+// The step-up is removed with a conditional save of the session, so when several requests try to use the same step-up
+// at once only one of them gets it.
+//
+// Parameters:
+//   - w: http.ResponseWriter to write the session cookie to the response.
+//   - r: *http.Request to get the session from the request.
+//   - purpose: string representing the purpose the step-up must have been made for.
+//
+// Returns:
+//   - bool: true if the session held an unused step-up for the purpose that had not expired, and it is now used up.
+//   - error: an error if there is an issue getting or saving the session, otherwise nil.
+func UseStepUp(w http.ResponseWriter, r *http.Request, purpose string) (bool, error) {
+	session, err := Store.Get(r, "session-name")
+	if err != nil {
+		return false, err
+	}
+
+	stepUpPurpose, ok := session.Values["stepUpPurpose"].(string)
+	if !ok || stepUpPurpose != purpose {
+		return false, nil
+	}
+
+	stepUpAt, ok := session.Values["stepUpAt"].(int64)
+	if !ok || time.Since(time.Unix(stepUpAt, 0)) > StepUpValidDuration {
+		return false, nil
+	}
+
+	delete(session.Values, "stepUpPurpose")
+	delete(session.Values, "stepUpAt")
+	err = session.Save(r, w)
+	if err == ErrSessionChanged {
+		// Another request used the step-up or changed the session since it was loaded
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
@@ -1,13 +1,22 @@
 package session_util
 
 import (
+	"context"
+	"fmt"
 	"net/http"
+
+	"github.com/gorilla/csrf"
 )
 
 // SessionMiddleware is a middleware function that checks for the existence of a session
 // and verifies if the "username" key is present in the session values. If the "username"
 // key is not found, it responds with an "Unauthorized" error and a 401 status code.
-// If the "username" key is found, it calls the next handler in the chain.
+// If the "username" key is found and the session has not passed the absolute lifetime of the session policy,
+// the idle timeout of the session is extended and it calls the next handler in the chain.
+//
+// A request with an access token in the Authorization header is authenticated by the token instead,
+// if the route accepts bearer tokens with a scope the token has, see AllowBearer.
+// Such requests do not carry cookies the browser sends by itself, so they are exempt from the CSRF check.
 //
 // Parameters:
 // - next: The next http.Handler to be called if the session is valid.
@@ -16,6 +25,11 @@ import (
 // - http.Handler: A handler that wraps the provided handler with session validation logic.
 func SessionMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if token, found := bearerToken(r); found {
+			serveBearer(w, r, token, next)
+			return
+		}
+
 		session, _ := Store.Get(r, "session-name")
 		_, ok := session.Values["username"]
 
@@ -23,6 +37,45 @@ func SessionMiddleware(next http.Handler) http.Handler {
 			http.Error(w, "Unauthorized", http.StatusUnauthorized)
 			return
 		}
+
+		// After the absolute lifetime the user must touch the TKey again
+		if sessionExpired(session) {
+			TerminateSession(w, r)
+			http.Error(w, "Session expired, please log in again", http.StatusUnauthorized)
+			return
+		}
+
+		if err := refreshSession(w, r, session); err != nil {
+			fmt.Println("Error refreshing session:", err)
+		}
 		next.ServeHTTP(w, r)
 	})
 }
+
+// serveBearer authenticates a request with an access token and calls the next handler
+// The user of the token is put in the context of the request, where the session getters find it.
+func serveBearer(w http.ResponseWriter, r *http.Request, token string, next http.Handler) {
+	scope, allowed := r.Context().Value(allowBearerContextKey{}).(string)
+	if !allowed {
+		http.Error(w, "Bearer tokens cannot be used for this request", http.StatusForbidden)
+		return
+	}
+
+	auth, err := authenticateBearer(r.Context(), token, scope)
+	if err == ErrInvalidScope {
+		w.Header().Set("WWW-Authenticate", `Bearer error="insufficient_scope", scope="`+scope+`"`)
+		http.Error(w, "Token does not have the required scope", http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		if err != ErrInvalidToken {
+			fmt.Println("Error authenticating bearer token:", err)
+		}
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	r = r.WithContext(context.WithValue(r.Context(), bearerContextKey{}, auth))
+	next.ServeHTTP(w, csrf.UnsafeSkipCheck(r))
+}
@@ -1,41 +1,200 @@
 // Package contains structs used to represent requests to the server.
 package structs
 
+import "time"
+
 // VerifyRequest represents a request to verify a user's identity.
-// It contains the username of the user and a cryptographic signature
-// to authenticate the request.
+// It contains the username of the user, the ID of the challenge that was signed
+// and a cryptographic signature to authenticate the request.
+// Clients that cannot use cookies set IssueTokens to get bearer tokens with the requested scope instead of a session.
 type VerifyRequest struct {
-	Username  string `json:"username"`
-	Signature []byte `json:"signature"`
+	Username    string `json:"username"`
+	ChallengeID string `json:"challenge_id"`
+	Signature   []byte `json:"signature"`
+	IssueTokens bool   `json:"issue_tokens"`
+	Scope       string `json:"scope"`
+}
+
+// TokenResponse represents the bearer tokens issued to a client
+// The access token is sent in the Authorization header, and the refresh token is exchanged for new tokens before it expires
+type TokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int    `json:"expires_in"`
+	Scope        string `json:"scope"`
+}
+
+// RefreshTokenRequest represents a request to refresh or revoke bearer tokens
+// It contains the refresh token that was last issued
+type RefreshTokenRequest struct {
+	RefreshToken string `json:"refresh_token"`
 }
 
 // LoginRequest represents the payload for a login request.
-// It contains the username of the user attempting to log in.
+// It contains the username of the user attempting to log in and the origin
+// of the page the login was started from, which the challenge is bound to.
 type LoginRequest struct {
 	Username string `json:"username"`
+	Origin   string `json:"origin"`
 }
 
 // LoginResponse represents the response received after a login attempt.
-// It contains a challenge string and a signature string, both of which
-// are used to verify the authenticity of the login request.
+// It contains the ID of the challenge, a challenge string and a signature string,
+// which are used to verify the authenticity of the login request.
+// The signature is made over the challenge with the server identity key and is base64 encoded.
 type LoginResponse struct {
-	Challenge string `json:"challenge"`
-	Signature string `json:"signature"`
+	ChallengeID string `json:"challenge_id"`
+	Challenge   string `json:"challenge"`
+	Signature   string `json:"signature"`
+}
+
+// ServerPublicKeyResponse represents the public part of the server identity key.
+// The key is used by the TKey client to verify the signature in a LoginResponse.
+type ServerPublicKeyResponse struct {
+	PublicKey []byte `json:"public_key"`
+	Algorithm string `json:"algorithm"`
+}
+
+// RegisterChallengeRequest represents a request for a registration challenge.
+// It contains the username to be registered and the origin the challenge should be bound to.
+type RegisterChallengeRequest struct {
+	Username string `json:"username"`
+	Origin   string `json:"origin"`
 }
 
 // RegisterRequest represents the data required to register a new user.
-// It includes the username and the user's public key.
+// It includes the username and the user's public key, the name and digest
+// of the TKey signer app that produced the key as reported by the client,
+// and the ID of a registration challenge with the key's signature over it.
 type RegisterRequest struct {
+	Username    string `json:"username"`
+	Pubkey      []byte `json:"pubkey"`
+	Label       string `json:"label"`
+	AppName     string `json:"app_name"`
+	AppDigest   string `json:"app_digest"`
+	ChallengeID string `json:"challenge_id"`
+	Signature   []byte `json:"signature"`
+}
+
+// RegisterResponse represents the response to a successful registration.
+// It contains the one-time recovery codes of the new user, which are only ever shown once.
+type RegisterResponse struct {
+	Message       string   `json:"message"`
+	RecoveryCodes []string `json:"recovery_codes"`
+}
+
+// RecoverRequest represents a request to recover an account with a recovery code.
+// It contains the username of the account and one of its unused recovery codes.
+type RecoverRequest struct {
 	Username string `json:"username"`
-	Pubkey   []byte `json:"pubkey"`
-	Label    string `json:"label"`
+	Code     string `json:"code"`
+}
+
+// RecoveryChallengeRequest represents a request for the challenge a new key signs during recovery.
+// It contains the origin the challenge should be bound to.
+type RecoveryChallengeRequest struct {
+	Origin string `json:"origin"`
+}
+
+// RecoveryCodesResponse represents a newly generated set of recovery codes.
+// The codes replace all codes the user had before.
+type RecoveryCodesResponse struct {
+	RecoveryCodes []string `json:"recovery_codes"`
 }
 
 // AddPublicKeyRequest represents a request to add a new public key for a user
-// It contains the username of the user, the new public key to be added, and the label for the public key
+// It contains the new public key to be added, the label for the public key,
+// the name and digest of the TKey signer app that produced the key, and the ID of
+// a "new-key" challenge together with the new key's signature over it, proving possession of the key
 type AddPublicKeyRequest struct {
-	Pubkey []byte `json:"pubkey"`
-	Label  string `json:"label"`
+	Pubkey      []byte `json:"pubkey"`
+	Label       string `json:"label"`
+	AppName     string `json:"app_name"`
+	AppDigest   string `json:"app_digest"`
+	ChallengeID string `json:"challenge_id"`
+	Signature   []byte `json:"signature"`
+}
+
+// PublicKeyInfo describes a public key of a user, its status and how it has been used
+// LastUsed is omitted if the key has never been used to log in
+type PublicKeyInfo struct {
+	Label           string     `json:"label"`
+	Pubkey          []byte     `json:"pubkey"`
+	CreatedAt       *time.Time `json:"created_at,omitempty"`
+	LastUsed        *time.Time `json:"last_used,omitempty"`
+	UseCount        int64      `json:"use_count"`
+	AppName         string     `json:"app_name,omitempty"`
+	AppDigest       string     `json:"app_digest,omitempty"`
+	Status          string     `json:"status"`
+	StatusReason    string     `json:"status_reason,omitempty"`
+	StatusChangedAt *time.Time `json:"status_changed_at,omitempty"`
+}
+
+// ListPublicKeysResponse represents the response to a request to list the public keys of a user
+type ListPublicKeysResponse struct {
+	Keys []PublicKeyInfo `json:"keys"`
+}
+
+// StepUpChallengeRequest represents a request for a challenge for a sensitive operation by an authenticated user
+// It contains the purpose of the challenge, e.g. "add-key", and the origin the challenge should be bound to
+type StepUpChallengeRequest struct {
+	Purpose string `json:"purpose"`
+	Origin  string `json:"origin"`
+}
+
+// StepUpRequest represents a request to authorize a sensitive operation with a TKey signature
+// It contains the purpose, the ID of the step-up challenge and the signature over it made by a registered key
+type StepUpRequest struct {
+	Purpose     string `json:"purpose"`
+	ChallengeID string `json:"challenge_id"`
+	Signature   []byte `json:"signature"`
+}
+
+// SessionInfo describes an active session of a user
+// Type is "browser" for a session cookie and "token" for bearer tokens.
+// Current is set for the session the listing was requested with
+type SessionInfo struct {
+	ID        string    `json:"id"`
+	Type      string    `json:"type"`
+	Current   bool      `json:"current"`
+	KeyLabel  string    `json:"key_label"`
+	UserAgent string    `json:"user_agent"`
+	IP        string    `json:"ip"`
+	CreatedAt time.Time `json:"created_at"`
+	LastSeen  time.Time `json:"last_seen"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// ListSessionsResponse represents the response to a request to list the active sessions of a user
+type ListSessionsResponse struct {
+	Sessions []SessionInfo `json:"sessions"`
+}
+
+// AuditEvent describes an entry in the audit log of a user's account
+type AuditEvent struct {
+	Type      string    `json:"type"`
+	KeyLabel  string    `json:"key_label,omitempty"`
+	Detail    string    `json:"detail,omitempty"`
+	IP        string    `json:"ip"`
+	UserAgent string    `json:"user_agent"`
+	Time      time.Time `json:"time"`
+}
+
+// ListAuditEventsResponse represents the response to a request for the audit log of a user, newest first
+type ListAuditEventsResponse struct {
+	Events []AuditEvent `json:"events"`
+}
+
+// RevokeSessionRequest represents a request to revoke one of the user's sessions
+// It contains the ID of the session as listed by /api/sessions
+type RevokeSessionRequest struct {
+	ID string `json:"id"`
+}
+
+// RevokeSessionsResponse represents the number of sessions that were revoked
+type RevokeSessionsResponse struct {
+	Revoked int `json:"revoked"`
 }
 
 // RemovePublicKeyRequest represents a request to remove a public key for a user
@@ -44,6 +203,26 @@ type RemovePublicKeyRequest struct {
 	Label string `json:"label"`
 }
 
+// RenamePublicKeyRequest represents a request to rename a public key of a user
+// It contains the current label of the public key and the new label
+type RenamePublicKeyRequest struct {
+	Label    string `json:"label"`
+	NewLabel string `json:"new_label"`
+}
+
+// SuspendPublicKeyRequest represents a request to suspend a public key of a user
+// It contains the label of the public key to be suspended and an optional reason
+type SuspendPublicKeyRequest struct {
+	Label  string `json:"label"`
+	Reason string `json:"reason"`
+}
+
+// ReactivatePublicKeyRequest represents a request to reactivate a suspended public key of a user
+// It contains the label of the public key to be reactivated
+type ReactivatePublicKeyRequest struct {
+	Label string `json:"label"`
+}
+
 // SaveNoteRequest represents a request to save a note.
 // It contains the name of the note and the note content itself.
 type SaveNoteRequest struct {
@@ -66,3 +245,73 @@ type UpdateNotesRequest struct {
 type DeleteNoteRequest struct {
 	ID string `json:"id"`
 }
+
+// OIDCDiscoveryResponse represents the OpenID Connect provider metadata
+// It is published at /.well-known/openid-configuration under the issuer
+type OIDCDiscoveryResponse struct {
+	Issuer                            string   `json:"issuer"`
+	AuthorizationEndpoint             string   `json:"authorization_endpoint"`
+	TokenEndpoint                     string   `json:"token_endpoint"`
+	UserInfoEndpoint                  string   `json:"userinfo_endpoint"`
+	JWKSURI                           string   `json:"jwks_uri"`
+	ResponseTypesSupported            []string `json:"response_types_supported"`
+	GrantTypesSupported               []string `json:"grant_types_supported"`
+	SubjectTypesSupported             []string `json:"subject_types_supported"`
+	IDTokenSigningAlgValuesSupported  []string `json:"id_token_signing_alg_values_supported"`
+	ScopesSupported                   []string `json:"scopes_supported"`
+	ClaimsSupported                   []string `json:"claims_supported"`
+	TokenEndpointAuthMethodsSupported []string `json:"token_endpoint_auth_methods_supported"`
+	CodeChallengeMethodsSupported     []string `json:"code_challenge_methods_supported"`
+}
+
+// OIDCTokenResponse represents the tokens issued to an OpenID Connect client for an authorization code
+type OIDCTokenResponse struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int    `json:"expires_in"`
+	IDToken     string `json:"id_token"`
+	Scope       string `json:"scope"`
+}
+
+// OIDCErrorResponse represents an error of the OpenID Connect token endpoint, as defined by OAuth 2.0
+type OIDCErrorResponse struct {
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description,omitempty"`
+}
+
+// OIDCUserInfoResponse represents the claims about the user returned by the OpenID Connect user info endpoint
+type OIDCUserInfoResponse struct {
+	Subject           string `json:"sub"`
+	PreferredUsername string `json:"preferred_username,omitempty"`
+}
+
+// DeviceAuthorizationResponse represents a login started in a browser that is approved from the TKey client
+// The user code is shown to the user, while the device code is kept by the browser to poll with
+type DeviceAuthorizationResponse struct {
+	DeviceCode string `json:"device_code"`
+	UserCode   string `json:"user_code"`
+	ExpiresIn  int    `json:"expires_in"`
+	Interval   int    `json:"interval"`
+}
+
+// DeviceChallengeRequest represents a request from the TKey client for a challenge approving a browser login
+// It contains the user logging in, the user code shown by the browser and the origin the challenge should be bound to
+type DeviceChallengeRequest struct {
+	Username string `json:"username"`
+	UserCode string `json:"user_code"`
+	Origin   string `json:"origin"`
+}
+
+// DeviceApproveRequest represents the approval of a browser login by the TKey client
+// It contains the user, the user code, and the ID of the device challenge with the signature over it
+type DeviceApproveRequest struct {
+	Username    string `json:"username"`
+	UserCode    string `json:"user_code"`
+	ChallengeID string `json:"challenge_id"`
+	Signature   []byte `json:"signature"`
+}
+
+// DeviceTokenRequest represents a poll by the browser waiting for its login to be approved
+type DeviceTokenRequest struct {
+	DeviceCode string `json:"device_code"`
+}
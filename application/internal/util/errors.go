@@ -0,0 +1,23 @@
+package util
+
+import "errors"
+
+// Errors returned by the repositories, whichever database they are backed by
+// Invalid input is reported with a structs.ErrorInputNotSanitized instead.
+var (
+	ErrUserNotFound    = errors.New("user not found")
+	ErrUserExists      = errors.New("user already exists")
+	ErrNoteNotFound    = errors.New("note not found")
+	ErrClientNotFound  = errors.New("client not found")
+	ErrClientExists    = errors.New("client already exists")
+	ErrKeyNotFound     = errors.New("specified public key is not found")
+	ErrMaxPublicKeys   = errors.New("user already has the maximum number of public keys")
+	ErrKeyRevoked      = errors.New("public key has been revoked")
+	ErrKeyExists       = errors.New("public key already exists for the user")
+	ErrLabelExists     = errors.New("label already exists for the user")
+	ErrLastActiveKey   = errors.New("user must have at least two public keys to remove one")
+	ErrKeyNotActive    = errors.New("public key is not active")
+	ErrKeyNotSuspended = errors.New("public key is not suspended")
+
+	ErrConcurrentUpdate = errors.New("user was changed by another request, try again")
+)
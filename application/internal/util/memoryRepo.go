@@ -0,0 +1,410 @@
+package util
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"sort"
+	"sync"
+	"time"
+)
+
+// MemoryUserRepo is a UserRepository that keeps the users in memory
+// It follows the same rules as UserRepo and is meant for tests and for running without a database.
+// The users are lost when the server stops.
+type MemoryUserRepo struct {
+	users map[string]*User
+	lock  sync.Mutex
+}
+
+// NewMemoryUserRepo creates an empty MemoryUserRepo
+//
+// Returns:
+//   - *MemoryUserRepo: A pointer to the new MemoryUserRepo
+func NewMemoryUserRepo() *MemoryUserRepo {
+	return &MemoryUserRepo{users: make(map[string]*User)}
+}
+
+// lockContext takes the lock unless the context has already ended, in which case its error is returned
+// Like a database, the repositories do not start an operation for a request that has timed out or been cancelled.
+func lockContext(ctx context.Context, lock *sync.Mutex) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	lock.Lock()
+	return nil
+}
+
+// copyUser returns a copy of the user that shares no slices with it,
+// so that callers cannot change the stored user without going through the repository
+func copyUser(user *User) *User {
+	userCopy := *user
+	userCopy.PublicKeys = append([]PublicKey(nil), user.PublicKeys...)
+	userCopy.RecoveryCodes = append([]string(nil), user.RecoveryCodes...)
+	return &userCopy
+}
+
+// CreateUser stores a new user with the given public key, see UserRepo.CreateUser
+func (repo *MemoryUserRepo) CreateUser(ctx context.Context, userName string, pubkey ed25519.PublicKey, label string, signerApp SignerApp) (*User, error) {
+	user, err := newUser(userName, pubkey, label, signerApp)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := lockContext(ctx, &repo.lock); err != nil {
+		return nil, err
+	}
+	defer repo.lock.Unlock()
+
+	if _, exists := repo.users[userName]; exists {
+		return nil, ErrUserExists
+	}
+	repo.users[userName] = copyUser(user)
+	return user, nil
+}
+
+// GetUser returns a copy of the user, or ErrUserNotFound if there is no such user
+func (repo *MemoryUserRepo) GetUser(ctx context.Context, userName string) (*User, error) {
+	if err := checkUsername(userName); err != nil {
+		return nil, err
+	}
+
+	if err := lockContext(ctx, &repo.lock); err != nil {
+		return nil, err
+	}
+	defer repo.lock.Unlock()
+
+	user, exists := repo.users[userName]
+	if !exists {
+		return nil, ErrUserNotFound
+	}
+	return copyUser(user), nil
+}
+
+// UpdateUser replaces the username and public keys of the user, see UserRepo.UpdateUser
+func (repo *MemoryUserRepo) UpdateUser(ctx context.Context, userName string, updatedUser User) error {
+	if err := checkUsername(userName); err != nil {
+		return err
+	}
+	if err := checkUsername(updatedUser.Username); err != nil {
+		return err
+	}
+
+	if err := lockContext(ctx, &repo.lock); err != nil {
+		return err
+	}
+	defer repo.lock.Unlock()
+
+	return repo.updateUser(userName, updatedUser)
+}
+
+// updateUser replaces the username and public keys of the user, the lock must be held
+func (repo *MemoryUserRepo) updateUser(userName string, updatedUser User) error {
+	user, exists := repo.users[userName]
+	if !exists {
+		return ErrUserNotFound
+	}
+
+	// Like the database, only the username and public keys are replaced
+	stored := copyUser(&updatedUser)
+	stored.RecoveryCodes = user.RecoveryCodes
+	delete(repo.users, userName)
+	repo.users[stored.Username] = stored
+	return nil
+}
+
+// DeleteUser deletes the user, or returns ErrUserNotFound if there is no such user
+func (repo *MemoryUserRepo) DeleteUser(ctx context.Context, userName string) error {
+	if err := checkUsername(userName); err != nil {
+		return err
+	}
+
+	if err := lockContext(ctx, &repo.lock); err != nil {
+		return err
+	}
+	defer repo.lock.Unlock()
+
+	if _, exists := repo.users[userName]; !exists {
+		return ErrUserNotFound
+	}
+	delete(repo.users, userName)
+	return nil
+}
+
+// GetPublicKeyLabels returns the labels of the keys of the user that have not been revoked
+func (repo *MemoryUserRepo) GetPublicKeyLabels(ctx context.Context, userName string) ([]string, error) {
+	user, err := repo.GetUser(ctx, userName)
+	if err != nil {
+		return nil, err
+	}
+
+	return publicKeyLabels(user), nil
+}
+
+// AddPublicKey adds a new public key to the user, see UserRepo.AddPublicKey
+func (repo *MemoryUserRepo) AddPublicKey(ctx context.Context, userName string, newPubKey ed25519.PublicKey, label string, signerApp SignerApp) error {
+	return repo.changeUser(ctx, userName, func(user *User) error {
+		return addPublicKey(user, newPubKey, label, signerApp)
+	})
+}
+
+// RecoverPublicKey replaces all keys of the user with a new public key, see UserRepo.RecoverPublicKey
+func (repo *MemoryUserRepo) RecoverPublicKey(ctx context.Context, userName string, newPubKey ed25519.PublicKey, label string, signerApp SignerApp) ([]string, error) {
+	var revoked []string
+	err := repo.changeUser(ctx, userName, func(user *User) error {
+		var err error
+		revoked, err = recoverPublicKey(user, newPubKey, label, signerApp)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return revoked, nil
+}
+
+// RemovePublicKey revokes a public key of the user, see UserRepo.RemovePublicKey
+func (repo *MemoryUserRepo) RemovePublicKey(ctx context.Context, userName string, label string) error {
+	return repo.changeUser(ctx, userName, func(user *User) error {
+		return removePublicKey(user, label)
+	})
+}
+
+// RenamePublicKey changes the label of a public key of the user, see UserRepo.RenamePublicKey
+func (repo *MemoryUserRepo) RenamePublicKey(ctx context.Context, userName string, label string, newLabel string) error {
+	return repo.changeUser(ctx, userName, func(user *User) error {
+		return renamePublicKey(user, label, newLabel)
+	})
+}
+
+// SuspendPublicKey suspends a public key of the user, see UserRepo.SuspendPublicKey
+func (repo *MemoryUserRepo) SuspendPublicKey(ctx context.Context, userName string, label string, reason string) error {
+	return repo.changeUser(ctx, userName, func(user *User) error {
+		return suspendPublicKey(user, label, reason)
+	})
+}
+
+// ReactivatePublicKey makes a suspended public key of the user active again, see UserRepo.ReactivatePublicKey
+func (repo *MemoryUserRepo) ReactivatePublicKey(ctx context.Context, userName string, label string) error {
+	return repo.changeUser(ctx, userName, func(user *User) error {
+		return reactivatePublicKey(user, label)
+	})
+}
+
+// RecordKeyUse records that the public key with the given label was used to log in
+func (repo *MemoryUserRepo) RecordKeyUse(ctx context.Context, userName string, label string) error {
+	return repo.changeUser(ctx, userName, func(user *User) error {
+		pubkey := findPublicKey(user.PublicKeys, label)
+		if pubkey == nil {
+			return ErrKeyNotFound
+		}
+		pubkey.LastUsed = time.Now()
+		pubkey.UseCount++
+		return nil
+	})
+}
+
+// SetRecoveryCodes replaces the recovery codes of the user with the given hashed codes
+func (repo *MemoryUserRepo) SetRecoveryCodes(ctx context.Context, userName string, codeHashes []string) error {
+	if err := checkUsername(userName); err != nil {
+		return err
+	}
+
+	if err := lockContext(ctx, &repo.lock); err != nil {
+		return err
+	}
+	defer repo.lock.Unlock()
+
+	user, exists := repo.users[userName]
+	if !exists {
+		return ErrUserNotFound
+	}
+	user.RecoveryCodes = append([]string(nil), codeHashes...)
+	return nil
+}
+
+// UseRecoveryCode consumes the recovery code with the given hash if the user has it
+func (repo *MemoryUserRepo) UseRecoveryCode(ctx context.Context, userName string, codeHash string) (bool, error) {
+	if err := checkUsername(userName); err != nil {
+		return false, err
+	}
+
+	if err := lockContext(ctx, &repo.lock); err != nil {
+		return false, err
+	}
+	defer repo.lock.Unlock()
+
+	user, exists := repo.users[userName]
+	if !exists {
+		return false, nil
+	}
+	for i, hash := range user.RecoveryCodes {
+		if hash == codeHash {
+			user.RecoveryCodes = append(user.RecoveryCodes[:i:i], user.RecoveryCodes[i+1:]...)
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// changeUser applies a change to a copy of the user and stores it if the change succeeds
+// The lock is held throughout, so concurrent changes to the same user cannot overwrite each other.
+func (repo *MemoryUserRepo) changeUser(ctx context.Context, userName string, change func(user *User) error) error {
+	if err := checkUsername(userName); err != nil {
+		return err
+	}
+
+	if err := lockContext(ctx, &repo.lock); err != nil {
+		return err
+	}
+	defer repo.lock.Unlock()
+
+	user, exists := repo.users[userName]
+	if !exists {
+		return ErrUserNotFound
+	}
+
+	changed := copyUser(user)
+	if err := change(changed); err != nil {
+		return err
+	}
+	return repo.updateUser(userName, *changed)
+}
+
+// MemoryNotesRepo is a NotesRepository that keeps the notes in memory
+// The notes are lost when the server stops.
+type MemoryNotesRepo struct {
+	notes map[string]NoteData
+	lock  sync.Mutex
+}
+
+// NewMemoryNotesRepo creates an empty MemoryNotesRepo
+//
+// Returns:
+//   - *MemoryNotesRepo: A pointer to the new MemoryNotesRepo
+func NewMemoryNotesRepo() *MemoryNotesRepo {
+	return &MemoryNotesRepo{notes: make(map[string]NoteData)}
+}
+
+// CreateNote stores a new note under a random ID and returns the ID
+func (repo *MemoryNotesRepo) CreateNote(ctx context.Context, username string, name string, note string) (string, error) {
+	id := make([]byte, 12)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+
+	if err := lockContext(ctx, &repo.lock); err != nil {
+		return "", err
+	}
+	defer repo.lock.Unlock()
+
+	noteData := NoteData{ID: hex.EncodeToString(id), Username: username, Name: name, Note: note}
+	repo.notes[noteData.ID] = noteData
+	return noteData.ID, nil
+}
+
+// GetNotes returns the notes of the user, ordered by ID
+func (repo *MemoryNotesRepo) GetNotes(ctx context.Context, username string) ([]NoteData, error) {
+	if err := lockContext(ctx, &repo.lock); err != nil {
+		return nil, err
+	}
+	defer repo.lock.Unlock()
+
+	var notes []NoteData
+	for _, note := range repo.notes {
+		if note.Username == username {
+			notes = append(notes, note)
+		}
+	}
+	sort.Slice(notes, func(i, j int) bool { return notes[i].ID < notes[j].ID })
+	return notes, nil
+}
+
+// GetNote returns the note with the ID, or ErrNoteNotFound if there is no such note
+func (repo *MemoryNotesRepo) GetNote(ctx context.Context, id string) (NoteData, error) {
+	if err := lockContext(ctx, &repo.lock); err != nil {
+		return NoteData{}, err
+	}
+	defer repo.lock.Unlock()
+
+	note, exists := repo.notes[id]
+	if !exists {
+		return NoteData{}, ErrNoteNotFound
+	}
+	return note, nil
+}
+
+// UpdateNote replaces the note with the ID, or returns ErrNoteNotFound if there is no such note
+func (repo *MemoryNotesRepo) UpdateNote(ctx context.Context, id string, username string, name string, note string) error {
+	if err := lockContext(ctx, &repo.lock); err != nil {
+		return err
+	}
+	defer repo.lock.Unlock()
+
+	if _, exists := repo.notes[id]; !exists {
+		return ErrNoteNotFound
+	}
+	repo.notes[id] = NoteData{ID: id, Username: username, Name: name, Note: note}
+	return nil
+}
+
+// DeleteNote deletes the note with the ID, or returns ErrNoteNotFound if there is no such note
+func (repo *MemoryNotesRepo) DeleteNote(ctx context.Context, id string) error {
+	if err := lockContext(ctx, &repo.lock); err != nil {
+		return err
+	}
+	defer repo.lock.Unlock()
+
+	if _, exists := repo.notes[id]; !exists {
+		return ErrNoteNotFound
+	}
+	delete(repo.notes, id)
+	return nil
+}
+
+// MemoryOIDCClientRepo is an OIDCClientRepository that keeps the clients in memory
+// The clients are lost when the server stops.
+type MemoryOIDCClientRepo struct {
+	clients map[string]*OIDCClient
+	lock    sync.Mutex
+}
+
+// NewMemoryOIDCClientRepo creates an empty MemoryOIDCClientRepo
+//
+// Returns:
+//   - *MemoryOIDCClientRepo: A pointer to the new MemoryOIDCClientRepo
+func NewMemoryOIDCClientRepo() *MemoryOIDCClientRepo {
+	return &MemoryOIDCClientRepo{clients: make(map[string]*OIDCClient)}
+}
+
+// CreateClient stores a newly registered client, or returns ErrClientExists if a client has the same ID
+func (repo *MemoryOIDCClientRepo) CreateClient(ctx context.Context, client *OIDCClient) error {
+	if err := lockContext(ctx, &repo.lock); err != nil {
+		return err
+	}
+	defer repo.lock.Unlock()
+
+	if _, exists := repo.clients[client.ClientID]; exists {
+		return ErrClientExists
+	}
+	stored := *client
+	stored.RedirectURIs = append([]string(nil), client.RedirectURIs...)
+	repo.clients[client.ClientID] = &stored
+	return nil
+}
+
+// GetClient returns a copy of the client, or ErrClientNotFound if no client has the ID
+func (repo *MemoryOIDCClientRepo) GetClient(ctx context.Context, clientID string) (*OIDCClient, error) {
+	if err := lockContext(ctx, &repo.lock); err != nil {
+		return nil, err
+	}
+	defer repo.lock.Unlock()
+
+	client, exists := repo.clients[clientID]
+	if !exists {
+		return nil, ErrClientNotFound
+	}
+	stored := *client
+	stored.RedirectURIs = append([]string(nil), client.RedirectURIs...)
+	return &stored, nil
+}
@@ -9,18 +9,18 @@ import (
 )
 
 type NoteData struct {
-	ID       primitive.ObjectID `bson:"_id,omitempty"` // Unique ID set by MongoDB
-	Username string             `bson:"username"`      // Username of the user
-	Name     string             `bson:"name"`          // Name of company/website for note
-	Note     string             `bson:"note"`          // Note as a string
+	ID       string // Unique ID set by the repository
+	Username string // Username of the user
+	Name     string // Name of company/website for note
+	Note     string // Note as a string
 }
 
 type NotesRepository interface {
-	CreateNote(username string, name string, note string) (*mongo.InsertOneResult, error)
-	GetNotes(username string) ([]NoteData, error)
-	GetNote(id string) (NoteData, error)
-	UpdateNote(id string, username string, name string, note string) (*mongo.UpdateResult, error)
-	DeleteNote(id string) (*mongo.DeleteResult, error)
+	CreateNote(ctx context.Context, username string, name string, note string) (string, error)
+	GetNotes(ctx context.Context, username string) ([]NoteData, error)
+	GetNote(ctx context.Context, id string) (NoteData, error)
+	UpdateNote(ctx context.Context, id string, username string, name string, note string) error
+	DeleteNote(ctx context.Context, id string) error
 }
 
 type NotesRepo struct {
@@ -29,78 +29,114 @@ type NotesRepo struct {
 
 const repoName = "user_notes"
 
+// noteDocument is how a note is stored in MongoDB, with the ID as an ObjectID
+type noteDocument struct {
+	ID       primitive.ObjectID `bson:"_id,omitempty"` // Unique ID set by MongoDB
+	Username string             `bson:"username"`      // Username of the user
+	Name     string             `bson:"name"`          // Name of company/website for note
+	Note     string             `bson:"note"`          // Note as a string
+}
+
+// toNoteData converts the stored document to a NoteData with the ID encoded in hex
+func (document *noteDocument) toNoteData() NoteData {
+	return NoteData{
+		ID:       document.ID.Hex(),
+		Username: document.Username,
+		Name:     document.Name,
+		Note:     document.Note,
+	}
+}
+
 func NewNotesRepo(db *mongo.Database) *NotesRepo {
 	return &NotesRepo{db: db}
 }
 
-func (repo *NotesRepo) CreateNote(username, name, note string) (*mongo.InsertOneResult, error) {
+// CreateNote stores a new note and returns its ID
+func (repo *NotesRepo) CreateNote(ctx context.Context, username, name, note string) (string, error) {
+	ctx, cancel := OperationContext(ctx)
+	defer cancel()
+
 	collection := repo.db.Collection(repoName)
 
-	user := NoteData{
+	document := noteDocument{
 		ID:       primitive.NewObjectID(),
 		Username: username,
 		Name:     name,
 		Note:     note,
 	}
 
-	result, err := collection.InsertOne(context.Background(), user)
+	_, err := collection.InsertOne(ctx, document)
 	if err != nil {
-		return nil, err
+		return "", err
 	}
 
-	return result, nil
+	return document.ID.Hex(), nil
 }
 
-func (repo *NotesRepo) GetNotes(username string) ([]NoteData, error) {
+func (repo *NotesRepo) GetNotes(ctx context.Context, username string) ([]NoteData, error) {
+	ctx, cancel := OperationContext(ctx)
+	defer cancel()
+
 	collection := repo.db.Collection(repoName)
 
 	filter := bson.M{"username": username}
-	cursor, err := collection.Find(context.Background(), filter)
+	cursor, err := collection.Find(ctx, filter)
 	if err != nil {
 		return nil, err
 	}
-	defer cursor.Close(context.Background())
+	defer cursor.Close(ctx)
 
-	var users []NoteData
-	for cursor.Next(context.Background()) {
-		var note NoteData
-		if err := cursor.Decode(&note); err != nil {
+	var notes []NoteData
+	for cursor.Next(ctx) {
+		var document noteDocument
+		if err := cursor.Decode(&document); err != nil {
 			return nil, err
 		}
-		users = append(users, note)
+		notes = append(notes, document.toNoteData())
 	}
 
 	if err := cursor.Err(); err != nil {
 		return nil, err
 	}
 
-	return users, nil
+	return notes, nil
 }
 
-func (repo *NotesRepo) GetNote(id string) (NoteData, error) {
+// GetNote returns the note with the ID, or ErrNoteNotFound if there is no such note
+func (repo *NotesRepo) GetNote(ctx context.Context, id string) (NoteData, error) {
+	ctx, cancel := OperationContext(ctx)
+	defer cancel()
+
 	collection := repo.db.Collection(repoName)
 
 	objectID, err := primitive.ObjectIDFromHex(id)
 	if err != nil {
-		return NoteData{}, err
+		return NoteData{}, ErrNoteNotFound
 	}
 
 	filter := bson.M{"_id": objectID}
-	var note NoteData
-	err = collection.FindOne(context.Background(), filter).Decode(&note)
+	var document noteDocument
+	err = collection.FindOne(ctx, filter).Decode(&document)
+	if err == mongo.ErrNoDocuments {
+		return NoteData{}, ErrNoteNotFound
+	}
 	if err != nil {
 		return NoteData{}, err
 	}
 
-	return note, nil
+	return document.toNoteData(), nil
 }
 
-func (repo *NotesRepo) UpdateNote(id string, username string, name string, note string) (*mongo.UpdateResult, error) {
+// UpdateNote replaces the note with the ID, or returns ErrNoteNotFound if there is no such note
+func (repo *NotesRepo) UpdateNote(ctx context.Context, id string, username string, name string, note string) error {
+	ctx, cancel := OperationContext(ctx)
+	defer cancel()
+
 	collection := repo.db.Collection(repoName)
 
 	objectID, err := primitive.ObjectIDFromHex(id)
 	if err != nil {
-		return nil, err
+		return ErrNoteNotFound
 	}
 
 	filter := bson.M{"_id": objectID}
@@ -112,27 +148,39 @@ func (repo *NotesRepo) UpdateNote(id string, username string, name string, note
 		},
 	}
 
-	result, err := collection.UpdateOne(context.Background(), filter, updatedData)
+	result, err := collection.UpdateOne(ctx, filter, updatedData)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	return result, nil
+	if result.MatchedCount == 0 {
+		return ErrNoteNotFound
+	}
+
+	return nil
 }
 
-func (repo *NotesRepo) DeleteNote(id string) (*mongo.DeleteResult, error) {
+// DeleteNote deletes the note with the ID, or returns ErrNoteNotFound if there is no such note
+func (repo *NotesRepo) DeleteNote(ctx context.Context, id string) error {
+	ctx, cancel := OperationContext(ctx)
+	defer cancel()
+
 	collection := repo.db.Collection(repoName)
 
 	objectID, err := primitive.ObjectIDFromHex(id)
 	if err != nil {
-		return nil, err
+		return ErrNoteNotFound
 	}
 
 	filter := bson.M{"_id": objectID}
-	result, err := collection.DeleteOne(context.Background(), filter)
+	result, err := collection.DeleteOne(ctx, filter)
 	if err != nil {
-		return nil, err
+		return err
+	}
+
+	if result.DeletedCount == 0 {
+		return ErrNoteNotFound
 	}
 
-	return result, nil
+	return nil
 }
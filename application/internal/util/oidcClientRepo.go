@@ -0,0 +1,173 @@
+package util
+
+import (
+	"chalmers/tkey-group22/application/internal/structs"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"net/url"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// OIDCClient represents an application registered to log its users in with the OpenID Connect provider
+type OIDCClient struct {
+	ClientID     string    `bson:"_id"`          // Random ID the client identifies itself with
+	Name         string    `bson:"name"`         // Name of the application
+	SecretHash   string    `bson:"secretHash"`   // SHA-256 hash of the client secret encoded in hex
+	RedirectURIs []string  `bson:"redirectUris"` // The only URIs users may be sent back to after logging in
+	CreatedAt    time.Time `bson:"createdAt"`    // Time the client was registered
+}
+
+// HasRedirectURI reports whether the URI is registered for the client
+// The URI must match exactly, as required by OpenID Connect
+func (client *OIDCClient) HasRedirectURI(uri string) bool {
+	for _, registered := range client.RedirectURIs {
+		if uri == registered {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckSecret reports whether the secret is the secret of the client
+func (client *OIDCClient) CheckSecret(secret string) bool {
+	return subtle.ConstantTimeCompare([]byte(HashClientSecret(secret)), []byte(client.SecretHash)) == 1
+}
+
+// HashClientSecret returns the hash a client secret is stored as
+// The secrets are long random values, so a single SHA-256 hash is enough to protect them
+//
+// Parameters:
+//   - secret: The client secret
+//
+// Returns:
+//   - string: The SHA-256 hash of the secret encoded in hex
+func HashClientSecret(secret string) string {
+	hash := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(hash[:])
+}
+
+// NewOIDCClient creates a client with a random ID and secret
+// Only the hash of the secret is kept in the client, so the secret must be handed to the application now.
+//
+// Parameters:
+//   - name: The name of the application
+//   - redirectURIs: The URIs users may be sent back to, absolute http or https URIs without a fragment
+//
+// Returns:
+//   - *OIDCClient: The new client, not yet stored
+//   - string: The client secret
+//   - error: An error if the name or a redirect URI is invalid, or the random generation fails
+func NewOIDCClient(name string, redirectURIs []string) (*OIDCClient, string, error) {
+	if name == "" {
+		return nil, "", &structs.ErrorInputNotSanitized{Message: "Client name cannot be empty"}
+	}
+	if len(redirectURIs) == 0 {
+		return nil, "", &structs.ErrorInputNotSanitized{Message: "At least one redirect URI is required"}
+	}
+	for _, redirectURI := range redirectURIs {
+		parsed, err := url.Parse(redirectURI)
+		if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" || parsed.Fragment != "" {
+			return nil, "", &structs.ErrorInputNotSanitized{Message: "Invalid redirect URI: " + redirectURI}
+		}
+	}
+
+	clientID := make([]byte, 16)
+	if _, err := rand.Read(clientID); err != nil {
+		return nil, "", err
+	}
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, "", err
+	}
+	encodedSecret := base64.RawURLEncoding.EncodeToString(secret)
+
+	client := &OIDCClient{
+		ClientID:     hex.EncodeToString(clientID),
+		Name:         name,
+		SecretHash:   HashClientSecret(encodedSecret),
+		RedirectURIs: redirectURIs,
+		CreatedAt:    time.Now(),
+	}
+	return client, encodedSecret, nil
+}
+
+// Interface for OIDCClientRepository
+// This interface defines the methods that an OIDCClientRepository should implement
+type OIDCClientRepository interface {
+	CreateClient(ctx context.Context, client *OIDCClient) error
+	GetClient(ctx context.Context, clientID string) (*OIDCClient, error)
+}
+
+// OIDCClientRepo holds the database reference
+type OIDCClientRepo struct {
+	db *mongo.Database
+}
+
+// oidcClientCollection is the MongoDB collection the registered clients are kept in
+const oidcClientCollection = "oidc_clients"
+
+// NewOIDCClientRepo initializes a new OIDCClientRepo with a given database
+//
+// Parameters:
+//   - db: The MongoDB database reference
+//
+// Returns:
+//   - *OIDCClientRepo: A pointer to the new OIDCClientRepo
+func NewOIDCClientRepo(db *mongo.Database) *OIDCClientRepo {
+	return &OIDCClientRepo{db: db}
+}
+
+// CreateClient stores a newly registered client
+//
+// Parameters:
+//   - ctx: The context of the request, the operation is abandoned when it ends or after OperationTimeout
+//   - client: The client to store, see NewOIDCClient
+//
+// Returns:
+//   - error: ErrClientExists if a client has the same ID, or an error if the insert operation fails
+func (repo *OIDCClientRepo) CreateClient(ctx context.Context, client *OIDCClient) error {
+	ctx, cancel := OperationContext(ctx)
+	defer cancel()
+
+	collection := repo.db.Collection(oidcClientCollection)
+
+	_, err := collection.InsertOne(ctx, client)
+	if mongo.IsDuplicateKeyError(err) {
+		return ErrClientExists
+	}
+	return err
+}
+
+// GetClient retrieves a registered client by its ID
+//
+// Parameters:
+//   - ctx: The context of the request, the operation is abandoned when it ends or after OperationTimeout
+//   - clientID: The ID of the client
+//
+// Returns:
+//   - *OIDCClient: The client
+//   - error: ErrClientNotFound if no client has the ID, or the database error
+func (repo *OIDCClientRepo) GetClient(ctx context.Context, clientID string) (*OIDCClient, error) {
+	ctx, cancel := OperationContext(ctx)
+	defer cancel()
+
+	collection := repo.db.Collection(oidcClientCollection)
+
+	var client OIDCClient
+	err := collection.FindOne(ctx, bson.M{"_id": clientID}).Decode(&client)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrClientNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &client, nil
+}
@@ -0,0 +1,164 @@
+package util
+
+import (
+	"context"
+	"database/sql"
+	"strconv"
+)
+
+// SQLiteNotesRepo is a NotesRepository backed by an SQLite database, see db.OpenSQLite for the tables
+// Notes belong to a registered user and are deleted together with it.
+type SQLiteNotesRepo struct {
+	db *sql.DB
+}
+
+// NewSQLiteNotesRepo initializes a new SQLiteNotesRepo with a given database
+//
+// Parameters:
+//   - db: The SQLite database, opened with db.OpenSQLite
+//
+// Returns:
+//   - *SQLiteNotesRepo: A pointer to the new SQLiteNotesRepo
+func NewSQLiteNotesRepo(db *sql.DB) *SQLiteNotesRepo {
+	return &SQLiteNotesRepo{db: db}
+}
+
+// CreateNote stores a new note and returns its ID, or ErrUserNotFound if the user is not registered
+func (repo *SQLiteNotesRepo) CreateNote(ctx context.Context, username string, name string, note string) (string, error) {
+	ctx, cancel := OperationContext(ctx)
+	defer cancel()
+
+	var noteID int64
+	err := repo.db.QueryRowContext(ctx,
+		"INSERT INTO notes (user_id, name, note) SELECT id, ?, ? FROM users WHERE username = ? RETURNING id",
+		name, note, username).Scan(&noteID)
+	if err == sql.ErrNoRows {
+		return "", ErrUserNotFound
+	}
+	if err != nil {
+		return "", err
+	}
+
+	return strconv.FormatInt(noteID, 10), nil
+}
+
+// GetNotes returns the notes of the user in the order they were created
+func (repo *SQLiteNotesRepo) GetNotes(ctx context.Context, username string) ([]NoteData, error) {
+	ctx, cancel := OperationContext(ctx)
+	defer cancel()
+
+	rows, err := repo.db.QueryContext(ctx,
+		`SELECT notes.id, users.username, notes.name, notes.note
+		FROM notes JOIN users ON users.id = notes.user_id
+		WHERE users.username = ? ORDER BY notes.id`, username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var notes []NoteData
+	for rows.Next() {
+		note, err := scanNote(rows)
+		if err != nil {
+			return nil, err
+		}
+		notes = append(notes, note)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return notes, nil
+}
+
+// GetNote returns the note with the ID, or ErrNoteNotFound if there is no such note
+func (repo *SQLiteNotesRepo) GetNote(ctx context.Context, id string) (NoteData, error) {
+	ctx, cancel := OperationContext(ctx)
+	defer cancel()
+
+	noteID, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		return NoteData{}, ErrNoteNotFound
+	}
+
+	row := repo.db.QueryRowContext(ctx,
+		`SELECT notes.id, users.username, notes.name, notes.note
+		FROM notes JOIN users ON users.id = notes.user_id
+		WHERE notes.id = ?`, noteID)
+	note, err := scanNote(row)
+	if err == sql.ErrNoRows {
+		return NoteData{}, ErrNoteNotFound
+	}
+	if err != nil {
+		return NoteData{}, err
+	}
+
+	return note, nil
+}
+
+// UpdateNote replaces the note with the ID, or returns ErrNoteNotFound if there is no such note
+// The note is given to the user with the username, which must be registered.
+func (repo *SQLiteNotesRepo) UpdateNote(ctx context.Context, id string, username string, name string, note string) error {
+	ctx, cancel := OperationContext(ctx)
+	defer cancel()
+
+	noteID, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		return ErrNoteNotFound
+	}
+
+	userID, err := getSQLiteUserID(ctx, repo.db, username)
+	if err != nil {
+		return err
+	}
+
+	result, err := repo.db.ExecContext(ctx,
+		"UPDATE notes SET user_id = ?, name = ?, note = ? WHERE id = ?", userID, name, note, noteID)
+	if err != nil {
+		return err
+	}
+
+	return checkNoteAffected(result)
+}
+
+// DeleteNote deletes the note with the ID, or returns ErrNoteNotFound if there is no such note
+func (repo *SQLiteNotesRepo) DeleteNote(ctx context.Context, id string) error {
+	ctx, cancel := OperationContext(ctx)
+	defer cancel()
+
+	noteID, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		return ErrNoteNotFound
+	}
+
+	result, err := repo.db.ExecContext(ctx, "DELETE FROM notes WHERE id = ?", noteID)
+	if err != nil {
+		return err
+	}
+
+	return checkNoteAffected(result)
+}
+
+// scanNote reads a note selected as id, username, name and note
+func scanNote(row interface{ Scan(dest ...any) error }) (NoteData, error) {
+	var noteID int64
+	var note NoteData
+	if err := row.Scan(&noteID, &note.Username, &note.Name, &note.Note); err != nil {
+		return NoteData{}, err
+	}
+	note.ID = strconv.FormatInt(noteID, 10)
+	return note, nil
+}
+
+// checkNoteAffected returns ErrNoteNotFound if the statement did not change any note
+func checkNoteAffected(result sql.Result) error {
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return ErrNoteNotFound
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+package util
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"time"
+)
+
+// SQLiteOIDCClientRepo is an OIDCClientRepository backed by an SQLite database, see db.OpenSQLite for the tables
+type SQLiteOIDCClientRepo struct {
+	db *sql.DB
+}
+
+// NewSQLiteOIDCClientRepo initializes a new SQLiteOIDCClientRepo with a given database
+//
+// Parameters:
+//   - db: The SQLite database, opened with db.OpenSQLite
+//
+// Returns:
+//   - *SQLiteOIDCClientRepo: A pointer to the new SQLiteOIDCClientRepo
+func NewSQLiteOIDCClientRepo(db *sql.DB) *SQLiteOIDCClientRepo {
+	return &SQLiteOIDCClientRepo{db: db}
+}
+
+// CreateClient stores a newly registered client
+// The redirect URIs are stored as a JSON array.
+//
+// Returns:
+//   - error: ErrClientExists if a client has the same ID, or an error if the insert fails
+func (repo *SQLiteOIDCClientRepo) CreateClient(ctx context.Context, client *OIDCClient) error {
+	ctx, cancel := OperationContext(ctx)
+	defer cancel()
+
+	redirectURIs, err := json.Marshal(client.RedirectURIs)
+	if err != nil {
+		return err
+	}
+
+	_, err = repo.db.ExecContext(ctx,
+		"INSERT INTO oidc_clients (client_id, name, secret_hash, redirect_uris, created_at) VALUES (?, ?, ?, ?, ?)",
+		client.ClientID, client.Name, client.SecretHash, string(redirectURIs), client.CreatedAt.UnixNano())
+	if isUniqueViolation(err) {
+		return ErrClientExists
+	}
+	return err
+}
+
+// GetClient retrieves a registered client by its ID
+//
+// Returns:
+//   - *OIDCClient: The client
+//   - error: ErrClientNotFound if no client has the ID, or the database error
+func (repo *SQLiteOIDCClientRepo) GetClient(ctx context.Context, clientID string) (*OIDCClient, error) {
+	ctx, cancel := OperationContext(ctx)
+	defer cancel()
+
+	var client OIDCClient
+	var redirectURIs string
+	var createdAt int64
+	err := repo.db.QueryRowContext(ctx,
+		"SELECT client_id, name, secret_hash, redirect_uris, created_at FROM oidc_clients WHERE client_id = ?",
+		clientID).Scan(&client.ClientID, &client.Name, &client.SecretHash, &redirectURIs, &createdAt)
+	if err == sql.ErrNoRows {
+		return nil, ErrClientNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal([]byte(redirectURIs), &client.RedirectURIs); err != nil {
+		return nil, err
+	}
+	client.CreatedAt = time.Unix(0, createdAt)
+
+	return &client, nil
+}
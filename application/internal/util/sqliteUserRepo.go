@@ -0,0 +1,463 @@
+package util
+
+import (
+	"context"
+	"crypto/ed25519"
+	"database/sql"
+	"errors"
+	"time"
+
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+// SQLiteUserRepo is a UserRepository backed by an SQLite database, see db.OpenSQLite for the tables
+// It lets the backend run as a single binary without a database server.
+type SQLiteUserRepo struct {
+	db *sql.DB
+}
+
+// NewSQLiteUserRepo initializes a new SQLiteUserRepo with a given database
+//
+// Parameters:
+//   - db: The SQLite database, opened with db.OpenSQLite
+//
+// Returns:
+//   - *SQLiteUserRepo: A pointer to the new SQLiteUserRepo
+func NewSQLiteUserRepo(db *sql.DB) *SQLiteUserRepo {
+	return &SQLiteUserRepo{db: db}
+}
+
+// sqlQuerier is implemented by both *sql.DB and *sql.Tx, so that queries can be run inside a transaction or not
+type sqlQuerier interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// isUniqueViolation reports whether the error is caused by a UNIQUE or PRIMARY KEY constraint
+func isUniqueViolation(err error) bool {
+	var sqliteErr *sqlite.Error
+	if !errors.As(err, &sqliteErr) {
+		return false
+	}
+	return sqliteErr.Code() == sqlite3.SQLITE_CONSTRAINT_UNIQUE || sqliteErr.Code() == sqlite3.SQLITE_CONSTRAINT_PRIMARYKEY
+}
+
+// toUnixNano stores a time as nanoseconds since the epoch, and a zero time as NULL
+func toUnixNano(t time.Time) sql.NullInt64 {
+	if t.IsZero() {
+		return sql.NullInt64{}
+	}
+	return sql.NullInt64{Int64: t.UnixNano(), Valid: true}
+}
+
+// fromUnixNano reads a time stored with toUnixNano
+func fromUnixNano(nanos sql.NullInt64) time.Time {
+	if !nanos.Valid {
+		return time.Time{}
+	}
+	return time.Unix(0, nanos.Int64)
+}
+
+// inTransaction runs the function in a transaction, which is committed if it succeeds and rolled back otherwise
+func (repo *SQLiteUserRepo) inTransaction(ctx context.Context, run func(tx *sql.Tx) error) error {
+	tx, err := repo.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if err := run(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// CreateUser inserts a new user with the specified username and public key and label, see UserRepo.CreateUser
+//
+// Returns:
+//   - *User: The new user.
+//   - error: An ErrorInputNotSanitized if the input is invalid, ErrUserExists if the username is taken,
+//     or an error if the insert fails.
+func (repo *SQLiteUserRepo) CreateUser(ctx context.Context, userName string, pubkey ed25519.PublicKey, label string, signerApp SignerApp) (*User, error) {
+	ctx, cancel := OperationContext(ctx)
+	defer cancel()
+
+	user, err := newUser(userName, pubkey, label, signerApp)
+	if err != nil {
+		return nil, err
+	}
+
+	err = repo.inTransaction(ctx, func(tx *sql.Tx) error {
+		result, err := tx.ExecContext(ctx, "INSERT INTO users (username) VALUES (?)", userName)
+		if isUniqueViolation(err) {
+			return ErrUserExists
+		}
+		if err != nil {
+			return err
+		}
+
+		userID, err := result.LastInsertId()
+		if err != nil {
+			return err
+		}
+		return insertPublicKeys(ctx, tx, userID, user.PublicKeys)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return user, nil
+}
+
+// GetUser retrieves a user together with its public keys and recovery codes
+//
+// Returns:
+//   - *User: A pointer to the User struct containing the user's information
+//   - error: ErrUserNotFound if there is no such user, or an error if the retrieval fails
+func (repo *SQLiteUserRepo) GetUser(ctx context.Context, userName string) (*User, error) {
+	ctx, cancel := OperationContext(ctx)
+	defer cancel()
+
+	if err := checkUsername(userName); err != nil {
+		return nil, err
+	}
+
+	user, _, err := getSQLiteUser(ctx, repo.db, userName)
+	return user, err
+}
+
+// UpdateUser replaces the username and the public keys of the user, see UserRepo.UpdateUser
+//
+// Returns:
+//   - error: ErrUserNotFound if there is no such user, ErrUserExists if the new username is taken,
+//     or an error if the update fails
+func (repo *SQLiteUserRepo) UpdateUser(ctx context.Context, userName string, updatedUser User) error {
+	ctx, cancel := OperationContext(ctx)
+	defer cancel()
+
+	if err := checkUsername(userName); err != nil {
+		return err
+	}
+	if err := checkUsername(updatedUser.Username); err != nil {
+		return err
+	}
+
+	return repo.inTransaction(ctx, func(tx *sql.Tx) error {
+		userID, err := getSQLiteUserID(ctx, tx, userName)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.ExecContext(ctx, "UPDATE users SET username = ? WHERE id = ?", updatedUser.Username, userID)
+		if isUniqueViolation(err) {
+			return ErrUserExists
+		}
+		if err != nil {
+			return err
+		}
+
+		return replacePublicKeys(ctx, tx, userID, updatedUser.PublicKeys)
+	})
+}
+
+// DeleteUser deletes a user, its public keys, recovery codes and notes
+//
+// Returns:
+//   - error: ErrUserNotFound if there is no such user, or an error if the deletion fails
+func (repo *SQLiteUserRepo) DeleteUser(ctx context.Context, userName string) error {
+	ctx, cancel := OperationContext(ctx)
+	defer cancel()
+
+	if err := checkUsername(userName); err != nil {
+		return err
+	}
+
+	result, err := repo.db.ExecContext(ctx, "DELETE FROM users WHERE username = ?", userName)
+	if err != nil {
+		return err
+	}
+
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if deleted == 0 {
+		return ErrUserNotFound
+	}
+
+	return nil
+}
+
+// GetPublicKeyLabels retrieves the labels of the public keys of the user that have not been revoked
+func (repo *SQLiteUserRepo) GetPublicKeyLabels(ctx context.Context, userName string) ([]string, error) {
+	user, err := repo.GetUser(ctx, userName)
+	if err != nil {
+		return nil, err
+	}
+
+	return publicKeyLabels(user), nil
+}
+
+// AddPublicKey adds a new public key to the user, see UserRepo.AddPublicKey
+func (repo *SQLiteUserRepo) AddPublicKey(ctx context.Context, userName string, newPubKey ed25519.PublicKey, label string, signerApp SignerApp) error {
+	return repo.changeUser(ctx, userName, func(user *User) error {
+		return addPublicKey(user, newPubKey, label, signerApp)
+	})
+}
+
+// RecoverPublicKey replaces all keys of the user with a new public key, see UserRepo.RecoverPublicKey
+func (repo *SQLiteUserRepo) RecoverPublicKey(ctx context.Context, userName string, newPubKey ed25519.PublicKey, label string, signerApp SignerApp) ([]string, error) {
+	var revoked []string
+	err := repo.changeUser(ctx, userName, func(user *User) error {
+		var err error
+		revoked, err = recoverPublicKey(user, newPubKey, label, signerApp)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return revoked, nil
+}
+
+// RemovePublicKey revokes a public key of the user, see UserRepo.RemovePublicKey
+func (repo *SQLiteUserRepo) RemovePublicKey(ctx context.Context, userName string, label string) error {
+	return repo.changeUser(ctx, userName, func(user *User) error {
+		return removePublicKey(user, label)
+	})
+}
+
+// RenamePublicKey changes the label of a public key of the user, see UserRepo.RenamePublicKey
+func (repo *SQLiteUserRepo) RenamePublicKey(ctx context.Context, userName string, label string, newLabel string) error {
+	return repo.changeUser(ctx, userName, func(user *User) error {
+		return renamePublicKey(user, label, newLabel)
+	})
+}
+
+// SuspendPublicKey suspends a public key of the user, see UserRepo.SuspendPublicKey
+func (repo *SQLiteUserRepo) SuspendPublicKey(ctx context.Context, userName string, label string, reason string) error {
+	return repo.changeUser(ctx, userName, func(user *User) error {
+		return suspendPublicKey(user, label, reason)
+	})
+}
+
+// ReactivatePublicKey makes a suspended public key of the user active again, see UserRepo.ReactivatePublicKey
+func (repo *SQLiteUserRepo) ReactivatePublicKey(ctx context.Context, userName string, label string) error {
+	return repo.changeUser(ctx, userName, func(user *User) error {
+		return reactivatePublicKey(user, label)
+	})
+}
+
+// RecordKeyUse records that the public key with the given label was used to log in
+//
+// Returns:
+//   - error: ErrKeyNotFound if the user has no key with the label, or an error if the update fails
+func (repo *SQLiteUserRepo) RecordKeyUse(ctx context.Context, userName string, label string) error {
+	ctx, cancel := OperationContext(ctx)
+	defer cancel()
+
+	if err := checkUsername(userName); err != nil {
+		return err
+	}
+
+	result, err := repo.db.ExecContext(ctx,
+		`UPDATE public_keys SET last_used = ?, use_count = use_count + 1
+		WHERE label = ? AND user_id = (SELECT id FROM users WHERE username = ?)`,
+		time.Now().UnixNano(), label, userName)
+	if err != nil {
+		return err
+	}
+
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if updated == 0 {
+		return ErrKeyNotFound
+	}
+
+	return nil
+}
+
+// SetRecoveryCodes replaces the recovery codes of the user with the given hashed codes
+//
+// Returns:
+//   - error: ErrUserNotFound if there is no such user, or an error if the update fails
+func (repo *SQLiteUserRepo) SetRecoveryCodes(ctx context.Context, userName string, codeHashes []string) error {
+	ctx, cancel := OperationContext(ctx)
+	defer cancel()
+
+	if err := checkUsername(userName); err != nil {
+		return err
+	}
+
+	return repo.inTransaction(ctx, func(tx *sql.Tx) error {
+		userID, err := getSQLiteUserID(ctx, tx, userName)
+		if err != nil {
+			return err
+		}
+
+		if _, err := tx.ExecContext(ctx, "DELETE FROM recovery_codes WHERE user_id = ?", userID); err != nil {
+			return err
+		}
+		for _, codeHash := range codeHashes {
+			if _, err := tx.ExecContext(ctx, "INSERT OR IGNORE INTO recovery_codes (user_id, code_hash) VALUES (?, ?)", userID, codeHash); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// UseRecoveryCode consumes the recovery code with the given hash if the user has it
+// The code is deleted by the statement that matches it, so a code can only be used once.
+//
+// Returns:
+//   - bool: true if the code was valid and has been consumed, otherwise false.
+//   - error: An error if the deletion fails.
+func (repo *SQLiteUserRepo) UseRecoveryCode(ctx context.Context, userName string, codeHash string) (bool, error) {
+	ctx, cancel := OperationContext(ctx)
+	defer cancel()
+
+	if err := checkUsername(userName); err != nil {
+		return false, err
+	}
+
+	result, err := repo.db.ExecContext(ctx,
+		"DELETE FROM recovery_codes WHERE code_hash = ? AND user_id = (SELECT id FROM users WHERE username = ?)",
+		codeHash, userName)
+	if err != nil {
+		return false, err
+	}
+
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return deleted == 1, nil
+}
+
+// changeUser reads the user, applies a change to its public keys and writes them back in one transaction
+func (repo *SQLiteUserRepo) changeUser(ctx context.Context, userName string, change func(user *User) error) error {
+	ctx, cancel := OperationContext(ctx)
+	defer cancel()
+
+	if err := checkUsername(userName); err != nil {
+		return err
+	}
+
+	return repo.inTransaction(ctx, func(tx *sql.Tx) error {
+		user, userID, err := getSQLiteUser(ctx, tx, userName)
+		if err != nil {
+			return err
+		}
+
+		if err := change(user); err != nil {
+			return err
+		}
+
+		return replacePublicKeys(ctx, tx, userID, user.PublicKeys)
+	})
+}
+
+// getSQLiteUserID returns the row ID of the user, or ErrUserNotFound if there is no such user
+func getSQLiteUserID(ctx context.Context, querier sqlQuerier, userName string) (int64, error) {
+	var userID int64
+	err := querier.QueryRowContext(ctx, "SELECT id FROM users WHERE username = ?", userName).Scan(&userID)
+	if err == sql.ErrNoRows {
+		return 0, ErrUserNotFound
+	}
+	return userID, err
+}
+
+// getSQLiteUser reads the user with its public keys, in the order they were added, and its recovery codes
+func getSQLiteUser(ctx context.Context, querier sqlQuerier, userName string) (*User, int64, error) {
+	userID, err := getSQLiteUserID(ctx, querier, userName)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	user := &User{Username: userName, PublicKeys: []PublicKey{}}
+
+	rows, err := querier.QueryContext(ctx,
+		`SELECT label, key, created_at, last_used, use_count, signer_app_name, signer_app_digest,
+			status, status_reason, status_changed_at
+		FROM public_keys WHERE user_id = ? ORDER BY id`, userID)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var pubkey PublicKey
+		var createdAt, lastUsed, statusChangedAt sql.NullInt64
+		err := rows.Scan(&pubkey.Label, &pubkey.Key, &createdAt, &lastUsed, &pubkey.UseCount,
+			&pubkey.SignerApp.Name, &pubkey.SignerApp.Digest, &pubkey.Status, &pubkey.StatusReason, &statusChangedAt)
+		if err != nil {
+			return nil, 0, err
+		}
+		pubkey.CreatedAt = fromUnixNano(createdAt)
+		pubkey.LastUsed = fromUnixNano(lastUsed)
+		pubkey.StatusChangedAt = fromUnixNano(statusChangedAt)
+		user.PublicKeys = append(user.PublicKeys, pubkey)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, err
+	}
+
+	codeRows, err := querier.QueryContext(ctx, "SELECT code_hash FROM recovery_codes WHERE user_id = ? ORDER BY rowid", userID)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer codeRows.Close()
+
+	for codeRows.Next() {
+		var codeHash string
+		if err := codeRows.Scan(&codeHash); err != nil {
+			return nil, 0, err
+		}
+		user.RecoveryCodes = append(user.RecoveryCodes, codeHash)
+	}
+	if err := codeRows.Err(); err != nil {
+		return nil, 0, err
+	}
+
+	return user, userID, nil
+}
+
+// replacePublicKeys replaces all public keys of the user with the given keys
+func replacePublicKeys(ctx context.Context, tx *sql.Tx, userID int64, keys []PublicKey) error {
+	if _, err := tx.ExecContext(ctx, "DELETE FROM public_keys WHERE user_id = ?", userID); err != nil {
+		return err
+	}
+	return insertPublicKeys(ctx, tx, userID, keys)
+}
+
+// insertPublicKeys adds the keys to the user in order
+// The unique constraints on the label and key are reported as ErrLabelExists and ErrKeyExists
+func insertPublicKeys(ctx context.Context, tx *sql.Tx, userID int64, keys []PublicKey) error {
+	for i, pubkey := range keys {
+		status := pubkey.Status
+		if status == "" {
+			status = KeyStatusActive
+		}
+
+		_, err := tx.ExecContext(ctx,
+			`INSERT INTO public_keys (user_id, label, key, created_at, last_used, use_count, signer_app_name,
+				signer_app_digest, status, status_reason, status_changed_at)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			userID, pubkey.Label, pubkey.Key, toUnixNano(pubkey.CreatedAt), toUnixNano(pubkey.LastUsed), pubkey.UseCount,
+			pubkey.SignerApp.Name, pubkey.SignerApp.Digest, status, pubkey.StatusReason, toUnixNano(pubkey.StatusChangedAt))
+		if isUniqueViolation(err) {
+			if findPublicKey(keys[:i], pubkey.Label) != nil {
+				return ErrLabelExists
+			}
+			return ErrKeyExists
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,74 @@
+package util
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// DefaultOperationTimeout is how long a single repository operation may take when nothing is configured
+const DefaultOperationTimeout = 5 * time.Second
+
+// OperationTimeout is how long a single repository operation may take, see LoadOperationTimeout
+// The operation is abandoned when it takes longer, or when the context it was called with ends first.
+var OperationTimeout = DefaultOperationTimeout
+
+// LoadOperationTimeout reads how long a single repository operation may take from DB_TIMEOUT
+// The duration is given in the format of time.ParseDuration, e.g. "5s".
+//
+// Returns:
+//   - time.Duration: The configured timeout, or DefaultOperationTimeout if DB_TIMEOUT is not set
+//   - error: An error if DB_TIMEOUT is invalid
+func LoadOperationTimeout() (time.Duration, error) {
+	value := os.Getenv("DB_TIMEOUT")
+	if value == "" {
+		return DefaultOperationTimeout, nil
+	}
+
+	timeout, err := time.ParseDuration(value)
+	if err != nil || timeout <= 0 {
+		return DefaultOperationTimeout, fmt.Errorf("invalid DB_TIMEOUT: %s", value)
+	}
+	return timeout, nil
+}
+
+// OperationContext derives the context of a single repository or store operation from the context it was called with
+// The returned cancel function must be called when the operation is done.
+//
+// Parameters:
+//   - ctx: The context the operation was called with, usually that of the request
+//
+// Returns:
+//   - context.Context: The context to run the operation with, ending after OperationTimeout at the latest
+//   - context.CancelFunc: The function releasing the context
+func OperationContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(ctx, OperationTimeout)
+}
+
+// IsTimeout reports whether a repository error means that the database did not answer before the deadline
+//
+// Parameters:
+//   - err: The error returned by a repository
+//
+// Returns:
+//   - bool: True if the operation timed out
+func IsTimeout(err error) bool {
+	// Also true for context.DeadlineExceeded, which is what the other databases return
+	return mongo.IsTimeout(err)
+}
+
+// IsUnavailable reports whether a repository error means that the database could not be reached,
+// or that the request the operation was made for was cancelled
+//
+// Parameters:
+//   - err: The error returned by a repository
+//
+// Returns:
+//   - bool: True if the operation could not be made
+func IsUnavailable(err error) bool {
+	return errors.Is(err, context.Canceled) || mongo.IsNetworkError(err)
+}
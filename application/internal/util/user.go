@@ -0,0 +1,447 @@
+package util
+
+import (
+	"chalmers/tkey-group22/application/internal/structs"
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"regexp"
+	"time"
+)
+
+// User struct represents a user in DB
+// It contains the user's username, public keys and recovery codes
+type User struct {
+	Username   string      `bson:"username"`   // Username of the user
+	PublicKeys []PublicKey `bson:"publicKeys"` // Public key of the user
+
+	RecoveryCodes []string `bson:"recoveryCodes,omitempty"` // SHA-256 hashes of the unused recovery codes, encoded in hex
+}
+
+// PublicKey represents a public key of a user together with metadata about its use
+type PublicKey struct {
+	Label     string    `bson:"label"`               // Label for the public key
+	Key       string    `bson:"key"`                 // Public key encoded in base64
+	CreatedAt time.Time `bson:"createdAt,omitempty"` // Time the key was registered
+	LastUsed  time.Time `bson:"lastUsed,omitempty"`  // Time of the last successful login with the key
+	UseCount  int64     `bson:"useCount"`            // Number of successful logins with the key
+	SignerApp SignerApp `bson:"signerApp"`           // TKey signer app the client reported when the key was registered
+
+	Status          string    `bson:"status,omitempty"`          // One of KeyStatusActive, KeyStatusSuspended or KeyStatusRevoked
+	StatusReason    string    `bson:"statusReason,omitempty"`    // Reason given when the key was suspended or revoked
+	StatusChangedAt time.Time `bson:"statusChangedAt,omitempty"` // Time the status last changed
+}
+
+// Statuses a public key can have
+// Only active keys can be used to log in. Suspended keys can be reactivated, while revoked
+// keys are kept for audit purposes and can never be used or added again.
+const (
+	KeyStatusActive    = "active"
+	KeyStatusSuspended = "suspended"
+	KeyStatusRevoked   = "revoked"
+)
+
+// IsActive reports whether the key can be used to log in
+// Keys stored before statuses were introduced have no status and are treated as active
+func (pubkey PublicKey) IsActive() bool {
+	return pubkey.Status == "" || pubkey.Status == KeyStatusActive
+}
+
+// SignerApp describes the TKey device app that produced a public key, as reported by the client
+type SignerApp struct {
+	Name   string `bson:"name,omitempty"`   // Name of the device app, e.g. "tk1  sign"
+	Digest string `bson:"digest,omitempty"` // SHA-512 digest of the device app binary encoded in hex
+}
+
+// Interface for UserRepository
+// This interface defines the methods that a UserRepository should implement
+// Implementations report a missing user with ErrUserNotFound, invalid input with a structs.ErrorInputNotSanitized,
+// and a change that breaks the rules for public keys with one of the other errors in errors.go
+// Every method is bounded by the context, and by OperationTimeout for the databases; see IsTimeout and IsUnavailable
+type UserRepository interface {
+	CreateUser(ctx context.Context, userName string, pubkey ed25519.PublicKey, label string, signerApp SignerApp) (*User, error)
+	GetUser(ctx context.Context, username string) (*User, error)
+	UpdateUser(ctx context.Context, userName string, updatedUser User) error
+	DeleteUser(ctx context.Context, userName string) error
+	AddPublicKey(ctx context.Context, userName string, newPubKey ed25519.PublicKey, label string, signerApp SignerApp) error
+	RecoverPublicKey(ctx context.Context, userName string, newPubKey ed25519.PublicKey, label string, signerApp SignerApp) ([]string, error)
+	RemovePublicKey(ctx context.Context, userName string, label string) error
+	RenamePublicKey(ctx context.Context, userName string, label string, newLabel string) error
+	SuspendPublicKey(ctx context.Context, userName string, label string, reason string) error
+	ReactivatePublicKey(ctx context.Context, userName string, label string) error
+	GetPublicKeyLabels(ctx context.Context, userName string) ([]string, error)
+	RecordKeyUse(ctx context.Context, userName string, label string) error
+	SetRecoveryCodes(ctx context.Context, userName string, codeHashes []string) error
+	UseRecoveryCode(ctx context.Context, userName string, codeHash string) (bool, error)
+}
+
+// Max num of keys a single user can have
+const MaxPublicKeys = 5
+
+// Max length of the signer app name reported by the client
+const maxSignerAppNameLength = 64
+
+// Max length of the reason given when suspending a key
+const maxStatusReasonLength = 200
+
+// The rules for users and their public keys below are shared by all UserRepository implementations.
+// They check the input and change a user that was read from the store, which then writes it back.
+
+// newUser checks the input for a new user and creates it with its first public key
+// The public key is encoded to base64 for storing.
+//
+// Parameters:
+//   - userName: The username of the new user.
+//   - pubkey: The ed25519 public key of the new user.
+//   - label: The label for the public key.
+//   - signerApp: The TKey signer app reported by the client, may be empty.
+//
+// Returns:
+//   - *User: The new user.
+//   - error: An ErrorInputNotSanitized if the input is invalid.
+func newUser(userName string, pubkey ed25519.PublicKey, label string, signerApp SignerApp) (*User, error) {
+	// Check that username is sanitized
+	if err := checkUsername(userName); err != nil {
+		return nil, err
+	}
+	// Check that the label is sanitized
+	if !isSanitized(label) {
+		return nil, &structs.ErrorInputNotSanitized{Message: "Label can only contain alphanumeric characters [a-z, A-Z, 0-9]"}
+	}
+
+	// check that username is not empty
+	if userName == "" {
+		return nil, &structs.ErrorInputNotSanitized{Message: "Username cannot be empty"}
+	}
+
+	// Check that the label is not empty
+	if label == "" {
+		return nil, &structs.ErrorInputNotSanitized{Message: "Label cannot be empty"}
+	}
+
+	// Check that the reported signer app is well formed
+	if err := validateSignerApp(signerApp); err != nil {
+		return nil, err
+	}
+
+	user := &User{
+		Username: userName,
+		PublicKeys: []PublicKey{
+			{
+				Key:       base64.StdEncoding.EncodeToString(pubkey),
+				Label:     label,
+				CreatedAt: time.Now(),
+				SignerApp: signerApp,
+				Status:    KeyStatusActive,
+			},
+		},
+	}
+	return user, nil
+}
+
+// checkUsername checks that a username only contains alphanumeric characters
+func checkUsername(userName string) error {
+	if !isSanitized(userName) {
+		return &structs.ErrorInputNotSanitized{Message: "Username can only contain alphanumeric characters [a-z, A-Z, 0-9]"}
+	}
+	return nil
+}
+
+// checkLabel checks that a label only contains alphanumeric characters
+func checkLabel(label string) error {
+	if !isSanitized(label) {
+		return &structs.ErrorInputNotSanitized{Message: "Label can only contain alphanumeric characters [a-z, A-Z, 0-9]"}
+	}
+	return nil
+}
+
+// publicKeyLabels returns the labels of the keys of the user that have not been revoked
+func publicKeyLabels(user *User) []string {
+	labels := make([]string, 0, len(user.PublicKeys))
+	for _, pubkey := range user.PublicKeys {
+		if pubkey.Status != KeyStatusRevoked {
+			labels = append(labels, pubkey.Label)
+		}
+	}
+	return labels
+}
+
+// addPublicKey adds a new public key to the user's list of public keys
+// Revoked keys do not count towards MaxPublicKeys, but a revoked key can never be added again.
+//
+// Parameters:
+//   - user: The user to change.
+//   - newPubKey: The new ed25519 public key to be added.
+//   - label: The label for the new public key.
+//   - signerApp: The TKey signer app reported by the client, may be empty.
+//
+// Returns:
+//   - error: An ErrorInputNotSanitized, ErrMaxPublicKeys, ErrKeyRevoked, ErrKeyExists or ErrLabelExists.
+func addPublicKey(user *User, newPubKey ed25519.PublicKey, label string, signerApp SignerApp) error {
+	if err := checkLabel(label); err != nil {
+		return err
+	}
+
+	// Check that the reported signer app is well formed
+	if err := validateSignerApp(signerApp); err != nil {
+		return err
+	}
+
+	if countUnrevokedKeys(user.PublicKeys) >= MaxPublicKeys {
+		return ErrMaxPublicKeys
+	}
+
+	encodedPubKey := base64.StdEncoding.EncodeToString(newPubKey)
+	for _, pubkey := range user.PublicKeys {
+		if pubkey.Key == encodedPubKey && pubkey.Status == KeyStatusRevoked {
+			return ErrKeyRevoked
+		}
+		if pubkey.Key == encodedPubKey {
+			return ErrKeyExists
+		}
+		if pubkey.Label == label {
+			return ErrLabelExists
+		}
+	}
+
+	user.PublicKeys = append(user.PublicKeys, PublicKey{
+		Key:       encodedPubKey,
+		Label:     label,
+		CreatedAt: time.Now(),
+		SignerApp: signerApp,
+		Status:    KeyStatusActive,
+	})
+	return nil
+}
+
+// recoverPublicKey replaces all keys of a user that is recovering their account with a new public key
+// Every key that has not been revoked is revoked, since the user has lost it, and the new key is added
+// following the rules of addPublicKey. Nothing is changed if the new key cannot be added.
+//
+// Parameters:
+//   - user: The user to change.
+//   - newPubKey: The new ed25519 public key to be added.
+//   - label: The label for the new public key.
+//   - signerApp: The TKey signer app reported by the client, may be empty.
+//
+// Returns:
+//   - []string: The labels of the keys that were revoked.
+//   - error: An ErrorInputNotSanitized, ErrKeyRevoked or ErrLabelExists.
+func recoverPublicKey(user *User, newPubKey ed25519.PublicKey, label string, signerApp SignerApp) ([]string, error) {
+	// The keys are revoked on a copy, so that the user is unchanged when the new key is rejected
+	recovered := *user
+	recovered.PublicKeys = append([]PublicKey(nil), user.PublicKeys...)
+	revoked := []string{}
+	for i := range recovered.PublicKeys {
+		if recovered.PublicKeys[i].Status != KeyStatusRevoked {
+			setKeyStatus(&recovered.PublicKeys[i], KeyStatusRevoked, "lost, replaced during recovery")
+			revoked = append(revoked, recovered.PublicKeys[i].Label)
+		}
+	}
+
+	if err := addPublicKey(&recovered, newPubKey, label, signerApp); err != nil {
+		return nil, err
+	}
+	user.PublicKeys = recovered.PublicKeys
+	return revoked, nil
+}
+
+// removePublicKey revokes an existing public key of the user
+// The key is kept with status KeyStatusRevoked so that it shows up in audits and cannot be added again.
+// The user must keep at least one other active key.
+//
+// Parameters:
+//   - user: The user to change.
+//   - label: The label of the public key to be removed.
+//
+// Returns:
+//   - error: An ErrorInputNotSanitized, ErrKeyNotFound or ErrLastActiveKey.
+func removePublicKey(user *User, label string) error {
+	if err := checkLabel(label); err != nil {
+		return err
+	}
+
+	pubkey := findPublicKey(user.PublicKeys, label)
+	if pubkey == nil || pubkey.Status == KeyStatusRevoked {
+		return ErrKeyNotFound
+	}
+
+	// Suspended keys can be revoked freely, but the last active key must be kept
+	if pubkey.IsActive() && countActiveKeys(user.PublicKeys) <= 1 {
+		return ErrLastActiveKey
+	}
+
+	setKeyStatus(pubkey, KeyStatusRevoked, "removed by user")
+	return nil
+}
+
+// renamePublicKey changes the label of a public key of the user
+// The new label must follow the same rules as when a key is added: it must be sanitized,
+// non-empty and not used by any other key of the user, including revoked keys.
+//
+// Parameters:
+//   - user: The user to change.
+//   - label: The current label of the public key.
+//   - newLabel: The new label for the public key.
+//
+// Returns:
+//   - error: An ErrorInputNotSanitized, ErrKeyNotFound or ErrLabelExists.
+func renamePublicKey(user *User, label string, newLabel string) error {
+	// Check that both labels are sanitized
+	if !isSanitized(label) || !isSanitized(newLabel) {
+		return &structs.ErrorInputNotSanitized{Message: "Label can only contain alphanumeric characters [a-z, A-Z, 0-9]"}
+	}
+
+	// Check that the new label is not empty
+	if newLabel == "" {
+		return &structs.ErrorInputNotSanitized{Message: "Label cannot be empty"}
+	}
+
+	pubkey := findPublicKey(user.PublicKeys, label)
+	if pubkey == nil || pubkey.Status == KeyStatusRevoked {
+		return ErrKeyNotFound
+	}
+
+	if findPublicKey(user.PublicKeys, newLabel) != nil {
+		return ErrLabelExists
+	}
+
+	pubkey.Label = newLabel
+	return nil
+}
+
+// suspendPublicKey suspends a public key of the user, e.g. when the TKey is lost
+// As with removal, the user must keep at least one other active key.
+//
+// Parameters:
+//   - user: The user to change.
+//   - label: The label of the public key to be suspended.
+//   - reason: Why the key is suspended, may be empty.
+//
+// Returns:
+//   - error: An ErrorInputNotSanitized, ErrKeyNotFound, ErrKeyNotActive or ErrLastActiveKey.
+func suspendPublicKey(user *User, label string, reason string) error {
+	if err := checkLabel(label); err != nil {
+		return err
+	}
+
+	// Check that the reason is reasonably sized
+	if len(reason) > maxStatusReasonLength {
+		return &structs.ErrorInputNotSanitized{Message: "Reason is too long"}
+	}
+
+	pubkey := findPublicKey(user.PublicKeys, label)
+	if pubkey == nil || pubkey.Status == KeyStatusRevoked {
+		return ErrKeyNotFound
+	}
+
+	if !pubkey.IsActive() {
+		return ErrKeyNotActive
+	}
+
+	if countActiveKeys(user.PublicKeys) <= 1 {
+		return ErrLastActiveKey
+	}
+
+	setKeyStatus(pubkey, KeyStatusSuspended, reason)
+	return nil
+}
+
+// reactivatePublicKey makes a suspended public key of the user active again
+// Revoked keys cannot be reactivated.
+//
+// Parameters:
+//   - user: The user to change.
+//   - label: The label of the public key to be reactivated.
+//
+// Returns:
+//   - error: An ErrorInputNotSanitized, ErrKeyNotFound or ErrKeyNotSuspended.
+func reactivatePublicKey(user *User, label string) error {
+	if err := checkLabel(label); err != nil {
+		return err
+	}
+
+	pubkey := findPublicKey(user.PublicKeys, label)
+	if pubkey == nil || pubkey.Status == KeyStatusRevoked {
+		return ErrKeyNotFound
+	}
+
+	if pubkey.Status != KeyStatusSuspended {
+		return ErrKeyNotSuspended
+	}
+
+	setKeyStatus(pubkey, KeyStatusActive, "")
+	return nil
+}
+
+// findPublicKey returns a pointer to the key with the given label in keys, or nil if there is none
+func findPublicKey(keys []PublicKey, label string) *PublicKey {
+	for i := range keys {
+		if keys[i].Label == label {
+			return &keys[i]
+		}
+	}
+	return nil
+}
+
+// countActiveKeys returns the number of keys that can be used to log in
+func countActiveKeys(keys []PublicKey) int {
+	count := 0
+	for _, pubkey := range keys {
+		if pubkey.IsActive() {
+			count++
+		}
+	}
+	return count
+}
+
+// countUnrevokedKeys returns the number of keys that have not been revoked
+func countUnrevokedKeys(keys []PublicKey) int {
+	count := 0
+	for _, pubkey := range keys {
+		if pubkey.Status != KeyStatusRevoked {
+			count++
+		}
+	}
+	return count
+}
+
+// setKeyStatus changes the status of a key and records why and when
+func setKeyStatus(pubkey *PublicKey, status string, reason string) {
+	pubkey.Status = status
+	pubkey.StatusReason = reason
+	pubkey.StatusChangedAt = time.Now()
+}
+
+// validateSignerApp checks that the signer app reported by the client is reasonably sized
+// and that the digest, if given, is a hex encoded SHA-512 digest
+//
+// Parameters:
+//   - signerApp: The signer app to check
+//
+// Returns:
+//   - error: An ErrorInputNotSanitized if the signer app is malformed, otherwise nil
+func validateSignerApp(signerApp SignerApp) error {
+	if len(signerApp.Name) > maxSignerAppNameLength {
+		return &structs.ErrorInputNotSanitized{Message: "Signer app name is too long"}
+	}
+
+	if signerApp.Digest != "" && !regexp.MustCompile("^[0-9a-f]{128}$").MatchString(signerApp.Digest) {
+		return &structs.ErrorInputNotSanitized{Message: "Signer app digest must be a hex encoded SHA-512 digest"}
+	}
+
+	return nil
+}
+
+// isSanitized checks if the input is sanitized by checking if it contains any non-alphanumeric characters
+//
+// Parameters:
+//   - input: The input to check
+//
+// Returns:
+//   - bool: True if the input is sanitized, false otherwise
+
+func isSanitized(input string) bool {
+	// Check if input contains any non-alphanumeric characters
+	return !regexp.MustCompile("[^a-zA-Z0-9]").MatchString(input)
+}
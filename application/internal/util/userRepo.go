@@ -4,43 +4,35 @@ import (
 	"chalmers/tkey-group22/application/internal/structs"
 	"context"
 	"crypto/ed25519"
-	"encoding/base64"
-	"errors"
-	"regexp"
+	"time"
 
 	"go.mongodb.org/mongo-driver/bson"
-	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 )
 
-// User struct represents a user in DB
-// It contains the user's unique ID, username and public key
-type User struct {
-	ID         primitive.ObjectID `bson:"_id,omitempty"` // Unique ID set by MongoDB
-	Username   string             `bson:"username"`      // Username of the user
-	PublicKeys []PublicKey        `bson:"publicKeys"`    // Public key of the user
+// UserRepo holds the database reference
+type UserRepo struct {
+	db *mongo.Database
 }
 
-type PublicKey struct {
-	Label string `bson:"label"` // Label for the public key
-	Key   string `bson:"key"`   // Public key encoded in base64
-}
+// maxChangeAttempts is how many times a change to the keys of a user is tried before giving up
+// when other changes to the user keep getting in between
+const maxChangeAttempts = 50
 
-// Interface for UserRepository
-// This interface defines the methods that a UserRepository should implement
-type UserRepository interface {
-	CreateUser(userName string, pubkey ed25519.PublicKey, label string) (*mongo.InsertOneResult, error)
-	GetUser(username string) (*User, error)
-	UpdateUser(userName string, updatedUser User) (*mongo.UpdateResult, error)
-	DeleteUser(userName string) (*mongo.DeleteResult, error)
-	AddPublicKey(userName string, newPubKey ed25519.PublicKey, label string) (*mongo.UpdateResult, error)
-	RemovePublicKey(userName string, label string) (*mongo.UpdateResult, error)
-	GetPublicKeyLabels(userName string) ([]string, error)
+// userDocument is how a user is stored in MongoDB
+// The version is increased by every update of the public keys, so that a change that was based on
+// an outdated read of the user can be detected and retried instead of overwriting the other change.
+type userDocument struct {
+	User    `bson:",inline"`
+	Version int64 `bson:"version"` // Number of updates of the public keys, missing on users stored before it was added
 }
 
-// UserRepo holds the database reference
-type UserRepo struct {
-	db *mongo.Database
+// versionFilter matches the user with the given version, where a missing version counts as 0
+func versionFilter(userName string, version int64) bson.M {
+	if version == 0 {
+		return bson.M{"username": userName, "version": bson.M{"$in": bson.A{0, nil}}}
+	}
+	return bson.M{"username": userName, "version": version}
 }
 
 // NewUserRepo initializes a new UserRepositoryImpl with a given database
@@ -55,110 +47,110 @@ func NewUserRepo(db *mongo.Database) *UserRepo {
 	return &UserRepo{db: db}
 }
 
-// Max num of keys a single user can have
-const MaxPublicKeys = 5
-
 // CreateUser inserts a new user with the specified username and public key and label into the MongoDB collection.
 // The public key is encoded to base64 before storing.
 //
 // Parameters:
+//   - ctx: The context of the request, the operation is abandoned when it ends or after OperationTimeout
 //   - userName: The username of the new user.
 //   - pubkey: The ed25519 public key of the new user.
 //   - label: The label for the public key.
+//   - signerApp: The TKey signer app reported by the client, may be empty.
 //
 // Returns:
-//   - *mongo.InsertOneResult: The result of the insert operation.
-//   - error: An error if the insert operation fails.
-func (repo *UserRepo) CreateUser(userName string, pubkey ed25519.PublicKey, label string) (*mongo.InsertOneResult, error) {
-	collection := repo.db.Collection("users")
+//   - *User: The new user.
+//   - error: An ErrorInputNotSanitized if the input is invalid, ErrUserExists if the username is taken,
+//     or an error if the insert operation fails.
+func (repo *UserRepo) CreateUser(ctx context.Context, userName string, pubkey ed25519.PublicKey, label string, signerApp SignerApp) (*User, error) {
+	ctx, cancel := OperationContext(ctx)
+	defer cancel()
 
-	// Check that username is sanitized
-	if !isSanitized(userName) {
-		return nil, &structs.ErrorInputNotSanitized{Message: "Username can only contain alphanumeric characters [a-z, A-Z, 0-9]"}
-	}
-	// Check that the label is sanitized
-	if !isSanitized(label) {
-		return nil, &structs.ErrorInputNotSanitized{Message: "Label can only contain alphanumeric characters [a-z, A-Z, 0-9]"}
-	}
+	collection := repo.db.Collection("users")
 
-	// check that username is not empty
-	if userName == "" {
-		return nil, &structs.ErrorInputNotSanitized{Message: "Username cannot be empty"}
+	user, err := newUser(userName, pubkey, label, signerApp)
+	if err != nil {
+		return nil, err
 	}
 
-	// Check that the label is not empty
-	if label == "" {
-		return nil, &structs.ErrorInputNotSanitized{Message: "Label cannot be empty"}
+	_, err = collection.InsertOne(ctx, userDocument{User: *user})
+	if mongo.IsDuplicateKeyError(err) {
+		return nil, ErrUserExists
 	}
-
-	// Encodes public key to base64 to allow storing in MongoDB
-	encodedPubKey := base64.StdEncoding.EncodeToString(pubkey)
-	user := User{
-		ID:       primitive.NewObjectID(),
-		Username: userName,
-		PublicKeys: []PublicKey{
-			{
-				Key:   encodedPubKey,
-				Label: label,
-			},
-		},
-	}
-
-	result, err := collection.InsertOne(context.Background(), user)
 	if err != nil {
 		return nil, err
 	}
 
-	return result, nil
+	return user, nil
 }
 
 // GetUser retrieves a user from the database by their username
 // It returns a pointer to a User struct and an error if the retrieval fails
 //
 // Parameters:
+//   - ctx: The context of the request, the operation is abandoned when it ends or after OperationTimeout
 //   - userName: The username of the user to retrieve
 //
 // Returns:
 //   - *User: A pointer to the User struct containing the user's information
-//   - error: An error if the retrieval fails
-func (repo *UserRepo) GetUser(userName string) (*User, error) {
+//   - error: ErrUserNotFound if there is no such user, or an error if the retrieval fails
+func (repo *UserRepo) GetUser(ctx context.Context, userName string) (*User, error) {
+	ctx, cancel := OperationContext(ctx)
+	defer cancel()
+
+	document, err := repo.getUserDocument(ctx, userName)
+	if err != nil {
+		return nil, err
+	}
+
+	return &document.User, nil
+}
+
+// getUserDocument retrieves a user together with the version of its public keys
+func (repo *UserRepo) getUserDocument(ctx context.Context, userName string) (*userDocument, error) {
 	collection := repo.db.Collection("users")
 
 	// Check that username is sanitized
-	if !isSanitized(userName) {
-		return nil, &structs.ErrorInputNotSanitized{Message: "Username can only contain alphanumeric characters [a-z, A-Z, 0-9]"}
+	if err := checkUsername(userName); err != nil {
+		return nil, err
 	}
 
 	filter := bson.M{"username": userName}
-	var user User
-	err := collection.FindOne(context.Background(), filter).Decode(&user)
+	var document userDocument
+	err := collection.FindOne(ctx, filter).Decode(&document)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrUserNotFound
+	}
 	if err != nil {
 		return nil, err
 	}
 
-	return &user, nil
+	return &document, nil
 }
 
 // UpdateUser updates the user document in the MongoDB collection with the given username
+// Only the username and the public keys are replaced, regardless of any changes made since the user was read.
 //
 // Parameters:
+//   - ctx: The context of the request, the operation is abandoned when it ends or after OperationTimeout
 //   - userName: The username of the user to be updated
 //   - updatedUser: A User struct containing the new values for the username and public key
 //
 // Returns:
-//   - *mongo.UpdateResult: The result of the update operation
-//   - error: An error if the update operation fails
-func (repo *UserRepo) UpdateUser(userName string, updatedUser User) (*mongo.UpdateResult, error) {
+//   - error: ErrUserNotFound if there is no such user, or an error if the update operation fails
+func (repo *UserRepo) UpdateUser(ctx context.Context, userName string, updatedUser User) error {
+	ctx, cancel := OperationContext(ctx)
+	defer cancel()
+
 	collection := repo.db.Collection("users")
 
 	// Check that old username is sanitized
 	if !isSanitized(userName) {
-		return nil, &structs.ErrorInputNotSanitized{Message: "Old username can only contain alphanumeric characters [a-z, A-Z, 0-9]"}
+		return &structs.ErrorInputNotSanitized{Message: "Old username can only contain alphanumeric characters [a-z, A-Z, 0-9]"}
 	}
 
 	// Check that new username is sanitized
 	if !isSanitized(updatedUser.Username) {
-		return nil, &structs.ErrorInputNotSanitized{Message: "New username can only contain alphanumeric characters [a-z, A-Z, 0-9]"}
+		return &structs.ErrorInputNotSanitized{Message: "New username can only contain alphanumeric characters [a-z, A-Z, 0-9]"}
 	}
 
 	filter := bson.M{"username": userName}
@@ -167,188 +159,360 @@ func (repo *UserRepo) UpdateUser(userName string, updatedUser User) (*mongo.Upda
 			"username":   updatedUser.Username,
 			"publicKeys": updatedUser.PublicKeys,
 		},
+		"$inc": bson.M{
+			"version": 1,
+		},
 	}
 
-	result, err := collection.UpdateOne(context.Background(), filter, updatedData)
+	result, err := collection.UpdateOne(ctx, filter, updatedData)
 	if err != nil {
-		return nil, err
+		return err
+	}
+
+	if result.MatchedCount == 0 {
+		return ErrUserNotFound
 	}
 
-	return result, nil
+	return nil
 }
 
 // DeleteUser deletes a user from the "users" collection in the MongoDB database
-// It returns a pointer to mongo.DeleteResult and an error if the deletion fails
 //
 // Parameters:
+//   - ctx: The context of the request, the operation is abandoned when it ends or after OperationTimeout
 //   - userName: The username of the user to be deleted
 //
 // Returns:
-//   - *mongo.DeleteResult: The result of the delete operation
-//   - error: An error if the deletion fails, otherwise nil
-func (repo *UserRepo) DeleteUser(userName string) (*mongo.DeleteResult, error) {
+//   - error: ErrUserNotFound if there is no such user, or an error if the deletion fails
+func (repo *UserRepo) DeleteUser(ctx context.Context, userName string) error {
+	ctx, cancel := OperationContext(ctx)
+	defer cancel()
+
 	collection := repo.db.Collection("users")
 
 	// Check that username is sanitized
-	if !isSanitized(userName) {
-		return nil, &structs.ErrorInputNotSanitized{Message: "Username can only contain alphanumeric characters [a-z, A-Z, 0-9]"}
+	if err := checkUsername(userName); err != nil {
+		return err
 	}
 
 	filter := bson.M{"username": userName}
-	result, err := collection.DeleteOne(context.Background(), filter)
+	result, err := collection.DeleteOne(ctx, filter)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	return result, nil
+	if result.DeletedCount == 0 {
+		return ErrUserNotFound
+	}
+
+	return nil
 }
 
 // GetPublicKeyLabels retrieves all the labels of the public keys associated with the given user
+// Revoked keys are left out
 //
 // Parameters:
+//   - ctx: The context of the request, the operation is abandoned when it ends or after OperationTimeout
 //   - userName: The username of the user
 //
 // Returns:
 //   - []string: A slice of labels for the user's public keys
 //   - error: An error if the retrieval fails
-func (repo *UserRepo) GetPublicKeyLabels(userName string) ([]string, error) {
-
-	// Check that username is sanitized
-	if !isSanitized(userName) {
-		return nil, &structs.ErrorInputNotSanitized{Message: "Username can only contain alphanumeric characters [a-z, A-Z, 0-9]"}
-	}
-
-	user, err := repo.GetUser(userName)
+func (repo *UserRepo) GetPublicKeyLabels(ctx context.Context, userName string) ([]string, error) {
+	user, err := repo.GetUser(ctx, userName)
 	if err != nil {
 		return nil, err
 	}
 
-	labels := make([]string, len(user.PublicKeys))
-	for i, pubkey := range user.PublicKeys {
-		labels[i] = pubkey.Label
-	}
-
-	return labels, nil
+	return publicKeyLabels(user), nil
 }
 
 // AddPublicKey adds a new public key to the user's list of public keys.
 // It encodes the new public key to base64 and updates the user's document in the MongoDB collection.
+// Revoked keys do not count towards MaxPublicKeys, but a revoked key can never be added again.
 //
 // Parameters:
+//   - ctx: The context of the request, the operation is abandoned when it ends or after OperationTimeout
 //   - userName: The username of the user to be updated.
 //   - newPubKey: The new ed25519 public key to be added.
 //   - label: The label for the new public key.
+//   - signerApp: The TKey signer app reported by the client, may be empty.
 //
 // Returns:
-//   - *mongo.UpdateResult: The result of the update operation.
-//   - error: An error if the update operation fails.
-func (repo *UserRepo) AddPublicKey(userName string, newPubKey ed25519.PublicKey, label string) (*mongo.UpdateResult, error) {
-
-	// Check that username is sanitized
-	if !isSanitized(userName) {
-		return nil, &structs.ErrorInputNotSanitized{Message: "Username can only contain alphanumeric characters [a-z, A-Z, 0-9]"}
-	}
-
-	// Check that label is sanitized
-	if !isSanitized(label) {
-		return nil, &structs.ErrorInputNotSanitized{Message: "Label can only contain alphanumeric characters [a-z, A-Z, 0-9]"}
-	}
+//   - error: An error if the key cannot be added, see addPublicKey, or the update operation fails.
+func (repo *UserRepo) AddPublicKey(ctx context.Context, userName string, newPubKey ed25519.PublicKey, label string, signerApp SignerApp) error {
+	return repo.changeUser(ctx, userName, func(user *User) error {
+		return addPublicKey(user, newPubKey, label, signerApp)
+	})
+}
 
-	user, err := repo.GetUser(userName)
+// RecoverPublicKey replaces all keys of a user that is recovering their account with a new public key.
+// Every key that has not been revoked is revoked and the new key is added in the same update,
+// so the lost keys do not count towards MaxPublicKeys and cannot be used once the new key is enrolled.
+//
+// Parameters:
+//   - ctx: The context of the request, the operation is abandoned when it ends or after OperationTimeout
+//   - userName: The username of the user to be updated.
+//   - newPubKey: The new ed25519 public key to be added.
+//   - label: The label for the new public key.
+//   - signerApp: The TKey signer app reported by the client, may be empty.
+//
+// Returns:
+//   - []string: The labels of the keys that were revoked.
+//   - error: An error if the key cannot be added, see recoverPublicKey, or the update operation fails.
+func (repo *UserRepo) RecoverPublicKey(ctx context.Context, userName string, newPubKey ed25519.PublicKey, label string, signerApp SignerApp) ([]string, error) {
+	var revoked []string
+	err := repo.changeUser(ctx, userName, func(user *User) error {
+		var err error
+		revoked, err = recoverPublicKey(user, newPubKey, label, signerApp)
+		return err
+	})
 	if err != nil {
 		return nil, err
 	}
+	return revoked, nil
+}
 
-	if len(user.PublicKeys) >= MaxPublicKeys {
-		return nil, errors.New("user already has the maximum number of public keys")
-	}
+// RemovePublicKey revokes an existing public key of the user.
+// The key is kept in the user's document with status KeyStatusRevoked so that it shows up in audits
+// and cannot be added again. The user must keep at least one other active key.
+//
+// Parameters:
+//   - ctx: The context of the request, the operation is abandoned when it ends or after OperationTimeout
+//   - userName: The username of the user to be updated.
+//   - label: The label of the public key to be removed.
+//
+// Returns:
+//   - error: An error if the key cannot be removed, see removePublicKey, or the update operation fails.
+func (repo *UserRepo) RemovePublicKey(ctx context.Context, userName string, label string) error {
+	return repo.changeUser(ctx, userName, func(user *User) error {
+		return removePublicKey(user, label)
+	})
+}
 
-	encodedPubKey := base64.StdEncoding.EncodeToString(newPubKey)
-	for _, pubkey := range user.PublicKeys {
-		if pubkey.Key == encodedPubKey {
-			return nil, errors.New("public key already exists for the user")
+// RenamePublicKey changes the label of a public key of the user.
+// The new label must follow the same rules as when a key is added: it must be sanitized,
+// non-empty and not used by any other key of the user, including revoked keys.
+//
+// Parameters:
+//   - ctx: The context of the request, the operation is abandoned when it ends or after OperationTimeout
+//   - userName: The username of the user to be updated.
+//   - label: The current label of the public key.
+//   - newLabel: The new label for the public key.
+//
+// Returns:
+//   - error: An error if the key is not found, the new label is taken, or the update operation fails.
+func (repo *UserRepo) RenamePublicKey(ctx context.Context, userName string, label string, newLabel string) error {
+	return repo.changeUser(ctx, userName, func(user *User) error {
+		return renamePublicKey(user, label, newLabel)
+	})
+}
 
-		}
-		if pubkey.Label == label {
-			return nil, errors.New("label already exists for the user")
-		}
+// SuspendPublicKey suspends a public key of the user, e.g. when the TKey is lost.
+// A suspended key cannot be used to log in until it is reactivated. As with removal,
+// the user must keep at least one other active key.
+//
+// Parameters:
+//   - ctx: The context of the request, the operation is abandoned when it ends or after OperationTimeout
+//   - userName: The username of the user to be updated.
+//   - label: The label of the public key to be suspended.
+//   - reason: Why the key is suspended, may be empty.
+//
+// Returns:
+//   - error: An error if the key is not found, is not active, is the user's last active key, or the update operation fails.
+func (repo *UserRepo) SuspendPublicKey(ctx context.Context, userName string, label string, reason string) error {
+	return repo.changeUser(ctx, userName, func(user *User) error {
+		return suspendPublicKey(user, label, reason)
+	})
+}
 
+// ReactivatePublicKey makes a suspended public key of the user active again.
+// Revoked keys cannot be reactivated.
+//
+// Parameters:
+//   - ctx: The context of the request, the operation is abandoned when it ends or after OperationTimeout
+//   - userName: The username of the user to be updated.
+//   - label: The label of the public key to be reactivated.
+//
+// Returns:
+//   - error: An error if the key is not found, is not suspended, or the update operation fails.
+func (repo *UserRepo) ReactivatePublicKey(ctx context.Context, userName string, label string) error {
+	return repo.changeUser(ctx, userName, func(user *User) error {
+		return reactivatePublicKey(user, label)
+	})
+}
+
+// RecordKeyUse records that the public key with the given label was used to log in.
+// The last used time and the use counter of the matching key are updated in place,
+// so concurrent logins are all counted and changes to other keys are kept.
+// The version is increased as well, so that a concurrent change to the keys does not overwrite the use.
+//
+// Parameters:
+//   - ctx: The context of the request, the operation is abandoned when it ends or after OperationTimeout
+//   - userName: The username of the user that logged in.
+//   - label: The label of the public key that made the signature.
+//
+// Returns:
+//   - error: ErrKeyNotFound if the user has no key with the label, or an error if the update operation fails.
+func (repo *UserRepo) RecordKeyUse(ctx context.Context, userName string, label string) error {
+	ctx, cancel := OperationContext(ctx)
+	defer cancel()
+
+	collection := repo.db.Collection("users")
+
+	// Check that username is sanitized
+	if err := checkUsername(userName); err != nil {
+		return err
 	}
 
-	user.PublicKeys = append(user.PublicKeys, PublicKey{
-		Key:   encodedPubKey,
-		Label: label,
-	})
+	filter := bson.M{"username": userName, "publicKeys.label": label}
+	update := bson.M{
+		"$set": bson.M{
+			"publicKeys.$.lastUsed": time.Now(),
+		},
+		"$inc": bson.M{
+			"publicKeys.$.useCount": 1,
+			"version":               1,
+		},
+	}
 
-	result, err := repo.UpdateUser(userName, *user)
+	result, err := collection.UpdateOne(ctx, filter, update)
 	if err != nil {
-		return nil, err
+		return err
+	}
+
+	if result.MatchedCount == 0 {
+		return ErrKeyNotFound
 	}
 
-	return result, nil
+	return nil
 }
 
-// RemovePublicKey removes an existing public key from the user's list of public keys.
-// It encodes the public key to be removed to base64 and updates the user's document in the MongoDB collection.
+// SetRecoveryCodes replaces the recovery codes of the user with the given hashed codes.
+// Any codes that were not used yet stop working.
 //
 // Parameters:
-//   - userName: The username of the user to be updated.
-//   - label: The label of the public key to be removed.
+//   - ctx: The context of the request, the operation is abandoned when it ends or after OperationTimeout
+//   - userName: The username of the user.
+//   - codeHashes: The hashes of the new recovery codes.
 //
 // Returns:
-//   - *mongo.UpdateResult: The result of the update operation.
-//   - error: An error if the update operation fails.
-func (repo *UserRepo) RemovePublicKey(userName string, label string) (*mongo.UpdateResult, error) {
+//   - error: ErrUserNotFound if there is no such user, or an error if the update operation fails.
+func (repo *UserRepo) SetRecoveryCodes(ctx context.Context, userName string, codeHashes []string) error {
+	ctx, cancel := OperationContext(ctx)
+	defer cancel()
+
+	collection := repo.db.Collection("users")
 
 	// Check that username is sanitized
-	if !isSanitized(userName) {
-		return nil, &structs.ErrorInputNotSanitized{Message: "Username can only contain alphanumeric characters [a-z, A-Z, 0-9]"}
+	if err := checkUsername(userName); err != nil {
+		return err
 	}
 
-	// Check that label is sanitized
-	if !isSanitized(label) {
-		return nil, &structs.ErrorInputNotSanitized{Message: "Label can only contain alphanumeric characters [a-z, A-Z, 0-9]"}
+	filter := bson.M{"username": userName}
+	update := bson.M{
+		"$set": bson.M{
+			"recoveryCodes": codeHashes,
+		},
 	}
 
-	user, err := repo.GetUser(userName)
+	result, err := collection.UpdateOne(ctx, filter, update)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	if len(user.PublicKeys) <= 1 {
-		return nil, errors.New("user must have at least two public keys to remove one")
+	if result.MatchedCount == 0 {
+		return ErrUserNotFound
 	}
 
-	keyFound := false
-	for i, pubkey := range user.PublicKeys {
-		if pubkey.Label == label {
-			user.PublicKeys = append(user.PublicKeys[:i], user.PublicKeys[i+1:]...)
-			keyFound = true
-			break
-		}
+	return nil
+}
+
+// UseRecoveryCode consumes the recovery code with the given hash if the user has it.
+// The code is removed in the same operation that matches it, so a code can only be used once
+// even if it is submitted concurrently.
+//
+// Parameters:
+//   - ctx: The context of the request, the operation is abandoned when it ends or after OperationTimeout
+//   - userName: The username of the user.
+//   - codeHash: The hash of the recovery code to use.
+//
+// Returns:
+//   - bool: true if the code was valid and has been consumed, otherwise false.
+//   - error: An error if the update operation fails.
+func (repo *UserRepo) UseRecoveryCode(ctx context.Context, userName string, codeHash string) (bool, error) {
+	ctx, cancel := OperationContext(ctx)
+	defer cancel()
+
+	collection := repo.db.Collection("users")
+
+	// Check that username is sanitized
+	if err := checkUsername(userName); err != nil {
+		return false, err
 	}
 
-	if !keyFound {
-		return nil, errors.New("specified public key to be removed is not found")
+	filter := bson.M{"username": userName, "recoveryCodes": codeHash}
+	update := bson.M{
+		"$pull": bson.M{
+			"recoveryCodes": codeHash,
+		},
 	}
 
-	result, err := repo.UpdateUser(userName, *user)
+	result, err := collection.UpdateOne(ctx, filter, update)
 	if err != nil {
-		return nil, err
+		return false, err
 	}
 
-	return result, nil
+	return result.ModifiedCount == 1, nil
 }
 
-// isSanitized checks if the input is sanitized by checking if it contains any non-alphanumeric characters
+// changeUser reads the user, applies a change to its public keys and writes them back
+// The keys are only written if no other update of them happened since the user was read.
+// Otherwise the change is applied again to the updated user, so that concurrent changes are never lost
+// and the rules for keys, such as MaxPublicKeys, hold for the combined result.
 //
 // Parameters:
-//   - input: The input to check
+//   - ctx: The context of the request, the operation is abandoned when it ends or after OperationTimeout
+//   - userName: The username of the user to change.
+//   - change: Changes the public keys of the user, or returns why they cannot be changed.
 //
 // Returns:
-//   - bool: True if the input is sanitized, false otherwise
+//   - error: The error returned by change, ErrUserNotFound, ErrConcurrentUpdate if the user kept
+//     being changed by others, or an error if an operation fails.
+func (repo *UserRepo) changeUser(ctx context.Context, userName string, change func(user *User) error) error {
+	ctx, cancel := OperationContext(ctx)
+	defer cancel()
+
+	collection := repo.db.Collection("users")
+
+	for attempt := 0; attempt < maxChangeAttempts; attempt++ {
+		document, err := repo.getUserDocument(ctx, userName)
+		if err != nil {
+			return err
+		}
+
+		if err := change(&document.User); err != nil {
+			return err
+		}
+
+		update := bson.M{
+			"$set": bson.M{
+				"publicKeys": document.PublicKeys,
+			},
+			"$inc": bson.M{
+				"version": 1,
+			},
+		}
+		result, err := collection.UpdateOne(ctx, versionFilter(userName, document.Version), update)
+		if err != nil {
+			return err
+		}
+
+		if result.MatchedCount == 1 {
+			return nil
+		}
+		// The user was changed or deleted since it was read, so read it again
+	}
 
-func isSanitized(input string) bool {
-	// Check if input contains any non-alphanumeric characters
-	return !regexp.MustCompile("[^a-zA-Z0-9]").MatchString(input)
+	return ErrConcurrentUpdate
 }
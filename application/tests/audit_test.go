@@ -0,0 +1,196 @@
+package tests
+
+import (
+	"bytes"
+	"chalmers/tkey-group22/application/internal"
+	"chalmers/tkey-group22/application/internal/audit"
+	"chalmers/tkey-group22/application/internal/handlers"
+	"chalmers/tkey-group22/application/internal/structs"
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// useAuditLog replaces the audit log with an empty one for the duration of the test.
+func useAuditLog(t *testing.T) {
+	original := audit.Log
+	audit.Log = audit.NewMemoryStore()
+	t.Cleanup(func() { audit.Log = original })
+}
+
+// auditEvents lists the audit log of the user of the given session.
+func auditEvents(t *testing.T, cookies []*http.Cookie, query string) (int, []structs.AuditEvent) {
+	req, _ := http.NewRequest(http.MethodGet, "/api/audit"+query, nil)
+	for _, cookie := range cookies {
+		req.AddCookie(cookie)
+	}
+	rr := httptest.NewRecorder()
+	handlers.ListAuditEventsHandler(rr, req)
+
+	var response structs.ListAuditEventsResponse
+	if rr.Code == http.StatusOK {
+		if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return rr.Code, response.Events
+}
+
+// eventTypes returns the types of the events in order.
+func eventTypes(events []structs.AuditEvent) []string {
+	types := make([]string, len(events))
+	for i, event := range events {
+		types[i] = event.Type
+	}
+	return types
+}
+
+// Challenges, failed and successful logins are recorded with the key, IP address and user agent.
+func TestAuditLog_Logins(t *testing.T) {
+	useAuditLog(t)
+
+	_, challenge := loginChallenge(t, "192.0.2.50", mockUsername)
+	rr := sessionRequest(t, handlers.VerifyHandler, verifyURL, structs.VerifyRequest{
+		Username:    mockUsername,
+		ChallengeID: challenge.ChallengeID,
+		Signature:   make([]byte, ed25519.SignatureSize),
+	}, nil)
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+
+	_, challenge = loginChallenge(t, "192.0.2.50", mockUsername)
+	body, _ := json.Marshal(structs.VerifyRequest{
+		Username:    mockUsername,
+		ChallengeID: challenge.ChallengeID,
+		Signature:   ed25519.Sign(mockPrivKey, []byte(challenge.Challenge)),
+	})
+	req, _ := http.NewRequest(http.MethodPost, verifyURL, bytes.NewBuffer(body))
+	req.RemoteAddr = "192.0.2.50:41000"
+	req.Header.Set("User-Agent", "AuditTest/1.0")
+	rr = httptest.NewRecorder()
+	handlers.VerifyHandler(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	// Another user's events are not listed
+	loginChallenge(t, "192.0.2.51", "bob")
+
+	code, events := auditEvents(t, rr.Result().Cookies(), "")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, []string{audit.EventLoginSucceeded, audit.EventChallengeIssued, audit.EventLoginFailed, audit.EventChallengeIssued}, eventTypes(events))
+
+	succeeded := events[0]
+	assert.Equal(t, "main", succeeded.KeyLabel)
+	assert.Equal(t, audit.LoginSession, succeeded.Detail)
+	assert.Equal(t, "192.0.2.50", succeeded.IP)
+	assert.Equal(t, "AuditTest/1.0", succeeded.UserAgent)
+	assert.Equal(t, internal.PurposeLogin, events[1].Detail)
+	assert.Empty(t, events[2].KeyLabel)
+
+	code, events = auditEvents(t, rr.Result().Cookies(), "?limit=1")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, []string{audit.EventLoginSucceeded}, eventTypes(events))
+
+	code, _ = auditEvents(t, rr.Result().Cookies(), "?limit=none")
+	assert.Equal(t, http.StatusBadRequest, code)
+
+	code, _ = auditEvents(t, nil, "")
+	assert.Equal(t, http.StatusUnauthorized, code)
+}
+
+// The history of an account starts at its registration, even if the username belonged to a deleted account before.
+func TestAuditLog_AccountHistory(t *testing.T) {
+	useAuditLog(t)
+	registerUser := func(label string) {
+		pubkey, privkey, _ := ed25519.GenerateKey(nil)
+		challenge := registrationChallenge(t, "quinn")
+		rr := register(t, structs.RegisterRequest{
+			Username:    "quinn",
+			Pubkey:      pubkey,
+			Label:       label,
+			ChallengeID: challenge.ChallengeID,
+			Signature:   ed25519.Sign(privkey, []byte(challenge.Challenge)),
+		})
+		if rr.Code != http.StatusOK {
+			t.Fatalf("Failed to register: %d %s", rr.Code, rr.Body.String())
+		}
+	}
+
+	registerUser("first")
+	laptop := loginCookies(t, "quinn", "first")
+	phone := loginCookies(t, "quinn", "first")
+
+	rr := sessionRequest(t, handlers.LogoutHandler, "/api/logout", nil, phone)
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	_, events := auditEvents(t, laptop, "")
+	assert.Equal(t, []string{audit.EventLogout, audit.EventRegister}, eventTypes(events))
+	assert.Equal(t, "first", events[0].KeyLabel)
+	assert.Equal(t, "first", events[1].KeyLabel)
+
+	rr = sessionRequest(t, handlers.UnregisterHandler, "/api/unregister", nil, laptop)
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	// The log is kept after the account is deleted
+	deleted, _ := audit.Log.List(context.Background(), "quinn", audit.MaxListLimit)
+	assert.Equal(t, audit.EventUnregister, deleted[0].Type)
+
+	registerUser("second")
+	_, events = auditEvents(t, loginCookies(t, "quinn", "second"), "")
+	assert.Equal(t, []string{audit.EventRegister}, eventTypes(events))
+	assert.Equal(t, "second", events[0].KeyLabel)
+}
+
+// Adding, renaming, suspending, reactivating and removing keys is recorded with the label of the key.
+func TestAuditLog_KeyChanges(t *testing.T) {
+	useAuditLog(t)
+	privkey, cookies := stepUpTestUser(t, "rita")
+	newPubkey, newPrivkey, _ := ed25519.GenerateKey(nil)
+
+	addCookies := stepUp(t, internal.PurposeAddKey, privkey, cookies)
+	challengeID, signature := signStepUpChallenge(t, internal.PurposeNewKey, newPrivkey, addCookies)
+	rr := sessionRequest(t, handlers.AddPublicKeyHandler, "/api/add-public-key", structs.AddPublicKeyRequest{
+		Pubkey:      newPubkey,
+		Label:       "backup",
+		ChallengeID: challengeID,
+		Signature:   signature,
+	}, addCookies)
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	rr = sessionRequest(t, handlers.RenamePublicKeyHandler, "/api/rename-public-key", structs.RenamePublicKeyRequest{Label: "backup", NewLabel: "spare"}, cookies)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	suspendCookies := stepUp(t, internal.PurposeSuspendKey, privkey, cookies)
+	rr = sessionRequest(t, handlers.SuspendPublicKeyHandler, "/api/suspend-public-key", structs.SuspendPublicKeyRequest{Label: "spare", Reason: "left at home"}, suspendCookies)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	reactivateCookies := stepUp(t, internal.PurposeReactivateKey, privkey, cookies)
+	rr = sessionRequest(t, handlers.ReactivatePublicKeyHandler, "/api/reactivate-public-key", structs.ReactivatePublicKeyRequest{Label: "spare"}, reactivateCookies)
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	removeCookies := stepUp(t, internal.PurposeRemoveKey, privkey, cookies)
+	rr = sessionRequest(t, handlers.RemovePublicKeyHandler, "/api/remove-public-key", structs.RemovePublicKeyRequest{Label: "spare"}, removeCookies)
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	_, events := auditEvents(t, removeCookies, "")
+	assert.Equal(t, audit.EventKeyRemoved, events[0].Type)
+	assert.Equal(t, "spare", events[0].KeyLabel)
+	assert.Contains(t, eventTypes(events), audit.EventKeyAdded)
+
+	keyEvents := []structs.AuditEvent{}
+	for _, event := range events {
+		if event.Type == audit.EventKeyRenamed || event.Type == audit.EventKeySuspended || event.Type == audit.EventKeyReactivated {
+			keyEvents = append(keyEvents, event)
+		}
+	}
+	if assert.Len(t, keyEvents, 3) {
+		assert.Equal(t, audit.EventKeyReactivated, keyEvents[0].Type)
+		assert.Equal(t, "spare", keyEvents[0].KeyLabel)
+		assert.Equal(t, audit.EventKeySuspended, keyEvents[1].Type)
+		assert.Equal(t, "left at home", keyEvents[1].Detail)
+		assert.Equal(t, audit.EventKeyRenamed, keyEvents[2].Type)
+		assert.Equal(t, "spare", keyEvents[2].KeyLabel)
+		assert.Equal(t, "backup", keyEvents[2].Detail)
+	}
+}
@@ -0,0 +1,228 @@
+package tests
+
+import (
+	"bytes"
+	"chalmers/tkey-group22/application/internal"
+	"chalmers/tkey-group22/application/internal/handlers"
+	"chalmers/tkey-group22/application/internal/jws"
+	"chalmers/tkey-group22/application/internal/session_util"
+	"chalmers/tkey-group22/application/internal/structs"
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// issueTestTokens issues bearer tokens with the given scope for the user.
+func issueTestTokens(t *testing.T, username string, scope string) *session_util.TokenPair {
+	req, _ := http.NewRequest(http.MethodPost, verifyURL, nil)
+	tokens, err := session_util.IssueTokens(req, username, "main", scope)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tokens
+}
+
+// bearerRequest sends a request with the access token to a handler registered with AllowBearer for the scope.
+// An empty scope registers the handler without AllowBearer.
+func bearerRequest(t *testing.T, method string, accessToken string, scope string, handler http.HandlerFunc) *httptest.ResponseRecorder {
+	t.Setenv("CSRF_KEYS", "")
+	t.Setenv("CSRF_KEY", newSecretKey)
+	original := session_util.CsrfMiddleware
+	t.Cleanup(func() { session_util.CsrfMiddleware = original })
+	if err := session_util.InitCSRF(); err != nil {
+		t.Fatal(err)
+	}
+
+	var route http.Handler = session_util.SessionMiddleware(session_util.CsrfMiddleware(handler))
+	if scope != "" {
+		route = session_util.AllowBearer(scope, route)
+	}
+
+	req, _ := http.NewRequest(method, "/api/test", nil)
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	rr := httptest.NewRecorder()
+	route.ServeHTTP(rr, req)
+	return rr
+}
+
+// refreshRequest sends a refresh token to the refresh or revoke handler.
+func refreshRequest(t *testing.T, handler http.HandlerFunc, refreshToken string) *httptest.ResponseRecorder {
+	rr, req := createRequest(t, http.MethodPost, "/api/token", map[string]string{"refresh_token": refreshToken})
+	handler(rr, req)
+	return rr
+}
+
+// respondWithUsername responds with the user the request was authenticated as.
+func respondWithUsername(w http.ResponseWriter, r *http.Request) {
+	username, _ := session_util.GetSessionUsername(r)
+	w.Write([]byte(username))
+}
+
+// A client that cannot use cookies gets bearer tokens from /api/verify, and can use them without a CSRF token.
+func TestVerifyHandler_IssuesTokens(t *testing.T) {
+	challenge, _ := internal.GenerateChallenge(context.Background(), mockUsername, internal.PurposeLogin, testOrigin)
+	body, _ := json.Marshal(structs.VerifyRequest{
+		Username:    mockUsername,
+		ChallengeID: challenge.ID,
+		Signature:   ed25519.Sign(mockPrivKey, []byte(challenge.Value)),
+		IssueTokens: true,
+		Scope:       "notes",
+	})
+	req, _ := http.NewRequest(http.MethodPost, verifyURL, bytes.NewBuffer(body))
+	rr := httptest.NewRecorder()
+	handlers.VerifyHandler(rr, req)
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Empty(t, rr.Result().Cookies())
+	assert.Equal(t, "no-store", rr.Header().Get("Cache-Control"))
+
+	var tokens structs.TokenResponse
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &tokens))
+	assert.Equal(t, "Bearer", tokens.TokenType)
+	assert.Equal(t, "notes", tokens.Scope)
+	assert.NotEmpty(t, tokens.RefreshToken)
+
+	rr = bearerRequest(t, http.MethodPost, tokens.AccessToken, session_util.ScopeNotes, respondWithUsername)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, mockUsername, rr.Body.String())
+}
+
+func TestVerifyHandler_InvalidScope(t *testing.T) {
+	challenge, _ := internal.GenerateChallenge(context.Background(), mockUsername, internal.PurposeLogin, testOrigin)
+	body, _ := json.Marshal(structs.VerifyRequest{
+		Username:    mockUsername,
+		ChallengeID: challenge.ID,
+		Signature:   ed25519.Sign(mockPrivKey, []byte(challenge.Value)),
+		IssueTokens: true,
+		Scope:       "notes admin",
+	})
+	req, _ := http.NewRequest(http.MethodPost, verifyURL, bytes.NewBuffer(body))
+	rr := httptest.NewRecorder()
+	handlers.VerifyHandler(rr, req)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+}
+
+// A token is only accepted by routes that allow bearer tokens with a scope the token has.
+func TestBearerToken_Scopes(t *testing.T) {
+	notes := issueTestTokens(t, "rosa", "notes")
+
+	assert.Equal(t, http.StatusOK, bearerRequest(t, http.MethodPost, notes.AccessToken, session_util.ScopeNotes, respondWithUsername).Code)
+
+	rr := bearerRequest(t, http.MethodPost, notes.AccessToken, session_util.ScopeAccount, respondWithUsername)
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+	assert.Contains(t, rr.Header().Get("WWW-Authenticate"), "insufficient_scope")
+
+	rr = bearerRequest(t, http.MethodPost, notes.AccessToken, "", respondWithUsername)
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+
+	rr = bearerRequest(t, http.MethodPost, "not-a-token", session_util.ScopeNotes, respondWithUsername)
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+
+	// Token sessions are listed together with the browser sessions of the user
+	all := issueTestTokens(t, "rosa", "")
+	rr = bearerRequest(t, http.MethodGet, all.AccessToken, session_util.ScopeAccount, handlers.ListSessionsHandler)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	var response structs.ListSessionsResponse
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &response))
+	assert.Len(t, response.Sessions, 2)
+	for _, session := range response.Sessions {
+		assert.Equal(t, session_util.SessionTypeToken, session.Type)
+	}
+}
+
+// Every refresh token can be used once, and using it again revokes the tokens issued after it.
+func TestRefreshTokenHandler_Rotation(t *testing.T) {
+	first := issueTestTokens(t, "sven", "")
+
+	rr := refreshRequest(t, handlers.RefreshTokenHandler, first.RefreshToken)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	var second structs.TokenResponse
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &second))
+	assert.NotEqual(t, first.RefreshToken, second.RefreshToken)
+	assert.Equal(t, http.StatusOK, bearerRequest(t, http.MethodPost, second.AccessToken, session_util.ScopeNotes, respondWithUsername).Code)
+
+	rr = refreshRequest(t, handlers.RefreshTokenHandler, first.RefreshToken)
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+	assert.Equal(t, http.StatusUnauthorized, refreshRequest(t, handlers.RefreshTokenHandler, second.RefreshToken).Code)
+	assert.Equal(t, http.StatusUnauthorized, bearerRequest(t, http.MethodPost, second.AccessToken, session_util.ScopeNotes, respondWithUsername).Code)
+}
+
+// Revoking the refresh token, or its session from the session list, ends the access token as well.
+func TestRevokeTokenHandler(t *testing.T) {
+	tokens := issueTestTokens(t, "tove", "")
+	rr := refreshRequest(t, handlers.RevokeTokenHandler, tokens.RefreshToken)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, http.StatusUnauthorized, bearerRequest(t, http.MethodPost, tokens.AccessToken, session_util.ScopeNotes, respondWithUsername).Code)
+
+	// Revoking an unknown token is not an error
+	rr = refreshRequest(t, handlers.RevokeTokenHandler, tokens.RefreshToken)
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	tokens = issueTestTokens(t, "tove", "")
+	browser := loginCookies(t, "tove", "main")
+	_, sessions := listSessions(t, browser)
+	var tokenID string
+	for _, session := range sessions {
+		if session.Type == session_util.SessionTypeToken {
+			tokenID = session.ID
+		}
+	}
+	assert.NotEmpty(t, tokenID)
+
+	rr = sessionRequest(t, handlers.RevokeSessionHandler, "/api/sessions/revoke", structs.RevokeSessionRequest{ID: tokenID}, browser)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, http.StatusUnauthorized, bearerRequest(t, http.MethodPost, tokens.AccessToken, session_util.ScopeNotes, respondWithUsername).Code)
+}
+
+// The session ID in an access token is not enough to revoke or refresh its session, and a guessed refresh token
+// is refused without ending the session.
+func TestRefreshToken_RequiresIssuedSecret(t *testing.T) {
+	tokens := issueTestTokens(t, "uma", "")
+	var claims session_util.AccessTokenClaims
+	_, err := jws.Verify(tokens.AccessToken, internal.ServerPublicKey(), &claims)
+	assert.NoError(t, err)
+
+	forged := claims.SessionID + ".anything"
+	assert.Equal(t, http.StatusOK, refreshRequest(t, handlers.RevokeTokenHandler, forged).Code)
+	assert.Equal(t, http.StatusUnauthorized, refreshRequest(t, handlers.RefreshTokenHandler, forged).Code)
+
+	handle, _, _ := strings.Cut(tokens.RefreshToken, ".")
+	guessed := handle + ".guessed"
+	assert.Equal(t, http.StatusUnauthorized, refreshRequest(t, handlers.RefreshTokenHandler, guessed).Code)
+	assert.Equal(t, http.StatusOK, refreshRequest(t, handlers.RevokeTokenHandler, guessed).Code)
+
+	// The session is still alive
+	assert.Equal(t, http.StatusOK, bearerRequest(t, http.MethodPost, tokens.AccessToken, session_util.ScopeNotes, respondWithUsername).Code)
+	assert.Equal(t, http.StatusOK, refreshRequest(t, handlers.RefreshTokenHandler, tokens.RefreshToken).Code)
+}
+
+// Refreshing with the same token from several requests at once gives new tokens to only one of them.
+func TestRefreshTokenHandler_ConcurrentRefresh(t *testing.T) {
+	tokens := issueTestTokens(t, "vera", "")
+
+	var wg sync.WaitGroup
+	codes := make([]int, 8)
+	for i := range codes {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			codes[i] = refreshRequest(t, handlers.RefreshTokenHandler, tokens.RefreshToken).Code
+		}(i)
+	}
+	wg.Wait()
+
+	succeeded := 0
+	for _, code := range codes {
+		if code == http.StatusOK {
+			succeeded++
+		}
+	}
+	assert.Equal(t, 1, succeeded)
+}
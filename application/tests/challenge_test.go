@@ -2,69 +2,110 @@ package tests
 
 import (
 	"chalmers/tkey-group22/application/internal"
+	"chalmers/tkey-group22/application/internal/util"
+	"context"
 	"crypto/ed25519"
-	"encoding/hex"
 	"testing"
 	"time"
 )
 
+// testOrigin is the relying-party origin challenges are requested for in tests
+const testOrigin = "http://localhost:3000"
+
+// newChallengeTestUser creates a mock repository holding a single user with a fresh key pair
+func newChallengeTestUser(t *testing.T, username string) (*util.MemoryUserRepo, ed25519.PrivateKey) {
+	pubkey, privKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+
+	repo := util.NewMemoryUserRepo()
+	if _, err := repo.CreateUser(context.Background(), username, pubkey, "main", util.SignerApp{}); err != nil {
+		t.Fatalf("Failed to create user: %v", err)
+	}
+
+	return repo, privKey
+}
+
 func TestVerifySignedResponse_ValidSignature(t *testing.T) {
-	pubkey, privKey, _ := ed25519.GenerateKey(nil)
+	repo, privKey := newChallengeTestUser(t, "validsignature")
 
 	// Generate a challenge
-	challengeValue, err := internal.GenerateChallenge(pubkey)
+	challenge, err := internal.GenerateChallenge(context.Background(), "validsignature", internal.PurposeLogin, testOrigin)
 	if err != nil {
 		t.Fatalf("Failed to generate challenge: %v", err)
 	}
 
 	// Sign the challenge
-	challengeBytes, _ := hex.DecodeString(challengeValue)
-	signature := ed25519.Sign(privKey, challengeBytes)
+	signature := ed25519.Sign(privKey, []byte(challenge.Value))
 
 	// Verify the signed response
-	valid, err := internal.VerifySignature(pubkey, signature)
+	key, err := internal.VerifySignature(context.Background(), "validsignature", challenge.ID, internal.PurposeLogin, signature, repo)
 	if err != nil {
 		t.Fatalf("Expected no error, got %v", err)
 	}
-	if !valid {
+	if key == nil {
 		t.Fatalf("Expected valid signature, got invalid")
 	}
+	if key.Label != "main" {
+		t.Fatalf("Expected the signing key to be reported, got %q", key.Label)
+	}
 }
 
 func TestVerifySignedResponse_InvalidSignature(t *testing.T) {
-	pubKey, _, _ := ed25519.GenerateKey(nil)
+	repo, _ := newChallengeTestUser(t, "invalidsignature")
+
+	challenge, err := internal.GenerateChallenge(context.Background(), "invalidsignature", internal.PurposeLogin, testOrigin)
+	if err != nil {
+		t.Fatalf("Failed to generate challenge: %v", err)
+	}
 
 	invalidSignature := []byte("invalidsignature")
-	valid, err := internal.VerifySignature(pubKey, invalidSignature)
+	key, err := internal.VerifySignature(context.Background(), "invalidsignature", challenge.ID, internal.PurposeLogin, invalidSignature, repo)
 	if err == nil {
 		t.Fatalf("Expected an error, got none")
 	}
-	if valid {
+	if key != nil {
 		t.Fatalf("Expected invalid signature, got valid")
 	}
 }
 
 func TestVerifySignedResponse_NonExistentChallenge(t *testing.T) {
-	pubkey, privKey, _ := ed25519.GenerateKey(nil)
+	repo, privKey := newChallengeTestUser(t, "nonexistent")
 
-	// Generate a challenge
-	challengeValue, err := internal.GenerateChallenge(pubkey)
+	// Sign something that was never issued as a challenge
+	signature := ed25519.Sign(privKey, []byte("not a challenge"))
+
+	// Test with a non-existent challenge
+	key, err := internal.VerifySignature(context.Background(), "nonexistent", "nonexistentchallengeid", internal.PurposeLogin, signature, repo)
+	if err == nil {
+		t.Fatalf("Expected an error, got none")
+	}
+	if key != nil {
+		t.Fatalf("Expected invalid signature for non-existent challenge, got valid")
+	}
+}
+
+func TestVerifySignedResponse_ChallengeIsSingleUse(t *testing.T) {
+	repo, privKey := newChallengeTestUser(t, "singleuse")
+
+	challenge, err := internal.GenerateChallenge(context.Background(), "singleuse", internal.PurposeLogin, testOrigin)
 	if err != nil {
 		t.Fatalf("Failed to generate challenge: %v", err)
 	}
+	signature := ed25519.Sign(privKey, []byte(challenge.Value))
 
-	// Sign the challenge
-	challengeBytes, _ := hex.DecodeString(challengeValue)
-	signature := ed25519.Sign(privKey, challengeBytes)
+	if key, err := internal.VerifySignature(context.Background(), "singleuse", challenge.ID, internal.PurposeLogin, signature, repo); key == nil || err != nil {
+		t.Fatalf("Expected first verification to succeed, got %v", err)
+	}
 
-	// Test with a non-existent challenge
-	nonExistentPubKey := []byte("nonexistentpubkey")
-	valid, err := internal.VerifySignature(nonExistentPubKey, signature)
+	// Replaying the same signature must fail since the challenge has been consumed
+	key, err := internal.VerifySignature(context.Background(), "singleuse", challenge.ID, internal.PurposeLogin, signature, repo)
 	if err == nil {
 		t.Fatalf("Expected an error, got none")
 	}
-	if valid {
-		t.Fatalf("Expected invalid signature for non-existent challenge, got valid")
+	if key != nil {
+		t.Fatalf("Expected replayed signature to be invalid, got valid")
 	}
 }
 
@@ -78,25 +119,216 @@ func TestVerifySignedResponse_ExpiredChallenge(t *testing.T) {
 		internal.ValidDuration = originalValidDuration
 	}()
 
-	pubkey, privKey, _ := ed25519.GenerateKey(nil)
+	repo, privKey := newChallengeTestUser(t, "expired")
 
 	// Generate a challenge
-	challengeValue, err := internal.GenerateChallenge(pubkey)
+	challenge, err := internal.GenerateChallenge(context.Background(), "expired", internal.PurposeLogin, testOrigin)
 	if err != nil {
 		t.Fatalf("Failed to generate challenge: %v", err)
 	}
 
 	// Sign the challenge
-	challengeBytes, _ := hex.DecodeString(challengeValue)
-	signature := ed25519.Sign(privKey, challengeBytes)
+	signature := ed25519.Sign(privKey, []byte(challenge.Value))
 
 	// Test with an expired challenge
 	time.Sleep(internal.ValidDuration + time.Duration(100)*time.Millisecond)
-	valid, err := internal.VerifySignature(pubkey, signature)
+	key, err := internal.VerifySignature(context.Background(), "expired", challenge.ID, internal.PurposeLogin, signature, repo)
 	if err == nil {
 		t.Fatalf("Expected an error, got none")
 	}
-	if valid {
+	if key != nil {
 		t.Fatalf("Expected invalid signature for expired challenge, got valid")
 	}
 }
+
+func TestVerifySignedResponse_ConcurrentChallenges(t *testing.T) {
+	repo, privKey := newChallengeTestUser(t, "concurrent")
+
+	// Two logins started at the same time, e.g. from two browser tabs
+	first, err := internal.GenerateChallenge(context.Background(), "concurrent", internal.PurposeLogin, testOrigin)
+	if err != nil {
+		t.Fatalf("Failed to generate challenge: %v", err)
+	}
+	second, err := internal.GenerateChallenge(context.Background(), "concurrent", internal.PurposeLogin, testOrigin)
+	if err != nil {
+		t.Fatalf("Failed to generate challenge: %v", err)
+	}
+	if first.ID == second.ID {
+		t.Fatalf("Expected unique challenge IDs")
+	}
+
+	// Both attempts must succeed, in any order
+	secondSignature := ed25519.Sign(privKey, []byte(second.Value))
+	if key, err := internal.VerifySignature(context.Background(), "concurrent", second.ID, internal.PurposeLogin, secondSignature, repo); key == nil || err != nil {
+		t.Fatalf("Expected second challenge to verify, got %v", err)
+	}
+	firstSignature := ed25519.Sign(privKey, []byte(first.Value))
+	if key, err := internal.VerifySignature(context.Background(), "concurrent", first.ID, internal.PurposeLogin, firstSignature, repo); key == nil || err != nil {
+		t.Fatalf("Expected first challenge to verify, got %v", err)
+	}
+}
+
+func TestVerifySignedResponse_ChallengeForOtherUser(t *testing.T) {
+	repo, privKey := newChallengeTestUser(t, "owner")
+
+	challenge, err := internal.GenerateChallenge(context.Background(), "someoneelse", internal.PurposeLogin, testOrigin)
+	if err != nil {
+		t.Fatalf("Failed to generate challenge: %v", err)
+	}
+	signature := ed25519.Sign(privKey, []byte(challenge.Value))
+
+	key, err := internal.VerifySignature(context.Background(), "owner", challenge.ID, internal.PurposeLogin, signature, repo)
+	if err == nil {
+		t.Fatalf("Expected an error, got none")
+	}
+	if key != nil {
+		t.Fatalf("Expected challenge issued to another user to be invalid, got valid")
+	}
+}
+
+func TestGenerateChallenge_PerUserCap(t *testing.T) {
+	for i := 0; i < internal.MaxChallengesPerUser; i++ {
+		if _, err := internal.GenerateChallenge(context.Background(), "capped", internal.PurposeLogin, testOrigin); err != nil {
+			t.Fatalf("Failed to generate challenge %d: %v", i, err)
+		}
+	}
+
+	if _, err := internal.GenerateChallenge(context.Background(), "capped", internal.PurposeLogin, testOrigin); err != internal.ErrTooManyChallenges {
+		t.Fatalf("Expected ErrTooManyChallenges, got %v", err)
+	}
+
+	// Other users are not affected by the cap
+	if _, err := internal.GenerateChallenge(context.Background(), "notcapped", internal.PurposeLogin, testOrigin); err != nil {
+		t.Fatalf("Expected challenge for another user, got %v", err)
+	}
+}
+
+func TestVerifySignedResponse_WrongPurpose(t *testing.T) {
+	repo, privKey := newChallengeTestUser(t, "wrongpurpose")
+
+	challenge, err := internal.GenerateChallenge(context.Background(), "wrongpurpose", internal.PurposeAddKey, testOrigin)
+	if err != nil {
+		t.Fatalf("Failed to generate challenge: %v", err)
+	}
+	signature := ed25519.Sign(privKey, []byte(challenge.Value))
+
+	// A signature made to add a key must not be usable to log in
+	key, err := internal.VerifySignature(context.Background(), "wrongpurpose", challenge.ID, internal.PurposeLogin, signature, repo)
+	if err == nil {
+		t.Fatalf("Expected an error, got none")
+	}
+	if key != nil {
+		t.Fatalf("Expected challenge for another purpose to be invalid, got valid")
+	}
+}
+
+func TestVerifySignedResponse_SuspendedKey(t *testing.T) {
+	repo, privKey := newChallengeTestUser(t, "suspended")
+	spareKey, _, _ := ed25519.GenerateKey(nil)
+	if err := repo.AddPublicKey(context.Background(), "suspended", spareKey, "spare", util.SignerApp{}); err != nil {
+		t.Fatalf("Failed to add key: %v", err)
+	}
+	if err := repo.SuspendPublicKey(context.Background(), "suspended", "main", "lost"); err != nil {
+		t.Fatalf("Failed to suspend key: %v", err)
+	}
+
+	challenge, err := internal.GenerateChallenge(context.Background(), "suspended", internal.PurposeLogin, testOrigin)
+	if err != nil {
+		t.Fatalf("Failed to generate challenge: %v", err)
+	}
+	signature := ed25519.Sign(privKey, []byte(challenge.Value))
+
+	// A suspended key must not be able to log in
+	key, err := internal.VerifySignature(context.Background(), "suspended", challenge.ID, internal.PurposeLogin, signature, repo)
+	if err == nil || key != nil {
+		t.Fatalf("Expected suspended key to be refused, got %v", key)
+	}
+
+	if err := repo.ReactivatePublicKey(context.Background(), "suspended", "main"); err != nil {
+		t.Fatalf("Failed to reactivate key: %v", err)
+	}
+
+	challenge, err = internal.GenerateChallenge(context.Background(), "suspended", internal.PurposeLogin, testOrigin)
+	if err != nil {
+		t.Fatalf("Failed to generate challenge: %v", err)
+	}
+	signature = ed25519.Sign(privKey, []byte(challenge.Value))
+
+	if key, err := internal.VerifySignature(context.Background(), "suspended", challenge.ID, internal.PurposeLogin, signature, repo); key == nil || err != nil {
+		t.Fatalf("Expected reactivated key to verify, got %v", err)
+	}
+}
+
+func TestGenerateChallenge_OriginNotAllowed(t *testing.T) {
+	_, err := internal.GenerateChallenge(context.Background(), "origin", internal.PurposeLogin, "https://evil.example")
+	if err != internal.ErrOriginNotAllowed {
+		t.Fatalf("Expected ErrOriginNotAllowed, got %v", err)
+	}
+}
+
+func TestChallengePayload_Fields(t *testing.T) {
+	challenge, err := internal.GenerateChallenge(context.Background(), "payload", internal.PurposeLogin, testOrigin)
+	if err != nil {
+		t.Fatalf("Failed to generate challenge: %v", err)
+	}
+
+	payload, err := internal.ParseChallengePayload(challenge.Value)
+	if err != nil {
+		t.Fatalf("Failed to parse payload: %v", err)
+	}
+	if payload.Origin != testOrigin || payload.Purpose != internal.PurposeLogin || payload.Username != "payload" {
+		t.Fatalf("Unexpected payload fields: %+v", payload)
+	}
+	if !payload.ExpiresAt.Equal(challenge.ExpiresAt) {
+		t.Fatalf("Expected payload expiry %v, got %v", challenge.ExpiresAt, payload.ExpiresAt)
+	}
+	if payload.Encode() != challenge.Value {
+		t.Fatalf("Expected payload to encode to the challenge value")
+	}
+
+	if _, err := internal.ParseChallengePayload("0123456789abcdef"); err == nil {
+		t.Fatalf("Expected an error for a raw challenge, got none")
+	}
+}
+
+func TestMemoryChallengeStore(t *testing.T) {
+	store := internal.NewMemoryChallengeStore()
+
+	challenge := &internal.Challenge{ID: "key", Username: "storeuser", Value: "abc", ExpiresAt: time.Now().Add(time.Minute)}
+	if err := store.Put(context.Background(), "key", challenge, time.Minute); err != nil {
+		t.Fatalf("Failed to put challenge: %v", err)
+	}
+
+	if exists, _ := store.Has(context.Background(), "key"); !exists {
+		t.Fatalf("Expected challenge to exist")
+	}
+	if count, _ := store.CountForUser(context.Background(), "storeuser"); count != 1 {
+		t.Fatalf("Expected 1 challenge for user, got %d", count)
+	}
+
+	taken, err := store.Take(context.Background(), "key")
+	if err != nil {
+		t.Fatalf("Failed to take challenge: %v", err)
+	}
+	if taken.Value != "abc" {
+		t.Fatalf("Expected challenge value abc, got %s", taken.Value)
+	}
+
+	// A challenge can only be taken once
+	if _, err := store.Take(context.Background(), "key"); err != internal.ErrNoActiveChallenge {
+		t.Fatalf("Expected ErrNoActiveChallenge, got %v", err)
+	}
+	if exists, _ := store.Has(context.Background(), "key"); exists {
+		t.Fatalf("Expected challenge to be removed")
+	}
+
+	// Expired challenges are not reported as active
+	expired := &internal.Challenge{ID: "expired", Username: "storeuser", Value: "def", ExpiresAt: time.Now().Add(-time.Second)}
+	store.Put(context.Background(), "expired", expired, time.Minute)
+	if exists, _ := store.Has(context.Background(), "expired"); exists {
+		t.Fatalf("Expected expired challenge to not be active")
+	}
+	if count, _ := store.CountForUser(context.Background(), "storeuser"); count != 0 {
+		t.Fatalf("Expected expired challenges to not be counted, got %d", count)
+	}
+}
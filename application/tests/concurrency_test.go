@@ -0,0 +1,87 @@
+package tests
+
+import (
+	"chalmers/tkey-group22/application/internal/util"
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// checkConcurrentKeyChanges adds and then removes keys of a user from many goroutines at once, and checks
+// that no change is lost and that the user never exceeds MaxPublicKeys or loses its last active key.
+func checkConcurrentKeyChanges(t *testing.T, repo util.UserRepository, username string) {
+	pubkey, _, _ := ed25519.GenerateKey(nil)
+	if _, err := repo.CreateUser(context.Background(), username, pubkey, "main", util.SignerApp{}); err != nil {
+		t.Fatal(err)
+	}
+
+	workers := util.MaxPublicKeys * 4
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+	var added []string
+
+	start := make(chan struct{})
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(label string) {
+			defer wg.Done()
+			newPubkey, _, _ := ed25519.GenerateKey(nil)
+			<-start
+			err := repo.AddPublicKey(context.Background(), username, newPubkey, label, util.SignerApp{})
+			if err == nil {
+				lock.Lock()
+				added = append(added, label)
+				lock.Unlock()
+			} else if !errors.Is(err, util.ErrMaxPublicKeys) && !errors.Is(err, util.ErrConcurrentUpdate) {
+				t.Errorf("Unexpected error adding key %s: %v", label, err)
+			}
+		}("key" + strconv.Itoa(i))
+	}
+	close(start)
+	wg.Wait()
+
+	// Every key that was added successfully is stored, and no more than allowed
+	labels, err := repo.GetPublicKeyLabels(context.Background(), username)
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, append([]string{"main"}, added...), labels)
+	assert.LessOrEqual(t, len(labels), util.MaxPublicKeys)
+
+	// Removing every key at once leaves exactly one active key
+	start = make(chan struct{})
+	for _, label := range labels {
+		wg.Add(1)
+		go func(label string) {
+			defer wg.Done()
+			<-start
+			err := repo.RemovePublicKey(context.Background(), username, label)
+			if err != nil && !errors.Is(err, util.ErrLastActiveKey) && !errors.Is(err, util.ErrConcurrentUpdate) {
+				t.Errorf("Unexpected error removing key %s: %v", label, err)
+			}
+		}(label)
+	}
+	close(start)
+	wg.Wait()
+
+	labels, err = repo.GetPublicKeyLabels(context.Background(), username)
+	assert.NoError(t, err)
+	assert.Len(t, labels, 1)
+}
+
+func TestConcurrentKeyChanges_MemoryRepo(t *testing.T) {
+	checkConcurrentKeyChanges(t, util.NewMemoryUserRepo(), "wanda")
+}
+
+func TestConcurrentKeyChanges_SQLiteRepo(t *testing.T) {
+	checkConcurrentKeyChanges(t, util.NewSQLiteUserRepo(openTestSQLite(t)), "wanda")
+}
+
+// Requires a MongoDB database, like the other tests of UserRepo
+func TestConcurrentKeyChanges_UserRepo(t *testing.T) {
+	_, repo := setupTestDB(t)
+	checkConcurrentKeyChanges(t, repo, testUser)
+}
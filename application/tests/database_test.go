@@ -7,8 +7,7 @@ import (
 	"crypto/ed25519"
 	"encoding/base64"
 	"strconv"
-
-	"log"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -19,12 +18,23 @@ const testDBName = "testdb"
 const testUser = "testuser"
 const testLabel = "label"
 
+// testDBUnavailable is the error of the first failed connection to the test database
+// The tests that need MongoDB are skipped after it, instead of each waiting for the connection to time out.
+var testDBUnavailable error
+
+// setupTestDB connects to the MongoDB test database at localhost:27017 and drops it when the test ends
+// The test is skipped when MongoDB cannot be reached, so the other tests can run without it.
 func setupTestDB(t *testing.T) (*mongo.Client, *util.UserRepo) {
+	if testDBUnavailable != nil {
+		t.Skipf("MongoDB is not available: %v", testDBUnavailable)
+	}
+
 	// Connect to the test database
-	inst, err := dbconnect.ConnectMongoDB("mongodb://localhost:27017", testDBName)
+	inst, err := dbconnect.ConnectMongoDB("mongodb://localhost:27017", testDBName, util.OperationTimeout)
 
 	if err != nil {
-		log.Fatal(err)
+		testDBUnavailable = err
+		t.Skipf("MongoDB is not available: %v", err)
 	}
 
 	client := inst.Client
@@ -52,11 +62,11 @@ func TestCreateUser(t *testing.T) {
 	assert.NoError(t, err)
 
 	// Create a new user
-	result, err := repo.CreateUser(testUser, pubkey, testLabel)
+	result, err := repo.CreateUser(context.Background(), testUser, pubkey, testLabel, util.SignerApp{})
 	assert.NoError(t, err)
 	assert.NotNil(t, result)
 	// Check that the user was created and is stored correctly in the database
-	user, err := repo.GetUser(testUser)
+	user, err := repo.GetUser(context.Background(), testUser)
 	assert.NoError(t, err)
 	assert.NotNil(t, user)
 	assert.Equal(t, testUser, user.Username)
@@ -74,15 +84,15 @@ func TestDeleteUser(t *testing.T) {
 	assert.NoError(t, err)
 
 	// Create a new user
-	result, err := repo.CreateUser(testUser, pubkey, testLabel)
+	result, err := repo.CreateUser(context.Background(), testUser, pubkey, testLabel, util.SignerApp{})
 	assert.NoError(t, err)
 	assert.NotNil(t, result)
 
 	// Remove user
-	repo.DeleteUser(testUser)
+	repo.DeleteUser(context.Background(), testUser)
 
 	// Check that user is not in database
-	user, err := repo.GetUser(testUser)
+	user, err := repo.GetUser(context.Background(), testUser)
 	assert.Error(t, err)
 	assert.Nil(t, user)
 
@@ -97,7 +107,7 @@ func TestUpdateUser(t *testing.T) {
 	assert.NoError(t, err)
 
 	// Create a new user
-	result, err := repo.CreateUser(testUser, pubkey, testLabel)
+	result, err := repo.CreateUser(context.Background(), testUser, pubkey, testLabel, util.SignerApp{})
 	assert.NoError(t, err)
 	assert.NotNil(t, result)
 
@@ -114,15 +124,15 @@ func TestUpdateUser(t *testing.T) {
 	}
 
 	// Update user data
-	repo.UpdateUser(testUser, newUser)
+	repo.UpdateUser(context.Background(), testUser, newUser)
 
 	// Check that the old user data is no longer in database
-	user, err := repo.GetUser(testUser)
+	user, err := repo.GetUser(context.Background(), testUser)
 	assert.Nil(t, user)
 	assert.Error(t, err)
 
 	// Check that new user data is in the database
-	user, err = repo.GetUser(newUser.Username)
+	user, err = repo.GetUser(context.Background(), newUser.Username)
 	assert.NotNil(t, user)
 	assert.NoError(t, err)
 	assert.Equal(t, newUser.Username, user.Username)
@@ -137,8 +147,8 @@ func TestGetUser(t *testing.T) {
 	_, repo := setupTestDB(t)
 
 	// Database should return null if requesting non existing user
-	user, err := repo.GetUser("DONOTEXIST")
-	assert.Error(t, err)
+	user, err := repo.GetUser(context.Background(), "DONOTEXIST")
+	assert.ErrorIs(t, err, util.ErrUserNotFound)
 	assert.Nil(t, user)
 
 	// Generate a new key pair
@@ -146,12 +156,12 @@ func TestGetUser(t *testing.T) {
 	assert.NoError(t, err)
 
 	// Create a new user
-	result, err := repo.CreateUser(testUser, pubkey, testLabel)
+	result, err := repo.CreateUser(context.Background(), testUser, pubkey, testLabel, util.SignerApp{})
 	assert.NoError(t, err)
 	assert.NotNil(t, result)
 
 	// GetUser should return correct user
-	user, err = repo.GetUser(testUser)
+	user, err = repo.GetUser(context.Background(), testUser)
 	assert.NoError(t, err)
 	assert.NotNil(t, user)
 	assert.Equal(t, testUser, user.Username)
@@ -168,18 +178,17 @@ func TestAddPublicKey(t *testing.T) {
 	initialLabel := "initial key"
 
 	// Create the user with the initial public key
-	_, err := repo.CreateUser(username, initialPubkey, initialLabel)
+	_, err := repo.CreateUser(context.Background(), username, initialPubkey, initialLabel, util.SignerApp{})
 	assert.NoError(t, err)
 
 	// Add a new public key to the existing user
 	newPubkey := ed25519.PublicKey([]byte("newpublickey"))
 	newLabel := "new key"
-	result, err := repo.AddPublicKey(username, newPubkey, newLabel)
+	err = repo.AddPublicKey(context.Background(), username, newPubkey, newLabel, util.SignerApp{})
 	assert.NoError(t, err)
-	assert.NotNil(t, result)
 
 	// Verify the new public key was added
-	user, err := repo.GetUser(username)
+	user, err := repo.GetUser(context.Background(), username)
 	assert.NoError(t, err)
 	assert.NotNil(t, user)
 	assert.Equal(t, 2, len(user.PublicKeys))
@@ -189,13 +198,13 @@ func TestAddPublicKey(t *testing.T) {
 	assert.Equal(t, newLabel, user.PublicKeys[1].Label)
 
 	// Try to add the same public key again
-	_, err = repo.AddPublicKey(username, newPubkey, newLabel)
+	err = repo.AddPublicKey(context.Background(), username, newPubkey, newLabel, util.SignerApp{})
 	assert.Error(t, err)
 	assert.Equal(t, "public key already exists for the user", err.Error())
 
 	// Try to add a new public key with an existing label
 	anotherPubkey := ed25519.PublicKey([]byte("anotherpublickey"))
-	_, err = repo.AddPublicKey(username, anotherPubkey, newLabel)
+	err = repo.AddPublicKey(context.Background(), username, anotherPubkey, newLabel, util.SignerApp{})
 	assert.Error(t, err)
 	assert.Equal(t, "label already exists for the user", err.Error())
 
@@ -203,14 +212,14 @@ func TestAddPublicKey(t *testing.T) {
 	for i := 2; i < util.MaxPublicKeys; i++ {
 		pubkey := ed25519.PublicKey([]byte("pubkey" + strconv.Itoa(i)))
 		label := "key" + strconv.Itoa(i)
-		_, err := repo.AddPublicKey(username, pubkey, label)
+		err := repo.AddPublicKey(context.Background(), username, pubkey, label, util.SignerApp{})
 		assert.NoError(t, err)
 	}
 
 	// Try to add another public key beyond the maximum limit
 	extraPubkey := ed25519.PublicKey([]byte("extrapubkey"))
 	extraLabel := "extra key"
-	_, err = repo.AddPublicKey(username, extraPubkey, extraLabel)
+	err = repo.AddPublicKey(context.Background(), username, extraPubkey, extraLabel, util.SignerApp{})
 	assert.Error(t, err)
 	assert.Equal(t, "user already has the maximum number of public keys", err.Error())
 }
@@ -223,34 +232,82 @@ func TestRemovePublicKey(t *testing.T) {
 	initialLabel := "initial key"
 
 	// Create the user with the initial public key
-	_, err := repo.CreateUser(username, initialPubkey, initialLabel)
+	_, err := repo.CreateUser(context.Background(), username, initialPubkey, initialLabel, util.SignerApp{})
 	assert.NoError(t, err)
 
 	// Add a new public key to the existing user
 	newPubkey := ed25519.PublicKey([]byte("newpublickey"))
 	newLabel := "new key"
-	_, err = repo.AddPublicKey(username, newPubkey, newLabel)
+	err = repo.AddPublicKey(context.Background(), username, newPubkey, newLabel, util.SignerApp{})
 	assert.NoError(t, err)
 
 	// Remove the new public key
-	result, err := repo.RemovePublicKey(username, newLabel)
+	err = repo.RemovePublicKey(context.Background(), username, newLabel)
 	assert.NoError(t, err)
-	assert.NotNil(t, result)
 
-	// Verify the public key was removed
-	user, err := repo.GetUser(username)
+	// Verify the public key was revoked and kept for audit
+	user, err := repo.GetUser(context.Background(), username)
 	assert.NoError(t, err)
 	assert.NotNil(t, user)
-	assert.Equal(t, 1, len(user.PublicKeys))
+	assert.Equal(t, 2, len(user.PublicKeys))
 	assert.Equal(t, base64.StdEncoding.EncodeToString(initialPubkey), user.PublicKeys[0].Key)
 	assert.Equal(t, initialLabel, user.PublicKeys[0].Label)
+	assert.True(t, user.PublicKeys[0].IsActive())
+	assert.Equal(t, util.KeyStatusRevoked, user.PublicKeys[1].Status)
+	assert.False(t, user.PublicKeys[1].StatusChangedAt.IsZero())
+
+	// A revoked key can never be added again
+	err = repo.AddPublicKey(context.Background(), username, newPubkey, "readded", util.SignerApp{})
+	assert.Error(t, err)
+	assert.Equal(t, "public key has been revoked", err.Error())
 
 	// Try to remove the last remaining public key
-	_, err = repo.RemovePublicKey(username, initialLabel)
+	err = repo.RemovePublicKey(context.Background(), username, initialLabel)
 	assert.Error(t, err)
 	assert.Equal(t, "user must have at least two public keys to remove one", err.Error())
 }
 
+func TestSuspendPublicKey(t *testing.T) {
+	_, repo := setupTestDB(t)
+
+	pubkey, _, err := ed25519.GenerateKey(nil)
+	assert.NoError(t, err)
+	_, err = repo.CreateUser(context.Background(), testUser, pubkey, testLabel, util.SignerApp{})
+	assert.NoError(t, err)
+
+	// The only active key of a user cannot be suspended
+	err = repo.SuspendPublicKey(context.Background(), testUser, testLabel, "lost on the train")
+	assert.ErrorIs(t, err, util.ErrLastActiveKey)
+
+	spareKey, _, err := ed25519.GenerateKey(nil)
+	assert.NoError(t, err)
+	err = repo.AddPublicKey(context.Background(), testUser, spareKey, "spare", util.SignerApp{})
+	assert.NoError(t, err)
+
+	err = repo.SuspendPublicKey(context.Background(), testUser, testLabel, "lost on the train")
+	assert.NoError(t, err)
+
+	user, err := repo.GetUser(context.Background(), testUser)
+	assert.NoError(t, err)
+	assert.Equal(t, util.KeyStatusSuspended, user.PublicKeys[0].Status)
+	assert.Equal(t, "lost on the train", user.PublicKeys[0].StatusReason)
+	assert.False(t, user.PublicKeys[0].IsActive())
+
+	// Suspending twice is refused
+	err = repo.SuspendPublicKey(context.Background(), testUser, testLabel, "")
+	assert.Error(t, err)
+
+	// The key can be reactivated, but only once
+	err = repo.ReactivatePublicKey(context.Background(), testUser, testLabel)
+	assert.NoError(t, err)
+	err = repo.ReactivatePublicKey(context.Background(), testUser, testLabel)
+	assert.Error(t, err)
+
+	user, err = repo.GetUser(context.Background(), testUser)
+	assert.NoError(t, err)
+	assert.True(t, user.PublicKeys[0].IsActive())
+}
+
 func TestGetPublicKeyLabels(t *testing.T) {
 	_, repo := setupTestDB(t)
 
@@ -259,20 +316,136 @@ func TestGetPublicKeyLabels(t *testing.T) {
 	initialLabel := "initial key"
 
 	// Create the user with the initial public key
-	_, err := repo.CreateUser(username, initialPubkey, initialLabel)
+	_, err := repo.CreateUser(context.Background(), username, initialPubkey, initialLabel, util.SignerApp{})
 	assert.NoError(t, err)
 
 	// Add a new public key to the existing user
 	newPubkey := ed25519.PublicKey([]byte("newpublickey"))
 	newLabel := "new key"
-	_, err = repo.AddPublicKey(username, newPubkey, newLabel)
+	err = repo.AddPublicKey(context.Background(), username, newPubkey, newLabel, util.SignerApp{})
 	assert.NoError(t, err)
 
 	// Retrieve the public key labels
-	labels, err := repo.GetPublicKeyLabels(username)
+	labels, err := repo.GetPublicKeyLabels(context.Background(), username)
 	assert.NoError(t, err)
 	assert.NotNil(t, labels)
 	assert.Equal(t, 2, len(labels))
 	assert.Contains(t, labels, initialLabel)
 	assert.Contains(t, labels, newLabel)
 }
+
+func TestRecordKeyUse(t *testing.T) {
+	_, repo := setupTestDB(t)
+
+	username := "testuser"
+	initialPubkey := ed25519.PublicKey([]byte("initialpublickey"))
+	initialLabel := "initialkey"
+
+	// Create the user with the initial public key
+	_, err := repo.CreateUser(context.Background(), username, initialPubkey, initialLabel, util.SignerApp{})
+	assert.NoError(t, err)
+
+	// Add a second key that is not used
+	newPubkey := ed25519.PublicKey([]byte("newpublickey"))
+	newLabel := "newkey"
+	err = repo.AddPublicKey(context.Background(), username, newPubkey, newLabel, util.SignerApp{})
+	assert.NoError(t, err)
+
+	// Record a login with the initial key
+	err = repo.RecordKeyUse(context.Background(), username, initialLabel)
+	assert.NoError(t, err)
+
+	err = repo.RecordKeyUse(context.Background(), username, initialLabel)
+	assert.NoError(t, err)
+
+	// Only the used key has a last used time and a use count
+	user, err := repo.GetUser(context.Background(), username)
+	assert.NoError(t, err)
+	assert.False(t, user.PublicKeys[0].LastUsed.IsZero())
+	assert.Equal(t, int64(2), user.PublicKeys[0].UseCount)
+	assert.True(t, user.PublicKeys[1].LastUsed.IsZero())
+	assert.Equal(t, int64(0), user.PublicKeys[1].UseCount)
+}
+
+func TestCreateUser_KeyMetadata(t *testing.T) {
+	_, repo := setupTestDB(t)
+
+	pubkey, _, err := ed25519.GenerateKey(nil)
+	assert.NoError(t, err)
+
+	signerApp := util.SignerApp{Name: "tk1  sign", Digest: strings.Repeat("ab", 64)}
+	_, err = repo.CreateUser(context.Background(), testUser, pubkey, testLabel, signerApp)
+	assert.NoError(t, err)
+
+	user, err := repo.GetUser(context.Background(), testUser)
+	assert.NoError(t, err)
+	assert.False(t, user.PublicKeys[0].CreatedAt.IsZero())
+	assert.Equal(t, signerApp, user.PublicKeys[0].SignerApp)
+
+	// A malformed digest is refused
+	err = repo.AddPublicKey(context.Background(), testUser, pubkey, "other", util.SignerApp{Digest: "not a digest"})
+	assert.Error(t, err)
+}
+
+func TestRenamePublicKey(t *testing.T) {
+	_, repo := setupTestDB(t)
+
+	pubkey, _, err := ed25519.GenerateKey(nil)
+	assert.NoError(t, err)
+	_, err = repo.CreateUser(context.Background(), testUser, pubkey, "key1", util.SignerApp{})
+	assert.NoError(t, err)
+
+	otherPubkey, _, err := ed25519.GenerateKey(nil)
+	assert.NoError(t, err)
+	err = repo.AddPublicKey(context.Background(), testUser, otherPubkey, "key2", util.SignerApp{})
+	assert.NoError(t, err)
+
+	err = repo.RenamePublicKey(context.Background(), testUser, "key1", "OfficeTKey")
+	assert.NoError(t, err)
+
+	labels, err := repo.GetPublicKeyLabels(context.Background(), testUser)
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{"OfficeTKey", "key2"}, labels)
+
+	// The new label must be unique and sanitized
+	err = repo.RenamePublicKey(context.Background(), testUser, "key2", "OfficeTKey")
+	assert.EqualError(t, err, "label already exists for the user")
+	err = repo.RenamePublicKey(context.Background(), testUser, "key2", "Office TKey")
+	assert.Error(t, err)
+
+	// Unknown labels are reported
+	err = repo.RenamePublicKey(context.Background(), testUser, "key1", "key3")
+	assert.EqualError(t, err, "specified public key is not found")
+}
+
+func TestUseRecoveryCode(t *testing.T) {
+	_, repo := setupTestDB(t)
+
+	username := "testuser"
+	_, err := repo.CreateUser(context.Background(), username, ed25519.PublicKey([]byte("initialpublickey")), "initialkey", util.SignerApp{})
+	assert.NoError(t, err)
+
+	err = repo.SetRecoveryCodes(context.Background(), username, []string{"hash1", "hash2"})
+	assert.NoError(t, err)
+
+	// A code can only be used once
+	used, err := repo.UseRecoveryCode(context.Background(), username, "hash1")
+	assert.NoError(t, err)
+	assert.True(t, used)
+
+	used, err = repo.UseRecoveryCode(context.Background(), username, "hash1")
+	assert.NoError(t, err)
+	assert.False(t, used)
+
+	user, err := repo.GetUser(context.Background(), username)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"hash2"}, user.RecoveryCodes)
+
+	// Setting new codes replaces the old ones
+	err = repo.SetRecoveryCodes(context.Background(), username, []string{"hash3"})
+	assert.NoError(t, err)
+
+	used, err = repo.UseRecoveryCode(context.Background(), username, "hash2")
+	assert.NoError(t, err)
+	assert.False(t, used)
+}
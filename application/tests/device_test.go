@@ -0,0 +1,163 @@
+package tests
+
+import (
+	"chalmers/tkey-group22/application/internal"
+	"chalmers/tkey-group22/application/internal/device"
+	"chalmers/tkey-group22/application/internal/handlers"
+	"chalmers/tkey-group22/application/internal/session_util"
+	"chalmers/tkey-group22/application/internal/structs"
+	"crypto/ed25519"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// startDeviceLogin starts a device login as the browser would.
+func startDeviceLogin(t *testing.T) structs.DeviceAuthorizationResponse {
+	rr := sessionRequest(t, handlers.DeviceAuthorizeHandler, "/api/device/authorize", nil, nil)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Failed to start device login: %d %s", rr.Code, rr.Body.String())
+	}
+	var response structs.DeviceAuthorizationResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	return response
+}
+
+// pollDeviceLogin polls for the device login as the browser would, and returns the OAuth error code if it is not approved.
+func pollDeviceLogin(t *testing.T, deviceCode string) (*httptest.ResponseRecorder, string) {
+	rr := sessionRequest(t, handlers.DeviceTokenHandler, "/api/device/token", structs.DeviceTokenRequest{DeviceCode: deviceCode}, nil)
+	var response structs.OIDCErrorResponse
+	if rr.Code != http.StatusOK {
+		json.Unmarshal(rr.Body.Bytes(), &response)
+	}
+	return rr, response.Error
+}
+
+// deviceChallenge requests a device challenge for the user code as the TKey client would.
+func deviceChallenge(t *testing.T, username string, userCode string) (*httptest.ResponseRecorder, structs.LoginResponse) {
+	rr := sessionRequest(t, handlers.DeviceChallengeHandler, "/api/device/challenge", structs.DeviceChallengeRequest{Username: username, UserCode: userCode, Origin: testOrigin}, nil)
+	var challenge structs.LoginResponse
+	if rr.Code == http.StatusOK {
+		if err := json.Unmarshal(rr.Body.Bytes(), &challenge); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return rr, challenge
+}
+
+// setPollInterval replaces the device poll interval for the duration of the test.
+func setPollInterval(t *testing.T, interval time.Duration) {
+	original := device.PollInterval
+	device.PollInterval = interval
+	t.Cleanup(func() { device.PollInterval = original })
+}
+
+// A browser is logged in once the user approves its code with the TKey on another machine.
+func TestDeviceLoginFlow(t *testing.T) {
+	setPollInterval(t, 0)
+	authorization := startDeviceLogin(t)
+	assert.Regexp(t, `^[B-Z]{4}-[B-Z]{4}$`, authorization.UserCode)
+
+	_, errorCode := pollDeviceLogin(t, authorization.DeviceCode)
+	assert.Equal(t, "authorization_pending", errorCode)
+
+	// The code is accepted however the user types it, and is part of the signed challenge
+	typed := strings.ToLower(authorization.UserCode)
+	rr, challenge := deviceChallenge(t, mockUsername, typed)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	payload, err := internal.ParseChallengePayload(challenge.Challenge)
+	assert.NoError(t, err)
+	assert.Equal(t, internal.PurposeDevice, payload.Purpose)
+	assert.Equal(t, device.NormalizeUserCode(authorization.UserCode), payload.UserCode)
+
+	signature := ed25519.Sign(mockPrivKey, []byte(challenge.Challenge))
+	rr = sessionRequest(t, handlers.DeviceApproveHandler, "/api/device/approve", structs.DeviceApproveRequest{
+		Username:    mockUsername,
+		UserCode:    typed,
+		ChallengeID: challenge.ChallengeID,
+		Signature:   signature,
+	}, nil)
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	rr, errorCode = pollDeviceLogin(t, authorization.DeviceCode)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Empty(t, errorCode)
+
+	req, _ := http.NewRequest(http.MethodGet, "/api/getuser", nil)
+	for _, cookie := range rr.Result().Cookies() {
+		req.AddCookie(cookie)
+	}
+	username, err := session_util.GetSessionUsername(req)
+	assert.NoError(t, err)
+	assert.Equal(t, mockUsername, username)
+
+	// The approval logs in a single browser
+	_, errorCode = pollDeviceLogin(t, authorization.DeviceCode)
+	assert.Equal(t, "expired_token", errorCode)
+}
+
+// A signature over a challenge for one code does not approve the browser showing another code.
+func TestDeviceApproveHandler_ChallengeForOtherCode(t *testing.T) {
+	setPollInterval(t, 0)
+	victim := startDeviceLogin(t)
+	attacker := startDeviceLogin(t)
+
+	_, challenge := deviceChallenge(t, mockUsername, victim.UserCode)
+	signature := ed25519.Sign(mockPrivKey, []byte(challenge.Challenge))
+	rr := sessionRequest(t, handlers.DeviceApproveHandler, "/api/device/approve", structs.DeviceApproveRequest{
+		Username:    mockUsername,
+		UserCode:    attacker.UserCode,
+		ChallengeID: challenge.ChallengeID,
+		Signature:   signature,
+	}, nil)
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+
+	_, errorCode := pollDeviceLogin(t, attacker.DeviceCode)
+	assert.Equal(t, "authorization_pending", errorCode)
+	_, errorCode = pollDeviceLogin(t, victim.DeviceCode)
+	assert.Equal(t, "authorization_pending", errorCode)
+}
+
+func TestDeviceChallengeHandler_InvalidRequests(t *testing.T) {
+	authorization := startDeviceLogin(t)
+
+	rr, _ := deviceChallenge(t, mockUsername, "BBBB-BBBB")
+	assert.Equal(t, http.StatusNotFound, rr.Code, "unknown code")
+
+	// Unknown users get a challenge as at /api/login, which can never be signed
+	rr, _ = deviceChallenge(t, "nobody", authorization.UserCode)
+	assert.Equal(t, http.StatusOK, rr.Code, "unknown user")
+
+	rr, _ = deviceChallenge(t, mockUsername, "")
+	assert.Equal(t, http.StatusBadRequest, rr.Code, "missing code")
+}
+
+// The browser is told to slow down when it polls more often than the interval, and the code expires.
+func TestDeviceTokenHandler_Polling(t *testing.T) {
+	authorization := startDeviceLogin(t)
+	assert.Equal(t, int(device.PollInterval.Seconds()), authorization.Interval)
+
+	_, errorCode := pollDeviceLogin(t, authorization.DeviceCode)
+	assert.Equal(t, "authorization_pending", errorCode)
+	_, errorCode = pollDeviceLogin(t, authorization.DeviceCode)
+	assert.Equal(t, "slow_down", errorCode)
+
+	_, errorCode = pollDeviceLogin(t, "unknown-device-code")
+	assert.Equal(t, "expired_token", errorCode)
+
+	original := device.CodeValidDuration
+	device.CodeValidDuration = -time.Second
+	t.Cleanup(func() { device.CodeValidDuration = original })
+	expired := startDeviceLogin(t)
+	_, errorCode = pollDeviceLogin(t, expired.DeviceCode)
+	assert.Equal(t, "expired_token", errorCode)
+	rr, _ := deviceChallenge(t, mockUsername, expired.UserCode)
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+}
@@ -1,26 +1,30 @@
-// This is outdated
 package tests
 
 import (
 	"bytes"
 	"chalmers/tkey-group22/application/internal"
+	"chalmers/tkey-group22/application/internal/audit"
+	"chalmers/tkey-group22/application/internal/handlers"
+	"chalmers/tkey-group22/application/internal/session_util"
+	"chalmers/tkey-group22/application/internal/structs"
+	"chalmers/tkey-group22/application/internal/util"
+	"context"
 	"crypto/ed25519"
 	"crypto/rand"
-	"encoding/csv"
-	"encoding/hex"
+	"encoding/base64"
 	"encoding/json"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
 
-// This test file could be changed to test all handlers.
-
-const usersFilePath = "../data/users.csv"
-const backupFilePath = "../data/users_backup.csv"
 const loginURL = "/api/login"
 const verifyURL = "/api/verify"
 const mockUsername = "MockUser"
@@ -28,105 +32,32 @@ const mockUsername = "MockUser"
 var mockPubKey ed25519.PublicKey
 var mockPrivKey ed25519.PrivateKey
 
-// backupUsersFile backs up the existing users.csv file to users_backup.csv.
-//
-// Parameters:
-//   - t: The testing.T instance.
-//
-// Returns:
-//   - None
-func backupUsersFile(t *testing.T) {
-	input, err := os.ReadFile(usersFilePath)
-	if err != nil {
-		t.Fatalf("Failed to read users file: %v", err)
-	}
-
-	err = os.WriteFile(backupFilePath, input, 0644)
-	if err != nil {
-		t.Fatalf("Failed to write backup file: %v", err)
-	}
-}
-
-// restoreUsersFile restores the original users.csv file from the backup.
-//
-// Parameters:
-//   - t: The testing.T instance.
-//
-// Returns:
-//   - None
-func restoreUsersFile(t *testing.T) {
-	input, err := os.ReadFile(backupFilePath)
-	if err != nil {
-		t.Fatalf("Failed to read backup file: %v", err)
-	}
-
-	err = os.WriteFile(usersFilePath, input, 0644)
-	if err != nil {
-		t.Fatalf("Failed to restore users file: %v", err)
-	}
-
-	err = os.Remove(backupFilePath)
-	if err != nil {
-		t.Fatalf("Failed to remove backup file: %v", err)
-	}
-}
-
-// writeMockData writes mock data to the users.csv file.
-//
-// Parameters:
-//   - t: The testing.T instance.
-//   - data: A 2D slice of strings representing the mock data to be written.
-//
-// Returns:
-//   - None
-func writeMockData(t *testing.T, data [][]string) {
-	file, err := os.Create(usersFilePath)
-	if err != nil {
-		t.Fatalf("Failed to create users file: %v", err)
-	}
-	defer file.Close()
-
-	writer := csv.NewWriter(file)
-	defer writer.Flush()
-
-	for _, record := range data {
-		if err := writer.Write(record); err != nil {
-			t.Fatalf("Failed to write record to users file: %v", err)
-		}
-	}
-}
-
-// TestMain sets up the test environment, runs the tests, and then restores the
-// original environment.
+// TestMain sets up the test environment with an in-memory user repository and a cookie
+// session store, and then runs the tests.
 //
 // Parameters:
 //   - m: The testing.M instance.
 //
 // Returns:
 //   - None
-//
-// Dependencies:
-//   - backupUsersFile
-//   - writeMockData
-//   - restoreUsersFile
-
 func TestMain(m *testing.M) {
-	backupUsersFile(nil)
 	mockPubKey, mockPrivKey, _ = ed25519.GenerateKey(nil)
-	mockData := [][]string{
-		{"username", "publickey"},
-		{"bob", "mocked_banana1234"},
-		{"alice", "mocked_apple1234"},
-		{mockUsername, string(mockPubKey)},
-	}
-	writeMockData(nil, mockData)
 
-	// Run the tests including helper funcs
-	code := m.Run()
+	repo := util.NewMemoryUserRepo()
+	bobPubKey, _, _ := ed25519.GenerateKey(nil)
+	alicePubKey, _, _ := ed25519.GenerateKey(nil)
+	repo.CreateUser(context.Background(), "bob", bobPubKey, "main", util.SignerApp{})
+	repo.CreateUser(context.Background(), "alice", alicePubKey, "main", util.SignerApp{})
+	repo.CreateUser(context.Background(), mockUsername, mockPubKey, "main", util.SignerApp{})
+	handlers.UserRepo = repo
+	handlers.OIDCClients = util.NewMemoryOIDCClientRepo()
 
-	restoreUsersFile(nil)
+	session_util.Store = session_util.NewServerStore(session_util.NewMemorySessionBackend(), []byte("test-session-key"))
 
-	os.Exit(code)
+	_, serverKey, _ := ed25519.GenerateKey(nil)
+	internal.SetServerIdentity(serverKey)
+
+	os.Exit(m.Run())
 }
 
 // createRequest creates a new HTTP request and response recorder for testing.
@@ -155,25 +86,78 @@ func createRequest(t *testing.T, method, url string, body map[string]string) (*h
 	return rr, req
 }
 
+// authenticateRequest adds the cookie of a new session for the given user and key to the request.
+//
+// Parameters:
+//   - t: The testing.T instance.
+//   - req: The request to authenticate.
+//   - username: The user the session belongs to.
+//   - keyLabel: The label of the key the session was authenticated with.
+func authenticateRequest(t *testing.T, req *http.Request, username string, keyLabel string) {
+	rr := httptest.NewRecorder()
+	sessionReq, _ := http.NewRequest(http.MethodPost, verifyURL, nil)
+	if err := session_util.SetSession(rr, sessionReq, username, keyLabel); err != nil {
+		t.Fatal(err)
+	}
+	for _, cookie := range rr.Result().Cookies() {
+		req.AddCookie(cookie)
+	}
+}
+
 // Valid input. Expects success.
 func TestLoginHandler_Success(t *testing.T) {
-	rr, req := createRequest(t, http.MethodPost, loginURL, map[string]string{"username": "bob"})
-	internal.LoginHandler(rr, req)
+	rr, req := createRequest(t, http.MethodPost, loginURL, map[string]string{"username": "bob", "origin": testOrigin})
+	handlers.LoginHandler(rr, req)
 
 	if status := rr.Code; status != http.StatusOK {
 		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
 	}
 
-	expected := `{"challenge":"`
+	expected := `{"challenge_id":"`
 	if !bytes.HasPrefix(rr.Body.Bytes(), []byte(expected)) {
 		t.Errorf("handler returned unexpected body: got %v want prefix %v", rr.Body.String(), expected)
 	}
 }
 
+// The challenge must carry a valid signature by the server identity key.
+func TestLoginHandler_ChallengeSignedByServer(t *testing.T) {
+	rr, req := createRequest(t, http.MethodPost, loginURL, map[string]string{"username": "alice", "origin": testOrigin})
+	handlers.LoginHandler(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	var response structs.LoginResponse
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &response))
+
+	signature, err := base64.StdEncoding.DecodeString(response.Signature)
+	assert.NoError(t, err)
+	assert.True(t, ed25519.Verify(internal.ServerPublicKey(), []byte(response.Challenge), signature))
+}
+
+func TestServerPublicKeyHandler(t *testing.T) {
+	rr, req := createRequest(t, http.MethodGet, "/api/public", nil)
+	handlers.ServerPublicKeyHandler(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	var response structs.ServerPublicKeyResponse
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &response))
+	assert.Equal(t, []byte(internal.ServerPublicKey()), response.PublicKey)
+	assert.Equal(t, "Ed25519", response.Algorithm)
+}
+
+// Origin that challenges may not be issued for. Expects fail.
+func TestLoginHandler_OriginNotAllowed(t *testing.T) {
+	rr, req := createRequest(t, http.MethodPost, loginURL, map[string]string{"username": "bob", "origin": "https://evil.example"})
+	handlers.LoginHandler(rr, req)
+
+	if status := rr.Code; status != http.StatusBadRequest {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusBadRequest)
+	}
+}
+
 // Invalid method. Expects fail.
 func TestLoginHandler_InvalidMethod(t *testing.T) {
 	rr, req := createRequest(t, http.MethodGet, loginURL, nil)
-	internal.LoginHandler(rr, req)
+	handlers.LoginHandler(rr, req)
 
 	if status := rr.Code; status != http.StatusMethodNotAllowed {
 		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusMethodNotAllowed)
@@ -183,7 +167,7 @@ func TestLoginHandler_InvalidMethod(t *testing.T) {
 // Invalid req body. Expects fail.
 func TestLoginHandler_InvalidRequestBody(t *testing.T) {
 	rr, req := createRequest(t, http.MethodPost, loginURL, map[string]string{"invalid": "body"})
-	internal.LoginHandler(rr, req)
+	handlers.LoginHandler(rr, req)
 
 	if status := rr.Code; status != http.StatusBadRequest {
 		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusBadRequest)
@@ -193,25 +177,30 @@ func TestLoginHandler_InvalidRequestBody(t *testing.T) {
 // No username in req body. Expects fail.
 func TestLoginHandler_UsernameNotProvided(t *testing.T) {
 	rr, req := createRequest(t, http.MethodPost, loginURL, map[string]string{})
-	internal.LoginHandler(rr, req)
+	handlers.LoginHandler(rr, req)
 
 	if status := rr.Code; status != http.StatusBadRequest {
 		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusBadRequest)
 	}
 }
 
-// Bad user. Expects fail.
+// Bad user. Gets a challenge like any other user, so the response does not tell that the user does not exist.
 func TestLoginHandler_UserNotFound(t *testing.T) {
-	rr, req := createRequest(t, http.MethodPost, loginURL, map[string]string{"username": "nonexistent"})
-	internal.LoginHandler(rr, req)
+	rr, req := createRequest(t, http.MethodPost, loginURL, map[string]string{"username": "nonexistent", "origin": testOrigin})
+	handlers.LoginHandler(rr, req)
 
-	if status := rr.Code; status != http.StatusNotFound {
-		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusNotFound)
+	if status := rr.Code; status != http.StatusOK {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
 	}
+
+	var challenge structs.LoginResponse
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &challenge))
+	assert.NotEmpty(t, challenge.ChallengeID)
+	assert.NotEmpty(t, challenge.Signature)
 }
 
 func TestVerifyHandler_InvalidRequestMethod(t *testing.T) {
-	handler := http.HandlerFunc(internal.VerifyHandler)
+	handler := http.HandlerFunc(handlers.VerifyHandler)
 
 	req, err := http.NewRequest(http.MethodGet, verifyURL, nil)
 	assert.NoError(t, err)
@@ -223,7 +212,7 @@ func TestVerifyHandler_InvalidRequestMethod(t *testing.T) {
 }
 
 func TestVerifyHandler_InvalidRequestBody(t *testing.T) {
-	handler := http.HandlerFunc(internal.VerifyHandler)
+	handler := http.HandlerFunc(handlers.VerifyHandler)
 
 	req, err := http.NewRequest(http.MethodPost, verifyURL, bytes.NewBuffer([]byte("invalid body")))
 	assert.NoError(t, err)
@@ -235,7 +224,7 @@ func TestVerifyHandler_InvalidRequestBody(t *testing.T) {
 }
 
 func TestVerifyHandler_NonHexadecimalSignature(t *testing.T) {
-	handler := http.HandlerFunc(internal.VerifyHandler)
+	handler := http.HandlerFunc(handlers.VerifyHandler)
 
 	requestBody := map[string]string{
 		"username":  mockUsername,
@@ -252,7 +241,7 @@ func TestVerifyHandler_NonHexadecimalSignature(t *testing.T) {
 }
 
 func TestVerifyHandler_NoActiveChallengeFound(t *testing.T) {
-	handler := http.HandlerFunc(internal.VerifyHandler)
+	handler := http.HandlerFunc(handlers.VerifyHandler)
 
 	// Generate a valid signature
 	_, privKey, _ := ed25519.GenerateKey(nil)
@@ -260,7 +249,7 @@ func TestVerifyHandler_NoActiveChallengeFound(t *testing.T) {
 
 	requestBody := map[string]string{
 		"username":  mockUsername,
-		"signature": hex.EncodeToString(signature),
+		"signature": base64.StdEncoding.EncodeToString(signature),
 	}
 	body, _ := json.Marshal(requestBody)
 	req, err := http.NewRequest(http.MethodPost, verifyURL, bytes.NewBuffer(body))
@@ -273,17 +262,18 @@ func TestVerifyHandler_NoActiveChallengeFound(t *testing.T) {
 }
 
 func TestVerifyHandler_InvalidSignature(t *testing.T) {
-	handler := http.HandlerFunc(internal.VerifyHandler)
+	handler := http.HandlerFunc(handlers.VerifyHandler)
 
-	internal.GenerateChallenge(mockUsername)
+	challenge, _ := internal.GenerateChallenge(context.Background(), mockUsername, internal.PurposeLogin, testOrigin)
 
 	// Generate random byte slice
 	invalidSignBytes := make([]byte, 32)
 	rand.Read(invalidSignBytes)
 
 	requestBody := map[string]string{
-		"username":  mockUsername,
-		"signature": hex.EncodeToString(invalidSignBytes),
+		"username":     mockUsername,
+		"challenge_id": challenge.ID,
+		"signature":    base64.StdEncoding.EncodeToString(invalidSignBytes),
 	}
 	body, _ := json.Marshal(requestBody)
 	req, err := http.NewRequest(http.MethodPost, verifyURL, bytes.NewBuffer(body))
@@ -296,16 +286,16 @@ func TestVerifyHandler_InvalidSignature(t *testing.T) {
 }
 
 func TestVerifyHandler_VerificationSuccessful(t *testing.T) {
-	handler := http.HandlerFunc(internal.VerifyHandler)
+	handler := http.HandlerFunc(handlers.VerifyHandler)
 
-	challengeHex, _ := internal.GenerateChallenge(mockUsername)
-	challengeBytes, _ := hex.DecodeString(challengeHex)
-	signature := ed25519.Sign(mockPrivKey, challengeBytes)
-	signatureHex := hex.EncodeToString(signature)
+	challenge, _ := internal.GenerateChallenge(context.Background(), mockUsername, internal.PurposeLogin, testOrigin)
+	signature := ed25519.Sign(mockPrivKey, []byte(challenge.Value))
+	encodedSignature := base64.StdEncoding.EncodeToString(signature)
 
 	requestBody := map[string]string{
-		"username":  mockUsername,
-		"signature": signatureHex,
+		"username":     mockUsername,
+		"challenge_id": challenge.ID,
+		"signature":    encodedSignature,
 	}
 	body, _ := json.Marshal(requestBody)
 	req, err := http.NewRequest(http.MethodPost, verifyURL, bytes.NewBuffer(body))
@@ -316,3 +306,702 @@ func TestVerifyHandler_VerificationSuccessful(t *testing.T) {
 
 	assert.Equal(t, http.StatusOK, rr.Code)
 }
+
+// A successful login reports the key that was used and records when it was used.
+func TestVerifyHandler_ReportsAuthenticatingKey(t *testing.T) {
+	challenge, _ := internal.GenerateChallenge(context.Background(), mockUsername, internal.PurposeLogin, testOrigin)
+	signature := ed25519.Sign(mockPrivKey, []byte(challenge.Value))
+
+	rr, req := createRequest(t, http.MethodPost, verifyURL, map[string]string{
+		"username":     mockUsername,
+		"challenge_id": challenge.ID,
+		"signature":    base64.StdEncoding.EncodeToString(signature),
+	})
+	handlers.VerifyHandler(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	user, err := handlers.UserRepo.GetUser(context.Background(), mockUsername)
+	assert.NoError(t, err)
+	assert.False(t, user.PublicKeys[0].LastUsed.IsZero())
+
+	// The session cookie identifies the key on /api/getuser
+	getUserRR := httptest.NewRecorder()
+	getUserReq, _ := http.NewRequest(http.MethodGet, "/api/getuser", nil)
+	for _, cookie := range rr.Result().Cookies() {
+		getUserReq.AddCookie(cookie)
+	}
+	handlers.GetUserHandler(getUserRR, getUserReq)
+	assert.Equal(t, http.StatusOK, getUserRR.Code)
+
+	var response map[string]string
+	assert.NoError(t, json.Unmarshal(getUserRR.Body.Bytes(), &response))
+	assert.Equal(t, mockUsername, response["user"])
+	assert.Equal(t, "main", response["keyLabel"])
+	assert.NotEmpty(t, response["authenticatedAt"])
+}
+
+// The key listing includes the metadata of every key of the user.
+func TestListPublicKeysHandler(t *testing.T) {
+	repo := util.NewMemoryUserRepo()
+	pubkey, _, _ := ed25519.GenerateKey(nil)
+	signerApp := util.SignerApp{Name: "tk1  sign", Digest: strings.Repeat("ab", 64)}
+	repo.CreateUser(context.Background(), "carol", pubkey, "main", signerApp)
+	repo.RecordKeyUse(context.Background(), "carol", "main")
+
+	originalRepo := handlers.UserRepo
+	handlers.UserRepo = repo
+	handlers.OIDCClients = util.NewMemoryOIDCClientRepo()
+	defer func() { handlers.UserRepo = originalRepo }()
+
+	rr, req := createRequest(t, http.MethodGet, "/api/list-public-keys", nil)
+	authenticateRequest(t, req, "carol", "main")
+	handlers.ListPublicKeysHandler(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	var response structs.ListPublicKeysResponse
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &response))
+	assert.Len(t, response.Keys, 1)
+
+	key := response.Keys[0]
+	assert.Equal(t, "main", key.Label)
+	assert.Equal(t, []byte(pubkey), key.Pubkey)
+	assert.Equal(t, int64(1), key.UseCount)
+	assert.Equal(t, signerApp.Name, key.AppName)
+	assert.Equal(t, signerApp.Digest, key.AppDigest)
+	assert.NotNil(t, key.CreatedAt)
+	assert.NotNil(t, key.LastUsed)
+}
+
+func TestListPublicKeysHandler_Unauthorized(t *testing.T) {
+	rr, req := createRequest(t, http.MethodGet, "/api/list-public-keys", nil)
+	handlers.ListPublicKeysHandler(rr, req)
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+}
+
+// A key can be suspended and reactivated through the handlers with a step-up, and the listing shows its status.
+func TestSuspendAndReactivatePublicKeyHandlers(t *testing.T) {
+	privkey, cookies := stepUpTestUser(t, "dave")
+	spareKey, _, _ := ed25519.GenerateKey(nil)
+	handlers.UserRepo.AddPublicKey(context.Background(), "dave", spareKey, "spare", util.SignerApp{})
+
+	// A session cookie alone is not enough
+	suspendRequest := structs.SuspendPublicKeyRequest{Label: "spare", Reason: "lost"}
+	rr := sessionRequest(t, handlers.SuspendPublicKeyHandler, "/api/suspend-public-key", suspendRequest, cookies)
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+
+	rr = sessionRequest(t, handlers.SuspendPublicKeyHandler, "/api/suspend-public-key", suspendRequest, stepUp(t, internal.PurposeSuspendKey, privkey, cookies))
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	// The step-up is used up
+	rr = sessionRequest(t, handlers.SuspendPublicKeyHandler, "/api/suspend-public-key", structs.SuspendPublicKeyRequest{Label: "main"}, cookies)
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+
+	rr, req := createRequest(t, http.MethodGet, "/api/list-public-keys", nil)
+	authenticateRequest(t, req, "dave", "main")
+	handlers.ListPublicKeysHandler(rr, req)
+	var response structs.ListPublicKeysResponse
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &response))
+	assert.Equal(t, util.KeyStatusActive, response.Keys[0].Status)
+	assert.Equal(t, util.KeyStatusSuspended, response.Keys[1].Status)
+	assert.Equal(t, "lost", response.Keys[1].StatusReason)
+
+	// The last active key cannot be suspended
+	rr = sessionRequest(t, handlers.SuspendPublicKeyHandler, "/api/suspend-public-key", structs.SuspendPublicKeyRequest{Label: "main"}, stepUp(t, internal.PurposeSuspendKey, privkey, cookies))
+	assert.Equal(t, http.StatusConflict, rr.Code)
+	user, _ := handlers.UserRepo.GetUser(context.Background(), "dave")
+	assert.True(t, user.PublicKeys[0].IsActive())
+
+	// Reactivating requires its own step-up
+	reactivateRequest := structs.ReactivatePublicKeyRequest{Label: "spare"}
+	rr = sessionRequest(t, handlers.ReactivatePublicKeyHandler, "/api/reactivate-public-key", reactivateRequest, stepUp(t, internal.PurposeSuspendKey, privkey, cookies))
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+
+	rr = sessionRequest(t, handlers.ReactivatePublicKeyHandler, "/api/reactivate-public-key", reactivateRequest, stepUp(t, internal.PurposeReactivateKey, privkey, cookies))
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	// Unknown keys are reported as not found
+	rr = sessionRequest(t, handlers.SuspendPublicKeyHandler, "/api/suspend-public-key", structs.SuspendPublicKeyRequest{Label: "other"}, stepUp(t, internal.PurposeSuspendKey, privkey, cookies))
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+}
+
+// Renaming the key the session was authenticated with keeps the session pointing at it.
+func TestRenamePublicKeyHandler(t *testing.T) {
+	repo := util.NewMemoryUserRepo()
+	pubkey, _, _ := ed25519.GenerateKey(nil)
+	otherPubkey, _, _ := ed25519.GenerateKey(nil)
+	repo.CreateUser(context.Background(), "erin", pubkey, "key1", util.SignerApp{})
+	repo.AddPublicKey(context.Background(), "erin", otherPubkey, "spare", util.SignerApp{})
+
+	originalRepo := handlers.UserRepo
+	handlers.UserRepo = repo
+	handlers.OIDCClients = util.NewMemoryOIDCClientRepo()
+	defer func() { handlers.UserRepo = originalRepo }()
+
+	rr, req := createRequest(t, http.MethodPost, "/api/rename-public-key", map[string]string{"label": "key1", "new_label": "OfficeTKey"})
+	authenticateRequest(t, req, "erin", "key1")
+	handlers.RenamePublicKeyHandler(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	labels, _ := repo.GetPublicKeyLabels(context.Background(), "erin")
+	assert.ElementsMatch(t, []string{"OfficeTKey", "spare"}, labels)
+
+	getUserRR := httptest.NewRecorder()
+	getUserReq, _ := http.NewRequest(http.MethodGet, "/api/getuser", nil)
+	for _, cookie := range rr.Result().Cookies() {
+		getUserReq.AddCookie(cookie)
+	}
+	handlers.GetUserHandler(getUserRR, getUserReq)
+	var response map[string]string
+	assert.NoError(t, json.Unmarshal(getUserRR.Body.Bytes(), &response))
+	assert.Equal(t, "OfficeTKey", response["keyLabel"])
+
+	// Labels must stay unique
+	rr, req = createRequest(t, http.MethodPost, "/api/rename-public-key", map[string]string{"label": "spare", "new_label": "OfficeTKey"})
+	authenticateRequest(t, req, "erin", "OfficeTKey")
+	handlers.RenamePublicKeyHandler(rr, req)
+	assert.Equal(t, http.StatusConflict, rr.Code)
+}
+
+// stepUpTestUser sets up a user with a single key and returns the key and a cookie of a session for the user.
+func stepUpTestUser(t *testing.T, username string) (ed25519.PrivateKey, []*http.Cookie) {
+	repo := util.NewMemoryUserRepo()
+	pubkey, privkey, _ := ed25519.GenerateKey(nil)
+	repo.CreateUser(context.Background(), username, pubkey, "main", util.SignerApp{})
+
+	originalRepo := handlers.UserRepo
+	handlers.UserRepo = repo
+	handlers.OIDCClients = util.NewMemoryOIDCClientRepo()
+	t.Cleanup(func() { handlers.UserRepo = originalRepo })
+
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodPost, verifyURL, nil)
+	if err := session_util.SetSession(rr, req, username, "main"); err != nil {
+		t.Fatal(err)
+	}
+	return privkey, rr.Result().Cookies()
+}
+
+// sessionRequest sends a JSON request with the given session cookies to a handler and returns the recorder.
+func sessionRequest(t *testing.T, handler http.HandlerFunc, url string, body interface{}, cookies []*http.Cookie) *httptest.ResponseRecorder {
+	requestBody, err := json.Marshal(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, _ := http.NewRequest(http.MethodPost, url, bytes.NewBuffer(requestBody))
+	for _, cookie := range cookies {
+		req.AddCookie(cookie)
+	}
+	rr := httptest.NewRecorder()
+	handler(rr, req)
+	return rr
+}
+
+// signStepUpChallenge requests a challenge for the purpose and signs it with the given key.
+func signStepUpChallenge(t *testing.T, purpose string, key ed25519.PrivateKey, cookies []*http.Cookie) (string, []byte) {
+	rr := sessionRequest(t, handlers.StepUpChallengeHandler, "/api/step-up-challenge", map[string]string{"purpose": purpose, "origin": testOrigin}, cookies)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Failed to get %s challenge: %d %s", purpose, rr.Code, rr.Body.String())
+	}
+	var challenge structs.LoginResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &challenge); err != nil {
+		t.Fatal(err)
+	}
+	return challenge.ChallengeID, ed25519.Sign(key, []byte(challenge.Challenge))
+}
+
+// stepUp performs a step-up for the purpose and returns the cookies of the session holding it.
+func stepUp(t *testing.T, purpose string, key ed25519.PrivateKey, cookies []*http.Cookie) []*http.Cookie {
+	challengeID, signature := signStepUpChallenge(t, purpose, key, cookies)
+	rr := sessionRequest(t, handlers.StepUpHandler, "/api/step-up", structs.StepUpRequest{Purpose: purpose, ChallengeID: challengeID, Signature: signature}, cookies)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Step-up failed: %d %s", rr.Code, rr.Body.String())
+	}
+	return rr.Result().Cookies()
+}
+
+// Adding a key requires a step-up signature by a registered key and a signature by the new key.
+func TestAddPublicKeyHandler_StepUp(t *testing.T) {
+	privkey, cookies := stepUpTestUser(t, "frank")
+	newPubkey, newPrivkey, _ := ed25519.GenerateKey(nil)
+
+	// A session cookie alone is not enough
+	challengeID, signature := signStepUpChallenge(t, internal.PurposeNewKey, newPrivkey, cookies)
+	addRequest := structs.AddPublicKeyRequest{Pubkey: newPubkey, Label: "backup", ChallengeID: challengeID, Signature: signature}
+	rr := sessionRequest(t, handlers.AddPublicKeyHandler, "/api/add-public-key", addRequest, cookies)
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+
+	// A step-up for another purpose is not enough either
+	removeCookies := stepUp(t, internal.PurposeRemoveKey, privkey, cookies)
+	rr = sessionRequest(t, handlers.AddPublicKeyHandler, "/api/add-public-key", addRequest, removeCookies)
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+
+	stepUpCookies := stepUp(t, internal.PurposeAddKey, privkey, cookies)
+
+	// The new key must prove possession, and the failed attempt uses up the step-up
+	_, otherPrivkey, _ := ed25519.GenerateKey(nil)
+	challengeID, signature = signStepUpChallenge(t, internal.PurposeNewKey, otherPrivkey, stepUpCookies)
+	addRequest.ChallengeID, addRequest.Signature = challengeID, signature
+	rr = sessionRequest(t, handlers.AddPublicKeyHandler, "/api/add-public-key", addRequest, stepUpCookies)
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+	rr = sessionRequest(t, handlers.AddPublicKeyHandler, "/api/add-public-key", addRequest, stepUpCookies)
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+
+	stepUpCookies = stepUp(t, internal.PurposeAddKey, privkey, cookies)
+	challengeID, signature = signStepUpChallenge(t, internal.PurposeNewKey, newPrivkey, stepUpCookies)
+	addRequest.ChallengeID, addRequest.Signature = challengeID, signature
+	rr = sessionRequest(t, handlers.AddPublicKeyHandler, "/api/add-public-key", addRequest, stepUpCookies)
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	labels, _ := handlers.UserRepo.GetPublicKeyLabels(context.Background(), "frank")
+	assert.ElementsMatch(t, []string{"main", "backup"}, labels)
+
+	// The step-up is used up
+	anotherPubkey, anotherPrivkey, _ := ed25519.GenerateKey(nil)
+	challengeID, signature = signStepUpChallenge(t, internal.PurposeNewKey, anotherPrivkey, stepUpCookies)
+	addRequest = structs.AddPublicKeyRequest{Pubkey: anotherPubkey, Label: "another", ChallengeID: challengeID, Signature: signature}
+	rr = sessionRequest(t, handlers.AddPublicKeyHandler, "/api/add-public-key", addRequest, rr.Result().Cookies())
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+}
+
+// A step-up must be signed by one of the user's own keys.
+func TestStepUpHandler_InvalidSignature(t *testing.T) {
+	_, cookies := stepUpTestUser(t, "grace")
+	_, otherPrivkey, _ := ed25519.GenerateKey(nil)
+
+	challengeID, signature := signStepUpChallenge(t, internal.PurposeAddKey, otherPrivkey, cookies)
+	rr := sessionRequest(t, handlers.StepUpHandler, "/api/step-up", structs.StepUpRequest{Purpose: internal.PurposeAddKey, ChallengeID: challengeID, Signature: signature}, cookies)
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+}
+
+// Removing a key requires a step-up.
+func TestRemovePublicKeyHandler_StepUp(t *testing.T) {
+	privkey, cookies := stepUpTestUser(t, "heidi")
+	spareKey, _, _ := ed25519.GenerateKey(nil)
+	handlers.UserRepo.AddPublicKey(context.Background(), "heidi", spareKey, "spare", util.SignerApp{})
+
+	rr := sessionRequest(t, handlers.RemovePublicKeyHandler, "/api/remove-public-key", map[string]string{"label": "spare"}, cookies)
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+
+	stepUpCookies := stepUp(t, internal.PurposeRemoveKey, privkey, cookies)
+	rr = sessionRequest(t, handlers.RemovePublicKeyHandler, "/api/remove-public-key", map[string]string{"label": "spare"}, stepUpCookies)
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	labels, _ := handlers.UserRepo.GetPublicKeyLabels(context.Background(), "heidi")
+	assert.Equal(t, []string{"main"}, labels)
+}
+
+// Requests sent at the same time with the same step-up cannot both use it.
+func TestRemovePublicKeyHandler_ConcurrentStepUp(t *testing.T) {
+	privkey, cookies := stepUpTestUser(t, "hugo")
+	labels := []string{"spare1", "spare2", "spare3", "spare4"}
+	for _, label := range labels {
+		spareKey, _, _ := ed25519.GenerateKey(nil)
+		handlers.UserRepo.AddPublicKey(context.Background(), "hugo", spareKey, label, util.SignerApp{})
+	}
+	stepUpCookies := stepUp(t, internal.PurposeRemoveKey, privkey, cookies)
+
+	var wg sync.WaitGroup
+	codes := make([]int, len(labels))
+	start := make(chan struct{})
+	for i, label := range labels {
+		wg.Add(1)
+		go func(i int, label string) {
+			defer wg.Done()
+			<-start
+			codes[i] = sessionRequest(t, handlers.RemovePublicKeyHandler, "/api/remove-public-key", map[string]string{"label": label}, stepUpCookies).Code
+		}(i, label)
+	}
+	close(start)
+	wg.Wait()
+
+	removed := 0
+	for _, code := range codes {
+		if code == http.StatusOK {
+			removed++
+		} else {
+			assert.Equal(t, http.StatusForbidden, code)
+		}
+	}
+	assert.Equal(t, 1, removed)
+
+	remaining, _ := handlers.UserRepo.GetPublicKeyLabels(context.Background(), "hugo")
+	assert.Len(t, remaining, len(labels))
+}
+
+// registrationChallenge requests a registration challenge for the username.
+func registrationChallenge(t *testing.T, username string) structs.LoginResponse {
+	rr, req := createRequest(t, http.MethodPost, "/api/register-challenge", map[string]string{"username": username, "origin": testOrigin})
+	handlers.RegisterChallengeHandler(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Failed to get registration challenge: %d %s", rr.Code, rr.Body.String())
+	}
+	var challenge structs.LoginResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &challenge); err != nil {
+		t.Fatal(err)
+	}
+	return challenge
+}
+
+// register sends a registration request and returns the recorder.
+func register(t *testing.T, request structs.RegisterRequest) *httptest.ResponseRecorder {
+	body, _ := json.Marshal(request)
+	req, _ := http.NewRequest(http.MethodPost, "/api/register", bytes.NewBuffer(body))
+	rr := httptest.NewRecorder()
+	handlers.RegisterHandler(rr, req)
+	return rr
+}
+
+// Registration requires the key to sign a registration challenge.
+func TestRegisterHandler_ProofOfPossession(t *testing.T) {
+	pubkey, privkey, _ := ed25519.GenerateKey(nil)
+
+	// A key that the caller does not control cannot be registered
+	_, otherPrivkey, _ := ed25519.GenerateKey(nil)
+	challenge := registrationChallenge(t, "ivan")
+	rr := register(t, structs.RegisterRequest{
+		Username:    "ivan",
+		Pubkey:      pubkey,
+		Label:       "main",
+		ChallengeID: challenge.ChallengeID,
+		Signature:   ed25519.Sign(otherPrivkey, []byte(challenge.Challenge)),
+	})
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+
+	challenge = registrationChallenge(t, "ivan")
+	rr = register(t, structs.RegisterRequest{
+		Username:    "ivan",
+		Pubkey:      pubkey,
+		Label:       "main",
+		ChallengeID: challenge.ChallengeID,
+		Signature:   ed25519.Sign(privkey, []byte(challenge.Challenge)),
+	})
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	user, err := handlers.UserRepo.GetUser(context.Background(), "ivan")
+	assert.NoError(t, err)
+	assert.Equal(t, base64.StdEncoding.EncodeToString(pubkey), user.PublicKeys[0].Key)
+
+	// Existing users cannot get a registration challenge
+	rr, req := createRequest(t, http.MethodPost, "/api/register-challenge", map[string]string{"username": "ivan", "origin": testOrigin})
+	handlers.RegisterChallengeHandler(rr, req)
+	assert.Equal(t, http.StatusConflict, rr.Code)
+}
+
+// Registration refuses anything that is not a 32 byte ed25519 key.
+func TestRegisterHandler_InvalidPublicKey(t *testing.T) {
+	challenge := registrationChallenge(t, "judy")
+	rr := register(t, structs.RegisterRequest{
+		Username:    "judy",
+		Pubkey:      []byte("garbage"),
+		Label:       "main",
+		ChallengeID: challenge.ChallengeID,
+	})
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+}
+
+// Registration returns recovery codes, which can each be used once to enroll a new key.
+func TestRecoveryCodes(t *testing.T) {
+	pubkey, privkey, _ := ed25519.GenerateKey(nil)
+	challenge := registrationChallenge(t, "kate")
+	rr := register(t, structs.RegisterRequest{
+		Username:    "kate",
+		Pubkey:      pubkey,
+		Label:       "main",
+		ChallengeID: challenge.ChallengeID,
+		Signature:   ed25519.Sign(privkey, []byte(challenge.Challenge)),
+	})
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	var registerResponse structs.RegisterResponse
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &registerResponse))
+	assert.Len(t, registerResponse.RecoveryCodes, internal.RecoveryCodeCount)
+
+	rr = sessionRequest(t, handlers.RecoverHandler, "/api/recover", structs.RecoverRequest{Username: "kate", Code: "not-a-code"}, nil)
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+
+	// Codes are accepted regardless of case and dashes
+	code := strings.ToUpper(strings.ReplaceAll(registerResponse.RecoveryCodes[0], "-", " "))
+	rr = sessionRequest(t, handlers.RecoverHandler, "/api/recover", structs.RecoverRequest{Username: "kate", Code: code}, nil)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	recoveryCookies := rr.Result().Cookies()
+
+	// A code can only be used once
+	rr = sessionRequest(t, handlers.RecoverHandler, "/api/recover", structs.RecoverRequest{Username: "kate", Code: code}, nil)
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+
+	// The recovery session does not authenticate the user
+	rr = sessionRequest(t, handlers.RegenerateRecoveryCodesHandler, "/api/regenerate-recovery-codes", nil, recoveryCookies)
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+
+	// The new key must prove possession
+	newPubkey, newPrivkey, _ := ed25519.GenerateKey(nil)
+	rr = sessionRequest(t, handlers.RecoveryChallengeHandler, "/api/recover/challenge", map[string]string{"origin": testOrigin}, recoveryCookies)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	var recoveryChallenge structs.LoginResponse
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &recoveryChallenge))
+
+	enrollRequest := structs.AddPublicKeyRequest{
+		Pubkey:      newPubkey,
+		Label:       "replacement",
+		ChallengeID: recoveryChallenge.ChallengeID,
+		Signature:   ed25519.Sign(newPrivkey, []byte(recoveryChallenge.Challenge)),
+	}
+	rr = sessionRequest(t, handlers.RecoveryEnrollHandler, "/api/recover/enroll", enrollRequest, recoveryCookies)
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	// The lost key is revoked
+	labels, _ := handlers.UserRepo.GetPublicKeyLabels(context.Background(), "kate")
+	assert.ElementsMatch(t, []string{"replacement"}, labels)
+
+	// The user is now logged in with the new key
+	rr = sessionRequest(t, handlers.RegenerateRecoveryCodesHandler, "/api/regenerate-recovery-codes", nil, rr.Result().Cookies())
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+}
+
+// A user that has lost all of their MaxPublicKeys keys can still enroll a new one, which replaces them.
+func TestRecoveryEnrollHandler_MaxPublicKeys(t *testing.T) {
+	useAuditLog(t)
+	ctx := context.Background()
+	pubkey, _, _ := ed25519.GenerateKey(nil)
+	_, err := handlers.UserRepo.CreateUser(ctx, "tina", pubkey, "key0", util.SignerApp{})
+	assert.NoError(t, err)
+	for i := 1; i < util.MaxPublicKeys; i++ {
+		pubkey, _, _ := ed25519.GenerateKey(nil)
+		assert.NoError(t, handlers.UserRepo.AddPublicKey(ctx, "tina", pubkey, fmt.Sprintf("key%d", i), util.SignerApp{}))
+	}
+	assert.NoError(t, handlers.UserRepo.SuspendPublicKey(ctx, "tina", "key1", "lost"))
+	assert.NoError(t, handlers.UserRepo.SetRecoveryCodes(ctx, "tina", []string{internal.HashRecoveryCode("tina-code")}))
+	// Whoever found one of the keys is logged in with it
+	finder := loginCookies(t, "tina", "key0")
+
+	rr := sessionRequest(t, handlers.RecoverHandler, "/api/recover", structs.RecoverRequest{Username: "tina", Code: "tina-code"}, nil)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	recoveryCookies := rr.Result().Cookies()
+
+	rr = sessionRequest(t, handlers.RecoveryChallengeHandler, "/api/recover/challenge", map[string]string{"origin": testOrigin}, recoveryCookies)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	var recoveryChallenge structs.LoginResponse
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &recoveryChallenge))
+
+	newPubkey, newPrivkey, _ := ed25519.GenerateKey(nil)
+	rr = sessionRequest(t, handlers.RecoveryEnrollHandler, "/api/recover/enroll", structs.AddPublicKeyRequest{
+		Pubkey:      newPubkey,
+		Label:       "replacement",
+		ChallengeID: recoveryChallenge.ChallengeID,
+		Signature:   ed25519.Sign(newPrivkey, []byte(recoveryChallenge.Challenge)),
+	}, recoveryCookies)
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	user, _ := handlers.UserRepo.GetUser(ctx, "tina")
+	lostLabels := []string{}
+	for _, key := range user.PublicKeys {
+		if key.Label == "replacement" {
+			assert.Equal(t, util.KeyStatusActive, key.Status)
+		} else {
+			assert.Equal(t, util.KeyStatusRevoked, key.Status, key.Label)
+			lostLabels = append(lostLabels, key.Label)
+		}
+	}
+
+	// Each lost key shows up as removed in the audit log
+	events, err := audit.Log.List(context.Background(), "tina", audit.MaxListLimit)
+	assert.NoError(t, err)
+	removedLabels := []string{}
+	for _, event := range events {
+		if event.Type == audit.EventKeyRemoved {
+			assert.Equal(t, "recovery", event.Detail)
+			removedLabels = append(removedLabels, event.KeyLabel)
+		}
+	}
+	assert.ElementsMatch(t, lostLabels, removedLabels)
+
+	code, _ := listSessions(t, finder)
+	assert.Equal(t, http.StatusUnauthorized, code)
+	code, sessions := listSessions(t, rr.Result().Cookies())
+	assert.Equal(t, http.StatusOK, code)
+	assert.Len(t, sessions, 1)
+}
+
+// Regenerating recovery codes requires a step-up and invalidates the old codes.
+func TestRegenerateRecoveryCodesHandler(t *testing.T) {
+	privkey, cookies := stepUpTestUser(t, "leo")
+	handlers.UserRepo.SetRecoveryCodes(context.Background(), "leo", []string{internal.HashRecoveryCode("old-code")})
+
+	rr := sessionRequest(t, handlers.RegenerateRecoveryCodesHandler, "/api/regenerate-recovery-codes", nil, cookies)
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+
+	stepUpCookies := stepUp(t, internal.PurposeRecoveryCodes, privkey, cookies)
+	rr = sessionRequest(t, handlers.RegenerateRecoveryCodesHandler, "/api/regenerate-recovery-codes", nil, stepUpCookies)
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	var response structs.RecoveryCodesResponse
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &response))
+	assert.Len(t, response.RecoveryCodes, internal.RecoveryCodeCount)
+
+	used, _ := handlers.UserRepo.UseRecoveryCode(context.Background(), "leo", internal.HashRecoveryCode("old-code"))
+	assert.False(t, used)
+	used, _ = handlers.UserRepo.UseRecoveryCode(context.Background(), "leo", internal.HashRecoveryCode(response.RecoveryCodes[0]))
+	assert.True(t, used)
+}
+
+// loginCookies creates a new session for the user and returns its cookies.
+func loginCookies(t *testing.T, username string, keyLabel string) []*http.Cookie {
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodPost, verifyURL, nil)
+	if err := session_util.SetSession(rr, req, username, keyLabel); err != nil {
+		t.Fatal(err)
+	}
+	return rr.Result().Cookies()
+}
+
+// listSessions lists the sessions of the user of the given session.
+func listSessions(t *testing.T, cookies []*http.Cookie) (int, []structs.SessionInfo) {
+	req, _ := http.NewRequest(http.MethodGet, "/api/sessions", nil)
+	for _, cookie := range cookies {
+		req.AddCookie(cookie)
+	}
+	rr := httptest.NewRecorder()
+	handlers.ListSessionsHandler(rr, req)
+
+	var response structs.ListSessionsResponse
+	if rr.Code == http.StatusOK {
+		if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return rr.Code, response.Sessions
+}
+
+// Sessions are kept on the server, so they can be listed and revoked from another device.
+func TestSessionHandlers(t *testing.T) {
+	laptop := loginCookies(t, "mike", "main")
+	phone := loginCookies(t, "mike", "backup")
+	otherUser := loginCookies(t, "nina", "main")
+
+	code, sessions := listSessions(t, laptop)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Len(t, sessions, 2)
+
+	var phoneID string
+	for _, session := range sessions {
+		if session.Current {
+			assert.Equal(t, "main", session.KeyLabel)
+		} else {
+			assert.Equal(t, "backup", session.KeyLabel)
+			phoneID = session.ID
+		}
+	}
+	assert.NotEmpty(t, phoneID)
+
+	// Sessions of other users cannot be revoked
+	_, otherSessions := listSessions(t, otherUser)
+	rr := sessionRequest(t, handlers.RevokeSessionHandler, "/api/sessions/revoke", structs.RevokeSessionRequest{ID: otherSessions[0].ID}, laptop)
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+	code, _ = listSessions(t, otherUser)
+	assert.Equal(t, http.StatusOK, code)
+
+	// A revoked session can no longer be used
+	rr = sessionRequest(t, handlers.RevokeSessionHandler, "/api/sessions/revoke", structs.RevokeSessionRequest{ID: phoneID}, laptop)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	code, _ = listSessions(t, phone)
+	assert.Equal(t, http.StatusUnauthorized, code)
+
+	// Revoking the other sessions keeps the current one
+	loginCookies(t, "mike", "main")
+	loginCookies(t, "mike", "main")
+	rr = sessionRequest(t, handlers.RevokeOtherSessionsHandler, "/api/sessions/revoke-others", nil, laptop)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	var revokeResponse structs.RevokeSessionsResponse
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &revokeResponse))
+	assert.Equal(t, 2, revokeResponse.Revoked)
+
+	code, sessions = listSessions(t, laptop)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Len(t, sessions, 1)
+
+	// Logging out ends the session on the server, so a copy of the cookie stops working
+	rr = sessionRequest(t, handlers.LogoutHandler, "/api/logout", nil, laptop)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	code, _ = listSessions(t, laptop)
+	assert.Equal(t, http.StatusUnauthorized, code)
+}
+
+// Behind the proxy, the address the proxy appended to X-Forwarded-For is used, not the ones the client sent.
+func TestClientIP_ForwardedFor(t *testing.T) {
+	req, _ := http.NewRequest(http.MethodGet, "/api/sessions", nil)
+	req.RemoteAddr = "10.0.0.2:50000"
+	req.Header.Set("X-Forwarded-For", "203.0.113.7, 192.0.2.30")
+	assert.Equal(t, "10.0.0.2", session_util.ClientIP(req))
+
+	session_util.TrustProxyHeaders = true
+	t.Cleanup(func() { session_util.TrustProxyHeaders = false })
+	assert.Equal(t, "192.0.2.30", session_util.ClientIP(req))
+}
+
+// Suspending or removing a key ends every session authenticated with it, also after the key was renamed.
+func TestKeySessionsEndWithKey(t *testing.T) {
+	privkey, laptop := stepUpTestUser(t, "olga")
+	spareKey, _, _ := ed25519.GenerateKey(nil)
+	handlers.UserRepo.AddPublicKey(context.Background(), "olga", spareKey, "spare", util.SignerApp{})
+	phone := loginCookies(t, "olga", "spare")
+
+	rr := sessionRequest(t, handlers.RenamePublicKeyHandler, "/api/rename-public-key", structs.RenamePublicKeyRequest{Label: "spare", NewLabel: "travel"}, laptop)
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	rr = sessionRequest(t, handlers.SuspendPublicKeyHandler, "/api/suspend-public-key", structs.SuspendPublicKeyRequest{Label: "travel"}, stepUp(t, internal.PurposeSuspendKey, privkey, laptop))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	code, _ := listSessions(t, phone)
+	assert.Equal(t, http.StatusUnauthorized, code)
+	code, _ = listSessions(t, laptop)
+	assert.Equal(t, http.StatusOK, code)
+
+	rr = sessionRequest(t, handlers.ReactivatePublicKeyHandler, "/api/reactivate-public-key", structs.ReactivatePublicKeyRequest{Label: "travel"}, stepUp(t, internal.PurposeReactivateKey, privkey, laptop))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	phone = loginCookies(t, "olga", "travel")
+
+	// Removing the key of the current session logs it out as well
+	stepUpCookies := stepUp(t, internal.PurposeRemoveKey, privkey, laptop)
+	rr = sessionRequest(t, handlers.RemovePublicKeyHandler, "/api/remove-public-key", structs.RemovePublicKeyRequest{Label: "main"}, stepUpCookies)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	code, _ = listSessions(t, stepUpCookies)
+	assert.Equal(t, http.StatusUnauthorized, code)
+	code, _ = listSessions(t, phone)
+	assert.Equal(t, http.StatusOK, code)
+}
+
+// Deleting the account ends the sessions of the user on every device.
+func TestUnregisterHandler_EndsAllSessions(t *testing.T) {
+	_, laptop := stepUpTestUser(t, "paul")
+	phone := loginCookies(t, "paul", "main")
+
+	rr := sessionRequest(t, handlers.UnregisterHandler, "/api/unregister", nil, laptop)
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	code, _ := listSessions(t, phone)
+	assert.Equal(t, http.StatusUnauthorized, code)
+}
+
+// A request of another device that is saving its session while the account is deleted does not bring the session back.
+func TestUnregisterHandler_EndsSessionsBeingSaved(t *testing.T) {
+	_, laptop := stepUpTestUser(t, "pia")
+	phone := loginCookies(t, "pia", "main")
+
+	// The phone's request has loaded its session and is about to save it
+	phoneRequest, _ := http.NewRequest(http.MethodGet, "/api/getuser", nil)
+	for _, cookie := range phone {
+		phoneRequest.AddCookie(cookie)
+	}
+	session, err := session_util.Store.Get(phoneRequest, "session-name")
+	assert.NoError(t, err)
+	session.Values["refreshedAt"] = time.Now().Unix()
+
+	rr := sessionRequest(t, handlers.UnregisterHandler, "/api/unregister", nil, laptop)
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	assert.ErrorIs(t, session.Save(phoneRequest, httptest.NewRecorder()), session_util.ErrSessionChanged)
+	sessions, err := session_util.Store.Backend.ListForUser(context.Background(), "pia")
+	assert.NoError(t, err)
+	assert.Empty(t, sessions)
+	code, _ := listSessions(t, phone)
+	assert.Equal(t, http.StatusUnauthorized, code)
+}
@@ -0,0 +1,141 @@
+package tests
+
+import (
+	"bytes"
+	"chalmers/tkey-group22/application/internal/handlers"
+	"chalmers/tkey-group22/application/internal/structs"
+	"chalmers/tkey-group22/application/internal/util"
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// The in-memory repository enforces the same rules for keys as the database and reports them with the domain errors.
+func TestMemoryRepo_KeyRules(t *testing.T) {
+	checkKeyRules(t, util.NewMemoryUserRepo())
+}
+
+// checkKeyRules checks that a UserRepository enforces the rules for keys and reports them with the domain errors.
+func checkKeyRules(t *testing.T, repo util.UserRepository) {
+	pubkey, _, _ := ed25519.GenerateKey(nil)
+	otherPubkey, _, _ := ed25519.GenerateKey(nil)
+
+	_, err := repo.CreateUser(context.Background(), "tess", pubkey, "main", util.SignerApp{})
+	assert.NoError(t, err)
+	_, err = repo.CreateUser(context.Background(), "tess", otherPubkey, "main", util.SignerApp{})
+	assert.ErrorIs(t, err, util.ErrUserExists)
+	_, err = repo.CreateUser(context.Background(), "not sanitized", pubkey, "main", util.SignerApp{})
+	assert.IsType(t, &structs.ErrorInputNotSanitized{}, err)
+
+	_, err = repo.GetUser(context.Background(), "nobody")
+	assert.ErrorIs(t, err, util.ErrUserNotFound)
+
+	assert.ErrorIs(t, repo.AddPublicKey(context.Background(), "tess", pubkey, "copy", util.SignerApp{}), util.ErrKeyExists)
+	assert.ErrorIs(t, repo.AddPublicKey(context.Background(), "tess", otherPubkey, "main", util.SignerApp{}), util.ErrLabelExists)
+	assert.ErrorIs(t, repo.RemovePublicKey(context.Background(), "tess", "main"), util.ErrLastActiveKey)
+	assert.ErrorIs(t, repo.RemovePublicKey(context.Background(), "tess", "missing"), util.ErrKeyNotFound)
+
+	assert.NoError(t, repo.AddPublicKey(context.Background(), "tess", otherPubkey, "backup", util.SignerApp{}))
+	assert.NoError(t, repo.RemovePublicKey(context.Background(), "tess", "backup"))
+	assert.ErrorIs(t, repo.AddPublicKey(context.Background(), "tess", otherPubkey, "again", util.SignerApp{}), util.ErrKeyRevoked)
+
+	assert.ErrorIs(t, repo.ReactivatePublicKey(context.Background(), "tess", "main"), util.ErrKeyNotSuspended)
+	assert.ErrorIs(t, repo.SuspendPublicKey(context.Background(), "tess", "main", "lost"), util.ErrLastActiveKey)
+
+	spareKey, _, _ := ed25519.GenerateKey(nil)
+	assert.NoError(t, repo.AddPublicKey(context.Background(), "tess", spareKey, "spare", util.SignerApp{}))
+	assert.NoError(t, repo.SuspendPublicKey(context.Background(), "tess", "spare", "lost"))
+	assert.ErrorIs(t, repo.SuspendPublicKey(context.Background(), "tess", "spare", "lost"), util.ErrKeyNotActive)
+	assert.ErrorIs(t, repo.SuspendPublicKey(context.Background(), "tess", "main", "lost"), util.ErrLastActiveKey)
+
+	labels, err := repo.GetPublicKeyLabels(context.Background(), "tess")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"main", "spare"}, labels)
+
+	assert.NoError(t, repo.DeleteUser(context.Background(), "tess"))
+	assert.ErrorIs(t, repo.DeleteUser(context.Background(), "tess"), util.ErrUserNotFound)
+}
+
+// Users returned by the in-memory repository are copies, so changing them does not change the stored user.
+func TestMemoryRepo_ReturnsCopies(t *testing.T) {
+	checkReturnsCopies(t, util.NewMemoryUserRepo())
+}
+
+// checkReturnsCopies checks that changing a user returned by a UserRepository does not change the stored user.
+func checkReturnsCopies(t *testing.T, repo util.UserRepository) {
+	pubkey, _, _ := ed25519.GenerateKey(nil)
+	user, _ := repo.CreateUser(context.Background(), "uma", pubkey, "main", util.SignerApp{})
+	user.PublicKeys[0].Label = "changed"
+
+	user, _ = repo.GetUser(context.Background(), "uma")
+	assert.Equal(t, "main", user.PublicKeys[0].Label)
+	user.PublicKeys[0].Label = "changed"
+
+	user, _ = repo.GetUser(context.Background(), "uma")
+	assert.Equal(t, "main", user.PublicKeys[0].Label)
+}
+
+// noteRequest sends a JSON note request with the given method and session cookies to a handler.
+func noteRequest(t *testing.T, handler http.HandlerFunc, method string, body interface{}, cookies []*http.Cookie) *httptest.ResponseRecorder {
+	requestBody, err := json.Marshal(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, _ := http.NewRequest(method, "/api/notes", bytes.NewBuffer(requestBody))
+	for _, cookie := range cookies {
+		req.AddCookie(cookie)
+	}
+	rr := httptest.NewRecorder()
+	handler(rr, req)
+	return rr
+}
+
+// Notes can be created, listed, updated and deleted without a database, and only by their owner.
+func TestNotesHandlers_MemoryRepo(t *testing.T) {
+	checkNotesHandlers(t, util.NewMemoryNotesRepo())
+}
+
+// checkNotesHandlers checks the note handlers with the NotesRepository, which must know the users bob and alice.
+func checkNotesHandlers(t *testing.T, notesRepo util.NotesRepository) {
+	original := handlers.NotesRepo
+	handlers.NotesRepo = notesRepo
+	t.Cleanup(func() { handlers.NotesRepo = original })
+
+	cookies := loginCookies(t, "bob", "main")
+	rr := noteRequest(t, handlers.CreateNoteHandler, http.MethodPost, structs.SaveNoteRequest{Name: "example.com", Note: "first"}, cookies)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	// The response is JSON encoded as a base64 string, which the GUI decodes
+	var encoded []byte
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &encoded))
+	var created map[string]string
+	assert.NoError(t, json.Unmarshal(encoded, &created))
+	id := created["id"]
+	assert.NotEmpty(t, id)
+
+	rr = noteRequest(t, handlers.UpdateNoteHandler, http.MethodPost, structs.UpdateNotesRequest{ID: id, Name: "example.com", Note: "second"}, cookies)
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	rr = noteRequest(t, handlers.GetNotesHandler, http.MethodGet, nil, cookies)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	var notes []util.NoteData
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &notes))
+	assert.Equal(t, []util.NoteData{{ID: id, Username: "bob", Name: "example.com", Note: "second"}}, notes)
+
+	// Other users cannot change the note
+	aliceCookies := loginCookies(t, "alice", "main")
+	rr = noteRequest(t, handlers.DeleteNoteHandler, http.MethodDelete, structs.DeleteNoteRequest{ID: id}, aliceCookies)
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+
+	rr = noteRequest(t, handlers.DeleteNoteHandler, http.MethodDelete, structs.DeleteNoteRequest{ID: id}, cookies)
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	rr = noteRequest(t, handlers.DeleteNoteHandler, http.MethodDelete, structs.DeleteNoteRequest{ID: id}, cookies)
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+	rr = noteRequest(t, handlers.UpdateNoteHandler, http.MethodPost, structs.UpdateNotesRequest{ID: "missing"}, cookies)
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+}
@@ -0,0 +1,72 @@
+package tests
+
+import (
+	dbconnect "chalmers/tkey-group22/application/data/db"
+	"chalmers/tkey-group22/application/internal/util"
+	"context"
+	"crypto/ed25519"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// The migrations must be numbered 1, 2, 3... in order, or none of them are applied.
+func TestMongoMigrations_Ordered(t *testing.T) {
+	for i, migration := range dbconnect.MongoMigrations {
+		assert.Equal(t, i+1, migration.Version, migration.Description)
+	}
+
+	err := dbconnect.Migrate(nil, []dbconnect.Migration{{Version: 2, Description: "skips a version"}})
+	assert.Error(t, err)
+}
+
+// Migrating creates a unique index on the username, so the same username cannot be registered twice.
+func TestMigrate_UniqueUsername(t *testing.T) {
+	client, repo := setupTestDB(t)
+	database := client.Database(testDBName)
+
+	assert.NoError(t, dbconnect.Migrate(database, dbconnect.MongoMigrations))
+	version, err := dbconnect.SchemaVersion(database)
+	assert.NoError(t, err)
+	assert.Equal(t, len(dbconnect.MongoMigrations), version)
+
+	// Migrating again does nothing
+	assert.NoError(t, dbconnect.Migrate(database, dbconnect.MongoMigrations))
+
+	pubkey, _, _ := ed25519.GenerateKey(nil)
+	_, err = repo.CreateUser(context.Background(), testUser, pubkey, testLabel, util.SignerApp{})
+	assert.NoError(t, err)
+	_, err = repo.CreateUser(context.Background(), testUser, pubkey, testLabel, util.SignerApp{})
+	assert.ErrorIs(t, err, util.ErrUserExists)
+}
+
+// Public keys stored before their status and use count were recorded are backfilled.
+func TestMigrate_BackfillsKeyMetadata(t *testing.T) {
+	client, repo := setupTestDB(t)
+	database := client.Database(testDBName)
+
+	_, err := database.Collection("users").InsertOne(context.Background(), bson.M{
+		"username": testUser,
+		"publicKeys": bson.A{
+			bson.M{"label": "old", "key": "b2xk"},
+			bson.M{"label": "new", "key": "bmV3", "status": util.KeyStatusSuspended, "useCount": 3},
+		},
+	})
+	assert.NoError(t, err)
+
+	assert.NoError(t, dbconnect.Migrate(database, dbconnect.MongoMigrations))
+
+	var stored bson.M
+	err = database.Collection("users").FindOne(context.Background(), bson.M{"username": testUser}).Decode(&stored)
+	assert.NoError(t, err)
+	keys := stored["publicKeys"].(bson.A)
+	assert.Equal(t, util.KeyStatusActive, keys[0].(bson.M)["status"])
+	assert.EqualValues(t, 0, keys[0].(bson.M)["useCount"])
+
+	// Fields that were already set are kept
+	user, err := repo.GetUser(context.Background(), testUser)
+	assert.NoError(t, err)
+	assert.Equal(t, util.KeyStatusSuspended, user.PublicKeys[1].Status)
+	assert.Equal(t, int64(3), user.PublicKeys[1].UseCount)
+}
@@ -0,0 +1,296 @@
+package tests
+
+import (
+	"bytes"
+	"chalmers/tkey-group22/application/internal"
+	"chalmers/tkey-group22/application/internal/audit"
+	"chalmers/tkey-group22/application/internal/handlers"
+	"chalmers/tkey-group22/application/internal/jws"
+	"chalmers/tkey-group22/application/internal/oidc"
+	"chalmers/tkey-group22/application/internal/structs"
+	"chalmers/tkey-group22/application/internal/util"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const oidcRedirectURI = "https://notes.example.com/callback"
+
+// newOIDCServer starts a server with the TKey login and the OpenID Connect provider endpoints.
+func newOIDCServer(t *testing.T) *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/login", handlers.LoginHandler)
+	mux.HandleFunc("/api/verify", handlers.VerifyHandler)
+	mux.HandleFunc("/api/oidc/.well-known/openid-configuration", handlers.OIDCDiscoveryHandler)
+	mux.HandleFunc("/api/oidc/jwks", handlers.OIDCJWKSHandler)
+	mux.HandleFunc("/api/oidc/authorize", handlers.OIDCAuthorizeHandler)
+	mux.HandleFunc("/api/oidc/token", handlers.OIDCTokenHandler)
+	mux.HandleFunc("/api/oidc/userinfo", handlers.OIDCUserInfoHandler)
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+
+	originalIssuer := oidc.Issuer
+	oidc.Issuer = server.URL + "/api/oidc"
+	t.Cleanup(func() { oidc.Issuer = originalIssuer })
+
+	return server
+}
+
+// newBrowser returns an HTTP client that keeps cookies and does not follow redirects.
+func newBrowser() *http.Client {
+	jar, _ := cookiejar.New(nil)
+	return &http.Client{
+		Jar: jar,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// registerOIDCClient registers a client application and returns it with its secret.
+func registerOIDCClient(t *testing.T) (*util.OIDCClient, string) {
+	client, secret, err := util.NewOIDCClient("Notes", []string{oidcRedirectURI})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := handlers.OIDCClients.CreateClient(context.Background(), client); err != nil {
+		t.Fatal(err)
+	}
+	return client, secret
+}
+
+// tkeyLogin logs the browser in by signing a login challenge with a software key.
+func tkeyLogin(t *testing.T, browser *http.Client, server *httptest.Server, username string, key ed25519.PrivateKey) {
+	body, _ := json.Marshal(map[string]string{"username": username, "origin": testOrigin})
+	res, err := browser.Post(server.URL+"/api/login", "application/json", bytes.NewBuffer(body))
+	assert.NoError(t, err)
+	defer res.Body.Close()
+	var challenge structs.LoginResponse
+	assert.NoError(t, json.NewDecoder(res.Body).Decode(&challenge))
+
+	signature := ed25519.Sign(key, []byte(challenge.Challenge))
+	body, _ = json.Marshal(map[string]string{
+		"username":     username,
+		"challenge_id": challenge.ChallengeID,
+		"signature":    base64.StdEncoding.EncodeToString(signature),
+	})
+	res, err = browser.Post(server.URL+"/api/verify", "application/json", bytes.NewBuffer(body))
+	assert.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+}
+
+// requestToken redeems an authorization code at the token endpoint.
+func requestToken(t *testing.T, server *httptest.Server, clientID string, secret string, form url.Values) (int, []byte) {
+	form.Set("grant_type", "authorization_code")
+	req, _ := http.NewRequest(http.MethodPost, server.URL+"/api/oidc/token", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(url.QueryEscape(clientID), url.QueryEscape(secret))
+
+	res, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	defer res.Body.Close()
+	var body bytes.Buffer
+	body.ReadFrom(res.Body)
+	return res.StatusCode, body.Bytes()
+}
+
+// A relying party logs a user in with the TKey from start to end, using a software signer in place of the TKey.
+func TestOIDCAuthorizationCodeFlow(t *testing.T) {
+	useAuditLog(t)
+	server := newOIDCServer(t)
+	client, secret := registerOIDCClient(t)
+	browser := newBrowser()
+
+	pubkey, key, _ := ed25519.GenerateKey(nil)
+	handlers.UserRepo.CreateUser(context.Background(), "sam", pubkey, "main", util.SignerApp{})
+
+	// The relying party finds the endpoints through discovery
+	res, err := http.Get(oidc.Issuer + "/.well-known/openid-configuration")
+	assert.NoError(t, err)
+	var discovery structs.OIDCDiscoveryResponse
+	assert.NoError(t, json.NewDecoder(res.Body).Decode(&discovery))
+	res.Body.Close()
+	assert.Equal(t, oidc.Issuer, discovery.Issuer)
+	assert.Contains(t, discovery.IDTokenSigningAlgValuesSupported, "EdDSA")
+
+	verifier := "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+	verifierHash := sha256.Sum256([]byte(verifier))
+	authorizeURL := discovery.AuthorizationEndpoint + "?" + url.Values{
+		"response_type":         {"code"},
+		"client_id":             {client.ClientID},
+		"redirect_uri":          {oidcRedirectURI},
+		"scope":                 {"openid profile"},
+		"state":                 {"xyz"},
+		"nonce":                 {"n-0S6_WzA2Mj"},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(verifierHash[:])},
+		"code_challenge_method": {"S256"},
+	}.Encode()
+
+	// The user is not logged in, so they are sent to the login page with the request
+	res, err = browser.Get(authorizeURL)
+	assert.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusFound, res.StatusCode)
+	loginPage, _ := url.Parse(res.Header.Get("Location"))
+	assert.Equal(t, "/", loginPage.Path)
+	pendingRequest := loginPage.Query().Get("authorize")
+	assert.NotEmpty(t, pendingRequest)
+
+	// After touching the TKey the login page returns to the authorization endpoint
+	tkeyLogin(t, browser, server, "sam", key)
+	res, err = browser.Get(discovery.AuthorizationEndpoint + "?" + pendingRequest)
+	assert.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusFound, res.StatusCode)
+	callback, _ := url.Parse(res.Header.Get("Location"))
+	assert.Equal(t, oidcRedirectURI, callback.Scheme+"://"+callback.Host+callback.Path)
+	assert.Equal(t, "xyz", callback.Query().Get("state"))
+	code := callback.Query().Get("code")
+	assert.NotEmpty(t, code)
+
+	// The login to the client shows up in the audit log of the user
+	events, err := audit.Log.List(context.Background(), "sam", 1)
+	assert.NoError(t, err)
+	assert.Equal(t, audit.EventOIDCLogin, events[0].Type)
+	assert.Equal(t, "main", events[0].KeyLabel)
+	assert.Equal(t, "Notes", events[0].Detail)
+
+	// The relying party redeems the code
+	form := url.Values{"code": {code}, "redirect_uri": {oidcRedirectURI}, "code_verifier": {verifier}}
+	status, body := requestToken(t, server, client.ClientID, secret, form)
+	assert.Equal(t, http.StatusOK, status)
+	var tokens structs.OIDCTokenResponse
+	assert.NoError(t, json.Unmarshal(body, &tokens))
+	assert.Equal(t, "Bearer", tokens.TokenType)
+
+	// The ID token is verified with the published key
+	res, err = http.Get(discovery.JWKSURI)
+	assert.NoError(t, err)
+	var keys jws.JWKSet
+	assert.NoError(t, json.NewDecoder(res.Body).Decode(&keys))
+	res.Body.Close()
+	assert.Len(t, keys.Keys, 1)
+	serverKey, _ := base64.RawURLEncoding.DecodeString(keys.Keys[0].X)
+	assert.Equal(t, internal.ServerPublicKey(), ed25519.PublicKey(serverKey))
+
+	var claims oidc.IDTokenClaims
+	header, err := jws.Verify(tokens.IDToken, serverKey, &claims)
+	assert.NoError(t, err)
+	assert.Equal(t, keys.Keys[0].KeyID, header.KeyID)
+	assert.Equal(t, oidc.Issuer, claims.Issuer)
+	assert.Equal(t, client.ClientID, claims.Audience)
+	assert.Equal(t, "sam", claims.Subject)
+	assert.Equal(t, "sam", claims.PreferredUsername)
+	assert.Equal(t, "n-0S6_WzA2Mj", claims.Nonce)
+	assert.Greater(t, claims.ExpiresAt, time.Now().Unix())
+	assert.LessOrEqual(t, claims.AuthTime, time.Now().Unix())
+
+	// The access token gives the user info, while the ID token does not
+	for token, expected := range map[string]int{tokens.AccessToken: http.StatusOK, tokens.IDToken: http.StatusUnauthorized} {
+		req, _ := http.NewRequest(http.MethodGet, discovery.UserInfoEndpoint, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		res, err = http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, res.StatusCode)
+		if res.StatusCode == http.StatusOK {
+			var userInfo structs.OIDCUserInfoResponse
+			assert.NoError(t, json.NewDecoder(res.Body).Decode(&userInfo))
+			assert.Equal(t, "sam", userInfo.Subject)
+		}
+		res.Body.Close()
+	}
+
+	// A code can only be redeemed once
+	status, body = requestToken(t, server, client.ClientID, secret, form)
+	assert.Equal(t, http.StatusBadRequest, status)
+	assert.Contains(t, string(body), "invalid_grant")
+}
+
+func TestOIDCAuthorizeHandler_InvalidRequests(t *testing.T) {
+	server := newOIDCServer(t)
+	client, _ := registerOIDCClient(t)
+	browser := newBrowser()
+
+	authorize := func(params url.Values) *http.Response {
+		res, err := browser.Get(server.URL + "/api/oidc/authorize?" + params.Encode())
+		assert.NoError(t, err)
+		res.Body.Close()
+		return res
+	}
+
+	// The user is never sent to a redirect URI that is not registered
+	res := authorize(url.Values{"response_type": {"code"}, "client_id": {client.ClientID}, "redirect_uri": {"https://evil.example.com/callback"}, "scope": {"openid"}})
+	assert.Equal(t, http.StatusBadRequest, res.StatusCode)
+	res = authorize(url.Values{"response_type": {"code"}, "client_id": {"unknown"}, "redirect_uri": {oidcRedirectURI}, "scope": {"openid"}})
+	assert.Equal(t, http.StatusBadRequest, res.StatusCode)
+
+	// Other errors are reported to the client
+	res = authorize(url.Values{"response_type": {"code"}, "client_id": {client.ClientID}, "redirect_uri": {oidcRedirectURI}, "scope": {"profile"}, "state": {"abc"}})
+	assert.Equal(t, http.StatusFound, res.StatusCode)
+	callback, _ := url.Parse(res.Header.Get("Location"))
+	assert.Equal(t, "invalid_scope", callback.Query().Get("error"))
+	assert.Equal(t, "abc", callback.Query().Get("state"))
+
+	res = authorize(url.Values{"response_type": {"token"}, "client_id": {client.ClientID}, "redirect_uri": {oidcRedirectURI}, "scope": {"openid"}})
+	callback, _ = url.Parse(res.Header.Get("Location"))
+	assert.Equal(t, "unsupported_response_type", callback.Query().Get("error"))
+}
+
+func TestOIDCTokenHandler_InvalidRequests(t *testing.T) {
+	server := newOIDCServer(t)
+	client, secret := registerOIDCClient(t)
+
+	authorization := &oidc.Authorization{ClientID: client.ClientID, RedirectURI: oidcRedirectURI, Username: mockUsername, Scope: "openid", CodeChallenge: "challenge"}
+	code, err := oidc.IssueCode(authorization)
+	assert.NoError(t, err)
+
+	// The client must authenticate with its secret
+	status, body := requestToken(t, server, client.ClientID, "wrong", url.Values{"code": {code}, "redirect_uri": {oidcRedirectURI}})
+	assert.Equal(t, http.StatusUnauthorized, status)
+	assert.Contains(t, string(body), "invalid_client")
+
+	// The PKCE code verifier is required when a code challenge was given
+	status, body = requestToken(t, server, client.ClientID, secret, url.Values{"code": {code}, "redirect_uri": {oidcRedirectURI}})
+	assert.Equal(t, http.StatusBadRequest, status)
+	assert.Contains(t, string(body), "invalid_grant")
+
+	// The code is issued for the redirect URI of the authorization request
+	authorization.CodeChallenge = ""
+	code, _ = oidc.IssueCode(authorization)
+	status, _ = requestToken(t, server, client.ClientID, secret, url.Values{"code": {code}, "redirect_uri": {"https://notes.example.com/other"}})
+	assert.Equal(t, http.StatusBadRequest, status)
+}
+
+func TestJWS_RejectsTamperedTokens(t *testing.T) {
+	pubkey, key, _ := ed25519.GenerateKey(nil)
+	sign := func(message []byte) ([]byte, error) { return ed25519.Sign(key, message), nil }
+
+	token, err := jws.Sign(jws.Header{Type: "JWT"}, map[string]string{"sub": "sam"}, sign)
+	assert.NoError(t, err)
+
+	var claims map[string]string
+	_, err = jws.Verify(token, pubkey, &claims)
+	assert.NoError(t, err)
+	assert.Equal(t, "sam", claims["sub"])
+
+	parts := strings.Split(token, ".")
+	forged := parts[0] + "." + base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"admin"}`)) + "." + parts[2]
+	_, err = jws.Verify(forged, pubkey, &claims)
+	assert.Equal(t, jws.ErrInvalidToken, err)
+
+	otherKey, _, _ := ed25519.GenerateKey(nil)
+	_, err = jws.Verify(token, otherKey, &claims)
+	assert.Equal(t, jws.ErrInvalidToken, err)
+}
@@ -0,0 +1,276 @@
+package tests
+
+import (
+	"bytes"
+	"chalmers/tkey-group22/application/internal"
+	"chalmers/tkey-group22/application/internal/audit"
+	"chalmers/tkey-group22/application/internal/handlers"
+	"chalmers/tkey-group22/application/internal/ratelimit"
+	"chalmers/tkey-group22/application/internal/session_util"
+	"chalmers/tkey-group22/application/internal/structs"
+	"chalmers/tkey-group22/application/internal/util"
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// setRateLimitPolicy applies the rate limiting policy for the duration of the test.
+func setRateLimitPolicy(t *testing.T, policy ratelimit.Policy) {
+	ratelimit.Configure(policy)
+	t.Cleanup(func() { ratelimit.Configure(ratelimit.DefaultPolicy()) })
+}
+
+// rateLimitedRequest sends a JSON request from the IP address through the rate limiting middleware to the handler.
+func rateLimitedRequest(t *testing.T, handler http.HandlerFunc, ip string, body interface{}) *httptest.ResponseRecorder {
+	requestBody, err := json.Marshal(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, _ := http.NewRequest(http.MethodPost, "/api/test", bytes.NewBuffer(requestBody))
+	req.RemoteAddr = ip + ":50000"
+	rr := httptest.NewRecorder()
+	ratelimit.Middleware(handler).ServeHTTP(rr, req)
+	return rr
+}
+
+// loginChallenge requests a login challenge for the user through the rate limiting middleware.
+func loginChallenge(t *testing.T, ip string, username string) (*httptest.ResponseRecorder, structs.LoginResponse) {
+	rr := rateLimitedRequest(t, handlers.LoginHandler, ip, structs.LoginRequest{Username: username, Origin: testOrigin})
+	var challenge structs.LoginResponse
+	if rr.Code == http.StatusOK {
+		if err := json.Unmarshal(rr.Body.Bytes(), &challenge); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return rr, challenge
+}
+
+func TestParseRate(t *testing.T) {
+	rate, err := ratelimit.ParseRate("30/m")
+	assert.NoError(t, err)
+	assert.Equal(t, ratelimit.Rate{Requests: 30, Per: time.Minute}, rate)
+
+	rate, err = ratelimit.ParseRate("100/10m")
+	assert.NoError(t, err)
+	assert.Equal(t, ratelimit.Rate{Requests: 100, Per: 10 * time.Minute}, rate)
+
+	for _, invalid := range []string{"30", "0/m", "-1/m", "30/week", "many/m"} {
+		_, err := ratelimit.ParseRate(invalid)
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestRateLimit_LoadPolicy(t *testing.T) {
+	t.Setenv("RATE_LIMIT_PER_IP", "60/m")
+	t.Setenv("LOCKOUT_MAX_FAILURES", "3")
+	policy, err := ratelimit.LoadPolicy()
+	assert.NoError(t, err)
+	assert.Equal(t, ratelimit.Rate{Requests: 60, Per: time.Minute}, policy.PerIP)
+	assert.Equal(t, 3, policy.MaxFailures)
+	assert.Equal(t, ratelimit.DefaultPolicy().PerUser, policy.PerUser)
+
+	t.Setenv("LOCKOUT_DURATION", "soon")
+	_, err = ratelimit.LoadPolicy()
+	assert.Error(t, err)
+}
+
+// Each IP address gets a burst of requests, after which it must wait.
+func TestRateLimit_PerIP(t *testing.T) {
+	policy := ratelimit.DefaultPolicy()
+	policy.PerIP = ratelimit.Rate{Requests: 3, Per: time.Minute}
+	setRateLimitPolicy(t, policy)
+
+	for i := 0; i < 3; i++ {
+		rr, _ := loginChallenge(t, "192.0.2.1", "bob")
+		assert.Equal(t, http.StatusOK, rr.Code)
+	}
+	// Requests without a username are limited as well
+	rr := rateLimitedRequest(t, handlers.DeviceAuthorizeHandler, "192.0.2.1", nil)
+	assert.Equal(t, http.StatusTooManyRequests, rr.Code)
+	assert.NotEmpty(t, rr.Header().Get("Retry-After"))
+
+	rr, _ = loginChallenge(t, "192.0.2.2", "alice")
+	assert.Equal(t, http.StatusOK, rr.Code)
+}
+
+// A username cannot be hammered by spreading the requests over many IP addresses.
+func TestRateLimit_PerUser(t *testing.T) {
+	policy := ratelimit.DefaultPolicy()
+	policy.PerUser = ratelimit.Rate{Requests: 2, Per: time.Minute}
+	setRateLimitPolicy(t, policy)
+
+	rr := rateLimitedRequest(t, handlers.VerifyHandler, "198.51.100.1", structs.VerifyRequest{Username: "alice"})
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+	rr = rateLimitedRequest(t, handlers.VerifyHandler, "198.51.100.2", structs.VerifyRequest{Username: "alice"})
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+	rr = rateLimitedRequest(t, handlers.VerifyHandler, "198.51.100.3", structs.VerifyRequest{Username: "alice"})
+	assert.Equal(t, http.StatusTooManyRequests, rr.Code)
+
+	rr = rateLimitedRequest(t, handlers.VerifyHandler, "198.51.100.3", structs.VerifyRequest{Username: "bob"})
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+}
+
+// After too many failed signatures a username is locked, even for the right signature, whether or not the user exists.
+func TestRateLimit_Lockout(t *testing.T) {
+	policy := ratelimit.DefaultPolicy()
+	policy.MaxFailures = 2
+	setRateLimitPolicy(t, policy)
+
+	for _, username := range []string{mockUsername, "nonexistent"} {
+		for i := 0; i < 2; i++ {
+			_, challenge := loginChallenge(t, "203.0.113.1", username)
+			rr := rateLimitedRequest(t, handlers.VerifyHandler, "203.0.113.1", structs.VerifyRequest{
+				Username:    username,
+				ChallengeID: challenge.ChallengeID,
+				Signature:   make([]byte, ed25519.SignatureSize),
+			})
+			assert.Equal(t, http.StatusUnauthorized, rr.Code, username)
+		}
+
+		rr, _ := loginChallenge(t, "203.0.113.2", username)
+		assert.Equal(t, http.StatusTooManyRequests, rr.Code, username)
+		assert.NotEmpty(t, rr.Header().Get("Retry-After"))
+	}
+
+	challenge, _ := internal.GenerateChallenge(context.Background(), mockUsername, internal.PurposeLogin, testOrigin)
+	rr := rateLimitedRequest(t, handlers.VerifyHandler, "203.0.113.3", structs.VerifyRequest{
+		Username:    mockUsername,
+		ChallengeID: challenge.ID,
+		Signature:   ed25519.Sign(mockPrivKey, []byte(challenge.Value)),
+	})
+	assert.Equal(t, http.StatusTooManyRequests, rr.Code)
+
+	// A successful login forgets earlier failures
+	ratelimit.Configure(policy)
+	_, first := loginChallenge(t, "203.0.113.4", mockUsername)
+	rr = rateLimitedRequest(t, handlers.VerifyHandler, "203.0.113.4", structs.VerifyRequest{Username: mockUsername, ChallengeID: first.ChallengeID})
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+	_, second := loginChallenge(t, "203.0.113.4", mockUsername)
+	rr = rateLimitedRequest(t, handlers.VerifyHandler, "203.0.113.4", structs.VerifyRequest{
+		Username:    mockUsername,
+		ChallengeID: second.ChallengeID,
+		Signature:   ed25519.Sign(mockPrivKey, []byte(second.Challenge)),
+	})
+	assert.Equal(t, http.StatusOK, rr.Code)
+	_, third := loginChallenge(t, "203.0.113.4", mockUsername)
+	rr = rateLimitedRequest(t, handlers.VerifyHandler, "203.0.113.4", structs.VerifyRequest{Username: mockUsername, ChallengeID: third.ChallengeID})
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+	rr, _ = loginChallenge(t, "203.0.113.4", mockUsername)
+	assert.Equal(t, http.StatusOK, rr.Code)
+}
+
+// The responses for a user that does not exist are the same as for one that does.
+func TestRateLimit_UniformResponses(t *testing.T) {
+	existing, existingChallenge := loginChallenge(t, "192.0.2.10", mockUsername)
+	unknown, unknownChallenge := loginChallenge(t, "192.0.2.10", "nonexistent")
+	assert.Equal(t, existing.Code, unknown.Code)
+	assert.Equal(t, existing.Header(), unknown.Header())
+
+	for username, challenge := range map[string]structs.LoginResponse{mockUsername: existingChallenge, "nonexistent": unknownChallenge} {
+		rr := rateLimitedRequest(t, handlers.VerifyHandler, "192.0.2.10", structs.VerifyRequest{
+			Username:    username,
+			ChallengeID: challenge.ChallengeID,
+			Signature:   make([]byte, ed25519.SignatureSize),
+		})
+		assert.Equal(t, http.StatusUnauthorized, rr.Code, username)
+		assert.Equal(t, "Invalid signature!!!\n", rr.Body.String(), username)
+	}
+}
+
+// Behind the proxy, a client cannot get around the limit by sending a different X-Forwarded-For with every request.
+func TestRateLimit_ForwardedFor(t *testing.T) {
+	session_util.TrustProxyHeaders = true
+	t.Cleanup(func() { session_util.TrustProxyHeaders = false })
+
+	policy := ratelimit.DefaultPolicy()
+	policy.PerIP = ratelimit.Rate{Requests: 2, Per: time.Minute}
+	setRateLimitPolicy(t, policy)
+
+	codes := []int{}
+	for i := 0; i < 3; i++ {
+		req, _ := http.NewRequest(http.MethodPost, "/api/test", nil)
+		req.RemoteAddr = "10.0.0.2:50000"
+		req.Header.Set("X-Forwarded-For", fmt.Sprintf("203.0.113.%d, 192.0.2.31", i))
+		rr := httptest.NewRecorder()
+		ratelimit.Middleware(http.HandlerFunc(handlers.DeviceAuthorizeHandler)).ServeHTTP(rr, req)
+		codes = append(codes, rr.Code)
+	}
+	assert.Equal(t, http.StatusTooManyRequests, codes[2])
+}
+
+// proxiedRequest builds a request as the nginx proxy of the frontend container forwards it to the backend
+// The proxy connects from its own address and appends the address of the client to any X-Forwarded-For the client sent.
+func proxiedRequest(clientIP string, sentForwardedFor string) *http.Request {
+	req, _ := http.NewRequest(http.MethodPost, "/api/test", nil)
+	req.RemoteAddr = "172.18.0.3:41000"
+	if sentForwardedFor != "" {
+		req.Header.Set("X-Forwarded-For", sentForwardedFor+", "+clientIP)
+	} else {
+		req.Header.Set("X-Forwarded-For", clientIP)
+	}
+	return req
+}
+
+// With the proxy trusted, as in compose.yaml, clients behind it are told apart and limited separately.
+func TestRateLimit_BehindProxy(t *testing.T) {
+	session_util.TrustProxyHeaders = true
+	t.Cleanup(func() { session_util.TrustProxyHeaders = false })
+
+	assert.Equal(t, "198.51.100.1", session_util.ClientIP(proxiedRequest("198.51.100.1", "")))
+	assert.Equal(t, "198.51.100.1", session_util.ClientIP(proxiedRequest("198.51.100.1", "203.0.113.9")))
+	assert.Equal(t, "198.51.100.2", session_util.ClientIP(proxiedRequest("198.51.100.2", "")))
+
+	policy := ratelimit.DefaultPolicy()
+	policy.PerIP = ratelimit.Rate{Requests: 2, Per: time.Minute}
+	setRateLimitPolicy(t, policy)
+
+	limited := func(clientIP string) bool {
+		rr := httptest.NewRecorder()
+		ratelimit.Middleware(http.HandlerFunc(handlers.DeviceAuthorizeHandler)).ServeHTTP(rr, proxiedRequest(clientIP, ""))
+		return rr.Code == http.StatusTooManyRequests
+	}
+	assert.False(t, limited("198.51.100.1"))
+	assert.False(t, limited("198.51.100.1"))
+	assert.True(t, limited("198.51.100.1"))
+
+	// Another client is not affected by the first one using up its limit
+	assert.False(t, limited("198.51.100.2"))
+}
+
+// Guessing recovery codes is rate limited and locks the username like failed signatures, and the failures are audited.
+func TestRateLimit_RecoveryLockout(t *testing.T) {
+	useAuditLog(t)
+	policy := ratelimit.DefaultPolicy()
+	policy.MaxFailures = 2
+	setRateLimitPolicy(t, policy)
+
+	pubkey, _, _ := ed25519.GenerateKey(nil)
+	handlers.UserRepo.CreateUser(context.Background(), "rolf", pubkey, "main", util.SignerApp{})
+	codes, hashes, err := internal.GenerateRecoveryCodes()
+	assert.NoError(t, err)
+	assert.NoError(t, handlers.UserRepo.SetRecoveryCodes(context.Background(), "rolf", hashes))
+
+	for i := 0; i < 2; i++ {
+		rr := rateLimitedRequest(t, handlers.RecoverHandler, "203.0.113.20", structs.RecoverRequest{Username: "rolf", Code: "not-a-code"})
+		assert.Equal(t, http.StatusUnauthorized, rr.Code)
+	}
+
+	// Even a valid code is refused while the username is locked
+	rr := rateLimitedRequest(t, handlers.RecoverHandler, "203.0.113.21", structs.RecoverRequest{Username: "rolf", Code: codes[0]})
+	assert.Equal(t, http.StatusTooManyRequests, rr.Code)
+
+	events, err := audit.Log.List(context.Background(), "rolf", 10)
+	assert.NoError(t, err)
+	assert.Len(t, events, 2)
+	for _, event := range events {
+		assert.Equal(t, audit.EventRecoveryFailed, event.Type)
+		assert.Equal(t, "203.0.113.20", event.IP)
+	}
+}
@@ -0,0 +1,114 @@
+package tests
+
+import (
+	"chalmers/tkey-group22/application/internal/handlers"
+	"chalmers/tkey-group22/application/internal/session_util"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const oldSecretKey = "Jx8vQ2mL5nR7tY1wZ4cB6dF9gH3kP0sA"
+const newSecretKey = "uE2iO7pA4sD9fG1hJ6kL3zX8cV5bN0mQ"
+
+func TestLoadSecretKeys(t *testing.T) {
+	t.Setenv("SESSION_KEYS", "")
+	t.Setenv("SESSION_KEY", "")
+	_, err := session_util.LoadSecretKeys("SESSION_KEYS", "SESSION_KEY")
+	assert.Error(t, err, "a key is required")
+
+	// A single key is read from SESSION_KEY
+	t.Setenv("SESSION_KEY", oldSecretKey)
+	keys, err := session_util.LoadSecretKeys("SESSION_KEYS", "SESSION_KEY")
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{[]byte(oldSecretKey)}, keys)
+
+	// SESSION_KEYS takes precedence, with the current key first
+	t.Setenv("SESSION_KEYS", newSecretKey+", "+oldSecretKey)
+	keys, err = session_util.LoadSecretKeys("SESSION_KEYS", "SESSION_KEY")
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{[]byte(newSecretKey), []byte(oldSecretKey)}, keys)
+}
+
+func TestLoadSecretKeys_WeakKeys(t *testing.T) {
+	weak := []string{
+		"qwerty",
+		"123abc",
+		strings.Repeat("a", 64),
+		newSecretKey + "," + newSecretKey,
+		newSecretKey + ",",
+	}
+	for _, value := range weak {
+		t.Setenv("CSRF_KEYS", value)
+		_, err := session_util.LoadSecretKeys("CSRF_KEYS", "CSRF_KEY")
+		assert.Error(t, err, value)
+	}
+}
+
+// A session signed with the previous key is still valid after the key is rotated.
+func TestSessionKeyRotation(t *testing.T) {
+	original := session_util.Store
+	t.Cleanup(func() { session_util.Store = original })
+	backend := session_util.NewMemorySessionBackend()
+
+	t.Setenv("SESSION_KEYS", "")
+	t.Setenv("SESSION_KEY", oldSecretKey)
+	assert.NoError(t, session_util.InitSession(backend))
+	cookies := loginCookies(t, "rita", "main")
+
+	t.Setenv("SESSION_KEYS", newSecretKey+","+oldSecretKey)
+	assert.NoError(t, session_util.InitSession(backend))
+	assert.Equal(t, http.StatusOK, protectedRequest(cookies).Code)
+
+	// Once the previous key is removed its cookies are no longer accepted
+	t.Setenv("SESSION_KEYS", newSecretKey)
+	assert.NoError(t, session_util.InitSession(backend))
+	assert.Equal(t, http.StatusUnauthorized, protectedRequest(cookies).Code)
+}
+
+// csrfRequest sends a request with the given cookies and CSRF token through the CSRF middleware.
+func csrfRequest(method string, cookies []*http.Cookie, token string) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest(method, "/api/csrf-token", nil)
+	for _, cookie := range cookies {
+		req.AddCookie(cookie)
+	}
+	if token != "" {
+		req.Header.Set("X-CSRF-Token", token)
+	}
+	rr := httptest.NewRecorder()
+	session_util.CsrfMiddleware(http.HandlerFunc(handlers.GetCSRF)).ServeHTTP(rr, req)
+	return rr
+}
+
+// A CSRF token issued with the previous key is still valid after the key is rotated.
+func TestCSRFKeyRotation(t *testing.T) {
+	original := session_util.CsrfMiddleware
+	t.Cleanup(func() { session_util.CsrfMiddleware = original })
+
+	t.Setenv("CSRF_KEYS", "")
+	t.Setenv("CSRF_KEY", oldSecretKey)
+	assert.NoError(t, session_util.InitCSRF())
+	rr := csrfRequest(http.MethodGet, nil, "")
+	cookies := rr.Result().Cookies()
+	token := rr.Header().Get("X-CSRF-Token")
+	assert.Len(t, cookies, 1)
+	assert.NotEmpty(t, token)
+
+	t.Setenv("CSRF_KEYS", newSecretKey+","+oldSecretKey)
+	assert.NoError(t, session_util.InitCSRF())
+	rr = csrfRequest(http.MethodPost, cookies, token)
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	// The client is given the cookie signed with the new key, which keeps working with the same token
+	resigned := rr.Result().Cookies()
+	assert.Len(t, resigned, 1)
+	assert.NotEqual(t, cookies[0].Value, resigned[0].Value)
+
+	t.Setenv("CSRF_KEYS", newSecretKey)
+	assert.NoError(t, session_util.InitCSRF())
+	assert.Equal(t, http.StatusForbidden, csrfRequest(http.MethodPost, cookies, token).Code)
+	assert.Equal(t, http.StatusOK, csrfRequest(http.MethodPost, resigned, token).Code)
+}
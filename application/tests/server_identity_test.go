@@ -0,0 +1,50 @@
+package tests
+
+import (
+	"chalmers/tkey-group22/application/internal"
+	"crypto/ed25519"
+	"encoding/base64"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInitServerIdentity_GeneratesAndReloadsKeyFile(t *testing.T) {
+	original := internal.ServerPublicKey()
+	path := filepath.Join(t.TempDir(), "server_identity.key")
+
+	// The first start generates a new key file
+	assert.NoError(t, internal.InitServerIdentity("", path))
+	generated := internal.ServerPublicKey()
+	assert.NotNil(t, generated)
+	assert.NotEqual(t, original, generated)
+
+	// Later starts load the same key from the file
+	_, otherKey, _ := ed25519.GenerateKey(nil)
+	internal.SetServerIdentity(otherKey)
+	assert.NoError(t, internal.InitServerIdentity("", path))
+	assert.Equal(t, generated, internal.ServerPublicKey())
+
+	restoreServerIdentity(t)
+}
+
+func TestInitServerIdentity_Seed(t *testing.T) {
+	_, key, _ := ed25519.GenerateKey(nil)
+	seed := base64.StdEncoding.EncodeToString(key.Seed())
+
+	assert.NoError(t, internal.InitServerIdentity(seed, filepath.Join(t.TempDir(), "unused.key")))
+	assert.Equal(t, key.Public(), internal.ServerPublicKey())
+
+	// Seeds of the wrong length are rejected
+	assert.Error(t, internal.InitServerIdentity(base64.StdEncoding.EncodeToString([]byte("short")), ""))
+
+	restoreServerIdentity(t)
+}
+
+// restoreServerIdentity installs a fresh server identity key for the tests that run afterwards
+func restoreServerIdentity(t *testing.T) {
+	_, key, err := ed25519.GenerateKey(nil)
+	assert.NoError(t, err)
+	internal.SetServerIdentity(key)
+}
@@ -0,0 +1,192 @@
+package tests
+
+import (
+	"chalmers/tkey-group22/application/internal/session_util"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// setSessionPolicy replaces the session policy for the duration of the test.
+func setSessionPolicy(t *testing.T, policy session_util.SessionPolicy) {
+	original := session_util.Policy
+	session_util.Policy = policy
+	t.Cleanup(func() { session_util.Policy = original })
+}
+
+// protectedRequest sends a request with the given cookies through SessionMiddleware.
+func protectedRequest(cookies []*http.Cookie) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest(http.MethodGet, "/api/getuser", nil)
+	for _, cookie := range cookies {
+		req.AddCookie(cookie)
+	}
+	rr := httptest.NewRecorder()
+	handler := session_util.SessionMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	handler.ServeHTTP(rr, req)
+	return rr
+}
+
+func TestLoadSessionPolicy(t *testing.T) {
+	policy, err := session_util.LoadSessionPolicy()
+	assert.NoError(t, err)
+	assert.Equal(t, session_util.DefaultSessionPolicy(), policy)
+
+	// The cookie is Secure in production unless explicitly turned off
+	t.Setenv("APP_ENV", "production")
+	policy, err = session_util.LoadSessionPolicy()
+	assert.NoError(t, err)
+	assert.True(t, policy.Secure)
+
+	t.Setenv("SESSION_IDLE_TIMEOUT", "15m")
+	t.Setenv("SESSION_ABSOLUTE_LIFETIME", "8h")
+	t.Setenv("SESSION_COOKIE_SAMESITE", "strict")
+	policy, err = session_util.LoadSessionPolicy()
+	assert.NoError(t, err)
+	assert.Equal(t, 15*time.Minute, policy.IdleTimeout)
+	assert.Equal(t, 8*time.Hour, policy.AbsoluteLifetime)
+	assert.Equal(t, http.SameSiteStrictMode, policy.SameSite)
+
+	t.Setenv("SESSION_COOKIE_SECURE", "false")
+	t.Setenv("SESSION_COOKIE_SAMESITE", "none")
+	_, err = session_util.LoadSessionPolicy()
+	assert.Error(t, err, "SameSite=None requires a Secure cookie")
+}
+
+func TestLoadSessionPolicy_InvalidSettings(t *testing.T) {
+	invalid := map[string]string{
+		"SESSION_IDLE_TIMEOUT":      "an hour",
+		"SESSION_ABSOLUTE_LIFETIME": "-1h",
+		"SESSION_COOKIE_SECURE":     "yes",
+		"SESSION_COOKIE_SAMESITE":   "sometimes",
+	}
+	for name, value := range invalid {
+		t.Run(name, func(t *testing.T) {
+			t.Setenv(name, value)
+			_, err := session_util.LoadSessionPolicy()
+			assert.Error(t, err)
+		})
+	}
+
+	// A session cannot end later by being unused than by its absolute lifetime
+	t.Setenv("SESSION_IDLE_TIMEOUT", "2h")
+	t.Setenv("SESSION_ABSOLUTE_LIFETIME", "1h")
+	_, err := session_util.LoadSessionPolicy()
+	assert.Error(t, err)
+}
+
+func TestSessionPolicy_CookieFlags(t *testing.T) {
+	setSessionPolicy(t, session_util.SessionPolicy{
+		IdleTimeout:      30 * time.Minute,
+		AbsoluteLifetime: 8 * time.Hour,
+		Secure:           true,
+		SameSite:         http.SameSiteStrictMode,
+	})
+
+	cookies := loginCookies(t, "olga", "main")
+	assert.Len(t, cookies, 1)
+	assert.Equal(t, 1800, cookies[0].MaxAge)
+	assert.True(t, cookies[0].Secure)
+	assert.True(t, cookies[0].HttpOnly)
+	assert.Equal(t, http.SameSiteStrictMode, cookies[0].SameSite)
+}
+
+// The idle timeout is extended while the session is used.
+func TestSessionMiddleware_RefreshesIdleTimeout(t *testing.T) {
+	setSessionPolicy(t, session_util.SessionPolicy{
+		IdleTimeout:      30 * time.Minute,
+		AbsoluteLifetime: 8 * time.Hour,
+		SameSite:         http.SameSiteLaxMode,
+	})
+	cookies := loginCookies(t, "petra", "main")
+
+	// A session that was just refreshed is not saved again
+	rr := protectedRequest(cookies)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Empty(t, rr.Result().Cookies())
+
+	// Pretend the session was last refreshed a while ago
+	req, _ := http.NewRequest(http.MethodGet, "/", nil)
+	for _, cookie := range cookies {
+		req.AddCookie(cookie)
+	}
+	session, _ := session_util.Store.Get(req, "session-name")
+	session.Values["refreshedAt"] = time.Now().Add(-10 * time.Minute).Unix()
+	assert.NoError(t, session.Save(req, httptest.NewRecorder()))
+
+	rr = protectedRequest(cookies)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	refreshed := rr.Result().Cookies()
+	assert.Len(t, refreshed, 1)
+	assert.Equal(t, 1800, refreshed[0].MaxAge)
+}
+
+// A session ends at its absolute lifetime, even when the idle timeout would keep it alive.
+func TestSessionMiddleware_AbsoluteLifetime(t *testing.T) {
+	setSessionPolicy(t, session_util.SessionPolicy{
+		IdleTimeout:      time.Hour,
+		AbsoluteLifetime: 90 * time.Minute,
+		SameSite:         http.SameSiteLaxMode,
+	})
+	cookies := loginCookies(t, "quinn", "main")
+	assert.Equal(t, http.StatusOK, protectedRequest(cookies).Code)
+
+	session_util.Policy.AbsoluteLifetime = time.Nanosecond
+	rr := protectedRequest(cookies)
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+	assert.Contains(t, rr.Body.String(), "Session expired")
+
+	// The session is gone, even if the lifetime is extended again
+	session_util.Policy.AbsoluteLifetime = 90 * time.Minute
+	assert.Equal(t, http.StatusUnauthorized, protectedRequest(cookies).Code)
+}
+
+// revokingBackend ends the sessions of a user right before the next change to a stored session is written,
+// as if the sessions were revoked by another request while a session was being saved.
+type revokingBackend struct {
+	session_util.SessionBackend
+	username string
+}
+
+func (backend *revokingBackend) Replace(ctx context.Context, record *session_util.SessionRecord, previousData []byte) (bool, error) {
+	backend.SessionBackend.DeleteForUser(ctx, backend.username, "")
+	return backend.SessionBackend.Replace(ctx, record, previousData)
+}
+
+// A session revoked while it is being refreshed is not stored again by the refresh.
+func TestSessionMiddleware_RevokedDuringRefresh(t *testing.T) {
+	setSessionPolicy(t, session_util.SessionPolicy{
+		IdleTimeout:      30 * time.Minute,
+		AbsoluteLifetime: 8 * time.Hour,
+		SameSite:         http.SameSiteLaxMode,
+	})
+	cookies := loginCookies(t, "rosa", "main")
+
+	// Pretend the session was last refreshed a while ago
+	req, _ := http.NewRequest(http.MethodGet, "/", nil)
+	for _, cookie := range cookies {
+		req.AddCookie(cookie)
+	}
+	session, _ := session_util.Store.Get(req, "session-name")
+	session.Values["refreshedAt"] = time.Now().Add(-10 * time.Minute).Unix()
+	assert.NoError(t, session.Save(req, httptest.NewRecorder()))
+
+	backend := session_util.Store.Backend
+	session_util.Store.Backend = &revokingBackend{SessionBackend: backend, username: "rosa"}
+	rr := protectedRequest(cookies)
+	session_util.Store.Backend = backend
+
+	// The request was authenticated before the revocation, but the refresh is dropped
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Empty(t, rr.Result().Cookies())
+
+	sessions, err := backend.ListForUser(context.Background(), "rosa")
+	assert.NoError(t, err)
+	assert.Empty(t, sessions)
+	assert.Equal(t, http.StatusUnauthorized, protectedRequest(cookies).Code)
+}
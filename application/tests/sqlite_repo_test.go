@@ -0,0 +1,107 @@
+package tests
+
+import (
+	"chalmers/tkey-group22/application/data/db"
+	"chalmers/tkey-group22/application/internal/util"
+	"context"
+	"crypto/ed25519"
+	"database/sql"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// openTestSQLite opens an empty SQLite database in a temporary directory
+func openTestSQLite(t *testing.T) *sql.DB {
+	database, err := db.OpenSQLite(filepath.Join(t.TempDir(), "tkey.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { database.Close() })
+	return database
+}
+
+// The SQLite repository enforces the same rules for keys as the other repositories.
+func TestSQLiteRepo_KeyRules(t *testing.T) {
+	checkKeyRules(t, util.NewSQLiteUserRepo(openTestSQLite(t)))
+}
+
+func TestSQLiteRepo_ReturnsCopies(t *testing.T) {
+	checkReturnsCopies(t, util.NewSQLiteUserRepo(openTestSQLite(t)))
+}
+
+// Keys keep their order and metadata, and recovery codes are kept when the keys change.
+func TestSQLiteRepo_KeyMetadata(t *testing.T) {
+	repo := util.NewSQLiteUserRepo(openTestSQLite(t))
+	pubkey, _, _ := ed25519.GenerateKey(nil)
+	otherPubkey, _, _ := ed25519.GenerateKey(nil)
+	signerApp := util.SignerApp{Name: "tk1  sign"}
+
+	_, err := repo.CreateUser(context.Background(), "vera", pubkey, "main", signerApp)
+	assert.NoError(t, err)
+	assert.NoError(t, repo.SetRecoveryCodes(context.Background(), "vera", []string{"hash1", "hash2"}))
+	assert.NoError(t, repo.AddPublicKey(context.Background(), "vera", otherPubkey, "backup", util.SignerApp{}))
+	assert.NoError(t, repo.RecordKeyUse(context.Background(), "vera", "main"))
+	assert.ErrorIs(t, repo.RecordKeyUse(context.Background(), "vera", "missing"), util.ErrKeyNotFound)
+
+	user, err := repo.GetUser(context.Background(), "vera")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"main", "backup"}, []string{user.PublicKeys[0].Label, user.PublicKeys[1].Label})
+	assert.Equal(t, signerApp, user.PublicKeys[0].SignerApp)
+	assert.Equal(t, int64(1), user.PublicKeys[0].UseCount)
+	assert.WithinDuration(t, time.Now(), user.PublicKeys[0].LastUsed, time.Minute)
+	assert.True(t, user.PublicKeys[1].LastUsed.IsZero())
+	assert.Equal(t, []string{"hash1", "hash2"}, user.RecoveryCodes)
+
+	used, err := repo.UseRecoveryCode(context.Background(), "vera", "hash1")
+	assert.NoError(t, err)
+	assert.True(t, used)
+	used, err = repo.UseRecoveryCode(context.Background(), "vera", "hash1")
+	assert.NoError(t, err)
+	assert.False(t, used)
+}
+
+// Notes belong to a registered user and are deleted together with it.
+func TestSQLiteRepo_Notes(t *testing.T) {
+	database := openTestSQLite(t)
+	users := util.NewSQLiteUserRepo(database)
+	notes := util.NewSQLiteNotesRepo(database)
+	for _, username := range []string{"bob", "alice"} {
+		pubkey, _, _ := ed25519.GenerateKey(nil)
+		if _, err := users.CreateUser(context.Background(), username, pubkey, "main", util.SignerApp{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	checkNotesHandlers(t, notes)
+
+	_, err := notes.CreateNote(context.Background(), "nobody", "example.com", "note")
+	assert.ErrorIs(t, err, util.ErrUserNotFound)
+
+	id, err := notes.CreateNote(context.Background(), "alice", "example.com", "note")
+	assert.NoError(t, err)
+	assert.NoError(t, users.DeleteUser(context.Background(), "alice"))
+	_, err = notes.GetNote(context.Background(), id)
+	assert.ErrorIs(t, err, util.ErrNoteNotFound)
+}
+
+// OpenID Connect clients are stored with their redirect URIs.
+func TestSQLiteRepo_OIDCClients(t *testing.T) {
+	repo := util.NewSQLiteOIDCClientRepo(openTestSQLite(t))
+	client, _, err := util.NewOIDCClient("Notes", []string{"https://notes.example/callback", "http://localhost:3000/callback"})
+	assert.NoError(t, err)
+
+	assert.NoError(t, repo.CreateClient(context.Background(), client))
+	assert.ErrorIs(t, repo.CreateClient(context.Background(), client), util.ErrClientExists)
+
+	stored, err := repo.GetClient(context.Background(), client.ClientID)
+	assert.NoError(t, err)
+	assert.Equal(t, client.RedirectURIs, stored.RedirectURIs)
+	assert.Equal(t, client.SecretHash, stored.SecretHash)
+	assert.True(t, client.CreatedAt.Equal(stored.CreatedAt))
+
+	_, err = repo.GetClient(context.Background(), "unknown")
+	assert.ErrorIs(t, err, util.ErrClientNotFound)
+}
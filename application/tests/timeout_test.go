@@ -0,0 +1,91 @@
+package tests
+
+import (
+	"chalmers/tkey-group22/application/internal/handlers"
+	"chalmers/tkey-group22/application/internal/util"
+	"context"
+	"crypto/ed25519"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// setOperationTimeout uses the timeout for repository operations until the test ends.
+func setOperationTimeout(t *testing.T, timeout time.Duration) {
+	original := util.OperationTimeout
+	util.OperationTimeout = timeout
+	t.Cleanup(func() { util.OperationTimeout = original })
+}
+
+func TestLoadOperationTimeout(t *testing.T) {
+	t.Setenv("DB_TIMEOUT", "")
+	timeout, err := util.LoadOperationTimeout()
+	assert.NoError(t, err)
+	assert.Equal(t, util.DefaultOperationTimeout, timeout)
+
+	t.Setenv("DB_TIMEOUT", "250ms")
+	timeout, err = util.LoadOperationTimeout()
+	assert.NoError(t, err)
+	assert.Equal(t, 250*time.Millisecond, timeout)
+
+	for _, value := range []string{"soon", "0s", "-1s"} {
+		t.Setenv("DB_TIMEOUT", value)
+		_, err = util.LoadOperationTimeout()
+		assert.Error(t, err, value)
+	}
+}
+
+// A request that has been cancelled or has run out of time gets 503 or 504 instead of looking like a missing user.
+func TestHandlers_DatabaseDeadline(t *testing.T) {
+	cookies := loginCookies(t, "bob", "main")
+	listKeys := func(ctx context.Context) int {
+		req, _ := http.NewRequestWithContext(ctx, http.MethodGet, "/api/list-public-keys", nil)
+		for _, cookie := range cookies {
+			req.AddCookie(cookie)
+		}
+		rr := httptest.NewRecorder()
+		handlers.ListPublicKeysHandler(rr, req)
+		return rr.Code
+	}
+
+	assert.Equal(t, http.StatusOK, listKeys(context.Background()))
+
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.Equal(t, http.StatusServiceUnavailable, listKeys(cancelled))
+
+	expired, cancel := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancel()
+	assert.Equal(t, http.StatusGatewayTimeout, listKeys(expired))
+}
+
+// An operation waiting for a database that does not answer is abandoned after OperationTimeout.
+func TestSQLiteRepo_OperationTimeout(t *testing.T) {
+	database := openTestSQLite(t)
+	repo := util.NewSQLiteUserRepo(database)
+	pubkey, _, _ := ed25519.GenerateKey(nil)
+	_, err := repo.CreateUser(context.Background(), "hugo", pubkey, "main", util.SignerApp{})
+	assert.NoError(t, err)
+
+	// The transaction holds the only connection, so the lookup has to wait for it
+	tx, err := database.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	setOperationTimeout(t, 50*time.Millisecond)
+
+	_, err = repo.GetUser(context.Background(), "hugo")
+	assert.True(t, util.IsTimeout(err), "expected a timeout, got %v", err)
+
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = repo.GetUser(cancelled, "hugo")
+	assert.True(t, util.IsUnavailable(err), "expected the cancellation, got %v", err)
+
+	assert.NoError(t, tx.Rollback())
+	_, err = repo.GetUser(context.Background(), "hugo")
+	assert.NoError(t, err)
+}
@@ -6,8 +6,6 @@ package main
 import (
 	"chalmers/tkey-group22/client/internal/auth"
 	"chalmers/tkey-group22/client/internal/structs"
-	. "chalmers/tkey-group22/client/internal/structs"
-	"chalmers/tkey-group22/client/internal/tkey"
 	"chalmers/tkey-group22/client/internal/util"
 	"encoding/json"
 	"flag"
@@ -47,6 +45,9 @@ func startCmdClient() {
 			// Perform login
 			util.CallLogin()
 		case 3:
+			// Approve the login of a browser on another machine
+			util.CallApproveDevice()
+		case 4:
 			// Stop program
 			return
 		default:
@@ -60,6 +61,7 @@ func startWebClient() {
 	http.Handle("/api/register", enableCors(http.HandlerFunc(registerHandler)))
 	http.Handle("/api/login", enableCors(http.HandlerFunc(loginHandler)))
 	http.Handle("/api/add-public-key", enableCors(http.HandlerFunc(addPublicKeyHandler)))
+	http.Handle("/api/sign", enableCors(http.HandlerFunc(signHandler)))
 	fmt.Println("Client running on http://localhost:6060")
 	http.ListenAndServe(":6060", nil)
 }
@@ -93,15 +95,11 @@ func loginHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	username := requestBody["username"]
-	user, signedChallenge, errMsg, err := auth.GetAndSign(origin, username)
+	response, errMsg, err := auth.GetAndSign(origin, username)
 	if err != nil {
 		http.Error(w, errMsg, http.StatusBadRequest)
 		return
 	}
-	response := GetAndSignResponse{
-		User:            user,
-		SignedChallenge: signedChallenge,
-	}
 
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
@@ -118,7 +116,7 @@ func loginHandler(w http.ResponseWriter, r *http.Request) {
 // Possible responses:
 // - 400 Bad Request: if the request body is invalid or cannot be parsed
 // - 500 Internal Server Error: if there is an error adding the public key
-// - 200 OK: if the public key is added successfully
+// - 200 OK: with the user's recovery codes if the user is registered successfully
 //
 //
 //	Error messages:
@@ -157,35 +155,96 @@ func registerHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, respBodyStr, http.StatusBadRequest)
 		return
 	}
+	// Pass on the recovery codes of the new user to the web client
+	defer resp.Body.Close()
+	var registerResponse structs.RegisterResponse
+	if err := json.NewDecoder(resp.Body).Decode(&registerResponse); err != nil {
+		http.Error(w, "Failed to read response body", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
-	w.Write([]byte("User registered successfully"))
+	json.NewEncoder(w).Encode(registerResponse)
 }
 
 // Handles add public key requests from the web client
-// It expects a POST request with no specific body content.
-// The handler retrieves a new public key from the TKey and responds with the generated public key.
+// It expects a POST request with a JSON body containing the username and a "new-key" challenge from the application.
+// The handler retrieves the public key of the connected TKey, signs the challenge with it to prove possession,
+// and responds with the public key, the signer app and the signature.
 //
 // Possible responses:
 // - 405 Method Not Allowed: if the request method is not POST
-// - 500 Internal Server Error: if there is an error generating the public key
-// - 200 OK: if the public key is generated successfully
+// - 400 Bad Request: if the request body is invalid or the challenge is refused
+// - 200 OK: if the public key is retrieved and the challenge signed successfully
 func addPublicKeyHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
 		return
 	}
 
-	// Generate the public key using TKey
-	pubkey, err := tkey.GetTkeyPubKey()
+	var requestBody structs.SignRequest
+	if err := json.NewDecoder(r.Body).Decode(&requestBody); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	challenge := &structs.LoginResponse{
+		ChallengeID: requestBody.ChallengeID,
+		Challenge:   requestBody.Challenge,
+		Signature:   requestBody.Signature,
+	}
+	response, err := auth.ProveNewKey(r.Header.Get("Origin"), requestBody.Username, challenge)
 	if err != nil {
-		http.Error(w, "Failed to generate public key", http.StatusInternalServerError)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	// Respond with the public key
-	response := structs.AddPublicKeyResponse{
-		Pubkey: []byte(pubkey),
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(response)
+}
+
+// Handles step-up signing requests from the web client
+// It expects a POST request with a JSON body containing the username, the purpose ("add-key", "remove-key", "suspend-key",
+// "reactivate-key" or "recovery-codes") and a step-up challenge from the application. The challenge is signed with the connected TKey if it was
+// issued by the trusted server for the requesting origin, purpose and user.
+//
+// Possible responses:
+// - 405 Method Not Allowed: if the request method is not POST
+// - 400 Bad Request: if the request body is invalid, the purpose is not allowed or the challenge is refused
+// - 200 OK: with the challenge ID and the signature
+func signHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var requestBody structs.SignRequest
+	if err := json.NewDecoder(r.Body).Decode(&requestBody); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	// Login challenges go through /api/login and new keys through /api/add-public-key
+	switch requestBody.Purpose {
+	case auth.PurposeAddKey, auth.PurposeRemoveKey, auth.PurposeSuspendKey, auth.PurposeReactivateKey, auth.PurposeRecoveryCodes:
+	default:
+		http.Error(w, "Purpose not allowed", http.StatusBadRequest)
+		return
+	}
+
+	challenge := &structs.LoginResponse{
+		ChallengeID: requestBody.ChallengeID,
+		Challenge:   requestBody.Challenge,
+		Signature:   requestBody.Signature,
 	}
+	response, err := auth.SignChallenge(r.Header.Get("Origin"), requestBody.Username, requestBody.Purpose, challenge)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(response)
@@ -0,0 +1,37 @@
+package auth
+
+import (
+	. "chalmers/tkey-group22/client/internal/structs"
+	"chalmers/tkey-group22/client/internal/tkey"
+)
+
+// ProveNewKey gets the public key of the connected TKey and signs a "new-key" challenge with it
+// The signature proves to the application that the key being added is controlled by the user
+//
+// Parameters:
+// - appurl: The URL of the application server, i.e. the origin of the requesting page
+// - username: The user the key is added for
+// - challenge: The "new-key" challenge and the server's signature over it
+//
+// Returns:
+// - An AddPublicKeyResponse with the public key, the signer app and the signature over the challenge
+// - An error if the challenge is refused or the TKey cannot be used
+func ProveNewKey(appurl string, username string, challenge *LoginResponse) (*AddPublicKeyResponse, error) {
+	pubkey, err := tkey.GetTkeyPubKey()
+	if err != nil {
+		return nil, err
+	}
+
+	signed, err := SignChallenge(appurl, username, PurposeNewKey, challenge)
+	if err != nil {
+		return nil, err
+	}
+
+	return &AddPublicKeyResponse{
+		Pubkey:      []byte(pubkey),
+		AppName:     tkey.GetEmbeddedAppName(),
+		AppDigest:   tkey.GetEmbeddedAppDigest(),
+		ChallengeID: signed.ChallengeID,
+		Signature:   signed.SignedChallenge,
+	}, nil
+}
@@ -0,0 +1,156 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// challengeHeader is the first line of every challenge payload issued by the application
+const challengeHeader = "tkey-passwordless-authentication challenge v1"
+
+// Purposes a challenge can be issued for
+const (
+	PurposeLogin     = "login"
+	PurposeRegister  = "register"
+	PurposeAddKey    = "add-key"
+	PurposeRemoveKey = "remove-key"
+	PurposeNewKey    = "new-key"
+
+	PurposeRecoveryCodes = "recovery-codes"
+	PurposeDevice        = "device"
+
+	PurposeSuspendKey    = "suspend-key"
+	PurposeReactivateKey = "reactivate-key"
+)
+
+// clockSkew is how far the local clock may be behind the server's before a challenge is treated as expired
+const clockSkew = 30 * time.Second
+
+// ChallengePayload is the structured data that the TKey is asked to sign
+// UserCode is only set for "device" challenges, which approve the login of the browser showing the code
+type ChallengePayload struct {
+	Origin    string
+	Purpose   string
+	Username  string
+	Nonce     string
+	ExpiresAt time.Time
+	UserCode  string
+}
+
+// ParseChallengePayload parses a challenge payload received from the application
+//
+// Parameters:
+// - encoded: The challenge as received from the server
+//
+// Returns:
+// - A ChallengePayload struct containing the parsed fields
+// - An error if the challenge is not a valid payload
+func ParseChallengePayload(encoded string) (*ChallengePayload, error) {
+	lines := strings.Split(encoded, "\n")
+	if (len(lines) != 6 && len(lines) != 7) || lines[0] != challengeHeader {
+		return nil, errors.New("malformed challenge payload")
+	}
+
+	fields := []string{"origin", "purpose", "username", "nonce", "expires"}
+	values := make([]string, len(fields))
+	for i, field := range fields {
+		value, found := strings.CutPrefix(lines[i+1], field+": ")
+		if !found {
+			return nil, fmt.Errorf("malformed challenge payload: missing %s", field)
+		}
+		values[i] = value
+	}
+
+	expiresAt, err := time.Parse(time.RFC3339, values[4])
+	if err != nil {
+		return nil, fmt.Errorf("malformed challenge payload: %w", err)
+	}
+
+	var userCode string
+	if len(lines) == 7 {
+		value, found := strings.CutPrefix(lines[6], "user-code: ")
+		if !found || value == "" {
+			return nil, errors.New("malformed challenge payload: missing user-code")
+		}
+		userCode = value
+	}
+
+	return &ChallengePayload{
+		Origin:    values[0],
+		Purpose:   values[1],
+		Username:  values[2],
+		Nonce:     values[3],
+		ExpiresAt: expiresAt,
+		UserCode:  userCode,
+	}, nil
+}
+
+// validateChallenge parses a challenge and checks that it was issued for the origin the
+// request came from, for the expected purpose and user, and that it has not expired.
+// This stops a page served from another origin from getting a signature that is valid for the application.
+//
+// Parameters:
+// - challenge: The challenge as received from the server
+// - origin: The origin of the page that asked for the signature
+// - purpose: The purpose the signature is requested for
+// - username: The user the signature is requested for
+//
+// Returns:
+// - The parsed ChallengePayload
+// - An error if the challenge is malformed or any field does not match
+func validateChallenge(challenge string, origin string, purpose string, username string) (*ChallengePayload, error) {
+	payload, err := ParseChallengePayload(challenge)
+	if err != nil {
+		return nil, err
+	}
+
+	if payload.Origin != strings.TrimSuffix(origin, "/") {
+		return nil, fmt.Errorf("challenge was issued for %s, not for %s", payload.Origin, origin)
+	}
+
+	if payload.Purpose != purpose {
+		return nil, fmt.Errorf("challenge was issued for %s, not for %s", payload.Purpose, purpose)
+	}
+
+	if payload.Username != username {
+		return nil, fmt.Errorf("challenge was issued for user '%s', not for '%s'", payload.Username, username)
+	}
+
+	if time.Now().Add(-clockSkew).After(payload.ExpiresAt) {
+		return nil, errors.New("challenge has expired")
+	}
+
+	// Only device challenges approve a browser login, and their code is checked by validateDeviceChallenge
+	if payload.UserCode != "" && payload.Purpose != PurposeDevice {
+		return nil, errors.New("challenge contains an unexpected user code")
+	}
+
+	return payload, nil
+}
+
+// validateDeviceChallenge validates a "device" challenge like validateChallenge, and checks that it
+// approves the browser showing the user code the user entered, and not some other browser.
+//
+// Parameters:
+// - challenge: The challenge as received from the server
+// - origin: The URL of the application server
+// - username: The user the signature is requested for
+// - userCode: The user code as entered by the user, already normalized
+//
+// Returns:
+// - The parsed ChallengePayload
+// - An error if the challenge is malformed or any field does not match
+func validateDeviceChallenge(challenge string, origin string, username string, userCode string) (*ChallengePayload, error) {
+	payload, err := validateChallenge(challenge, origin, PurposeDevice, username)
+	if err != nil {
+		return nil, err
+	}
+
+	if payload.UserCode != userCode {
+		return nil, fmt.Errorf("challenge approves code %s, not %s", payload.UserCode, userCode)
+	}
+
+	return payload, nil
+}
@@ -0,0 +1,78 @@
+package auth
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// buildChallenge encodes a challenge payload the way the application does
+func buildChallenge(origin string, purpose string, username string, expiresAt time.Time) string {
+	return strings.Join([]string{
+		challengeHeader,
+		"origin: " + origin,
+		"purpose: " + purpose,
+		"username: " + username,
+		"nonce: 00112233445566778899aabbccddeeff",
+		"expires: " + expiresAt.UTC().Format(time.RFC3339),
+	}, "\n")
+}
+
+func TestValidateChallenge_Valid(t *testing.T) {
+	challenge := buildChallenge("http://localhost:3000", PurposeLogin, "alice", time.Now().Add(time.Minute))
+
+	payload, err := validateChallenge(challenge, "http://localhost:3000/", PurposeLogin, "alice")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if payload.Username != "alice" || payload.Origin != "http://localhost:3000" {
+		t.Fatalf("Unexpected payload: %+v", payload)
+	}
+}
+
+func TestValidateChallenge_Mismatch(t *testing.T) {
+	expires := time.Now().Add(time.Minute)
+	challenge := buildChallenge("http://localhost:3000", PurposeLogin, "alice", expires)
+
+	cases := map[string]struct {
+		challenge string
+		origin    string
+		purpose   string
+		username  string
+	}{
+		"other origin":  {challenge, "https://evil.example", PurposeLogin, "alice"},
+		"other purpose": {challenge, "http://localhost:3000", PurposeAddKey, "alice"},
+		"other user":    {challenge, "http://localhost:3000", PurposeLogin, "bob"},
+		"expired":       {buildChallenge("http://localhost:3000", PurposeLogin, "alice", time.Now().Add(-time.Hour)), "http://localhost:3000", PurposeLogin, "alice"},
+		"raw challenge": {"0123456789abcdef", "http://localhost:3000", PurposeLogin, "alice"},
+	}
+
+	for name, c := range cases {
+		if _, err := validateChallenge(c.challenge, c.origin, c.purpose, c.username); err == nil {
+			t.Errorf("%s: expected an error, got none", name)
+		}
+	}
+}
+
+func TestValidateDeviceChallenge(t *testing.T) {
+	challenge := buildChallenge("http://localhost:8080", PurposeDevice, "alice", time.Now().Add(time.Minute)) + "\nuser-code: BCDFGHJK"
+
+	payload, err := validateDeviceChallenge(challenge, "http://localhost:8080", "alice", normalizeUserCode("bcdf-ghjk"))
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if payload.UserCode != "BCDFGHJK" {
+		t.Fatalf("Unexpected payload: %+v", payload)
+	}
+
+	// A challenge for another code would log in another browser
+	if _, err := validateDeviceChallenge(challenge, "http://localhost:8080", "alice", "BCDFGHJL"); err == nil {
+		t.Error("other code: expected an error, got none")
+	}
+
+	// Only device challenges may carry a user code
+	login := buildChallenge("http://localhost:8080", PurposeLogin, "alice", time.Now().Add(time.Minute)) + "\nuser-code: BCDFGHJK"
+	if _, err := validateChallenge(login, "http://localhost:8080", PurposeLogin, "alice"); err == nil {
+		t.Error("login with user code: expected an error, got none")
+	}
+}
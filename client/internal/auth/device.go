@@ -0,0 +1,113 @@
+package auth
+
+import (
+	"bytes"
+	. "chalmers/tkey-group22/client/internal/structs"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// ApproveDevice approves the login of a browser on another machine that shows the given user code
+// A "device" challenge bound to the user code is fetched from the application and signed with the TKey,
+// after which the browser is logged in as the user the next time it checks.
+// This requires that the app has the /api/device/challenge and /api/device/approve endpoints.
+//
+// Parameters:
+// - appurl: The URL of the application server
+// - username: The user to log the browser in as
+// - userCode: The user code shown by the browser, e.g. "BCDF-GHJK"
+//
+// Returns:
+// - A error message string (if applicable)
+// - An error if the challenge is refused, the signing fails or the application does not accept the approval
+func ApproveDevice(appurl string, username string, userCode string) (string, error) {
+	userCode = normalizeUserCode(userCode)
+
+	body, err := json.Marshal(DeviceChallengeRequest{Username: username, UserCode: userCode, Origin: appurl})
+	if err != nil {
+		return "", err
+	}
+	challenge := &LoginResponse{}
+	if errMsg, err := postDevice(appurl+"/api/device/challenge", body, challenge); err != nil {
+		return errMsg, err
+	}
+
+	// Refuse to sign challenges that are not signed by the server we trust
+	if err := verifyServerSignature(appurl, challenge); err != nil {
+		return "", err
+	}
+
+	// Refuse to sign challenges that would log in another browser than the one showing the code
+	payload, err := validateDeviceChallenge(challenge.Challenge, appurl, username, userCode)
+	if err != nil {
+		return "", err
+	}
+
+	fmt.Printf("This logs in the browser showing the code %s as user '%s'\n", payload.UserCode, username)
+	_, signature, err := signChallenge(username, payload, challenge)
+	if err != nil {
+		return "", err
+	}
+
+	body, err = json.Marshal(DeviceApproveRequest{
+		Username:    username,
+		UserCode:    userCode,
+		ChallengeID: challenge.ChallengeID,
+		Signature:   signature,
+	})
+	if err != nil {
+		return "", err
+	}
+	return postDevice(appurl+"/api/device/approve", body, nil)
+}
+
+// An internal function that posts a request to a device endpoint of the application
+//
+// Parameters:
+// - url: The URL of the endpoint
+// - body: The JSON encoded request body
+// - response: Where to decode the response body to, or nil if it is not needed
+//
+// Returns:
+// - The error message of the application (if applicable)
+// - An error if the request fails or is refused
+func postDevice(url string, body []byte, response interface{}) (string, error) {
+	c := &http.Client{}
+	resp, err := c.Post(url, "application/json", bytes.NewBuffer(body))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		// Continue processing
+	case http.StatusNotFound:
+		return string(respBody), fmt.Errorf("user not found, or no browser is waiting with this code")
+	case http.StatusUnauthorized:
+		return string(respBody), fmt.Errorf("the login was not approved")
+	default:
+		return string(respBody), fmt.Errorf("unexpected error: %s", resp.Status)
+	}
+
+	if response != nil {
+		if err := json.Unmarshal(respBody, response); err != nil {
+			return "", fmt.Errorf("error decoding response")
+		}
+	}
+	return "", nil
+}
+
+// normalizeUserCode converts a user code as typed to the form the application issues it in
+// Letters are upper-cased and separators removed, so "bcdf-ghjk" is the same code as "BCDFGHJK"
+func normalizeUserCode(userCode string) string {
+	return strings.NewReplacer("-", "", " ", "").Replace(strings.ToUpper(strings.TrimSpace(userCode)))
+}
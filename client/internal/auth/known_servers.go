@@ -0,0 +1,174 @@
+package auth
+
+import (
+	. "chalmers/tkey-group22/client/internal/structs"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// KnownServersFile is the file the pinned server identity keys are stored in
+// If empty, known_servers.json in the user's config directory is used
+var KnownServersFile = ""
+
+var knownServersLock sync.Mutex
+
+// knownServersPath returns the path of the file holding the pinned server keys
+func knownServersPath() (string, error) {
+	if KnownServersFile != "" {
+		return KnownServersFile, nil
+	}
+
+	configDir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(configDir, "tkey-client", "known_servers.json"), nil
+}
+
+// loadKnownServers reads the pinned server keys, mapping server URL to base64 encoded public key
+func loadKnownServers(path string) (map[string]string, error) {
+	knownServers := make(map[string]string)
+
+	content, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return knownServers, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(content, &knownServers); err != nil {
+		return nil, fmt.Errorf("unable to read known servers file %s: %w", path, err)
+	}
+	return knownServers, nil
+}
+
+// saveKnownServers writes the pinned server keys
+func saveKnownServers(path string, knownServers map[string]string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+
+	content, err := json.MarshalIndent(knownServers, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, content, 0600)
+}
+
+// getServerKey returns the identity key pinned for the server
+// The first time a server is contacted its key is fetched from the /api/public endpoint and pinned (trust on first use).
+// After that the pinned key is always used, so an impostor server cannot replace it.
+//
+// Parameters:
+// - appurl: The URL of the application server
+//
+// Returns:
+// - The pinned ed25519 public key of the server
+// - An error if the key cannot be fetched or the known servers file cannot be used
+func getServerKey(appurl string) (ed25519.PublicKey, error) {
+	knownServersLock.Lock()
+	defer knownServersLock.Unlock()
+
+	serverURL := strings.TrimSuffix(appurl, "/")
+
+	path, err := knownServersPath()
+	if err != nil {
+		return nil, err
+	}
+
+	knownServers, err := loadKnownServers(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if encodedKey, pinned := knownServers[serverURL]; pinned {
+		pubkey, err := base64.StdEncoding.DecodeString(encodedKey)
+		if err != nil || len(pubkey) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("invalid key pinned for %s in %s", serverURL, path)
+		}
+		return ed25519.PublicKey(pubkey), nil
+	}
+
+	pubkey, err := fetchServerKey(serverURL)
+	if err != nil {
+		return nil, err
+	}
+
+	knownServers[serverURL] = base64.StdEncoding.EncodeToString(pubkey)
+	if err := saveKnownServers(path, knownServers); err != nil {
+		return nil, err
+	}
+
+	fingerprint := sha256.Sum256(pubkey)
+	fmt.Printf("Trusting new server %s with key fingerprint %s\n", serverURL, hex.EncodeToString(fingerprint[:]))
+
+	return pubkey, nil
+}
+
+// fetchServerKey fetches the identity key published by the server
+//
+// Parameters:
+// - serverURL: The URL of the application server
+//
+// Returns:
+// - The ed25519 public key of the server
+// - An error if the request fails or the key is invalid
+func fetchServerKey(serverURL string) (ed25519.PublicKey, error) {
+	endpoint := "/api/public"
+
+	c := &http.Client{}
+
+	resp, err := c.Get(serverURL + endpoint)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("error in response when getting server public key")
+	}
+
+	var res ServerPublicKeyResponse
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return nil, fmt.Errorf("error decoding server public key")
+	}
+
+	if len(res.PublicKey) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("server public key has invalid length")
+	}
+
+	return ed25519.PublicKey(res.PublicKey), nil
+}
+
+// verifyServerSignature checks that a challenge was signed by the pinned identity key of the server
+//
+// Parameters:
+// - appurl: The URL of the application server
+// - res: The response containing the challenge and the server's signature
+//
+// Returns:
+// - An error if the signature is missing or not made by the pinned key
+func verifyServerSignature(appurl string, res *LoginResponse) error {
+	pubkey, err := getServerKey(appurl)
+	if err != nil {
+		return err
+	}
+
+	signature, err := base64.StdEncoding.DecodeString(res.Signature)
+	if err != nil || !ed25519.Verify(pubkey, []byte(res.Challenge), signature) {
+		return fmt.Errorf("challenge is not signed by the trusted key for %s, refusing to sign", appurl)
+	}
+
+	return nil
+}
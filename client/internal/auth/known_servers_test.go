@@ -0,0 +1,75 @@
+package auth
+
+import (
+	. "chalmers/tkey-group22/client/internal/structs"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+// newIdentityServer starts a server that publishes the given identity key at /api/public
+func newIdentityServer(t *testing.T, pubkey ed25519.PublicKey) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(ServerPublicKeyResponse{PublicKey: pubkey, Algorithm: "Ed25519"})
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+// signedChallenge returns a LoginResponse whose challenge is signed with the given key
+func signedChallenge(key ed25519.PrivateKey, challenge string) *LoginResponse {
+	signature := ed25519.Sign(key, []byte(challenge))
+	return &LoginResponse{Challenge: challenge, Signature: base64.StdEncoding.EncodeToString(signature)}
+}
+
+func TestVerifyServerSignature_TrustOnFirstUse(t *testing.T) {
+	KnownServersFile = filepath.Join(t.TempDir(), "known_servers.json")
+	t.Cleanup(func() { KnownServersFile = "" })
+
+	pubkey, privkey, _ := ed25519.GenerateKey(nil)
+	server := newIdentityServer(t, pubkey)
+
+	// The first contact pins the published key
+	if err := verifyServerSignature(server.URL, signedChallenge(privkey, "challenge")); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	// A challenge signed with another key is refused
+	_, impostorKey, _ := ed25519.GenerateKey(nil)
+	if err := verifyServerSignature(server.URL, signedChallenge(impostorKey, "challenge")); err == nil {
+		t.Fatalf("Expected an error for an impostor signature, got none")
+	}
+
+	// An unsigned challenge is refused
+	if err := verifyServerSignature(server.URL, &LoginResponse{Challenge: "challenge"}); err == nil {
+		t.Fatalf("Expected an error for an unsigned challenge, got none")
+	}
+}
+
+func TestVerifyServerSignature_PinnedKeyIsNotReplaced(t *testing.T) {
+	KnownServersFile = filepath.Join(t.TempDir(), "known_servers.json")
+	t.Cleanup(func() { KnownServersFile = "" })
+
+	pubkey, privkey, _ := ed25519.GenerateKey(nil)
+	server := newIdentityServer(t, pubkey)
+	if err := verifyServerSignature(server.URL, signedChallenge(privkey, "challenge")); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	// Pretend an impostor now answers on the same URL and publishes its own key
+	impostorPubkey, impostorKey, _ := ed25519.GenerateKey(nil)
+	knownServers, _ := loadKnownServers(KnownServersFile)
+	impostor := newIdentityServer(t, impostorPubkey)
+	knownServers[impostor.URL] = knownServers[server.URL]
+	if err := saveKnownServers(KnownServersFile, knownServers); err != nil {
+		t.Fatalf("Failed to save known servers: %v", err)
+	}
+
+	if err := verifyServerSignature(impostor.URL, signedChallenge(impostorKey, "challenge")); err == nil {
+		t.Fatalf("Expected an error for a server with a changed key, got none")
+	}
+}
@@ -12,51 +12,140 @@ import (
 
 // Programatically returns a signed challenge. Expects an appurl to request the
 // challenge from and a username to associate with that challenge.
+// The appurl is also the origin the challenge must be bound to, and the challenge is
+// only signed if its payload matches it.
 // It returns an error if unable to get challenge or sign the challenge.
 // It will also return a message related to the error if applicable.
 //
 // Parameters:
-// - appurl: The URL of the application server
+// - appurl: The URL of the application server, i.e. the origin of the requesting page
 // - username: The username of the user to login
 //
 // Returns:
-// - A signed challenge
-// - An username
+// - A GetAndSignResponse containing the username, the challenge ID and the signed challenge
 // - A error message string (if applicable)
 // - An error if the login process fails
-func GetAndSign(appurl string, username string) (string, []byte, string, error) {
+func GetAndSign(appurl string, username string) (*GetAndSignResponse, string, error) {
 
 	// Fetches the generated challenge from the server
 	challengeResponse, errMsg, err := getChallenge(appurl, username)
 
 	if err != nil {
 		fmt.Println("Error getting challenge")
-		return "", nil, errMsg, err
+		return nil, errMsg, err
 	}
 
-	// TODO: Implement signature verification
-	// if !verifySignature(challengeResponse) {
-	// 	return fmt.Errorf("signature verification failed")
-	// }
+	response, err := SignChallenge(appurl, username, PurposeLogin, challengeResponse)
+	if err != nil {
+		return nil, err.Error(), err
+	}
+	return response, "", nil
+}
+
+// Login logs the user in without a browser and returns bearer tokens for the application's API
+// The challenge is fetched and signed as in GetAndSign, and the signature is sent to /api/verify
+// asking for an access token and a refresh token with the given scope.
+//
+// Parameters:
+// - appurl: The URL of the application server
+// - username: The username of the user to login
+// - scope: Space separated scopes of the tokens, e.g. "notes account", all scopes if empty
+//
+// Returns:
+// - A TokenResponse containing the access token and the refresh token
+// - A error message string (if applicable)
+// - An error if the login process fails
+func Login(appurl string, username string, scope string) (*TokenResponse, string, error) {
+	signed, errMsg, err := GetAndSign(appurl, username)
+	if err != nil {
+		return nil, errMsg, err
+	}
+
+	body, err := json.Marshal(VerifyRequest{
+		Username:    signed.User,
+		ChallengeID: signed.ChallengeID,
+		Signature:   signed.SignedChallenge,
+		IssueTokens: true,
+		Scope:       scope,
+	})
+	if err != nil {
+		return nil, "", err
+	}
+
+	c := &http.Client{}
+	resp, err := c.Post(appurl+"/api/verify", "application/json", bytes.NewBuffer(body))
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, string(respBody), fmt.Errorf("login failed: %s", resp.Status)
+	}
+
+	var tokens TokenResponse
+	if err := json.Unmarshal(respBody, &tokens); err != nil {
+		return nil, "", fmt.Errorf("error decoding token response")
+	}
+	return &tokens, "", nil
+}
+
+// SignChallenge signs a challenge issued by the application with the TKey
+// The challenge is only signed if it is signed by the pinned key of the server and was issued
+// for the given origin, purpose and user.
+//
+// Parameters:
+// - appurl: The URL of the application server, i.e. the origin of the requesting page
+// - username: The user the challenge must be issued to
+// - purpose: The purpose the challenge must be issued for
+// - challenge: The challenge and the server's signature over it
+//
+// Returns:
+// - A GetAndSignResponse containing the username, the challenge ID and the signed challenge
+// - An error if the challenge is refused or the signing fails
+func SignChallenge(appurl string, username string, purpose string, challenge *LoginResponse) (*GetAndSignResponse, error) {
+	// Refuse to sign challenges that are not signed by the server we trust
+	if err := verifyServerSignature(appurl, challenge); err != nil {
+		return nil, err
+	}
+
+	// Refuse to sign challenges that were not issued for this origin, purpose and user
+	payload, err := validateChallenge(challenge.Challenge, appurl, purpose, username)
+	if err != nil {
+		return nil, err
+	}
 
 	// Signs the challenge
-	user, signedChallenge, err := signChallenge(username, challengeResponse)
+	user, signedChallenge, err := signChallenge(username, payload, challenge)
 	if err != nil {
-		return "", nil, err.Error(), err
+		return nil, err
 	}
-	return user, signedChallenge, "", nil
+
+	return &GetAndSignResponse{
+		User:            user,
+		ChallengeID:     challenge.ChallengeID,
+		SignedChallenge: signedChallenge,
+	}, nil
 }
 
 // An internal function that signs the challenge using the tkey
+// It displays what is being signed before asking for a touch
 //
 // Parameters:
 // - username: The username of the user to sign the challenge for
+// - payload: The validated payload of the challenge
 // - challenge: The challenge to sign
 //
 // Returns:
-// - A VerifyRequest struct containing the username and signature
+// - The username and the signature
 // - An error if the signing process fails
-func signChallenge(username string, challenge *LoginResponse) (string, []byte, error) {
+func signChallenge(username string, payload *ChallengePayload, challenge *LoginResponse) (string, []byte, error) {
+	fmt.Printf("%s requests a signature for '%s' as user '%s'\n", payload.Origin, payload.Purpose, payload.Username)
 	fmt.Printf("Touch the TKey to continue...\n")
 	sig, err := tkey.Sign([]byte(challenge.Challenge))
 	if err != nil {
@@ -80,7 +169,7 @@ func getChallenge(appurl string, user string) (*LoginResponse, string, error) {
 
 	c := &http.Client{}
 
-	body, err := json.Marshal(LoginRequest{Username: user})
+	body, err := json.Marshal(LoginRequest{Username: user, Origin: appurl})
 	if err != nil {
 		return nil, "", err
 	}
@@ -111,6 +200,8 @@ func getChallenge(appurl string, user string) (*LoginResponse, string, error) {
 		return nil, respBodyStr, fmt.Errorf("user not found")
 	case http.StatusBadRequest:
 		return nil, respBodyStr, fmt.Errorf("invalid request body or missing username")
+	case http.StatusTooManyRequests:
+		return nil, respBodyStr, fmt.Errorf("too many login attempts, try again later")
 	case http.StatusInternalServerError:
 		return nil, respBodyStr, fmt.Errorf("unable to read user data")
 	default:
@@ -127,34 +218,3 @@ func getChallenge(appurl string, user string) (*LoginResponse, string, error) {
 
 	return res, "", nil
 }
-
-// TODO: Uncomment once server verification is implemented
-// func verifySignature(res *LoginResponse) bool {
-// 	pubkey, err := getPublicKey()
-// 	if err != nil {
-// 		return false
-// 	}
-// 	return ed25519.Verify(pubkey, []byte(res.Challenge), []byte(res.Signature))
-// }
-
-// func getPublicKey() ([]byte, error) {
-// 	baseUrl := "http://localhost:8080"
-// 	endpoint := "/api/public"
-
-// 	c := &http.Client{}
-
-// 	resp, err := c.Get(baseUrl + endpoint)
-// 	if err != nil {
-// 		return nil, err
-// 	}
-
-// 	if resp.StatusCode != http.StatusOK {
-// 		return nil, fmt.Errorf("error in response when getting public key")
-// 	}
-
-// 	var pubkey []byte
-
-// 	err = json.NewDecoder(resp.Body).Decode(&pubkey)
-
-// 	return pubkey, err
-// }
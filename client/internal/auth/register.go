@@ -11,7 +11,8 @@ import (
 )
 
 // Register registers a new user with the given username and label at the specified app URL
-// This requires that the app has the /api/register endpoint
+// This requires that the app has the /api/register-challenge and /api/register endpoints
+// The registration challenge is signed with the TKey to prove possession of the registered key
 // It returns an error if the registration process fails
 //
 // Parameters:
@@ -29,8 +30,18 @@ func Register(appurl string, username string, label string) (*http.Response, err
 		return nil, err
 	}
 
+	challenge, res, err := getRegisterChallenge(appurl, username)
+	if err != nil {
+		return res, err
+	}
+
+	signed, err := SignChallenge(appurl, username, PurposeRegister, challenge)
+	if err != nil {
+		return nil, err
+	}
+
 	regurl := appurl + "/api/register"
-	res, err := sendRequest(regurl, pubkey, username, label)
+	res, err = sendRequest(regurl, pubkey, username, label, signed)
 
 	if err != nil {
 		return res, err
@@ -40,6 +51,7 @@ func Register(appurl string, username string, label string) (*http.Response, err
 }
 
 // sendRequest sends a registration request to the specified application URL with the provided public key, username, and label
+// The name and digest of the embedded TKey signer app are reported along with the key
 // It returns an error if the request fails or if the server responds with a status code indicating an error. It also returns a response body if an error occurs.
 //
 // Parameters:
@@ -47,15 +59,24 @@ func Register(appurl string, username string, label string) (*http.Response, err
 // - pubkey: The public key of the user being registered
 // - username: The username of the user being registered
 // - label: The label for the public key
+// - signed: The signed registration challenge
 //
 // Returns:
 // - An error if the request fails or if the server responds with an error status code
 // - A string containing the body of the response in case of error.
 
-func sendRequest(appurl string, pubkey ed25519.PublicKey, username string, label string) (*http.Response, error) {
+func sendRequest(appurl string, pubkey ed25519.PublicKey, username string, label string, signed *GetAndSignResponse) (*http.Response, error) {
 	c := &http.Client{}
 
-	data := RegisterRequest{Username: username, Pubkey: []byte(pubkey), Label: label}
+	data := RegisterRequest{
+		Username:    username,
+		Pubkey:      []byte(pubkey),
+		Label:       label,
+		AppName:     tkey.GetEmbeddedAppName(),
+		AppDigest:   tkey.GetEmbeddedAppDigest(),
+		ChallengeID: signed.ChallengeID,
+		Signature:   signed.SignedChallenge,
+	}
 	reqBody, err := json.Marshal(data)
 	if err != nil {
 		return nil, err
@@ -75,9 +96,48 @@ func sendRequest(appurl string, pubkey ed25519.PublicKey, username string, label
 		return res, fmt.Errorf("user '%s' already exists", username)
 	case http.StatusBadRequest:
 		return res, fmt.Errorf("invalid request body for user '%s'", username)
+	case http.StatusUnauthorized:
+		return res, fmt.Errorf("the application did not accept the signature for user '%s'", username)
 	case http.StatusInternalServerError:
 		return res, fmt.Errorf("unable to save user data for user '%s'", username)
 	default:
 		return res, fmt.Errorf("unexpected error: %s", res.Status)
 	}
 }
+
+// getRegisterChallenge fetches a registration challenge for the username from the application
+// If the application refuses, the response is returned with its body unread so the error message can be passed on
+//
+// Parameters:
+// - appurl: The URL of the application server
+// - username: The username of the user being registered
+//
+// Returns:
+// - The challenge and the server's signature over it
+// - The response of the application if it refused to issue a challenge
+// - An error if the request fails or the application refuses
+func getRegisterChallenge(appurl string, username string) (*LoginResponse, *http.Response, error) {
+	c := &http.Client{}
+
+	body, err := json.Marshal(RegisterChallengeRequest{Username: username, Origin: appurl})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	res, err := c.Post(appurl+"/api/register-challenge", "application/json", bytes.NewBuffer(body))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if res.StatusCode != http.StatusOK {
+		return nil, res, fmt.Errorf("unable to get registration challenge: %s", res.Status)
+	}
+	defer res.Body.Close()
+
+	var challenge LoginResponse
+	if err := json.NewDecoder(res.Body).Decode(&challenge); err != nil {
+		return nil, nil, fmt.Errorf("error decoding registration challenge")
+	}
+
+	return &challenge, nil, nil
+}
@@ -1 +1,42 @@
 package auth
+
+import (
+	. "chalmers/tkey-group22/client/internal/structs"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestGetRegisterChallenge(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var request RegisterChallengeRequest
+		json.NewDecoder(r.Body).Decode(&request)
+		if request.Username == "taken" {
+			http.Error(w, "User already exists", http.StatusConflict)
+			return
+		}
+		json.NewEncoder(w).Encode(LoginResponse{ChallengeID: "id", Challenge: "challenge for " + request.Origin})
+	}))
+	defer server.Close()
+
+	challenge, _, err := getRegisterChallenge(server.URL, "alice")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if challenge.ChallengeID != "id" || challenge.Challenge != "challenge for "+server.URL {
+		t.Fatalf("Unexpected challenge: %+v", challenge)
+	}
+
+	// The application's refusal is passed on so the web client can show it
+	_, res, err := getRegisterChallenge(server.URL, "taken")
+	if err == nil || res == nil {
+		t.Fatalf("Expected an error and the response, got %v", err)
+	}
+	body, _ := io.ReadAll(res.Body)
+	res.Body.Close()
+	if string(body) != "User already exists\n" {
+		t.Fatalf("Unexpected response body: %q", body)
+	}
+}
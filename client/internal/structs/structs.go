@@ -1,11 +1,31 @@
 package structs
 
+// RegisterChallengeRequest represents a request for a registration challenge
+// It contains the username to be registered and the origin the challenge should be bound to
+type RegisterChallengeRequest struct {
+	Username string `json:"username"`
+	Origin   string `json:"origin"`
+}
+
 // RegisterRequest represents the data required to register a new user
-// It includes the username, the user's public key, and the label for the public key
+// It includes the username, the user's public key, the label for the public key,
+// the name and digest of the TKey signer app that produced the key, and the ID of
+// the registration challenge with the key's signature over it
 type RegisterRequest struct {
-	Username string `json:"username"`
-	Pubkey   []byte `json:"pubkey"`
-	Label    string `json:"label"`
+	Username    string `json:"username"`
+	Pubkey      []byte `json:"pubkey"`
+	Label       string `json:"label"`
+	AppName     string `json:"app_name"`
+	AppDigest   string `json:"app_digest"`
+	ChallengeID string `json:"challenge_id"`
+	Signature   []byte `json:"signature"`
+}
+
+// RegisterResponse represents the response of the application to a successful registration
+// It contains the one-time recovery codes of the new user, which are only shown once
+type RegisterResponse struct {
+	Message       string   `json:"message"`
+	RecoveryCodes []string `json:"recovery_codes"`
 }
 
 // UnregisterRequest represents the payload for a unregister request
@@ -15,35 +35,93 @@ type UnregisterRequest struct {
 }
 
 // LoginRequest represents the payload for a login request
-// It contains the username of the user attempting to log in
+// It contains the username of the user attempting to log in and the origin the challenge should be bound to
 type LoginRequest struct {
 	Username string `json:"username"`
+	Origin   string `json:"origin"`
 }
 
 // LoginResponse represents the response received after a login attempt
-// It contains a challenge string and a signature string, both of which are used to verify the authenticity of the login request
+// It contains the challenge ID, a challenge string and a signature string, which are used to verify the authenticity of the login request
+// The signature is made over the challenge with the server identity key and is base64 encoded
 type LoginResponse struct {
-	Challenge string `json:"challenge"`
-	Signature string `json:"signature"`
+	ChallengeID string `json:"challenge_id"`
+	Challenge   string `json:"challenge"`
+	Signature   string `json:"signature"`
+}
+
+// ServerPublicKeyResponse represents the identity key published by the application server
+// It is pinned on first use and used to verify the signature of every challenge
+type ServerPublicKeyResponse struct {
+	PublicKey []byte `json:"public_key"`
+	Algorithm string `json:"algorithm"`
 }
 
 // VerifyRequest represents a request to verify a user's identity
-// It contains the username of the user and a cryptographic signature to authenticate the request
+// It contains the username of the user, the ID of the signed challenge and a cryptographic signature to authenticate the request
+// IssueTokens asks for bearer tokens with the given scope instead of a session cookie
 type VerifyRequest struct {
-	Username  string `json:"username"`
-	Signature []byte `json:"signature"`
+	Username    string `json:"username"`
+	ChallengeID string `json:"challenge_id"`
+	Signature   []byte `json:"signature"`
+	IssueTokens bool   `json:"issue_tokens"`
+	Scope       string `json:"scope"`
+}
+
+// TokenResponse represents the bearer tokens the application issues when logging in without a browser
+// The access token is sent in the Authorization header of requests, and the refresh token is exchanged for new tokens
+type TokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int    `json:"expires_in"`
+	Scope        string `json:"scope"`
 }
 
 type VerifyResponse struct {
 }
 
+// GetAndSignResponse represents a challenge that has been fetched and signed by the TKey
+// It contains the username, the ID of the challenge and the signature, which the web client passes on to /api/verify
 type GetAndSignResponse struct {
 	User            string `json:"user"`
+	ChallengeID     string `json:"challenge_id"`
 	SignedChallenge []byte `json:"signed_challenge"`
 }
 
-// AddPublicKeyRequest represents a response to add a new public key for a user
-// It contains the new public key to be added
+// SignRequest represents a request from the web client to sign a challenge it got from the application
+// It contains the user and purpose the challenge must be issued for, and the challenge as returned by the application
+type SignRequest struct {
+	Username    string `json:"username"`
+	Purpose     string `json:"purpose"`
+	ChallengeID string `json:"challenge_id"`
+	Challenge   string `json:"challenge"`
+	Signature   string `json:"signature"`
+}
+
+// AddPublicKeyResponse represents a response to add a new public key for a user
+// It contains the new public key to be added, the name and digest of the TKey signer app that produced it,
+// and the key's signature over a "new-key" challenge proving possession of it
 type AddPublicKeyResponse struct {
-	Pubkey []byte `json:"pubkey"`
+	Pubkey      []byte `json:"pubkey"`
+	AppName     string `json:"app_name"`
+	AppDigest   string `json:"app_digest"`
+	ChallengeID string `json:"challenge_id"`
+	Signature   []byte `json:"signature"`
+}
+
+// DeviceChallengeRequest represents a request for a challenge approving the login of a browser on another machine
+// It contains the user to log in as, the user code shown by the browser and the origin the challenge should be bound to
+type DeviceChallengeRequest struct {
+	Username string `json:"username"`
+	UserCode string `json:"user_code"`
+	Origin   string `json:"origin"`
+}
+
+// DeviceApproveRequest represents the approval of a browser login, with the signature over the device challenge
+type DeviceApproveRequest struct {
+	Username    string `json:"username"`
+	UserCode    string `json:"user_code"`
+	ChallengeID string `json:"challenge_id"`
+	Signature   []byte `json:"signature"`
 }
@@ -3,6 +3,8 @@ package util
 import (
 	"bufio"
 	"chalmers/tkey-group22/client/internal/auth"
+	"chalmers/tkey-group22/client/internal/structs"
+	"encoding/json"
 	"fmt"
 	"log"
 	"os"
@@ -20,36 +22,70 @@ func SelectMode() int {
 	fmt.Println("\nSelect Mode:")
 	fmt.Println("1. Register")
 	fmt.Println("2. Login")
-	fmt.Println("3. Exit")
+	fmt.Println("3. Approve browser login")
+	fmt.Println("4. Exit")
 
 	var choice int
-	fmt.Print("Enter choice (1/2/3): ")
+	fmt.Print("Enter choice (1/2/3/4): ")
 	fmt.Scanln(&choice)
 	return choice
 }
 
 // CallLogin retrieves the username and attempts to log in the user using the provided app URL
-// If an error occurs during the login process, it prints the error
+// If the login succeeds, the bearer tokens for the application's API are printed, otherwise the error is printed
 func CallLogin() {
 	username := getUsername()
-	_, _, errMsg, err := auth.GetAndSign(appurl, username)
+	tokens, errMsg, err := auth.Login(appurl, username, "")
 	if err != nil {
 		le.Println(errMsg)
 		le.Println(err)
-	} else {
-		fmt.Printf("User '%s' has been successfully logged in!\n", username)
+		return
 	}
+
+	fmt.Printf("User '%s' has been successfully logged in!\n", username)
+	fmt.Printf("Send the access token as \"Authorization: Bearer <token>\", it expires in %d seconds:\n", tokens.ExpiresIn)
+	fmt.Println("  " + tokens.AccessToken)
+	fmt.Println("Exchange the refresh token for new tokens at /api/token/refresh:")
+	fmt.Println("  " + tokens.RefreshToken)
+}
+
+// CallApproveDevice retrieves the username and the code shown by a browser waiting to be logged in,
+// and approves the login of that browser with the TKey
+// If an error occurs during the approval, it prints the error
+func CallApproveDevice() {
+	username := getUsername()
+	userCode := getUserCode()
+	errMsg, err := auth.ApproveDevice(appurl, username, userCode)
+	if err != nil {
+		le.Println(errMsg)
+		le.Println(err)
+		return
+	}
+
+	fmt.Printf("The browser has been logged in as '%s'!\n", username)
 }
 
 // CallRegister retrieves the username and label, and attempts to register it with the authentication service
-// If an error occurs during the registration process, it prints the error
+// If the registration succeeds, the recovery codes of the new user are printed, otherwise the error is printed
 func CallRegister() {
 	username := getUsername()
 	label := getLabel()
-	errMsg, err := auth.Register(appurl, username, label)
+	res, err := auth.Register(appurl, username, label)
 	if err != nil {
-		le.Println(errMsg)
 		le.Println(err)
+		return
+	}
+	defer res.Body.Close()
+
+	var registerResponse structs.RegisterResponse
+	if err := json.NewDecoder(res.Body).Decode(&registerResponse); err != nil {
+		le.Println("Unable to read recovery codes:", err)
+		return
+	}
+
+	fmt.Println("Store these recovery codes somewhere safe. Each can be used once to regain access if every TKey is lost:")
+	for _, code := range registerResponse.RecoveryCodes {
+		fmt.Println("  " + code)
 	}
 }
 
@@ -74,3 +110,14 @@ func getLabel() string {
 	label, _ := reader.ReadString('\n')
 	return strings.TrimSpace(label)
 }
+
+// getUserCode gets the code shown by the browser waiting to be logged in from the user
+//
+// Returns:
+// - string: The code entered by the user
+func getUserCode() string {
+	reader := bufio.NewReader(os.Stdin)
+	fmt.Print("Please enter the code shown in the browser: ")
+	userCode, _ := reader.ReadString('\n')
+	return strings.TrimSpace(userCode)
+}